@@ -0,0 +1,291 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/jstaf/onedriver/control"
+	"github.com/jstaf/onedriver/graph"
+	flag "github.com/spf13/pflag"
+)
+
+// commands are the words that run a command instead of mounting, when given
+// in place of a mountpoint
+var commands = map[string]bool{
+	"stats":       true,
+	"health":      true,
+	"clear-cache": true,
+	"ls":          true,
+	"stat":        true,
+	"get":         true,
+	"put":         true,
+	"completion":  true,
+	"trace":       true,
+	"errors":      true,
+	"retry":       true,
+	"conflicts":   true,
+	"resolve":     true,
+	"restore":     true,
+	"__complete":  true, // used by the completion scripts
+}
+
+// commandArgs checks the arguments given to a command, and returns those of
+// them that are left for the mountpoint.
+func commandArgs(command string, args []string) ([]string, error) {
+	switch command {
+	case "ls", "stat":
+		if len(args) > 1 {
+			return nil, errors.New("only one path can be given")
+		}
+	case "completion", "__complete":
+		if len(args) != 1 {
+			return nil, fmt.Errorf("%s takes one argument", command)
+		}
+	case "trace":
+		if len(args) == 0 || len(args) > 2 || (args[0] != "on" && args[0] != "off") {
+			return nil, errors.New("trace takes \"on\" or \"off\", and optionally a mountpoint")
+		}
+		return args[1:], nil
+	case "retry":
+		if len(args) != 1 {
+			return nil, errors.New("retry takes the path of a file or folder in a mounted filesystem")
+		}
+	case "resolve":
+		if len(args) != 2 || (args[1] != "local" && args[1] != "remote") {
+			return nil, errors.New("resolve takes the path of a file in a mounted filesystem, " +
+				"and \"local\" or \"remote\" for the version to keep")
+		}
+	case "restore":
+		if len(args) != 1 {
+			return nil, errors.New("restore takes the path of an item in the recycle bin folder, " +
+				"or of a version in a .versions folder, of a mounted filesystem")
+		}
+	case "get", "put":
+		if len(args) != 2 {
+			return nil, fmt.Errorf("%s takes a source and a destination path", command)
+		}
+	case "clear-cache":
+		if len(args) > 1 {
+			return nil, errors.New("only one account can be given")
+		}
+		if len(args) == 1 {
+			flag.Set("account", args[0])
+		}
+	case "":
+		if len(args) == 2 {
+			// how mount(8) runs us for "mount -t fuse.onedriver <account> <mountpoint>",
+			// and it waits for us to exit
+			if source := args[0]; source != "onedriver" && source != "default" {
+				flag.Set("account", source)
+			}
+			flag.Set("daemon", "true")
+			return args[1:], nil
+		}
+		return args, nil
+	case "stats", "health", "errors", "conflicts":
+		// the mountpoint of the instance to ask, if any
+		return args, nil
+	}
+	// none of what is left is a mountpoint
+	return nil, nil
+}
+
+// target is the instance of onedriver a command is run against.
+type target struct {
+	cacheRoot   string // cache directory all accounts are in
+	instanceDir string // cache directory of the instance
+	mountpoint  string // looked up by its mountpoint instead, if given
+}
+
+// socket returns the control socket of the instance.
+func (t target) socket() (string, error) {
+	if t.mountpoint == "" {
+		return control.SocketPath(t.instanceDir), nil
+	}
+	return findInstance(t.cacheRoot, t.mountpoint)
+}
+
+// runCommand runs a command that works on a running instance of onedriver, or
+// on its cache, and returns the exit code. Returns false if command is not one
+// of them.
+func runCommand(command string, args []string, t target, asJSON bool,
+	maxSyncAge time.Duration, force bool) (int, bool) {
+	var err error
+	switch command {
+	case "clear-cache":
+		if err := clearCache(t.instanceDir, force); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not clear cache: %s\n", err)
+			return 1, true
+		}
+		fmt.Printf("Cleared cache in %s.\n", t.instanceDir)
+	case "health":
+		socket, err := t.socket()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return healthNotRunning, true
+		}
+		code, description := checkHealth(socket, maxSyncAge)
+		if code == healthOK {
+			fmt.Println(description)
+		} else {
+			fmt.Fprintln(os.Stderr, description)
+		}
+		return code, true
+	case "trace":
+		var socket string
+		if socket, err = t.socket(); err == nil {
+			if _, err = control.Send(socket, "trace", args[0]); err == nil {
+				fmt.Printf("Request tracing turned %s.\n", args[0])
+			}
+		}
+	case "errors", "conflicts", "stats":
+		printer := map[string]func(string, bool) error{
+			"errors":    printErrors,
+			"conflicts": printConflicts,
+			"stats":     printStats,
+		}[command]
+		var socket string
+		if socket, err = t.socket(); err == nil {
+			err = printer(socket, asJSON)
+		}
+	case "retry":
+		err = retryFailures(t.cacheRoot, args[0])
+	case "resolve":
+		err = resolveConflict(t.cacheRoot, args[0], args[1])
+	case "restore":
+		if err := restoreItem(args[0]); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not restore %s: %s\n", args[0], err)
+			return 1, true
+		}
+	default:
+		return 0, false
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1, true
+	}
+	return 0, true
+}
+
+// restoreItem restores an item in the recycle bin folder of a mounted
+// filesystem, or makes a version in a .versions folder the current one.
+func restoreItem(path string) error {
+	_, err := os.Stat(path)
+	if err == nil {
+		err = syscall.Setxattr(path, "user.onedriver.restore", []byte("1"), 0)
+	}
+	switch err {
+	case syscall.EINVAL:
+		return errors.New("not in the recycle bin folder or a .versions folder of a mounted filesystem")
+	case syscall.ENOENT:
+		return errors.New("no longer in the recycle bin, or no longer kept by OneDrive")
+	case syscall.EBUSY:
+		return errors.New("the file is open or has changes that are not uploaded yet")
+	case syscall.ENOTSUP:
+		return errors.New("not in a filesystem mounted by onedriver")
+	}
+	return err
+}
+
+// changePin pins a file or folder in a mounted filesystem, or unpins one if
+// pin is empty.
+func changePin(pin string, unpin string) error {
+	if pin != "" {
+		return syscall.Setxattr(pin, "user.onedriver.pin", []byte("1"), 0)
+	}
+	err := syscall.Removexattr(unpin, "user.onedriver.pin")
+	if err == syscall.ENODATA {
+		return errors.New("not pinned itself, only the folder it is in is")
+	}
+	return err
+}
+
+// freeUpSpace drops the cached content of a file, or of every file in a
+// folder, of a mounted filesystem.
+func freeUpSpace(path string) error {
+	err := syscall.Setxattr(path, "user.onedriver.dehydrate", []byte("1"), 0)
+	if err == syscall.EBUSY {
+		return errors.New("file is open, has changes that have not been " +
+			"uploaded yet, or is in a pinned folder")
+	}
+	return err
+}
+
+// signOut deletes the credentials and cache of the account stored in dir,
+// unmounting it first if onedriver is running for it.
+func signOut(dir string, force bool) error {
+	socket := control.SocketPath(dir)
+	if _, err := control.Send(socket, "unmount"); err == nil {
+		fmt.Println("Unmounting...")
+		if !waitForExit(socket, time.Minute) {
+			return errors.New("timed out waiting for onedriver to unmount")
+		}
+	}
+	if err := checkUnsynced(dir, force); err != nil {
+		return err
+	}
+	return graph.Logout(dir)
+}
+
+// clearCache deletes the cache of the account stored in dir, unless onedriver
+// is running for it or it has changes that have not been uploaded yet (and
+// force is not set).
+func clearCache(dir string, force bool) error {
+	if _, err := control.Send(control.SocketPath(dir), "mountpoint"); err == nil {
+		return errors.New("onedriver is running for this account, unmount it first")
+	}
+	if err := checkUnsynced(dir, force); err != nil {
+		return err
+	}
+	return graph.ClearCache(dir)
+}
+
+// checkUnsynced returns an error if the cache of the account stored in dir has
+// changes that have not been uploaded yet, which deleting it would lose, unless
+// force is set.
+func checkUnsynced(dir string, force bool) error {
+	unsynced, err := graph.UnsyncedChanges(filepath.Join(dir, "onedriver.db"))
+	if err != nil && !force {
+		// likely what is wrong with it in the first place
+		return fmt.Errorf("could not check the cache for changes that have not "+
+			"been uploaded yet (%s), use --force to delete it anyway", err)
+	}
+	if unsynced > 0 && !force {
+		return fmt.Errorf("%d item(s) have changes that have not been uploaded "+
+			"yet, mount the account to upload them or use --force to delete "+
+			"them anyway", unsynced)
+	}
+	return nil
+}
+
+// browseRemote runs "ls" or "stat" on a path on the server, the root of the
+// drive if none is given.
+func browseRemote(command string, args []string, auth *graph.Auth, asJSON bool) error {
+	remotePath := "/"
+	if len(args) == 1 {
+		remotePath = path.Clean("/" + args[0])
+	}
+	var err error
+	if command == "ls" {
+		err = listRemote(remotePath, auth, asJSON)
+	} else {
+		err = statRemote(remotePath, auth, asJSON)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", remotePath, err)
+	}
+	return nil
+}
+
+// transferFile runs "get" or "put", copying a file from or to the server.
+func transferFile(command string, args []string, auth *graph.Auth) error {
+	if command == "get" {
+		return graph.DownloadFile(path.Clean("/"+args[0]), args[1], auth)
+	}
+	return graph.UploadFile(args[0], path.Clean("/"+args[1]), auth)
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	flag "github.com/spf13/pflag"
+)
+
+// pathFlags are the options that take a path, and whether it is a directory.
+var pathFlags = map[string]bool{
+	"cache-dir":          true,
+	"config":             false,
+	"pidfile":            false,
+	"log-file":           false,
+	"client-secret-file": false,
+}
+
+// completedCommands returns the commands to complete, without the hidden ones.
+func completedCommands() []string {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		if !strings.HasPrefix(name, "__") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// completedFlags returns the options to complete, as they are written on the
+// command line, and those of them that take a value.
+func completedFlags() ([]string, []string) {
+	var all, valued []string
+	flag.VisitAll(func(f *flag.Flag) {
+		if f.Hidden {
+			return
+		}
+		names := []string{"--" + f.Name}
+		if f.Shorthand != "" {
+			names = append(names, "-"+f.Shorthand)
+		}
+		all = append(all, names...)
+		if f.NoOptDefVal == "" && f.Value.Type() != "bool" {
+			valued = append(valued, names...)
+		}
+	})
+	return all, valued
+}
+
+// printCompletion prints the completion script for shell.
+func printCompletion(out io.Writer, shell string) error {
+	switch shell {
+	case "bash":
+		fmt.Fprint(out, bashCompletion())
+	case "zsh":
+		// zsh can use the bash script as is
+		fmt.Fprint(out, "#compdef onedriver\n\nautoload -U +X bashcompinit && bashcompinit\n\n")
+		fmt.Fprint(out, bashCompletion())
+	case "fish":
+		fmt.Fprint(out, fishCompletion())
+	default:
+		return fmt.Errorf("unsupported shell \"%s\", expected bash, zsh or fish", shell)
+	}
+	return nil
+}
+
+func bashCompletion() string {
+	all, valued := completedFlags()
+	var dirFlags, fileFlags []string
+	for name, isDir := range pathFlags {
+		names := []string{"--" + name}
+		if short := flag.Lookup(name).Shorthand; short != "" {
+			names = append(names, "-"+short)
+		}
+		if isDir {
+			dirFlags = append(dirFlags, names...)
+		} else {
+			fileFlags = append(fileFlags, names...)
+		}
+	}
+	sort.Strings(dirFlags)
+	sort.Strings(fileFlags)
+	return fmt.Sprintf(`# bash completion for onedriver
+_onedriver() {
+    local cur="${COMP_WORDS[COMP_CWORD]}"
+    local prev="${COMP_WORDS[COMP_CWORD-1]}"
+    case "$prev" in
+        --account)
+            COMPREPLY=($(compgen -W "$(onedriver __complete accounts 2>/dev/null)" -- "$cur"))
+            return ;;
+        %s)
+            COMPREPLY=($(compgen -d -- "$cur"))
+            return ;;
+        %s)
+            COMPREPLY=($(compgen -f -- "$cur"))
+            return ;;
+        %s)
+            return ;;
+    esac
+    if [[ "$cur" == -* ]]; then
+        COMPREPLY=($(compgen -W "%s" -- "$cur"))
+        return
+    fi
+
+    local word command=""
+    for word in "${COMP_WORDS[@]:1:COMP_CWORD-1}"; do
+        case "$word" in
+            %s)
+                command="$word"
+                break ;;
+        esac
+    done
+    case "$command" in
+        "")
+            COMPREPLY=($(compgen -W "%s" -- "$cur") $(compgen -d -- "$cur")) ;;
+        stats|health|errors|conflicts)
+            COMPREPLY=($(compgen -W "$(onedriver __complete mountpoints 2>/dev/null)" -- "$cur")) ;;
+        clear-cache)
+            COMPREPLY=($(compgen -W "$(onedriver __complete accounts 2>/dev/null)" -- "$cur")) ;;
+        completion)
+            COMPREPLY=($(compgen -W "bash zsh fish" -- "$cur")) ;;
+        trace)
+            if [[ "$prev" == trace ]]; then
+                COMPREPLY=($(compgen -W "on off" -- "$cur"))
+            else
+                COMPREPLY=($(compgen -W "$(onedriver __complete mountpoints 2>/dev/null)" -- "$cur"))
+            fi ;;
+        resolve)
+            if [[ "$prev" == resolve ]]; then
+                COMPREPLY=($(compgen -f -- "$cur"))
+            else
+                COMPREPLY=($(compgen -W "local remote" -- "$cur"))
+            fi ;;
+        get|put|retry|restore)
+            COMPREPLY=($(compgen -f -- "$cur")) ;;
+    esac
+}
+complete -F _onedriver onedriver
+`,
+		strings.Join(dirFlags, "|"),
+		strings.Join(fileFlags, "|"),
+		strings.Join(valued, "|"),
+		strings.Join(all, " "),
+		strings.Join(completedCommands(), "|"),
+		strings.Join(completedCommands(), " "),
+	)
+}
+
+func fishCompletion() string {
+	var script strings.Builder
+	script.WriteString("# fish completion for onedriver\ncomplete -c onedriver -f\n")
+	flag.VisitAll(func(f *flag.Flag) {
+		if f.Hidden {
+			return
+		}
+		line := "complete -c onedriver -l " + f.Name
+		if f.Shorthand != "" {
+			line += " -s " + f.Shorthand
+		}
+		if f.NoOptDefVal == "" && f.Value.Type() != "bool" {
+			line += " -r"
+			if _, ok := pathFlags[f.Name]; ok {
+				line += " -F"
+			}
+		}
+		if f.Name == "account" {
+			line += " -a '(onedriver __complete accounts 2>/dev/null)'"
+		}
+		script.WriteString(line + " -d " + fishQuote(summary(f.Usage)) + "\n")
+	})
+
+	commands := strings.Join(completedCommands(), " ")
+	fmt.Fprintf(&script, "complete -c onedriver -n 'not __fish_seen_subcommand_from %s' -a '%s'\n",
+		commands, commands)
+	fmt.Fprintf(&script, "complete -c onedriver -n 'not __fish_seen_subcommand_from %s' -a '(__fish_complete_directories)'\n",
+		commands)
+	script.WriteString("complete -c onedriver -n '__fish_seen_subcommand_from stats health errors conflicts' " +
+		"-a '(onedriver __complete mountpoints 2>/dev/null)'\n")
+	script.WriteString("complete -c onedriver -n '__fish_seen_subcommand_from clear-cache' " +
+		"-a '(onedriver __complete accounts 2>/dev/null)'\n")
+	script.WriteString("complete -c onedriver -n '__fish_seen_subcommand_from completion' " +
+		"-a 'bash zsh fish'\n")
+	script.WriteString("complete -c onedriver -n '__fish_seen_subcommand_from trace; " +
+		"and not __fish_seen_subcommand_from on off' -a 'on off'\n")
+	script.WriteString("complete -c onedriver -n '__fish_seen_subcommand_from on off' " +
+		"-a '(onedriver __complete mountpoints 2>/dev/null)'\n")
+	script.WriteString("complete -c onedriver -n '__fish_seen_subcommand_from get put retry restore' -F\n")
+	script.WriteString("complete -c onedriver -n '__fish_seen_subcommand_from resolve; " +
+		"and not __fish_seen_subcommand_from local remote' -F -a 'local remote'\n")
+	return script.String()
+}
+
+// summary returns the first sentence of the help text of an option.
+func summary(usage string) string {
+	if end := strings.Index(usage, ". "); end >= 0 {
+		usage = usage[:end]
+	}
+	return strings.TrimSuffix(usage, ".")
+}
+
+// fishQuote quotes s for fish.
+func fishQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
+
+// printCompletions prints what the completion scripts asked for with the
+// hidden "__complete" command, one per line: the names of accounts, or the
+// mountpoints of running instances.
+// Accounts count if they have a cache in cacheDir, or are named in the
+// configuration as account or by mounts.
+func printCompletions(what string, cacheDir string, account string, mounts []string) {
+	var words []string
+	switch what {
+	case "accounts":
+		seen := make(map[string]bool)
+		dirs, _ := filepath.Glob(filepath.Join(cacheDir, "accounts", "*"))
+		for _, dir := range dirs {
+			seen[filepath.Base(dir)] = true
+		}
+		if account != "" {
+			seen[account] = true
+		}
+		for _, spec := range mounts {
+			if split := strings.SplitN(spec, "=", 2); len(split) == 2 {
+				seen[split[0]] = true
+			}
+		}
+		for name := range seen {
+			words = append(words, name)
+		}
+	case "mountpoints":
+		for _, mountpoint := range runningInstances(cacheDir) {
+			words = append(words, mountpoint)
+		}
+	}
+	sort.Strings(words)
+	for _, word := range words {
+		fmt.Println(word)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/jstaf/onedriver/control"
+	"github.com/jstaf/onedriver/graph"
+)
+
+// printConflicts asks a running instance for the files changed both here and
+// on the server whose uploads it is holding, and prints them, as JSON if
+// asJSON is set.
+func printConflicts(socket string, asJSON bool) error {
+	response, err := control.Send(socket, "conflicts")
+	if err != nil {
+		return err
+	}
+	if asJSON {
+		fmt.Print(response)
+		return nil
+	}
+	var conflicts []graph.Conflict
+	if err = json.Unmarshal([]byte(response), &conflicts); err != nil {
+		return err
+	}
+	if len(conflicts) == 0 {
+		fmt.Println("No conflicts.")
+		return nil
+	}
+	for _, conflict := range conflicts {
+		path := conflict.Path
+		if path == "" {
+			path = conflict.ID
+		}
+		server := "changed on the server"
+		if conflict.Remote.Deleted != nil {
+			server = "deleted on the server"
+		}
+		fmt.Printf("%s\n    %s, %s ago\n", path, server,
+			time.Since(conflict.Detected).Round(time.Second))
+	}
+	fmt.Println("\nRun \"onedriver resolve <path> local|remote\" to keep one of the versions.")
+	return nil
+}
+
+// resolveConflict asks the instance of onedriver that path is in to settle the
+// conflict of the file at path by keeping its local or remote version.
+func resolveConflict(cacheDir string, path string, keep string) error {
+	socket, relative, err := instanceOf(cacheDir, path)
+	if err != nil {
+		return err
+	}
+	_, err = control.Send(socket, "resolve", keep, relative)
+	return err
+}
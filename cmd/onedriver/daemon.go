@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Go programs can't fork, so --daemon starts onedriver again in the background
+// with this set in its environment. The copy in the background tells the one in
+// the foreground that the filesystem is mounted over a pipe it gets as its first
+// extra file, after which the one in the foreground exits.
+const daemonEnv = "ONEDRIVER_DAEMON"
+
+// daemonized returns whether this is the copy of onedriver started in the
+// background by --daemon.
+func daemonized() bool {
+	return os.Getenv(daemonEnv) == "1"
+}
+
+// daemonize starts onedriver again in the background, with its output going to
+// logPath, and waits for it to mount the filesystem. Returns the process ID of
+// the copy in the background once it has.
+func daemonize(logPath string) (int, error) {
+	logFile, err := os.OpenFile(logPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer logFile.Close()
+	ready, mounted, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer ready.Close()
+
+	executable, err := os.Executable()
+	if err != nil {
+		mounted.Close()
+		return 0, err
+	}
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), daemonEnv+"=1")
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	cmd.ExtraFiles = []*os.File{mounted}
+	// its own session, so it isn't stopped along with the shell that started it
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	err = cmd.Start()
+	mounted.Close()
+	if err != nil {
+		return 0, err
+	}
+	pid := cmd.Process.Pid
+	cmd.Process.Release()
+
+	// only closed without a word if it exits before mounting
+	if line, _ := bufio.NewReader(ready).ReadString('\n'); line != "mounted\n" {
+		return 0, fmt.Errorf("onedriver exited before mounting, see %s for why", logPath)
+	}
+	return pid, nil
+}
+
+// daemonMounted tells the copy of onedriver in the foreground that started this
+// one that the filesystem is mounted.
+func daemonMounted() {
+	mounted := os.NewFile(3, "mounted")
+	if mounted == nil {
+		return
+	}
+	fmt.Fprintln(mounted, "mounted")
+	mounted.Close()
+}
+
+// writePidfile writes the ID of this process to path. Refuses to if it names a
+// process that is still running, as another onedriver may be using it.
+func writePidfile(path string) error {
+	if contents, err := ioutil.ReadFile(path); err == nil {
+		pid, err := strconv.Atoi(strings.TrimSpace(string(contents)))
+		if err == nil && pid != os.Getpid() && syscall.Kill(pid, 0) != syscall.ESRCH {
+			return fmt.Errorf("%s belongs to process %d, which is still running", path, pid)
+		}
+		// left behind by one that didn't exit cleanly
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	return ioutil.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+}
+
+// removePidfile removes the pidfile at path, if it was written by this process.
+func removePidfile(path string) error {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(string(contents)) != strconv.Itoa(os.Getpid()) {
+		return errors.New("pidfile belongs to another process")
+	}
+	return os.Remove(path)
+}
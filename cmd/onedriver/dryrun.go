@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+
+	"github.com/jstaf/onedriver/graph"
+)
+
+// dryRun goes through what mounting an account needs without mounting it:
+// signing in, reading the root of the drive and what is in it, getting a delta
+// link to follow changes with, and a mountpoint to mount on. Each step is
+// printed as it is done. Nothing is cached, so it is safe to run while the
+// account is mounted.
+func dryRun(m *mount, auth *graph.Auth, create bool) error {
+	fmt.Printf("%s:\n", m.mountpoint)
+	step := func(format string, args ...interface{}) {
+		fmt.Printf("  "+format+"\n", args...)
+	}
+
+	user, err := graph.GetUser(auth)
+	if err != nil {
+		return fmt.Errorf("could not sign in: %w", err)
+	}
+	step("Signed in as %s", user.UserPrincipalName)
+	if !auth.CanWrite() {
+		step("No permission to change files was granted, it would be mounted read-only")
+	}
+
+	root, err := graph.GetRoot(m.source, auth)
+	if err != nil {
+		return fmt.Errorf("could not fetch the root of the drive: %w", err)
+	}
+	children, err := graph.GetChildrenID(root.ID(), auth)
+	if err != nil {
+		return fmt.Errorf("could not list the root of the drive: %w", err)
+	}
+	step("Listed the root of the drive: %d item(s), %s in total",
+		len(children), formatBytes(root.Size()))
+
+	if _, err = graph.GetDeltaLink(m.source, auth); err != nil {
+		return fmt.Errorf("could not start following changes on the server: %w", err)
+	}
+	step("Changes on the server can be followed")
+
+	st, err := os.Stat(m.mountpoint)
+	switch {
+	case errors.Is(err, syscall.ENOTCONN):
+		step("Mountpoint is a stale mount, it would be cleaned up first")
+	case os.IsNotExist(err) && create:
+		step("Mountpoint does not exist, it would be created")
+	case err != nil:
+		return fmt.Errorf("mountpoint can't be used: %w", err)
+	case !st.IsDir():
+		return errors.New("mountpoint is not a directory")
+	default:
+		step("Mountpoint is ready")
+	}
+	if _, err = os.Stat("/dev/fuse"); err != nil {
+		return fmt.Errorf("FUSE is not available: %w", err)
+	}
+	return nil
+}
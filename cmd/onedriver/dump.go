@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// how long the state of a mount gets to be dumped, a deadlocked one never will
+const dumpTimeout = 10 * time.Second
+
+// handleDumps writes a debug dump to dir every time onedriver gets SIGUSR1.
+func handleDumps(dir string, mounts []*mount) {
+	dumpChan := make(chan os.Signal, 1)
+	signal.Notify(dumpChan, syscall.SIGUSR1)
+	go func() {
+		for range dumpChan {
+			path, err := writeDump(dir, mounts)
+			if err != nil {
+				log.WithField("err", err).Error("Could not write debug dump.")
+				continue
+			}
+			log.WithField("path", path).Info("Wrote debug dump.")
+		}
+	}()
+}
+
+// writeDump writes the stacks of every goroutine and the state of each mount
+// to a new file in dir, and returns its path. The stacks come first, as they
+// are what shows a deadlock, and are also all there is of it once the state
+// of a deadlocked mount can't be had.
+func writeDump(dir string, mounts []*mount) (string, error) {
+	now := time.Now()
+	path := filepath.Join(dir, fmt.Sprintf("onedriver-dump-%s.txt", now.Format("20060102-150405")))
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	fmt.Fprintf(file, "onedriver %s debug dump, %s, pid %d\n\n", version, now.Format(time.RFC3339),
+		os.Getpid())
+	stacks := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(stacks, true)
+		if n < len(stacks) {
+			stacks = stacks[:n]
+			break
+		}
+		stacks = make([]byte, 2*len(stacks))
+	}
+	fmt.Fprintf(file, "Goroutines (%d):\n\n%s\n", runtime.NumGoroutine(), stacks)
+
+	for i, m := range mounts {
+		fmt.Fprintf(file, "\nMount %d:\n", i+1)
+		buf := &bytes.Buffer{}
+		done := make(chan struct{})
+		go func() {
+			m.cache.WriteDebugDump(buf)
+			close(done)
+		}()
+		select {
+		case <-done:
+			file.Write(buf.Bytes())
+		case <-time.After(dumpTimeout):
+			// buf is still being written to, so none of it can be used
+			fmt.Fprintf(file, "Timed out after %s, the cache is probably deadlocked.\n", dumpTimeout)
+		}
+	}
+	return path, file.Sync()
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jstaf/onedriver/control"
+	"github.com/jstaf/onedriver/graph"
+)
+
+// printErrors asks a running instance for the changes the server refused and
+// prints them, as JSON if asJSON is set.
+func printErrors(socket string, asJSON bool) error {
+	response, err := control.Send(socket, "errors")
+	if err != nil {
+		return err
+	}
+	if asJSON {
+		fmt.Print(response)
+		return nil
+	}
+	var failures []graph.PendingChange
+	if err = json.Unmarshal([]byte(response), &failures); err != nil {
+		return err
+	}
+	if len(failures) == 0 {
+		fmt.Println("No failed changes.")
+		return nil
+	}
+	for _, change := range failures {
+		reason := change.Reason
+		if reason == "" {
+			reason = graph.ReasonOther
+		}
+		fmt.Printf("%-12s %-7s %s\n", reason, change.Op, change.Path)
+		fmt.Printf("             %s ago: %s\n",
+			time.Since(change.Updated).Round(time.Second), change.Error)
+	}
+	fmt.Println("\nRun \"onedriver retry <path>\" to send them again.")
+	return nil
+}
+
+// retryFailures asks the instance of onedriver that path is in to send the
+// failed changes to path, or to anything beneath it, to the server again.
+func retryFailures(cacheDir string, path string) error {
+	socket, relative, err := instanceOf(cacheDir, path)
+	if err != nil {
+		return err
+	}
+	response, err := control.Send(socket, "retry", relative)
+	fmt.Print(response)
+	return err
+}
+
+// instanceOf finds the control socket of the instance of onedriver path is
+// in, and where path is in its filesystem.
+func instanceOf(cacheDir string, path string) (string, string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", "", err
+	}
+	socket, relative := "", ""
+	for s, mountpoint := range runningInstances(cacheDir) {
+		rel, err := filepath.Rel(mountpoint, abs)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+			continue
+		}
+		// the innermost mount wins, in case one is mounted inside another
+		if socket == "" || len(rel) < len(relative) {
+			socket, relative = s, rel
+		}
+	}
+	if socket == "" {
+		return "", "", fmt.Errorf("%s is not in a filesystem mounted by onedriver", abs)
+	}
+	return socket, filepath.Join("/", relative), nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jstaf/onedriver/control"
+	"github.com/jstaf/onedriver/graph"
+)
+
+// exit codes of "onedriver health", one for each way it can be unwell
+const (
+	healthOK           = 0
+	healthError        = 1 // could not check, like for bad arguments
+	healthNotRunning   = 2 // onedriver is not running for the mountpoint
+	healthUnresponsive = 3 // the filesystem does not answer
+	healthSignedOut    = 4 // the account has to sign in again
+	healthStale        = 5 // changes have not been fetched from the server lately
+)
+
+// how long the filesystem gets to answer before it is considered hung
+const healthTimeout = 10 * time.Second
+
+// checkHealth checks on the instance of onedriver behind socket: that its
+// filesystem answers, that it is signed in, and that it fetched changes from
+// the server within maxAge, or within three polling intervals if maxAge is 0.
+// It returns the exit code for what it found and a description of it.
+func checkHealth(socket string, maxAge time.Duration) (int, string) {
+	response, err := control.Send(socket, "mountpoint")
+	if err != nil {
+		return healthNotRunning, fmt.Sprintf("onedriver is not running: %s", err)
+	}
+	mountpoint := strings.TrimSpace(response)
+
+	// a hung filesystem hangs whoever touches it, so give up on it instead
+	answered := make(chan error, 1)
+	go func() {
+		_, err := os.Stat(mountpoint)
+		answered <- err
+	}()
+	select {
+	case err := <-answered:
+		if err != nil {
+			return healthUnresponsive, fmt.Sprintf("%s is not responding: %s", mountpoint, err)
+		}
+	case <-time.After(healthTimeout):
+		return healthUnresponsive, fmt.Sprintf("%s did not respond within %s", mountpoint, healthTimeout)
+	}
+
+	response, err = control.Send(socket, "health")
+	if err != nil {
+		return healthUnresponsive, fmt.Sprintf("onedriver is not responding: %s", err)
+	}
+	var health graph.Health
+	if err = json.Unmarshal([]byte(response), &health); err != nil {
+		return healthError, err.Error()
+	}
+	if !health.SignedIn {
+		return healthSignedOut, "signed out, run \"onedriver --reauth\" to sign in again"
+	}
+	if health.Paused {
+		return healthOK, fmt.Sprintf("%s is mounted, syncing is paused", mountpoint)
+	}
+	if maxAge == 0 {
+		maxAge = 3 * health.PollInterval
+	}
+	age := health.SyncAge(time.Now()).Round(time.Second)
+	if age > maxAge {
+		reason := ""
+		if health.Offline != "" {
+			reason = " (" + health.Offline + ")"
+		}
+		return healthStale, fmt.Sprintf("changes have not been fetched from the server for %s%s",
+			age, reason)
+	}
+	return healthOK, fmt.Sprintf("%s is mounted, changes were fetched %s ago", mountpoint, age)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"path/filepath"
+	"sort"
+
+	"github.com/jstaf/onedriver/graph"
+	log "github.com/sirupsen/logrus"
+)
+
+// processStatus is what is served at /status: the state of every mount, for
+// status bars and monitoring that would rather not talk D-Bus or Prometheus.
+type processStatus struct {
+	Version string           `json:"version"`
+	State   graph.SyncStatus `json:"state"` // the worst of the mounts
+	Mounts  []mountStatus    `json:"mounts"`
+}
+
+type mountStatus struct {
+	Mountpoint string               `json:"mountpoint"`
+	State      graph.SyncStatus     `json:"state"`
+	ReadOnly   bool                 `json:"readOnly"`
+	Health     graph.Health         `json:"health"`
+	Stats      graph.Stats          `json:"stats"` // queues, quota and requests
+	Transfers  graph.TransferStatus `json:"transfers"`
+}
+
+// serveStatus serves the status of mounts as JSON on addr (host:port) at
+// /status. Without a host, it is only served on localhost. The listener is
+// opened before returning, like for serveMetrics.
+func serveStatus(addr string, mounts []*mount) error {
+	if host, port, err := net.SplitHostPort(addr); err == nil && host == "" {
+		addr = net.JoinHostPort("localhost", port)
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	caches := make(map[string]*graph.Cache, len(mounts))
+	for _, m := range mounts {
+		abs, _ := filepath.Abs(m.mountpoint)
+		caches[abs] = m.cache
+	}
+	handler := http.NewServeMux()
+	handler.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(currentStatus(caches))
+	})
+	go func() {
+		if err := http.Serve(listener, handler); err != nil {
+			log.WithField("err", err).Error("Status listener stopped.")
+		}
+	}()
+	log.WithField("addr", listener.Addr()).Info("Serving status.")
+	return nil
+}
+
+// currentStatus returns the status of caches, by the mountpoint they are
+// mounted at.
+func currentStatus(caches map[string]*graph.Cache) processStatus {
+	mountpoints := make([]string, 0, len(caches))
+	for mountpoint := range caches {
+		mountpoints = append(mountpoints, mountpoint)
+	}
+	sort.Strings(mountpoints)
+	status := processStatus{
+		Version: version,
+		State:   overallState(caches),
+		Mounts:  make([]mountStatus, 0, len(caches)),
+	}
+	for _, mountpoint := range mountpoints {
+		cache := caches[mountpoint]
+		status.Mounts = append(status.Mounts, mountStatus{
+			Mountpoint: mountpoint,
+			State:      cache.SyncState(),
+			ReadOnly:   cache.IsReadOnly(),
+			Health:     cache.Health(),
+			Stats:      cache.Stats(),
+			Transfers:  cache.Transfers(),
+		})
+	}
+	return status
+}
@@ -2,16 +2,20 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/signal"
+	"path"
 	"path/filepath"
 	"strings"
 	"syscall"
 	"time"
 
-	"github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/jstaf/onedriver/config"
+	"github.com/jstaf/onedriver/control"
 	"github.com/jstaf/onedriver/graph"
 	"github.com/jstaf/onedriver/logger"
 	log "github.com/sirupsen/logrus"
@@ -28,10 +32,99 @@ func usage() {
 This program will mount your OneDrive account as a Linux filesystem at the
 specified mountpoint. Note that this is not a sync client - files are fetched
 on-demand and cached locally. Only files you actually use will be downloaded.
-While offline, the filesystem will be read-only until connectivity is re-
-established.
+While offline, whatever was cached before can still be read, and changes are
+queued and sent once connectivity is re-established, which is detected
+automatically. Anything changed on the server in the meantime is not
+overwritten.
 
 Usage: onedriver [options] <mountpoint>
+       onedriver <account> <mountpoint> -o <options>
+       onedriver [options] stats [mountpoint]
+       onedriver [options] health [mountpoint]
+       onedriver [options] clear-cache [account]
+       onedriver [options] ls|stat [path]
+       onedriver [options] get <remote path> <local path>
+       onedriver [options] put <local path> <remote path>
+       onedriver [options] trace on|off [mountpoint]
+       onedriver [options] errors [mountpoint]
+       onedriver [options] retry <path>
+       onedriver [options] conflicts [mountpoint]
+       onedriver [options] resolve <path> local|remote
+       onedriver restore <path>
+       onedriver completion bash|zsh|fish
+
+Commands:
+  stats    Show cache hit rates, pending uploads, how long ago changes were
+           fetched from the server, requests made to the server, and quota
+           usage for the instance of onedriver mounted at mountpoint (or of
+           the account given by --account), then exit.
+  health   Check that the instance of onedriver mounted at mountpoint (or of
+           the account given by --account) is working, for monitoring
+           scripts. The exit code tells what is wrong: 0 all is well, 2
+           onedriver is not running, 3 the filesystem does not respond, 4 the
+           account has to sign in again, 5 changes have not been fetched from
+           the server within --max-sync-age, 1 the check itself failed.
+  clear-cache
+           Delete the metadata and file content cached for an account (or
+           the one given by --account), to recover from a corrupted cache.
+           Unlike --wipe-cache, the account stays signed in. Refuses to while
+           onedriver is running for the account, or while changes have not
+           been uploaded yet unless --force is given.
+  ls       List a folder on the server, by its path from the root of the
+           drive, without mounting anything. Useful to check that signing in
+           works and what is on the drive where FUSE is unavailable.
+  stat     Show the details of a file or folder on the server, like ls.
+  get      Download a file from the server without mounting anything, for
+           scripts and cron jobs. Its content is checked against the hashes
+           the server has for it before it is written to the local path.
+  put      Upload a file to the server without mounting anything, replacing
+           what is at the remote path. Large files are uploaded in chunks.
+           Both get and put follow the transfer options below, like
+           --max-upload-rate, and put a file in a folder under its own name
+           if the path they are given is a folder.
+  trace    Turn the logging of every request to the server on or off for
+           the instance of onedriver mounted at mountpoint (or of the account
+           given by --account), like --trace-requests but without restarting.
+  errors   Show the changes the server refused for good, like uploads that
+           did not fit in the quota, or files with names OneDrive does not
+           allow, with why they failed. They are kept until they are retried
+           or the item is changed again, restarts included.
+  retry    Send the failed changes to a file or folder in a mounted
+           filesystem, or to anything beneath it, to the server again. Files
+           are uploaded as they are now. Retrying the mountpoint retries
+           everything.
+  conflicts
+           Show the files changed both here and on the server that could
+           not be settled by --conflict-policy, like files that were open at
+           the time. Their changes are not uploaded until they are resolved.
+  resolve  Settle the conflict of a file in a mounted filesystem by keeping
+           its local version, which is uploaded over the server's, or the
+           server's, which replaces the local changes.
+  restore  Restore an item listed in the recycle bin folder of a mounted
+           filesystem (see --recycle-bin) to where it was deleted from.
+           Moving it out of that folder restores it wherever it is moved.
+           Only personal accounts can restore items this way. A previous
+           version of a file, like
+           Documents/.versions/report.docx/2024-05-01 10.22.03 report.docx,
+           is made the current version again.
+  completion
+           Print a script that completes onedriver's options and commands in
+           the given shell, including account names and the mountpoints of
+           running instances.
+
+Options can also be set in a configuration file (see --config), one per line
+as "option: value", with lists of values written as "[a, b]" or as "- item"
+lines below the option. The mountpoint can be set there as "mountpoint".
+Options given on the command line take precedence. Sending onedriver SIGHUP
+rereads log-level, poll-interval, max-upload-rate, max-download-rate,
+no-notifications, trace-requests, slow-op-threshold, include and exclude from
+the file without unmounting. Sending it SIGUSR1 writes a debug dump of what it
+is doing to onedriver-dump-<time>.txt in the cache directory.
+
+The second form is how mount(8) runs onedriver for /etc/fstab entries like
+"work /home/user/Work fuse.onedriver noauto,user 0 0", where the account is
+"onedriver" or "default" for the default account. onedriver keeps running in
+the background once mounted, as with --daemon.
 
 Valid options:
 `)
@@ -42,19 +135,306 @@ func main() {
 	// setup cli parsing
 	authOnly := flag.BoolP("auth-only", "a", false,
 		"Authenticate to OneDrive and then exit.")
-	logLevel := flag.StringP("log", "l", "debug", "Set logging level/verbosity. "+
+	authBrowser := flag.Bool("auth-browser", false,
+		"Sign in using your default web browser instead of the built-in sign in "+
+			"window. The app registration used must allow http://localhost as a "+
+			"redirect URI, see --client-id.")
+	tenant := flag.String("tenant", "",
+		"Azure AD tenant to sign in against: \"common\" (default, any account), "+
+			"\"organizations\" (work or school accounts only), \"consumers\" "+
+			"(personal accounts only), or a tenant ID or domain. Only used when "+
+			"signing in for the first time.")
+	cloud := flag.String("cloud", "",
+		"National cloud to connect to, one of: "+strings.Join(graph.Clouds(), ", ")+
+			". Defaults to the global service. Only used when signing in for the "+
+			"first time.")
+	clientID := flag.String("client-id", "",
+		"Application (client) ID of your own Azure app registration to sign in "+
+			"with, instead of onedriver's. Only used when signing in for the first time.")
+	redirectURI := flag.String("redirect-uri", "",
+		"Redirect URI registered for --client-id.")
+	clientSecretFile := flag.String("client-secret-file", "",
+		"File containing the client secret for --client-id, if your app "+
+			"registration is a confidential client.")
+	scopes := flag.String("scopes", "",
+		"Microsoft Graph permissions to request, space separated. Defaults to "+
+			"\"user.read files.readwrite.all offline_access\". If no write "+
+			"permission (files.readwrite, files.readwrite.all, "+
+			"sites.readwrite.all) is granted, the filesystem is mounted read-only. "+
+			"Only used when signing in for the first time.")
+	authDeviceCode := flag.Bool("auth-device-code", false,
+		"Authenticate using a code entered in a browser on another device, "+
+			"for machines without a browser or display. Only used when "+
+			"signing in for the first time.")
+	logLevel := flag.StringP("log-level", "l", "debug", "Set logging level/verbosity. "+
 		"Can be one of: fatal, error, warn, info, debug, trace")
+	// the old name, still accepted
+	flag.StringVar(logLevel, "log", "debug", "")
+	flag.CommandLine.MarkHidden("log")
 	cacheDir := flag.StringP("cache-dir", "c", "",
 		"Change the default cache directory used by onedriver. "+
 			"Will be created if the path does not already exist.")
+	account := flag.String("account", "",
+		"Use a named account profile. Each account has its own credentials and "+
+			"cache, so several accounts (e.g. \"personal\" and \"work\") can be "+
+			"mounted at once, see --mount.")
+	site := flag.String("site", "",
+		"Mount the document library of a SharePoint site instead of the "+
+			"account's own drive. The site is given by its URL (e.g. "+
+			"\"https://contoso.sharepoint.com/sites/team\") or its ID. "+
+			"Does not apply to accounts mounted with --mount.")
+	library := flag.String("library", "",
+		"Name of the document library of --site to mount, if not its default "+
+			"one (\"Documents\").")
+	drive := flag.String("drive", "",
+		"Mount the drive with this ID instead of the account's own drive, "+
+			"such as another user's drive shared with the account. Does not "+
+			"apply to accounts mounted with --mount.")
+	remoteRoot := flag.String("root", "",
+		"Mount only this folder of the drive (e.g. \"/Projects/2024\"), "+
+			"which is shown as the root of the filesystem. Does not apply to "+
+			"accounts mounted with --mount.")
+	mountFlags := flag.StringArray("mount", nil,
+		"Also mount a named account profile, as \"account=mountpoint\". Can be "+
+			"given several times to serve several accounts from one process.")
+	superviseFlag := flag.Bool("supervise", false,
+		"Run the filesystem in a child process and start it over if it "+
+			"crashes or is disconnected by the kernel. The cache and changes "+
+			"waiting to be uploaded are kept. Can't be used with --daemon.")
+	dryRunFlag := flag.Bool("dry-run", false,
+		"Check that onedriver could be mounted with these options, without "+
+			"mounting it: sign in, list the root of the drive, start following "+
+			"changes on the server and check the mountpoint, then exit.")
+	createMountpoint := flag.Bool("create-mountpoint", false,
+		"Create the mountpoint if it does not exist, and remove it again once "+
+			"unmounted.")
+	force := flag.Bool("force", false,
+		"Let \"onedriver clear-cache\", --purge and --logout delete changes "+
+			"that have not been uploaded yet.")
 	wipeCache := flag.BoolP("wipe-cache", "w", false,
 		"Delete the existing onedriver cache directory and then exit. "+
 			"Equivalent to resetting the program.")
+	purge := flag.StringP("purge", "p", "",
+		"Evict a single item (and everything beneath it) from the cache by path "+
+			"or ID and then exit. Paths must start with \"/\". "+
+			"The item will be re-fetched on next access. Refuses to if any of "+
+			"it has changes that have not been uploaded yet, unless --force is "+
+			"given.")
+	pin := flag.String("pin", "",
+		"Keep a file or folder in a mounted onedriver filesystem available "+
+			"offline and then exit. Its content is downloaded ahead of time and "+
+			"kept up to date. Same as setting the user.onedriver.pin extended "+
+			"attribute.")
+	unpin := flag.String("unpin", "",
+		"Stop keeping a file or folder available offline and then exit.")
+	freeSpace := flag.String("free-space", "",
+		"Free up the space the content of a file, or of every file in a folder, "+
+			"takes up in the cache of a mounted onedriver filesystem and then "+
+			"exit. The files stay visible and are downloaded again when read. "+
+			"Files that are open or have changes that have not been uploaded yet "+
+			"are kept. Unpins the file or folder.")
+	notifyListen := flag.String("notify-listen", "",
+		"Address (host:port) to listen on for Microsoft Graph change notifications. "+
+			"Requires --notify-url.")
+	notifyURL := flag.String("notify-url", "",
+		"Public HTTPS URL that forwards to --notify-listen. When set, server-side "+
+			"changes are pushed to onedriver instead of waiting for the next poll.")
+	metricsListen := flag.String("metrics-listen", "",
+		"Address (host:port) to publish metrics on for Prometheus, at /metrics. "+
+			"Covers requests to the server, FUSE operations, the cache, uploads "+
+			"and how far behind the server each mount is.")
+	statusListen := flag.String("status-listen", "",
+		"Address (host:port, or :port for localhost) to serve the status of "+
+			"mounts on as JSON, at /status. Covers whether they are online and "+
+			"signed in, pending changes and transfers, quota, and when changes "+
+			"were last fetched from the server.")
+	pause := flag.Bool("pause", false,
+		"Pause syncing for an already running instance of onedriver and then exit. "+
+			"The filesystem stays mounted, but changes are not synced until resumed.")
+	resume := flag.Bool("resume", false,
+		"Resume syncing for an already running instance of onedriver and then exit.")
+	pauseTransfers := flag.Bool("pause-transfers", false,
+		"Pause uploads and downloads of file content for an already running "+
+			"instance of onedriver and then exit. Unlike --pause, changes are still "+
+			"synced, and transfers continue where they left off when resumed.")
+	resumeTransfers := flag.Bool("resume-transfers", false,
+		"Resume uploads and downloads for an already running instance of "+
+			"onedriver and then exit.")
+	resync := flag.Bool("resync", false,
+		"Force a full resync with the server. Discards cached metadata (local "+
+			"changes that have not been uploaded are kept) and revalidates "+
+			"everything against the server. If onedriver is already running, "+
+			"the running instance is told to resync and this command exits.")
+	maxSyncAge := flag.Duration("max-sync-age", 0,
+		"How long \"onedriver health\" accepts changes not having been fetched "+
+			"from the server for. Defaults to three times --poll-interval of the "+
+			"running instance.")
+	jsonOutput := flag.Bool("json", false,
+		"Print the output of \"onedriver stats\", \"errors\", \"conflicts\", \"ls\" and "+
+			"\"stat\" as JSON.")
+	status := flag.Bool("status", false,
+		"Show local changes that have not been synced to the server yet, and "+
+			"the progress of uploads and downloads, for an already running "+
+			"instance of onedriver and then exit.")
+	proxy := flag.String("proxy", "",
+		"Send all requests through this proxy (http://, https://, or socks5://, "+
+			"with optional user:password@ for authenticated proxies). Overrides "+
+			"HTTP_PROXY/HTTPS_PROXY/NO_PROXY, which are honored otherwise.")
+	authStatus := flag.Bool("auth-status", false,
+		"Show which account onedriver is signed in to, when the current "+
+			"session expires, and what it has been granted access to, then exit.")
+	reauth := flag.Bool("reauth", false,
+		"Sign in again, for when your session has expired or been revoked. "+
+			"A running instance of onedriver picks up the new sign in and "+
+			"resumes syncing without being remounted.")
+	logout := flag.Bool("logout", false,
+		"Sign out, deleting the stored credentials and cache of the account "+
+			"(see --account), and then exit. A running instance of onedriver for "+
+			"the account is unmounted first. Refuses to while changes have not "+
+			"been uploaded yet unless --force is given.")
+	chunkSize := flag.Uint64("upload-chunk-size", 10,
+		"Size in MiB of the chunks large files are uploaded in. Larger chunks "+
+			"upload faster on good connections, smaller ones lose less progress "+
+			"on bad ones. At most 60. By default chunk sizes are adjusted to the "+
+			"connection, starting from this size. Setting it turns that off for "+
+			"uploads.")
+	fixedChunks := flag.Bool("no-chunk-tuning", false,
+		"Always transfer content in chunks of the same size, rather than "+
+			"adjusting their size to how fast and reliable the connection is.")
+	traceRequests := flag.Bool("trace-requests", false,
+		"Log every request to the server with the IDs Microsoft support needs "+
+			"to look it up (request-id and client-request-id), how long it took "+
+			"and which attempt it was. Can be turned on and off while running with "+
+			"the trace command.")
+	noNotifications := flag.Bool("no-notifications", false,
+		"Don't show desktop notifications when uploads fail, conflicting "+
+			"changes are saved as a copy, OneDrive is full, or the account has "+
+			"to sign in again.")
+	maxUploadRate := flag.Uint64("max-upload-rate", 0,
+		"Limit uploads of file content to this many KiB per second, shared "+
+			"by all uploads. 0 means no limit.")
+	maxDownloadRate := flag.Uint64("max-download-rate", 0,
+		"Limit downloads of file content to this many KiB per second, shared "+
+			"by all downloads. 0 means no limit.")
+	downloadWorkers := flag.Int("download-workers", 4,
+		"How many parts of a large file are downloaded at once. 1 downloads "+
+			"files from start to end in a single stream.")
+	uploadDelay := flag.Duration("upload-delay", 2*time.Second,
+		"How long to wait for further changes to a file before uploading it, "+
+			"so files that are saved many times in quick succession are only "+
+			"uploaded once.")
+	offlineContent := flag.String("offline-content", graph.OfflineContentError,
+		"What reading a file whose content isn't cached does while offline: "+
+			"\"error\" fails with an I/O error, \"nodata\" fails with ENODATA, "+
+			"\"wait\" waits for the connection to come back (see --offline-wait) "+
+			"before failing with an I/O error.")
+	offlineWait := flag.Duration("offline-wait", 30*time.Second,
+		"How long reads wait for the connection to come back with "+
+			"--offline-content=wait.")
+	conflictPolicy := flag.String("conflict-policy", string(graph.ConflictKeepBoth),
+		"How changes made offline that clash with changes made on the server "+
+			"in the meantime are settled: \"keep-both\" saves the local version "+
+			"of a file as a conflicted copy next to the server's, \"keep-local\" "+
+			"overwrites the server's version, \"keep-remote\" drops the local "+
+			"changes.")
+	folderConflictPolicy := flag.StringSlice("folder-conflict-policy", nil,
+		"Use a different conflict policy for a folder and everything in it, "+
+			"as \"/path/to/folder=policy\". Can be given several times.")
+	evictAfter := flag.Duration("evict-after", 30*24*time.Hour,
+		"Free up the space taken by the content of files that have not been "+
+			"opened for this long. The files stay visible and are downloaded "+
+			"again when read. Pinned files are kept. 0 keeps everything.")
+	include := flag.StringSlice("include", nil,
+		"Only show these folders, by path from the root of the drive (e.g. "+
+			"\"/Documents\"). Can be given several times. Patterns like "+
+			"\"/Projects/*\" are allowed.")
+	exclude := flag.StringSlice("exclude", nil,
+		"Leave out items matching a pattern, along with everything in them. "+
+			"Patterns starting with \"/\" match a path from the root of the "+
+			"drive, others match names anywhere (e.g. \"node_modules\" or "+
+			"\"*.tmp\"). Can be given several times. Excluded items are not "+
+			"shown or cached, and nothing can be created in their place.")
+	recycleBin := flag.Bool("recycle-bin", false,
+		"Show what is known to be in the OneDrive recycle bin in a read-only "+
+			"\"Recycle Bin\" folder at the root of the filesystem: items that "+
+			"were deleted while onedriver was running. See \"onedriver restore\".")
+	readOnlyFlag := flag.Bool("read-only", false,
+		"Mount the filesystem read-only. All changes are refused and nothing is "+
+			"ever uploaded. Same as \"-o ro\".")
+	mountOpts := flag.StringSliceP("options", "o", nil,
+		"Comma separated mount options. Supported options: ro, rw, allow_other "+
+			"(let other users access the mount), allow_root (let root access the "+
+			"mount), uid and gid (who files are shown as belonging to). "+
+			"allow_other and allow_root require user_allow_other in "+
+			"/etc/fuse.conf when not mounting as root. Any other onedriver "+
+			"option can be given the same way (e.g. \"account=work\"), and "+
+			"standard mount options like noauto or _netdev are ignored, so "+
+			"onedriver can be mounted from /etc/fstab.")
+	generateSystemdFlag := flag.String("generate-systemd", "",
+		"Print a systemd user unit that mounts onedriver at this mountpoint, "+
+			"along with how to install it, and then exit.")
+	daemon := flag.Bool("daemon", false,
+		"Keep running in the background once the filesystem is mounted. The "+
+			"process ID is written to --pidfile and logs to --log-file.")
+	pidfile := flag.String("pidfile", "",
+		"Where --daemon writes its process ID to. Defaults to onedriver.pid in "+
+			"the cache directory.")
+	logFile := flag.String("log-file", "",
+		"Write logs to this file instead of the terminal. Defaults to "+
+			"onedriver.log in the cache directory with --daemon.")
+	logMaxSize := flag.Uint64("log-max-size", 10,
+		"Size in MiB the log file may grow to before it is moved aside and a "+
+			"new one is started. 0 lets it grow forever.")
+	logKeep := flag.Int("log-keep", 3,
+		"How many log files that were moved aside to keep.")
+	pollInterval := flag.Duration("poll-interval", 30*time.Second,
+		"How often to check the server for changes.")
+	slowOpThreshold := flag.Duration("slow-op-threshold", 10*time.Second,
+		"Log filesystem operations that take longer than this, with the path "+
+			"they were for. 0 turns this off.")
+	configPath := flag.String("config", config.DefaultPath(),
+		"Read options from this configuration file, if it exists.")
 	versionFlag := flag.BoolP("version", "v", false, "Display program version.")
 	debugOn := flag.BoolP("debug", "d", false, "Enable FUSE debug logging.")
 	flag.BoolP("help", "h", false, "Displays this help message.")
 	flag.Usage = usage
 	flag.Parse()
+	command, args := "", flag.Args()
+	if len(args) > 0 && commands[args[0]] {
+		command, args = args[0], args[1:]
+	}
+	rest, err := commandArgs(command, args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if command == "completion" {
+		if err := printCompletion(os.Stdout, args[0]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	given := changedFlags()
+	mountpoint, err := applyConfig(*configPath, flag.CommandLine.Changed("config"), rest)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	configured := changedFlags()
+	fuseOpts, err := parseMountOptions(*mountOpts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	// options from the command line or mount options survive a reload, those
+	// from the configuration file don't
+	pinned := changedFlags()
+	for name := range configured {
+		if !given[name] {
+			delete(pinned, name)
+		}
+	}
 
 	clen := 0
 	if len(commit) > 7 {
@@ -64,27 +444,258 @@ func main() {
 		fmt.Printf("onedriver v%s %s\n", version, commit[:clen])
 		os.Exit(0)
 	}
+	if *generateSystemdFlag != "" {
+		if err := generateSystemd(*generateSystemdFlag); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not generate systemd unit: %s\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
 
 	dir := *cacheDir
 	if dir == "" {
 		dir = graph.CacheDir()
 	}
+	cacheRoot := dir
+	if command == "__complete" {
+		printCompletions(args[0], cacheRoot, *account, *mountFlags)
+		os.Exit(0)
+	}
+	if *account != "" {
+		accountDir, err := graph.AccountDir(dir, *account)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		dir = accountDir
+	}
+	served := remote{site: *site, library: *library, drive: *drive}
+	if *remoteRoot != "" && path.Clean("/"+*remoteRoot) != "/" {
+		served.root = path.Clean("/" + *remoteRoot)
+	}
+	switch {
+	case served.library != "" && served.site == "":
+		fmt.Fprintln(os.Stderr, "--library can only be used with --site.")
+		os.Exit(1)
+	case served.site != "" && served.drive != "":
+		fmt.Fprintln(os.Stderr, "--site and --drive can't be used together.")
+		os.Exit(1)
+	}
+	// anything but the whole drive of the account has its own cache, and its
+	// own instance to control
+	instanceDir := dir
+	if served != (remote{}) {
+		instanceDir = served.dir(dir)
+	}
 
+	if *proxy != "" {
+		if err := graph.SetProxy(*proxy); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid proxy: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if *logout {
+		if err := signOut(dir, *force); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not sign out: %s\n", err)
+			os.Exit(1)
+		}
+		fmt.Println("Signed out.")
+		os.Exit(0)
+	}
 	if *wipeCache {
-		os.RemoveAll(dir)
+		os.RemoveAll(instanceDir)
+	}
+	if *purge != "" {
+		purged, err := graph.PurgeCache(filepath.Join(instanceDir, "onedriver.db"), *purge, *force)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not purge \"%s\" from cache: %s\n", *purge, err)
+			os.Exit(1)
+		}
+		fmt.Printf("Purged %d item(s) from cache.\n", purged)
+		os.Exit(0)
+	}
+	if *pin != "" || *unpin != "" {
+		if err := changePin(*pin, *unpin); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not change pin: %s\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if *freeSpace != "" {
+		if err := freeUpSpace(*freeSpace); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not free up space: %s\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if *pause || *resume || *pauseTransfers || *resumeTransfers {
+		command := "pause"
+		switch {
+		case *resume:
+			command = "resume"
+		case *pauseTransfers:
+			command = "pause-transfers"
+		case *resumeTransfers:
+			command = "resume-transfers"
+		}
+		if _, err := control.Send(control.SocketPath(instanceDir), command); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	t := target{cacheRoot: cacheRoot, instanceDir: instanceDir, mountpoint: mountpoint}
+	if code, ran := runCommand(command, args, t, *jsonOutput, *maxSyncAge, *force); ran {
+		os.Exit(code)
+	}
+	if *status {
+		if err := printStatus(instanceDir); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if *resync {
+		if _, err := control.Send(control.SocketPath(instanceDir), "resync"); err == nil {
+			fmt.Println("Resync started.")
+			os.Exit(0)
+		}
+		// not running, resync once we are mounted
+	}
+	if err := graph.ValidateCloud(*cloud); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	authConfig := graph.AuthConfig{
+		Tenant:      *tenant,
+		Cloud:       *cloud,
+		ClientID:    *clientID,
+		RedirectURL: *redirectURI,
+		DeviceCode:  *authDeviceCode,
+		Browser:     *authBrowser,
+		Scopes:      *scopes,
+	}
+	if *clientSecretFile != "" {
+		// kept out of the command line so it doesn't show up in ps
+		secret, err := ioutil.ReadFile(*clientSecretFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not read client secret: %s\n", err)
+			os.Exit(1)
+		}
+		authConfig.ClientSecret = strings.TrimSpace(string(secret))
+	}
+	if command == "ls" || command == "stat" {
+		os.MkdirAll(dir, 0700)
+		auth := graph.AuthenticateConfig(filepath.Join(dir, "auth_tokens.json"), authConfig)
+		if err := browseRemote(command, args, auth, *jsonOutput); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if *authStatus {
+		if err := printAuthStatus(filepath.Join(dir, "auth_tokens.json")); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if *reauth {
+		os.MkdirAll(dir, 0700)
+		graph.Reauthenticate(filepath.Join(dir, "auth_tokens.json"), authConfig)
+		if _, err := control.Send(control.SocketPath(dir), "reauth"); err == nil {
+			fmt.Println("Signed in, syncing will resume shortly.")
+		}
+		os.Exit(0)
 	}
 	if *authOnly {
-		graph.Authenticate(filepath.Join(dir, "auth_tokens.json"))
+		os.MkdirAll(dir, 0700)
+		graph.AuthenticateConfig(filepath.Join(dir, "auth_tokens.json"), authConfig)
 	}
 	if *wipeCache || *authOnly {
 		os.Exit(0)
 	}
 
+	readOnly := *readOnlyFlag || fuseOpts.readOnly
+	allowOther, allowRoot := fuseOpts.allowOther, fuseOpts.allowRoot
+	if allowOther && allowRoot {
+		fmt.Fprintln(os.Stderr, "allow_other and allow_root cannot be used together.")
+		os.Exit(1)
+	}
+	if (allowOther || allowRoot) && os.Getuid() != 0 && !userAllowOther() {
+		// fusermount would refuse with a much less helpful message
+		fmt.Fprintln(os.Stderr, "allow_other and allow_root can only be used by "+
+			"regular users if \"user_allow_other\" is set in /etc/fuse.conf.")
+		os.Exit(1)
+	}
+
+	graph.SetOwner(fuseOpts.uid, fuseOpts.gid)
+	graph.SetChunkSize(*chunkSize * 1024 * 1024)
+	graph.SetChunkTuning(!*fixedChunks && !flag.CommandLine.Changed("upload-chunk-size"),
+		!*fixedChunks)
+	graph.SetMaxUploadRate(*maxUploadRate * 1024)
+	graph.SetMaxDownloadRate(*maxDownloadRate * 1024)
+	graph.SetDesktopNotifications(!*noNotifications)
+	graph.SetRequestTracing(*traceRequests)
+	graph.SetSlowOpThreshold(*slowOpThreshold)
+	graph.SetDownloadWorkers(*downloadWorkers)
+	graph.SetUploadDelay(*uploadDelay)
+	graph.SetEvictAfter(*evictAfter)
+	if err := graph.SetOfflineContent(*offlineContent, *offlineWait); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := graph.SetConflictPolicy(*conflictPolicy, *folderConflictPolicy); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := graph.SetSyncFilter(*include, *exclude); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
 	log.SetLevel(logger.StringToLevel(*logLevel))
 	log.SetReportCaller(true)
 	log.SetFormatter(logger.LogrusFormatter())
+	logger.CaptureStandardLog(log.InfoLevel)
+	if *logFile == "" && *daemon {
+		os.MkdirAll(instanceDir, 0700)
+		*logFile = filepath.Join(instanceDir, "onedriver.log")
+	}
+	if *logFile != "" && (!*daemon || daemonized()) {
+		// the copy of onedriver that starts one in the background keeps
+		// logging to the terminal
+		output, err := logger.NewRotatingFile(*logFile, int64(*logMaxSize)*1024*1024, *logKeep)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not open log file: %s\n", err)
+			os.Exit(1)
+		}
+		defer output.Close()
+		log.SetOutput(output)
+	}
+
+	quiet := command == "get" || command == "put" || *dryRunFlag
+	if quiet && !flag.CommandLine.Changed("log-level") && !flag.CommandLine.Changed("log") {
+		// only problems are worth reporting when not mounting
+		log.SetLevel(log.WarnLevel)
+	}
+	if command == "get" || command == "put" {
+		os.MkdirAll(dir, 0700)
+		auth := graph.AuthenticateConfig(filepath.Join(dir, "auth_tokens.json"), authConfig)
+		if err := transferFile(command, args, auth); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not %s %s: %s\n", command, args[0], err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
 
-	if len(flag.Args()) != 1 {
+	mounts, err := parseMounts(mountpoint, dir, cacheRoot, served, *mountFlags)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if len(mounts) == 0 {
 		// no mountpoint provided
 		flag.Usage()
 		os.Exit(1)
@@ -93,71 +704,339 @@ func main() {
 	log.Infof("onedriver v%s %s", version, commit[:clen])
 
 	// setup filesystem
-	if st, _ := os.Stat(dir); st == nil {
-		os.Mkdir(dir, 0700)
-	}
-
-	root := graph.NewFS(
-		filepath.Join(dir, "onedriver.db"),
-		filepath.Join(dir, "auth_tokens.json"),
-		30*time.Second,
-	)
-
-	// Create .xdg-volume-info for a nice little onedrive logo in the corner of the
-	// mountpoint and show the account name in the nautilus sidebar
-	cache := root.GetCache()
-	auth := cache.GetAuth()
-	if child, _ := cache.GetPath("/.xdg-volume-info", auth); child == nil {
-		log.Info("Creating .xdg-volume-info")
-		user, err := graph.GetUser(auth)
-		if err != nil {
-			log.Error("Could not create .xdg-volume-info: ", err)
-		} else {
-			xdgVolumeInfo := fmt.Sprintf("[Volume Info]\nName=%s\n", user.UserPrincipalName)
-			if _, err := os.Stat("/usr/share/icons/onedriver.png"); err == nil {
-				xdgVolumeInfo += "IconFile=/usr/share/icons/onedriver.png\n"
-			}
-			// just upload directly and shove it in the cache
-			// (since the fs isn't mounted yet)
-			resp, err := graph.Put(
-				graph.ResourcePath("/.xdg-volume-info")+":/content",
-				auth,
-				strings.NewReader(xdgVolumeInfo),
-			)
-			if err != nil {
-				log.Error(err)
+	for _, m := range mounts {
+		if st, _ := os.Stat(m.dir); st == nil {
+			os.MkdirAll(m.dir, 0700)
+		}
+		// sign in before mounting, in case this is the first run
+		auth := graph.AuthenticateConfig(m.authPath(), authConfig)
+		if m.remote.site != "" {
+			if err := m.resolveLibrary(auth); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
 			}
-			inode := graph.NewInode(".xdg-volume-info", 0644, root)
-			err = json.Unmarshal(resp, &inode)
-			if err == nil {
-				cache.InsertID(inode.ID(), inode)
+		}
+		if *dryRunFlag {
+			if err := dryRun(m, auth, *createMountpoint); err != nil {
+				fmt.Fprintf(os.Stderr, "  Failed: %s\n", err)
+				os.Exit(1)
 			}
 		}
 	}
+	if *dryRunFlag {
+		fmt.Println("Everything checks out, onedriver can be mounted.")
+		os.Exit(0)
+	}
 
-	second := time.Second
-	server, err := fs.Mount(flag.Arg(0), root, &fs.Options{
-		EntryTimeout: &second,
-		AttrTimeout:  &second,
-		MountOptions: fuse.MountOptions{
-			Name:          "onedriver",
-			FsName:        "onedriver",
-			DisableXAttrs: true,
-			MaxBackground: 1024,
-		},
-	})
-	if err != nil {
-		log.Error(err)
-		log.Fatalf("Mount failed. Is the mountpoint already in use? "+
-			"(Try running \"fusermount -u %s\")\n", flag.Arg(0))
+	if *pidfile == "" {
+		*pidfile = filepath.Join(instanceDir, "onedriver.pid")
+	}
+	mountpoints := make([]string, 0, len(mounts))
+	for _, m := range mounts {
+		mountpoints = append(mountpoints, m.mountpoint)
+	}
+	if *superviseFlag && !supervised() {
+		if *daemon {
+			fmt.Fprintln(os.Stderr, "--supervise can't be used with --daemon.")
+			os.Exit(1)
+		}
+		// signed in already, the copies it starts just load the tokens
+		os.Exit(supervise(mountpoints))
+	}
+	if *daemon && !daemonized() {
+		// signed in already, so nothing in the background needs the terminal
+		pid, err := daemonize(*logFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not start in the background: %s\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Mounted at %s, running in the background as process %d.\n",
+			strings.Join(mountpoints, ", "), pid)
+		os.Exit(0)
+	}
+	if *daemon {
+		if err := writePidfile(*pidfile); err != nil {
+			log.WithField("err", err).Fatal("Could not write pidfile.")
+		}
+	}
+
+	settings := mountSettings{
+		readOnly:     readOnly,
+		allowOther:   allowOther,
+		allowRoot:    allowRoot,
+		debug:        *debugOn,
+		resync:       *resync,
+		recycleBin:   *recycleBin,
+		create:       *createMountpoint,
+		pollInterval: *pollInterval,
+		notifyListen: *notifyListen,
+		notifyURL:    *notifyURL,
+	}
+	servers := make([]*fuse.Server, 0, len(mounts))
+	caches := make([]*graph.Cache, 0, len(mounts))
+	// what is left behind once everything is unmounted
+	cleanup := func() {
+		if *daemon {
+			removePidfile(*pidfile)
+		}
+		for _, m := range mounts {
+			m.removeMountpoint()
+		}
+	}
+	for _, m := range mounts {
+		if err := m.start(settings, len(mounts) > 1); err != nil {
+			log.Error(err)
+			// don't leave the others behind with nothing serving them
+			for _, mounted := range mounts[:len(servers)] {
+				mounted.server.Unmount()
+			}
+			cleanup()
+			log.Fatalf("Mount failed. Is the mountpoint already in use? "+
+				"(Try running \"fusermount -u %s\")\n", m.mountpoint)
+		}
+		servers = append(servers, m.server)
+		caches = append(caches, m.cache)
+	}
+	publishStatus(mounts)
+	if *metricsListen != "" {
+		if err := serveMetrics(*metricsListen, mounts); err != nil {
+			log.WithField("err", err).Error("Could not publish metrics.")
+		}
+	}
+	if *statusListen != "" {
+		if err := serveStatus(*statusListen, mounts); err != nil {
+			log.WithField("err", err).Error("Could not serve status.")
+		}
+	}
+	if err := sdNotify("READY=1\nSTATUS=Mounted at " + strings.Join(mountpoints, ", ")); err != nil {
+		log.WithField("err", err).Warn("Could not tell systemd the filesystem is mounted.")
+	}
+	if *daemon {
+		daemonMounted()
 	}
-	server.SetDebug(*debugOn)
 
 	// setup sigint handler for graceful unmount on interrupt
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	go graph.UnmountHandler(sigChan, server)
+	go graph.UnmountAllHandler(sigChan, servers, caches, cleanup)
+
+	// reread the configuration file on SIGHUP
+	handleReloads(*configPath, pinned, include, exclude, caches, func() {
+		log.SetLevel(logger.StringToLevel(*logLevel))
+		graph.SetMaxUploadRate(*maxUploadRate * 1024)
+		graph.SetMaxDownloadRate(*maxDownloadRate * 1024)
+		graph.SetDesktopNotifications(!*noNotifications)
+		graph.SetRequestTracing(*traceRequests)
+		graph.SetSlowOpThreshold(*slowOpThreshold)
+		for _, cache := range caches {
+			cache.SetPollInterval(*pollInterval)
+		}
+	})
+
+	// write a debug dump on SIGUSR1, for hangs that need more than the logs
+	handleDumps(cacheRoot, mounts)
+
+	// serve filesystems
+	serve(mounts)
+	sdNotify("STOPPING=1")
+	cleanup()
+}
+
+// applyConfig sets the options in a configuration file that were not given on
+// the command line, and returns the mountpoint, which is taken from args if
+// given there. A missing configuration file is only an error if it was asked
+// for.
+func applyConfig(path string, required bool, args []string) (string, error) {
+	mountpoint := ""
+	if len(args) > 1 {
+		return "", errors.New("only one mountpoint can be given")
+	}
+	if len(args) == 1 {
+		mountpoint = args[0]
+	}
+	settings, err := config.Load(path)
+	if os.IsNotExist(err) && !required {
+		return mountpoint, nil
+	} else if err != nil {
+		return "", err
+	}
 
-	// serve filesystem
-	server.Wait()
+	home, _ := os.UserHomeDir()
+	for _, setting := range settings {
+		for i, value := range setting.Values {
+			if strings.HasPrefix(value, "~/") && home != "" {
+				// the shell does this for the command line
+				setting.Values[i] = filepath.Join(home, value[2:])
+			}
+		}
+		if setting.Key == "mountpoint" {
+			if mountpoint == "" && len(setting.Values) == 1 {
+				mountpoint = setting.Values[0]
+			}
+			continue
+		}
+		option := flag.Lookup(setting.Key)
+		if option == nil || setting.Key == "config" {
+			return "", fmt.Errorf("%s:%d: unknown option \"%s\"", path, setting.Line, setting.Key)
+		}
+		if option.Changed {
+			continue
+		}
+		values := setting.Values
+		if len(values) == 0 && option.Value.Type() == "bool" {
+			// "read-only:" on its own turns it on
+			values = []string{"true"}
+		}
+		for _, value := range values {
+			if err := flag.Set(setting.Key, value); err != nil {
+				return "", fmt.Errorf("%s:%d: invalid value for \"%s\": %s",
+					path, setting.Line, setting.Key, err)
+			}
+		}
+	}
+	return mountpoint, nil
+}
+
+// printStatus asks a running instance whether it is online, and for its pending
+// changes and transfers, and prints them.
+func printStatus(cacheDir string) error {
+	response, err := control.Send(control.SocketPath(cacheDir), "connection")
+	if err != nil {
+		return err
+	}
+	var connection graph.ConnectionStatus
+	if err = json.Unmarshal([]byte(response), &connection); err != nil {
+		return err
+	}
+	if !connection.Online {
+		fmt.Printf("Offline since %s, changes are queued until the connection "+
+			"is restored (%s).\n\n", connection.Since.Format(time.Stamp), connection.Error)
+	}
+
+	response, err = control.Send(control.SocketPath(cacheDir), "status")
+	if err != nil {
+		return err
+	}
+	var changes []graph.PendingChange
+	if err = json.Unmarshal([]byte(response), &changes); err != nil {
+		return err
+	}
+	if len(changes) == 0 {
+		fmt.Println("All local changes have been synced.")
+	}
+	for _, change := range changes {
+		line := fmt.Sprintf("%-10s %-7s %s", change.State, change.Op, change.Path)
+		if change.Size > 0 {
+			line += fmt.Sprintf(" [%d%%]", change.Uploaded*100/change.Size)
+		}
+		if change.Error != "" {
+			line += " (" + change.Error + ")"
+		}
+		fmt.Println(line)
+	}
+	return printTransfers(cacheDir)
+}
+
+// printTransfers asks a running instance for the progress of its transfers and
+// prints it.
+func printTransfers(cacheDir string) error {
+	response, err := control.Send(control.SocketPath(cacheDir), "transfers")
+	if err != nil {
+		return err
+	}
+	var status graph.TransferStatus
+	if err = json.Unmarshal([]byte(response), &status); err != nil {
+		return err
+	}
+	if len(status.Transfers) == 0 {
+		return nil
+	}
+	fmt.Printf("\n%d transfer(s), %d upload(s) queued", len(status.Transfers), status.Queued)
+	if status.Paused {
+		fmt.Print(" (paused)")
+	} else if status.Metered {
+		fmt.Print(" (large transfers held on a metered connection)")
+	}
+	fmt.Println(":")
+	for _, transfer := range status.Transfers {
+		line := fmt.Sprintf("%-8s %-6s %s", transfer.Direction, transfer.State, transfer.Path)
+		if transfer.Total > 0 {
+			line += fmt.Sprintf(" [%d%%, %s of %s]", transfer.Done*100/transfer.Total,
+				formatBytes(transfer.Done), formatBytes(transfer.Total))
+		}
+		if transfer.Rate > 0 {
+			line += fmt.Sprintf(" %s/s", formatBytes(transfer.Rate))
+		}
+		if transfer.ETA > 0 {
+			line += fmt.Sprintf(", %s left", time.Duration(transfer.ETA)*time.Second)
+		}
+		fmt.Println(line)
+	}
+	return nil
+}
+
+// formatBytes formats a number of bytes in the largest binary unit it fits.
+func formatBytes(n uint64) string {
+	const units = "KMGTPE"
+	if n < 1024 {
+		return fmt.Sprintf("%d B", n)
+	}
+	value, unit := float64(n)/1024, 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	return fmt.Sprintf("%.1f %ciB", value, units[unit])
+}
+
+// userAllowOther returns whether /etc/fuse.conf lets regular users use the
+// allow_other and allow_root mount options.
+func userAllowOther() bool {
+	conf, err := ioutil.ReadFile("/etc/fuse.conf")
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(conf), "\n") {
+		if strings.TrimSpace(line) == "user_allow_other" {
+			return true
+		}
+	}
+	return false
+}
+
+// waitForExit waits for the instance listening on a control socket to exit.
+// Returns false if it is still running after timeout.
+func waitForExit(socket string, timeout time.Duration) bool {
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline); {
+		if _, err := control.Send(socket, "status"); err != nil {
+			return true
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	return false
+}
+
+// printAuthStatus prints details about the account tokens belong to.
+func printAuthStatus(authPath string) error {
+	status, err := graph.GetAuthStatus(authPath)
+	if err != nil {
+		return fmt.Errorf("not signed in: %w", err)
+	}
+	if status.Valid {
+		fmt.Printf("Signed in as:  %s (%s)\n", status.Account, status.Name)
+	} else {
+		fmt.Printf("Session is not valid: %s\n", status.Error)
+	}
+	fmt.Printf("Tenant:        %s (%s cloud)\n", status.Tenant, status.Cloud)
+	fmt.Printf("Token expires: %s\n", status.Expires.Format(time.RFC1123))
+	if len(status.Scopes) > 0 {
+		fmt.Printf("Scopes:        %s\n", strings.Join(status.Scopes, " "))
+	}
+	if status.DriveType != "" {
+		fmt.Printf("Drive:         %s, owned by %s\n", status.DriveType, status.DriveOwner)
+	}
+	if !status.Valid {
+		return errors.New("run \"onedriver --reauth\" to sign in again")
+	}
+	return nil
 }
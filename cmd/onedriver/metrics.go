@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"path/filepath"
+
+	"github.com/jstaf/onedriver/graph"
+	log "github.com/sirupsen/logrus"
+)
+
+// serveMetrics publishes metrics for mounts on addr (host:port) at /metrics,
+// for Prometheus to scrape. The listener is opened before returning, so a bad
+// address or one that is in use is reported right away.
+func serveMetrics(addr string, mounts []*mount) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	caches := make(map[string]*graph.Cache, len(mounts))
+	for _, m := range mounts {
+		abs, _ := filepath.Abs(m.mountpoint)
+		caches[abs] = m.cache
+	}
+	handler := http.NewServeMux()
+	handler.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		graph.WriteMetrics(w, caches)
+	})
+	go func() {
+		if err := http.Serve(listener, handler); err != nil {
+			log.WithField("err", err).Error("Metrics listener stopped.")
+		}
+	}()
+	log.WithField("addr", listener.Addr()).Info("Serving metrics.")
+	return nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// prepareMountpoint makes sure there is somewhere to mount an account. A
+// mount left behind by an onedriver that died, which fails everything with
+// "transport endpoint is not connected", is cleaned up, and a missing
+// mountpoint is created if create is set. Returns whether the mountpoint was
+// created.
+func prepareMountpoint(mountpoint string, create bool) (bool, error) {
+	_, err := os.Stat(mountpoint)
+	if errors.Is(err, syscall.ENOTCONN) {
+		log.WithField("mountpoint", mountpoint).Warn(
+			"Mountpoint is a stale mount left behind by a previous run, unmounting it.")
+		if output, err := exec.Command("fusermount", "-uz", mountpoint).CombinedOutput(); err != nil {
+			return false, fmt.Errorf("could not unmount stale mount at %s: %s", mountpoint, output)
+		}
+		_, err = os.Stat(mountpoint)
+	}
+	if os.IsNotExist(err) && create {
+		if err = os.MkdirAll(mountpoint, 0755); err != nil {
+			return false, err
+		}
+		log.WithField("mountpoint", mountpoint).Info("Created mountpoint.")
+		return true, nil
+	}
+	if os.IsNotExist(err) {
+		return false, fmt.Errorf("mountpoint %s does not exist, create it or use "+
+			"--create-mountpoint", mountpoint)
+	}
+	return false, err
+}
+
+// removeMountpoint removes the mountpoint of an account once it is unmounted,
+// if onedriver created it. Anything put there in the meantime is left alone.
+func (m *mount) removeMountpoint() {
+	if !m.created {
+		return
+	}
+	if err := os.Remove(m.mountpoint); err != nil && !os.IsNotExist(err) {
+		log.WithFields(log.Fields{
+			"mountpoint": m.mountpoint,
+			"err":        err,
+		}).Warn("Could not remove mountpoint.")
+	}
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/jstaf/onedriver/control"
+	"github.com/jstaf/onedriver/graph"
+	log "github.com/sirupsen/logrus"
+)
+
+// mount is a OneDrive account mounted by this process. Every account has its
+// own cache and control socket, while requests to the server share connections.
+type mount struct {
+	dir        string // cache directory of the account
+	authDir    string // where the account signs in, if not dir
+	remote     remote // what is served, if not the whole drive of the account
+	source     graph.Source
+	mountpoint string
+	cache      *graph.Cache
+	server     *fuse.Server
+	ctl        *control.Server
+	ctlClosed  sync.Once
+	created    bool // whether we created the mountpoint, and remove it on exit
+}
+
+// mountSettings are the settings every account is mounted with.
+type mountSettings struct {
+	readOnly     bool
+	allowOther   bool
+	allowRoot    bool
+	debug        bool
+	resync       bool
+	recycleBin   bool // show the recycle bin folder
+	create       bool // create missing mountpoints
+	pollInterval time.Duration
+	notifyListen string // only used when a single account is mounted
+	notifyURL    string
+}
+
+// remote is what a mount serves when it is not the whole drive of its account.
+type remote struct {
+	site    string // SharePoint site whose document library is served
+	library string // name of that library, the default one if empty
+	drive   string // ID of another drive
+	root    string // path of the folder served as the root
+}
+
+// dir returns the cache directory of r when mounted with the account kept in
+// accountDir. Each has its own, next to the cache of the account's own drive.
+// A site given by URL gets a different one than the same site given by ID.
+func (r remote) dir(accountDir string) string {
+	kind, key := "drives", r.drive
+	if r.site != "" {
+		kind, key = "sites", r.site+"\n"+strings.ToLower(r.library)
+	}
+	if r.root != "" {
+		key += "\n" + r.root
+	}
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(accountDir, kind, hex.EncodeToString(sum[:8]))
+}
+
+// serve makes m serve r instead of the drive of the account, which it still
+// signs in with.
+func (m *mount) serve(r remote) {
+	m.authDir = m.dir
+	m.dir = r.dir(m.dir)
+	m.remote = r
+	m.source = graph.Source{Drive: r.drive, Root: r.root}
+}
+
+// unmounting tracks accounts unmounted through their control socket while
+// others stay mounted, so the process doesn't exit halfway through.
+var unmounting sync.WaitGroup
+
+// parseMounts returns the accounts to mount: the one given by --account at
+// mountpoint, if there is one, and those given as "account=mountpoint" in
+// specs. cacheDir is the directory the caches of named accounts are kept in.
+// The --account mount serves served instead of the whole drive of the
+// account, if it is set.
+func parseMounts(mountpoint string, dir string, cacheDir string, served remote, specs []string) ([]*mount, error) {
+	mounts := make([]*mount, 0, len(specs)+1)
+	if mountpoint != "" {
+		m := &mount{dir: dir, mountpoint: mountpoint}
+		if served != (remote{}) {
+			m.serve(served)
+		}
+		mounts = append(mounts, m)
+	}
+	home, _ := os.UserHomeDir()
+	for _, spec := range specs {
+		split := strings.SplitN(spec, "=", 2)
+		if len(split) != 2 || split[1] == "" {
+			return nil, fmt.Errorf("invalid mount \"%s\", expected \"account=mountpoint\"", spec)
+		}
+		accountDir, err := graph.AccountDir(cacheDir, split[0])
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(split[1], "~/") && home != "" {
+			split[1] = filepath.Join(home, split[1][2:])
+		}
+		mounts = append(mounts, &mount{dir: accountDir, mountpoint: split[1]})
+	}
+
+	dirs := make(map[string]bool)
+	mountpoints := make(map[string]bool)
+	for _, m := range mounts {
+		abs, _ := filepath.Abs(m.mountpoint)
+		if mountpoints[abs] {
+			return nil, fmt.Errorf("%s is given as the mountpoint of more than one account", abs)
+		}
+		if dirs[m.dir] {
+			// they would fight over the cache
+			return nil, fmt.Errorf("account at %s is mounted more than once", m.mountpoint)
+		}
+		mountpoints[abs] = true
+		dirs[m.dir] = true
+	}
+	return mounts, nil
+}
+
+// authPath returns the path of the tokens the account signs in with.
+func (m *mount) authPath() string {
+	if m.authDir != "" {
+		return filepath.Join(m.authDir, "auth_tokens.json")
+	}
+	return filepath.Join(m.dir, "auth_tokens.json")
+}
+
+// start loads the cache of the account, listens on its control socket, and
+// mounts it. shared is whether other accounts are served by this process too.
+func (m *mount) start(settings mountSettings, shared bool) error {
+	created, err := prepareMountpoint(m.mountpoint, settings.create)
+	if err != nil {
+		return err
+	}
+	m.created = created
+
+	root := graph.NewSourceFS(
+		context.Background(),
+		filepath.Join(m.dir, "onedriver.db"),
+		m.authPath(),
+		settings.pollInterval,
+		m.source,
+	)
+
+	// Create .xdg-volume-info for a nice little onedrive logo in the corner of the
+	// mountpoint and show the account name in the nautilus sidebar
+	cache := root.GetCache()
+	m.cache = cache
+	auth := cache.GetAuth()
+	if settings.readOnly {
+		cache.SetReadOnly()
+	}
+	if settings.recycleBin {
+		cache.ShowRecycleBin()
+	}
+	readOnly := cache.IsReadOnly()
+	// it names the account, and belongs at the root of its drive
+	partial := m.source != (graph.Source{})
+	if child, _ := cache.GetPath("/.xdg-volume-info", auth); child == nil && !readOnly && !partial {
+		log.Info("Creating .xdg-volume-info")
+		user, err := graph.GetUser(auth)
+		if err != nil {
+			log.Error("Could not create .xdg-volume-info: ", err)
+		} else {
+			xdgVolumeInfo := fmt.Sprintf("[Volume Info]\nName=%s\n", user.UserPrincipalName)
+			if _, err := os.Stat("/usr/share/icons/onedriver.png"); err == nil {
+				xdgVolumeInfo += "IconFile=/usr/share/icons/onedriver.png\n"
+			}
+			// just upload directly and shove it in the cache
+			// (since the fs isn't mounted yet)
+			resp, err := graph.Put(
+				graph.ResourcePath("/.xdg-volume-info")+":/content",
+				auth,
+				strings.NewReader(xdgVolumeInfo),
+			)
+			if err != nil {
+				log.Error(err)
+			}
+			inode := graph.NewInode(".xdg-volume-info", 0644, root)
+			err = json.Unmarshal(resp, &inode)
+			if err == nil {
+				cache.InsertID(inode.ID(), inode)
+			}
+		}
+	}
+
+	if settings.resync {
+		cache.Resync()
+	}
+
+	if shared && (settings.notifyListen != "" || settings.notifyURL != "") {
+		// there is only one address to listen on
+		log.Warn("Change notifications can only be used when a single account " +
+			"is mounted, ignoring change notification settings.")
+	} else if settings.notifyListen != "" && settings.notifyURL != "" {
+		if err := cache.StartNotifications(settings.notifyListen, settings.notifyURL); err != nil {
+			log.WithField("err", err).Error("Could not subscribe to change " +
+				"notifications, falling back to polling.")
+		}
+	} else if settings.notifyListen != "" || settings.notifyURL != "" {
+		log.Warn("--notify-listen and --notify-url must be used together, " +
+			"ignoring change notification settings.")
+	}
+
+	// control socket used by other invocations of onedriver to talk to us
+	ctl, err := control.NewServer(control.SocketPath(m.dir))
+	if err != nil {
+		log.WithField("err", err).Error("Could not start control socket.")
+	} else {
+		m.ctl = ctl
+		m.handle(shared)
+		go ctl.Serve()
+	}
+
+	second := time.Second
+	mountOptions := fuse.MountOptions{
+		Name:          "onedriver",
+		FsName:        "onedriver",
+		MaxBackground: 1024,
+	}
+	if readOnly {
+		mountOptions.Options = append(mountOptions.Options, "ro")
+	}
+	if settings.allowOther || settings.allowRoot {
+		mountOptions.AllowOther = settings.allowOther
+		if settings.allowRoot {
+			mountOptions.Options = append(mountOptions.Options, "allow_root")
+		}
+		// without this, anyone let in could read and change everything, since
+		// onedriver doesn't check permissions itself
+		mountOptions.Options = append(mountOptions.Options, "default_permissions")
+	}
+	m.server, err = fs.Mount(m.mountpoint, root, &fs.Options{
+		EntryTimeout: &second,
+		AttrTimeout:  &second,
+		MountOptions: mountOptions,
+	})
+	if err != nil {
+		return err
+	}
+	m.server.SetDebug(settings.debug)
+	graph.RecordFuseLatencies(m.server)
+	return nil
+}
+
+// handle answers the requests made to the control socket of the account.
+func (m *mount) handle(shared bool) {
+	cache := m.cache
+	m.ctl.Handle("pause", func(args []string) (string, error) {
+		cache.Pause()
+		return "", nil
+	})
+	m.ctl.Handle("resume", func(args []string) (string, error) {
+		cache.Resume()
+		return "", nil
+	})
+	m.ctl.Handle("pause-transfers", func(args []string) (string, error) {
+		graph.PauseTransfers()
+		return "", nil
+	})
+	m.ctl.Handle("resume-transfers", func(args []string) (string, error) {
+		graph.ResumeTransfers()
+		return "", nil
+	})
+	m.ctl.Handle("resync", func(args []string) (string, error) {
+		cache.Resync()
+		return "", nil
+	})
+	m.ctl.Handle("reauth", func(args []string) (string, error) {
+		return "", cache.Reauth()
+	})
+	m.ctl.Handle("status", func(args []string) (string, error) {
+		status, err := json.Marshal(cache.PendingChanges())
+		return string(status) + "\n", err
+	})
+	m.ctl.Handle("connection", func(args []string) (string, error) {
+		connection, err := json.Marshal(cache.Connection())
+		return string(connection) + "\n", err
+	})
+	m.ctl.Handle("transfers", func(args []string) (string, error) {
+		transfers, err := json.Marshal(cache.Transfers())
+		return string(transfers) + "\n", err
+	})
+	m.ctl.Handle("stats", func(args []string) (string, error) {
+		stats, err := json.Marshal(cache.Stats())
+		return string(stats) + "\n", err
+	})
+	m.ctl.Handle("health", func(args []string) (string, error) {
+		health, err := json.Marshal(cache.Health())
+		return string(health) + "\n", err
+	})
+	m.ctl.Handle("errors", func(args []string) (string, error) {
+		failures, err := json.Marshal(cache.Failures())
+		return string(failures) + "\n", err
+	})
+	m.ctl.Handle("retry", func(args []string) (string, error) {
+		path := ""
+		if len(args) > 0 {
+			path = args[0]
+		}
+		retried, err := cache.Retry(path)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("Retrying %d failed change(s).\n", retried), nil
+	})
+	m.ctl.Handle("conflicts", func(args []string) (string, error) {
+		conflicts, err := json.Marshal(cache.Conflicts())
+		return string(conflicts) + "\n", err
+	})
+	m.ctl.Handle("resolve", func(args []string) (string, error) {
+		if len(args) != 2 || (args[0] != "local" && args[0] != "remote") {
+			return "", errors.New("expected \"local\" or \"remote\" and a path")
+		}
+		keep := graph.ConflictKeepLocal
+		if args[0] == "remote" {
+			keep = graph.ConflictKeepRemote
+		}
+		return "", cache.Resolve(args[1], keep)
+	})
+	m.ctl.Handle("trace", func(args []string) (string, error) {
+		if len(args) != 1 || (args[0] != "on" && args[0] != "off") {
+			return "", errors.New("expected \"on\" or \"off\"")
+		}
+		graph.SetRequestTracing(args[0] == "on")
+		return "", nil
+	})
+	m.ctl.Handle("mountpoint", func(args []string) (string, error) {
+		abs, err := filepath.Abs(m.mountpoint)
+		return abs + "\n", err
+	})
+	m.ctl.Handle("unmount", func(args []string) (string, error) {
+		if !shared {
+			// handled like any other request to exit, see UnmountHandler
+			return "", syscall.Kill(os.Getpid(), syscall.SIGTERM)
+		}
+		// the other accounts stay mounted
+		unmounting.Add(1)
+		go func() {
+			defer unmounting.Done()
+			graph.Unmount(m.server, cache)
+			m.closeControl()
+			m.removeMountpoint()
+		}()
+		return "", nil
+	})
+}
+
+// serve serves the filesystems of mounts until they are all unmounted.
+func serve(mounts []*mount) {
+	var served sync.WaitGroup
+	for _, m := range mounts {
+		served.Add(1)
+		go func(m *mount) {
+			defer served.Done()
+			m.server.Wait()
+		}(m)
+	}
+	served.Wait()
+	unmounting.Wait()
+	for _, m := range mounts {
+		m.closeControl()
+	}
+}
+
+// closeControl stops listening on the control socket of the account.
+func (m *mount) closeControl() {
+	if m.ctl != nil {
+		m.ctlClosed.Do(func() { m.ctl.Close() })
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	flag "github.com/spf13/pflag"
+)
+
+// fuseOptions are the mount options that change how the filesystem is mounted.
+type fuseOptions struct {
+	readOnly   bool
+	allowOther bool
+	allowRoot  bool
+	uid        int // -1 when not given
+	gid        int
+}
+
+// ignoredOptions are standard mount options that mount(8) and fusermount take
+// care of themselves, or that mean nothing to onedriver. They show up when
+// onedriver is mounted from /etc/fstab.
+var ignoredOptions = map[string]bool{
+	"rw": true, "defaults": true, "auto": true, "noauto": true, "user": true,
+	"nouser": true, "users": true, "owner": true, "group": true, "_netdev": true,
+	"nofail": true, "dev": true, "nodev": true, "suid": true, "nosuid": true,
+	"exec": true, "noexec": true, "async": true, "sync": true, "atime": true,
+	"noatime": true, "relatime": true, "norelatime": true, "strictatime": true,
+	"lazytime": true, "nolazytime": true, "diratime": true, "nodiratime": true,
+}
+
+// parseMountOptions reads mount options given with -o, like
+// "ro,allow_other,uid=1000". Other options are taken to be onedriver options of
+// the same name, like "account=work" or "cache_dir=/path", and are set unless
+// they were given on the command line as well.
+func parseMountOptions(options []string) (fuseOptions, error) {
+	parsed := fuseOptions{uid: -1, gid: -1}
+	for _, option := range options {
+		name, value := option, ""
+		if split := strings.SplitN(option, "=", 2); len(split) == 2 {
+			name, value = split[0], split[1]
+		}
+		switch {
+		case name == "":
+			continue
+		case name == "ro":
+			parsed.readOnly = true
+		case name == "allow_other":
+			parsed.allowOther = true
+		case name == "allow_root":
+			parsed.allowRoot = true
+		case name == "uid" || name == "gid":
+			id, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return parsed, fmt.Errorf("invalid mount option \"%s\"", option)
+			}
+			if name == "uid" {
+				parsed.uid = int(id)
+			} else {
+				parsed.gid = int(id)
+			}
+		case ignoredOptions[name] || strings.HasPrefix(name, "x-"):
+			// "x-" options are for other programs, like x-systemd.automount
+			continue
+		default:
+			key := strings.Replace(name, "_", "-", -1)
+			setting := flag.Lookup(key)
+			if setting == nil || key == "options" || key == "config" {
+				return parsed, fmt.Errorf("unsupported mount option \"%s\"", name)
+			}
+			if setting.Changed {
+				continue
+			}
+			if value == "" && setting.Value.Type() == "bool" {
+				value = "true"
+			}
+			if err := flag.Set(key, value); err != nil {
+				return parsed, fmt.Errorf("invalid mount option \"%s\": %s", option, err)
+			}
+		}
+	}
+	return parsed, nil
+}
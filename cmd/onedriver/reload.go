@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/jstaf/onedriver/config"
+	"github.com/jstaf/onedriver/graph"
+	log "github.com/sirupsen/logrus"
+	flag "github.com/spf13/pflag"
+)
+
+// reloadable are the options read again from the configuration file when
+// onedriver is sent SIGHUP, each with any other names it goes by. Everything
+// else only changes on a restart.
+var reloadable = [][]string{
+	{"log-level", "log"},
+	{"poll-interval"},
+	{"max-upload-rate"},
+	{"max-download-rate"},
+	{"no-notifications"},
+	{"trace-requests"},
+	{"slow-op-threshold"},
+	{"include"},
+	{"exclude"},
+}
+
+// changedFlags returns the names of the options that have been set, one way or
+// another.
+func changedFlags() map[string]bool {
+	changed := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		changed[f.Name] = true
+	})
+	return changed
+}
+
+// reloadConfig sets the reloadable options to what the configuration file at
+// path says now, or back to their defaults if they are no longer in it.
+// Options in pinned were given on the command line and keep their value.
+// Setting a list option adds to it, so lists holds the values of those options
+// to empty them first.
+func reloadConfig(path string, pinned map[string]bool, lists map[string]*[]string) error {
+	settings, err := config.Load(path)
+	if err != nil {
+		return err
+	}
+	values := make(map[string][]string)
+	for _, setting := range settings {
+		values[setting.Key] = setting.Values
+	}
+
+	for _, names := range reloadable {
+		given, found := false, false
+		var setting []string
+		for _, name := range names {
+			given = given || pinned[name]
+			if v, ok := values[name]; ok {
+				setting, found = v, true
+			}
+		}
+		if given {
+			continue
+		}
+		if list, ok := lists[names[0]]; ok {
+			*list = nil
+		} else if !found {
+			setting = []string{flag.Lookup(names[0]).DefValue}
+		}
+		for _, value := range setting {
+			if err := flag.Set(names[0], value); err != nil {
+				return fmt.Errorf("%s: invalid value for \"%s\": %s", path, names[0], err)
+			}
+		}
+	}
+	return nil
+}
+
+// handleReloads rereads the configuration file at path whenever onedriver is
+// sent SIGHUP, and calls apply to put the options in effect. The caches are
+// resynced if the include or exclude patterns changed, to fetch whatever is no
+// longer left out.
+func handleReloads(path string, pinned map[string]bool, include *[]string,
+	exclude *[]string, caches []*graph.Cache, apply func()) {
+	reloadChan := make(chan os.Signal, 1)
+	signal.Notify(reloadChan, syscall.SIGHUP)
+	go func() {
+		for range reloadChan {
+			filter := fmt.Sprint(*include, *exclude)
+			err := reloadConfig(path, pinned, map[string]*[]string{
+				"include": include,
+				"exclude": exclude,
+			})
+			if err != nil {
+				log.WithField("err", err).Error("Could not reload configuration.")
+				continue
+			}
+			apply()
+			if fmt.Sprint(*include, *exclude) != filter {
+				if err := graph.SetSyncFilter(*include, *exclude); err != nil {
+					log.WithField("err", err).Error("Could not reload include and exclude patterns.")
+					continue
+				}
+				for _, cache := range caches {
+					cache.Resync()
+				}
+			}
+			log.Info("Configuration reloaded.")
+		}
+	}()
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jstaf/onedriver/graph"
+)
+
+// printJSON prints v as indented JSON.
+func printJSON(v interface{}) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+// listRemote lists the folder at path on the server, folders first, like
+// "ls -l" would.
+func listRemote(path string, auth *graph.Auth, asJSON bool) error {
+	children, err := graph.GetChildren(path, auth)
+	if err != nil {
+		return err
+	}
+	sort.Slice(children, func(i, j int) bool {
+		if children[i].IsDir() != children[j].IsDir() {
+			return children[i].IsDir()
+		}
+		return strings.ToLower(children[i].Name()) < strings.ToLower(children[j].Name())
+	})
+	if asJSON {
+		items := make([]graph.DriveItem, 0, len(children))
+		for _, child := range children {
+			items = append(items, child.DriveItem)
+		}
+		return printJSON(items)
+	}
+	for _, child := range children {
+		size := formatBytes(child.Size())
+		name := child.Name()
+		if child.IsDir() {
+			size = "-"
+			name += "/"
+		}
+		modified := time.Unix(int64(child.ModTime()), 0).Format("2006-01-02 15:04")
+		fmt.Printf("%10s  %s  %s\n", size, modified, name)
+	}
+	return nil
+}
+
+// statRemote prints the details of the item at path on the server.
+func statRemote(path string, auth *graph.Auth, asJSON bool) error {
+	item, err := graph.GetItemPath(path, auth)
+	if err != nil {
+		return err
+	}
+	if asJSON {
+		return printJSON(item.DriveItem)
+	}
+
+	row := func(name string, value string) {
+		if value != "" {
+			fmt.Printf("%-13s %s\n", name+":", value)
+		}
+	}
+	row("Path", path)
+	row("ID", item.ID())
+	if item.IsDir() {
+		row("Type", "folder")
+		if item.Folder != nil {
+			row("Children", fmt.Sprint(item.Folder.ChildCount))
+		}
+	} else {
+		row("Type", "file")
+		row("Size", fmt.Sprintf("%s (%d bytes)", formatBytes(item.Size()), item.Size()))
+	}
+	row("Modified", time.Unix(int64(item.ModTime()), 0).Format(time.RFC1123))
+	if item.DriveItem.Parent != nil {
+		row("Parent ID", item.DriveItem.Parent.ID)
+	}
+	row("ETag", item.ETag)
+	if item.FileInternal != nil {
+		row("SHA1", item.FileInternal.Hashes.SHA1Hash)
+		row("QuickXorHash", item.FileInternal.Hashes.QuickXorHash)
+	}
+	row("Web URL", item.WebURL)
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/jstaf/onedriver/graph"
+	log "github.com/sirupsen/logrus"
+)
+
+// library is what is known about the SharePoint document library a mount
+// serves. It is saved in the cache of the mount so it can start offline.
+type library struct {
+	Site    string `json:"site"`
+	Library string `json:"library,omitempty"`
+	Drive   string `json:"drive"`
+}
+
+// resolveLibrary works out which drive the document library of m is. The one
+// found the last time is used when offline.
+func (m *mount) resolveLibrary(auth *graph.Auth) error {
+	path := filepath.Join(m.dir, "library.json")
+	saved := library{}
+	if contents, err := ioutil.ReadFile(path); err == nil {
+		json.Unmarshal(contents, &saved)
+	}
+
+	site, err := graph.GetSite(m.remote.site, auth)
+	var drive graph.Drive
+	if err == nil {
+		drive, err = graph.GetLibrary(site.ID, m.remote.library, auth)
+	}
+	if err != nil {
+		if graph.IsOffline(err) && saved.Drive != "" {
+			log.WithField("drive", saved.Drive).Warn(
+				"Offline, using the document library found last time.")
+			m.source.Drive = saved.Drive
+			return nil
+		}
+		return fmt.Errorf("could not find the document library of %s: %w", m.remote.site, err)
+	}
+	if saved.Drive != "" && saved.Drive != drive.ID {
+		// the cache is of a library that is no longer there, or renamed
+		return fmt.Errorf("the document library of %s is not the one cached in %s "+
+			"anymore, delete that directory to start over", m.remote.site, m.dir)
+	}
+	log.WithFields(log.Fields{
+		"site":    site.WebURL,
+		"library": drive.Name,
+		"drive":   drive.ID,
+	}).Info("Mounting SharePoint document library.")
+	m.source.Drive = drive.ID
+	if saved.Drive == "" {
+		contents, _ := json.Marshal(library{
+			Site:    m.remote.site,
+			Library: m.remote.library,
+			Drive:   drive.ID,
+		})
+		if err = ioutil.WriteFile(path, contents, 0600); err != nil {
+			log.WithField("err", err).Warn("Could not save which document library is mounted.")
+		}
+	}
+	return nil
+}
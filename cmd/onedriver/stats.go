@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jstaf/onedriver/control"
+	"github.com/jstaf/onedriver/graph"
+)
+
+// runningInstances returns the mountpoints of the instances of onedriver
+// running for any account kept in cacheDir, or for any document library,
+// drive or folder mounted with one, by the control socket to reach each with.
+func runningInstances(cacheDir string) map[string]string {
+	sockets := []string{control.SocketPath(cacheDir)}
+	for _, dirs := range []string{
+		filepath.Join(cacheDir, "accounts", "*"),
+		filepath.Join(cacheDir, "sites", "*"),
+		filepath.Join(cacheDir, "drives", "*"),
+		filepath.Join(cacheDir, "accounts", "*", "sites", "*"),
+		filepath.Join(cacheDir, "accounts", "*", "drives", "*"),
+	} {
+		found, _ := filepath.Glob(control.SocketPath(dirs))
+		sockets = append(sockets, found...)
+	}
+	instances := make(map[string]string)
+	for _, socket := range sockets {
+		if response, err := control.Send(socket, "mountpoint"); err == nil {
+			instances[socket] = strings.TrimSpace(response)
+		}
+	}
+	return instances
+}
+
+// findInstance returns the control socket of the instance of onedriver mounted
+// at mountpoint, looking through every account kept in cacheDir.
+func findInstance(cacheDir string, mountpoint string) (string, error) {
+	abs, err := filepath.Abs(mountpoint)
+	if err != nil {
+		return "", err
+	}
+	for socket, mounted := range runningInstances(cacheDir) {
+		if mounted == abs {
+			return socket, nil
+		}
+	}
+	return "", fmt.Errorf("onedriver is not running at %s", abs)
+}
+
+// printStats asks a running instance how its cache has been doing and prints
+// it, as JSON if asJSON is set.
+func printStats(socket string, asJSON bool) error {
+	response, err := control.Send(socket, "stats")
+	if err != nil {
+		return err
+	}
+	if asJSON {
+		fmt.Print(response)
+		return nil
+	}
+	var stats graph.Stats
+	if err = json.Unmarshal([]byte(response), &stats); err != nil {
+		return err
+	}
+
+	row := func(name string, format string, args ...interface{}) {
+		fmt.Printf("%-17s "+format+"\n", append([]interface{}{name + ":"}, args...)...)
+	}
+	if mountpoint, err := control.Send(socket, "mountpoint"); err == nil {
+		row("Mountpoint", "%s", strings.TrimSpace(mountpoint))
+	}
+	row("Files opened", "%s", hitRate(stats.ContentHits, stats.ContentMisses))
+	row("Folders listed", "%s", hitRate(stats.ListingHits, stats.ListingMisses))
+	row("Pending", "%d change(s), %d upload(s)", stats.PendingChanges, stats.PendingUploads)
+	if stats.LastDelta.IsZero() {
+		row("Last sync", "never")
+	} else {
+		row("Last sync", "%s ago", time.Since(stats.LastDelta).Round(time.Second))
+	}
+
+	methods := make([]string, 0, len(stats.Requests))
+	total := uint64(0)
+	for method, count := range stats.Requests {
+		methods = append(methods, fmt.Sprintf("%s %d", method, count))
+		total += count
+	}
+	sort.Strings(methods)
+	if total > 0 {
+		row("Requests", "%d (%s)", total, strings.Join(methods, ", "))
+	} else {
+		row("Requests", "0")
+	}
+	for n, op := range busiestOperations(stats.Operations) {
+		latency := stats.Operations[op]
+		line := fmt.Sprintf("%s %d, median %s, 99%% %s, max %s", op, latency.Count,
+			roundLatency(latency.P50), roundLatency(latency.P99), roundLatency(latency.Max))
+		if latency.Slow > 0 {
+			line += fmt.Sprintf(", %d slow", latency.Slow)
+		}
+		if n == 0 {
+			row("Operations", "%s", line)
+		} else {
+			fmt.Printf("%-17s %s\n", "", line)
+		}
+	}
+
+	quota := stats.Quota
+	switch {
+	case stats.QuotaError != "":
+		row("Quota", "unknown (%s)", stats.QuotaError)
+	case quota.Total > 0:
+		row("Quota", "%s of %s used (%d%%), %s in the recycle bin",
+			formatBytes(quota.Used), formatBytes(quota.Total),
+			quota.Used*100/quota.Total, formatBytes(quota.Deleted))
+	default:
+		row("Quota", "%s used", formatBytes(quota.Used))
+	}
+	return nil
+}
+
+// how many kinds of FUSE operations "onedriver stats" shows
+const operationsShown = 8
+
+// busiestOperations returns the kinds of FUSE operations that took the most
+// time altogether, busiest first.
+func busiestOperations(latencies map[string]graph.OperationLatency) []string {
+	ops := make([]string, 0, len(latencies))
+	for op := range latencies {
+		ops = append(ops, op)
+	}
+	total := func(op string) time.Duration {
+		return latencies[op].Mean * time.Duration(latencies[op].Count)
+	}
+	sort.Slice(ops, func(i, j int) bool {
+		if total(ops[i]) != total(ops[j]) {
+			return total(ops[i]) > total(ops[j])
+		}
+		return ops[i] < ops[j]
+	})
+	if len(ops) > operationsShown {
+		ops = ops[:operationsShown]
+	}
+	return ops
+}
+
+// roundLatency rounds a latency to what is worth showing of it.
+func roundLatency(latency time.Duration) time.Duration {
+	if latency < time.Millisecond {
+		return latency.Round(time.Microsecond)
+	}
+	return latency.Round(time.Millisecond)
+}
+
+// hitRate formats how many lookups were answered by the cache.
+func hitRate(hits uint64, misses uint64) string {
+	if hits+misses == 0 {
+		return "none yet"
+	}
+	return fmt.Sprintf("%d%% from the cache (%d of %d)",
+		hits*100/(hits+misses), hits, hits+misses)
+}
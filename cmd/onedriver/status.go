@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/godbus/dbus/v5/introspect"
+	"github.com/jstaf/onedriver/graph"
+	log "github.com/sirupsen/logrus"
+)
+
+// The sync status of mounted filesystems is published on the session bus, for
+// file manager emblems and desktop indicators. The first onedriver to start
+// takes statusBusName, others add ".instance<pid>" to it.
+const (
+	statusBusName   = "io.github.jstaf.onedriver"
+	statusPath      = dbus.ObjectPath("/io/github/jstaf/onedriver")
+	statusInterface = "io.github.jstaf.onedriver.Status"
+	errNotMounted   = "io.github.jstaf.onedriver.Error.NotMounted"
+)
+
+// how often the overall state is checked for changes that don't come from a
+// file, like going offline
+const statusCheckInterval = 5 * time.Second
+
+// pathStatus is a change in the sync status of a file, waiting to be signalled.
+type pathStatus struct {
+	path   string
+	status graph.SyncStatus
+}
+
+// statusService answers questions about the sync status of mounts over D-Bus.
+// Its exported methods are the methods of statusInterface.
+type statusService struct {
+	conn    *dbus.Conn
+	caches  map[string]*graph.Cache // by absolute mountpoint
+	changes chan pathStatus
+}
+
+// publishStatus publishes the sync status of mounts on the session bus, if
+// there is one.
+func publishStatus(mounts []*mount) {
+	conn, err := dbus.ConnectSessionBus()
+	if err != nil {
+		log.WithField("err", err).Debug("Not publishing sync status over D-Bus.")
+		return
+	}
+	name := statusBusName
+	reply, err := conn.RequestName(name, dbus.NameFlagDoNotQueue)
+	if err == nil && reply != dbus.RequestNameReplyPrimaryOwner {
+		name = fmt.Sprintf("%s.instance%d", statusBusName, os.Getpid())
+		reply, err = conn.RequestName(name, dbus.NameFlagDoNotQueue)
+		if err == nil && reply != dbus.RequestNameReplyPrimaryOwner {
+			err = fmt.Errorf("%s is taken", name)
+		}
+	}
+	if err != nil {
+		log.WithField("err", err).Warn("Could not publish sync status over D-Bus.")
+		conn.Close()
+		return
+	}
+
+	s := &statusService{
+		conn:    conn,
+		caches:  make(map[string]*graph.Cache, len(mounts)),
+		changes: make(chan pathStatus, 256),
+	}
+	for _, m := range mounts {
+		mountpoint, _ := filepath.Abs(m.mountpoint)
+		s.caches[mountpoint] = m.cache
+		m.cache.OnSyncStatus(func(path string, status graph.SyncStatus) {
+			select {
+			case s.changes <- pathStatus{filepath.Join(mountpoint, path), status}:
+			default:
+				// nobody can keep up with that many anyway, the state is
+				// still signalled
+			}
+		})
+	}
+	conn.Export(s, statusPath, statusInterface)
+	conn.Export(introspect.NewIntrospectable(&introspect.Node{
+		Name: string(statusPath),
+		Interfaces: []introspect.Interface{
+			introspect.IntrospectData,
+			{
+				Name:    statusInterface,
+				Methods: introspect.Methods(s),
+				Signals: []introspect.Signal{
+					{Name: "StateChanged", Args: []introspect.Arg{
+						{Name: "state", Type: "s"},
+					}},
+					{Name: "PathStatusChanged", Args: []introspect.Arg{
+						{Name: "path", Type: "s"},
+						{Name: "status", Type: "s"},
+					}},
+				},
+			},
+		},
+	}), statusPath, "org.freedesktop.DBus.Introspectable")
+	log.WithField("name", name).Info("Publishing sync status over D-Bus.")
+	go s.signal()
+}
+
+// statusOrder ranks overall states from best to worst.
+var statusOrder = map[graph.SyncStatus]int{
+	graph.StatusSynced:     0,
+	graph.StatusPending:    1,
+	graph.StatusSyncing:    2,
+	graph.StatusPaused:     3,
+	graph.StatusOffline:    4,
+	graph.StatusConflicted: 5,
+	graph.StatusError:      6,
+}
+
+// state returns the overall state of every mount.
+func (s *statusService) state() graph.SyncStatus {
+	return overallState(s.caches)
+}
+
+// State returns the overall state of every mount.
+func (s *statusService) State() (string, *dbus.Error) {
+	return string(s.state()), nil
+}
+
+// Mountpoints returns where the filesystems are mounted.
+func (s *statusService) Mountpoints() ([]string, *dbus.Error) {
+	mountpoints := make([]string, 0, len(s.caches))
+	for mountpoint := range s.caches {
+		mountpoints = append(mountpoints, mountpoint)
+	}
+	return mountpoints, nil
+}
+
+// overallState returns the worst of the states of caches.
+func overallState(caches map[string]*graph.Cache) graph.SyncStatus {
+	worst := graph.StatusSynced
+	for _, cache := range caches {
+		if state := cache.SyncState(); statusOrder[state] > statusOrder[worst] {
+			worst = state
+		}
+	}
+	return worst
+}
+
+// PathStatus returns the sync status of a local path in one of the mounts,
+// and the error that last stopped it from syncing.
+func (s *statusService) PathStatus(path string) (string, string, *dbus.Error) {
+	path = filepath.Clean(path)
+	for mountpoint, cache := range s.caches {
+		if path == mountpoint || strings.HasPrefix(path, mountpoint+"/") {
+			status, message := cache.SyncStatus("/" + strings.TrimPrefix(path[len(mountpoint):], "/"))
+			return string(status), message, nil
+		}
+	}
+	return "", "", dbus.NewError(errNotMounted, []interface{}{path + " is not in a onedriver mount"})
+}
+
+// signal sends signals for changes to the sync status of files, and for
+// changes to the overall state.
+func (s *statusService) signal() {
+	last := s.state()
+	ticker := time.NewTicker(statusCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case change := <-s.changes:
+			err := s.conn.Emit(statusPath, statusInterface+".PathStatusChanged",
+				change.path, string(change.status))
+			if err != nil {
+				log.WithField("err", err).Debug("Could not signal sync status over D-Bus.")
+				return
+			}
+		case <-ticker.C:
+		}
+		if state := s.state(); state != last {
+			last = state
+			s.conn.Emit(statusPath, statusInterface+".StateChanged", string(state))
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// With --supervise, onedriver starts itself again with this set in its
+// environment, and starts that copy over whenever it crashes or the kernel
+// disconnects its filesystem. Everything worth keeping is on disk, in the cache
+// and the upload queue, so the new copy picks up where the old one stopped.
+const superviseEnv = "ONEDRIVER_SUPERVISED"
+
+// how often the supervisor checks that the filesystems are still connected
+const superviseCheckInterval = 30 * time.Second
+
+// how long to wait before starting onedriver over, doubling while it keeps
+// crashing
+const (
+	minRestartDelay = time.Second
+	maxRestartDelay = time.Minute
+	// a copy that ran for this long was not crash looping
+	stableRunTime = 5 * time.Minute
+)
+
+// supervised returns whether this is the copy of onedriver started by
+// --supervise.
+func supervised() bool {
+	return os.Getenv(superviseEnv) == "1"
+}
+
+// disconnected returns whether any of the mountpoints is a mount whose
+// onedriver is gone, which fails everything with "transport endpoint is not
+// connected".
+func disconnected(mountpoints []string) bool {
+	for _, mountpoint := range mountpoints {
+		if _, err := os.Stat(mountpoint); errors.Is(err, syscall.ENOTCONN) {
+			return true
+		}
+	}
+	return false
+}
+
+// supervise runs onedriver as a child process with the same arguments, and
+// starts it over whenever it crashes or the filesystem at any of mountpoints
+// is disconnected. It stops once onedriver exits after being unmounted or
+// asked to exit, and returns the exit code to exit with.
+func supervise(mountpoints []string) int {
+	executable, err := os.Executable()
+	if err != nil {
+		log.WithField("err", err).Error("Could not find the onedriver executable.")
+		return 1
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR1)
+	delay := minRestartDelay
+
+	for {
+		cmd := exec.Command(executable, os.Args[1:]...)
+		cmd.Env = append(os.Environ(), superviseEnv+"=1")
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Start(); err != nil {
+			log.WithField("err", err).Error("Could not start onedriver.")
+			return 1
+		}
+		started := time.Now()
+		exited := make(chan error, 1)
+		go func() { exited <- cmd.Wait() }()
+
+		stopping, hung := false, false
+		ticker := time.NewTicker(superviseCheckInterval)
+	wait:
+		for {
+			select {
+			case sig := <-signals:
+				// SIGHUP reloads the configuration and SIGUSR1 writes a
+				// debug dump, the others stop us
+				stopping = stopping || (sig != syscall.SIGHUP && sig != syscall.SIGUSR1)
+				cmd.Process.Signal(sig)
+			case <-ticker.C:
+				if !hung && disconnected(mountpoints) {
+					log.Error("Filesystem was disconnected, restarting onedriver.")
+					hung = true
+					cmd.Process.Kill()
+				}
+			case <-exited:
+				break wait
+			}
+		}
+		ticker.Stop()
+
+		// exiting by itself after being unmounted, or after being asked to
+		// by a signal, is not a crash
+		code := cmd.ProcessState.ExitCode()
+		asked := code == 0 || code == 128+int(syscall.SIGINT) || code == 128+int(syscall.SIGTERM)
+		if stopping || (asked && !hung && !disconnected(mountpoints)) {
+			if code < 0 {
+				code = 1
+			}
+			return code
+		}
+
+		if time.Since(started) > stableRunTime {
+			delay = minRestartDelay
+		}
+		log.WithFields(log.Fields{
+			"status": cmd.ProcessState.String(),
+			"delay":  delay,
+		}).Error("onedriver exited unexpectedly, remounting.")
+		timer := time.NewTimer(delay)
+		for waiting := true; waiting; {
+			select {
+			case sig := <-signals:
+				if sig != syscall.SIGHUP && sig != syscall.SIGUSR1 {
+					timer.Stop()
+					return 128 + int(sig.(syscall.Signal))
+				}
+			case <-timer.C:
+				waiting = false
+			}
+		}
+		if delay *= 2; delay > maxRestartDelay {
+			delay = maxRestartDelay
+		}
+	}
+}
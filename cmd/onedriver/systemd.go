@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// unitTemplate is the systemd user unit mounting onedriver at the path given as
+// its instance name, like onedriver@home-user-OneDrive.service. %f is that path
+// with its leading slash put back, %I would be relative to the home directory.
+// systemd is told the filesystem is mounted over sd_notify, so units ordered
+// after it only start once it is.
+const unitTemplate = `[Unit]
+Description=onedriver (%%f)
+
+[Service]
+Type=notify
+ExecStart=%s %%f
+ExecReload=/bin/kill -HUP $MAINPID
+ExecStopPost=-%s -uz %%f
+Restart=on-failure
+RestartSec=10
+
+[Install]
+WantedBy=default.target
+`
+
+// systemdUnit returns the unit template for the onedriver binary at executable.
+func systemdUnit(executable string) string {
+	fusermount, err := exec.LookPath("fusermount")
+	if err != nil {
+		fusermount = "/usr/bin/fusermount"
+	}
+	return fmt.Sprintf(unitTemplate, executable, fusermount)
+}
+
+// systemdEscape escapes a path the way "systemd-escape --path" does, for use
+// as the instance name of a unit.
+func systemdEscape(path string) string {
+	path = strings.Trim(filepath.Clean(path), "/")
+	if path == "" {
+		return "-" // the root
+	}
+	var escaped strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		switch {
+		case c == '/':
+			escaped.WriteByte('-')
+		case c == '.' && i == 0,
+			!(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+				c == ':' || c == '_' || c == '.'):
+			fmt.Fprintf(&escaped, `\x%02x`, c)
+		default:
+			escaped.WriteByte(c)
+		}
+	}
+	return escaped.String()
+}
+
+// generateSystemd prints a unit template to mount onedriver at mountpoint with,
+// along with how to install it.
+func generateSystemd(mountpoint string) error {
+	abs, err := filepath.Abs(mountpoint)
+	if err != nil {
+		return err
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	fmt.Print(systemdUnit(executable))
+
+	service := "onedriver@" + systemdEscape(abs) + ".service"
+	fmt.Fprintf(os.Stderr, `
+# Save the unit above as ~/.config/systemd/user/onedriver@.service, then mount
+# %s now and on every login with:
+#
+#   mkdir -p '%s'
+#   systemctl --user daemon-reload
+#   systemctl --user enable --now '%s'
+#
+# Other options can be set in the configuration file (see --config).
+`, abs, abs, service)
+	return nil
+}
+
+// sdNotify tells systemd about the state of the service, if it was started by
+// systemd with Type=notify. Does nothing otherwise.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	if strings.HasPrefix(socket, "@") {
+		// abstract namespace
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
@@ -0,0 +1,165 @@
+// Package config reads onedriver's configuration file, so that a setup can be
+// kept in one place instead of on the command line. The file is YAML, with one
+// setting per command line option of the same name:
+//
+//	mountpoint: ~/OneDrive
+//	log: info
+//	poll-interval: 1m
+//	exclude:
+//	  - node_modules
+//	  - "*.tmp"
+//
+// Only the parts of YAML needed for that are understood: "key: value" pairs,
+// lists written either as "- item" lines below their key or as "[a, b]",
+// quoted strings, and comments.
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Setting is a single setting from the configuration file.
+type Setting struct {
+	Key    string
+	Values []string // a single value, or the items of a list
+	Line   int      // where the setting is in the file
+}
+
+// DefaultPath returns where the configuration file is looked for by default.
+func DefaultPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		dir = filepath.Join(os.Getenv("HOME"), ".config")
+	}
+	return filepath.Join(dir, "onedriver", "config.yml")
+}
+
+// Load reads the settings in a configuration file.
+func Load(path string) ([]Setting, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	settings, err := Parse(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return settings, nil
+}
+
+// Parse reads settings from the contents of a configuration file. Keys are
+// returned with underscores turned into dashes, so "cache_dir" and
+// "cache-dir" are the same setting.
+func Parse(r io.Reader) ([]Setting, error) {
+	settings := make([]Setting, 0)
+	var current *Setting // a setting whose list items may follow
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := stripComment(scanner.Text())
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || trimmed == "---" {
+			continue
+		}
+		indented := line[0] == ' ' || line[0] == '\t'
+
+		if strings.HasPrefix(trimmed, "- ") || trimmed == "-" {
+			if current == nil || !indented {
+				return nil, fmt.Errorf("line %d: list item without a key", n)
+			}
+			current.Values = append(current.Values,
+				unquote(strings.TrimSpace(strings.TrimPrefix(trimmed, "-"))))
+			continue
+		}
+		if indented {
+			return nil, fmt.Errorf("line %d: unexpected indentation", n)
+		}
+
+		colon := strings.Index(trimmed, ":")
+		if colon <= 0 {
+			return nil, fmt.Errorf("line %d: expected \"key: value\"", n)
+		}
+		key := strings.Replace(strings.TrimSpace(trimmed[:colon]), "_", "-", -1)
+		value := strings.TrimSpace(trimmed[colon+1:])
+		setting := Setting{Key: key, Line: n}
+		switch {
+		case value == "":
+			// list items follow, or nothing at all
+			setting.Values = make([]string, 0)
+		case strings.HasPrefix(value, "["):
+			if !strings.HasSuffix(value, "]") {
+				return nil, fmt.Errorf("line %d: unterminated list", n)
+			}
+			setting.Values = make([]string, 0)
+			for _, item := range splitFlow(value[1 : len(value)-1]) {
+				setting.Values = append(setting.Values, unquote(item))
+			}
+		default:
+			setting.Values = []string{unquote(value)}
+		}
+		settings = append(settings, setting)
+		current = &settings[len(settings)-1]
+		if value != "" {
+			current = nil
+		}
+	}
+	return settings, scanner.Err()
+}
+
+// stripComment removes a trailing comment, leaving "#" in quoted strings alone.
+func stripComment(line string) string {
+	quote := rune(0)
+	for i, c := range line {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// splitFlow splits the items of a "[a, b]" list.
+func splitFlow(items string) []string {
+	split := make([]string, 0)
+	quote := rune(0)
+	start := 0
+	for i, c := range items {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ',':
+			split = append(split, strings.TrimSpace(items[start:i]))
+			start = i + 1
+		}
+	}
+	if last := strings.TrimSpace(items[start:]); last != "" || len(split) > 0 {
+		split = append(split, last)
+	}
+	return split
+}
+
+// unquote removes the quotes around a quoted string.
+func unquote(value string) string {
+	if len(value) >= 2 {
+		if (value[0] == '"' && value[len(value)-1] == '"') ||
+			(value[0] == '\'' && value[len(value)-1] == '\'') {
+			return value[1 : len(value)-1]
+		}
+	}
+	return value
+}
@@ -0,0 +1,53 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Both ways of writing lists should be understood, along with quotes and
+// comments.
+func TestParse(t *testing.T) {
+	settings, err := Parse(strings.NewReader(`# onedriver settings
+mountpoint: "/home/user/One Drive"
+log: info   # less noise
+cache_dir: /tmp/onedriver
+exclude:
+  - node_modules
+  - "*.tmp # not a comment"
+include: [/Documents, '/Projects/*']
+read-only:
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Setting{
+		{Key: "mountpoint", Values: []string{"/home/user/One Drive"}, Line: 2},
+		{Key: "log", Values: []string{"info"}, Line: 3},
+		{Key: "cache-dir", Values: []string{"/tmp/onedriver"}, Line: 4},
+		{Key: "exclude", Values: []string{"node_modules", "*.tmp # not a comment"}, Line: 5},
+		{Key: "include", Values: []string{"/Documents", "/Projects/*"}, Line: 8},
+		{Key: "read-only", Values: []string{}, Line: 9},
+	}
+	if !reflect.DeepEqual(settings, expected) {
+		t.Fatalf("Expected %+v, got %+v", expected, settings)
+	}
+}
+
+// Files that are not made of settings should be refused, with the line
+// that is wrong.
+func TestParseInvalid(t *testing.T) {
+	for _, invalid := range []string{
+		"just some text",
+		"- item without a key",
+		"log: info\n  indented: setting",
+		"include: [/Documents",
+	} {
+		if _, err := Parse(strings.NewReader(invalid)); err == nil {
+			t.Errorf("%q should not parse.", invalid)
+		} else if !strings.Contains(err.Error(), "line ") {
+			t.Errorf("Error for %q does not say which line: %s", invalid, err)
+		}
+	}
+}
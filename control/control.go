@@ -0,0 +1,138 @@
+// Package control implements a small line-based control protocol over a unix
+// socket, used to talk to a running onedriver instance. A request is a JSON
+// array of the command and its arguments on a single line, so arguments like
+// paths come through as they are, whitespace and all.
+package control
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Handler handles a single control command. Its return value is sent back to
+// the client.
+type Handler func(args []string) (string, error)
+
+// Server listens for control commands on a unix socket.
+type Server struct {
+	path     string
+	listener net.Listener
+
+	mutex    sync.RWMutex
+	handlers map[string]Handler
+}
+
+// SocketPath returns the location of the control socket for a cache directory.
+func SocketPath(cacheDir string) string {
+	return filepath.Join(cacheDir, "onedriver.sock")
+}
+
+// NewServer creates a control server listening at path. A stale socket left
+// behind by a previous instance is removed.
+func NewServer(path string) (*Server, error) {
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return nil, errors.New("another onedriver instance is already listening on " + path)
+	}
+	os.Remove(path)
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	os.Chmod(path, 0600)
+	return &Server{
+		path:     path,
+		listener: listener,
+		handlers: make(map[string]Handler),
+	}, nil
+}
+
+// Handle registers a handler for a command.
+func (s *Server) Handle(command string, handler Handler) {
+	s.mutex.Lock()
+	s.handlers[command] = handler
+	s.mutex.Unlock()
+}
+
+// Serve accepts connections until the server is closed. Should be called as a
+// goroutine.
+func (s *Server) Serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// Close stops the server and removes its socket.
+func (s *Server) Close() error {
+	err := s.listener.Close()
+	os.Remove(s.path)
+	return err
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Minute))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil && line == "" {
+		return
+	}
+	var fields []string
+	if err := json.Unmarshal([]byte(line), &fields); err != nil {
+		fmt.Fprintf(conn, "error: malformed request: %s\n", err)
+		return
+	}
+	if len(fields) == 0 {
+		fmt.Fprintln(conn, "error: empty command")
+		return
+	}
+
+	s.mutex.RLock()
+	handler, exists := s.handlers[fields[0]]
+	s.mutex.RUnlock()
+	if !exists {
+		fmt.Fprintf(conn, "error: unknown command \"%s\"\n", fields[0])
+		return
+	}
+	log.WithField("command", fields[0]).Debug("Received control command.")
+	response, err := handler(fields[1:])
+	if err != nil {
+		fmt.Fprintf(conn, "error: %s\n", err)
+		return
+	}
+	fmt.Fprint(conn, response)
+}
+
+// Send sends a command to a running onedriver instance and returns its
+// response.
+func Send(path string, command string, args ...string) (string, error) {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return "", fmt.Errorf("could not connect to onedriver (is it running?): %w", err)
+	}
+	defer conn.Close()
+	request, _ := json.Marshal(append([]string{command}, args...))
+	fmt.Fprintf(conn, "%s\n", request)
+
+	// read it whole, lines of JSON can get longer than a bufio.Scanner allows
+	response, err := ioutil.ReadAll(conn)
+	text := string(response)
+	if strings.HasPrefix(text, "error: ") {
+		return "", errors.New(strings.TrimSpace(strings.TrimPrefix(text, "error: ")))
+	}
+	return text, err
+}
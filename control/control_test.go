@@ -0,0 +1,51 @@
+package control
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Commands sent to a server should be routed to the matching handler, and
+// handler errors and unknown commands reported back to the client.
+func TestSend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "onedriver-control")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "test.sock")
+	server, err := NewServer(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	server.Handle("echo", func(args []string) (string, error) {
+		return strings.Join(args, " ") + "\n", nil
+	})
+	go server.Serve()
+
+	response, err := Send(path, "echo", "hello", "world")
+	if err != nil || response != "hello world\n" {
+		t.Fatalf("Unexpected response \"%s\", err: %v", response, err)
+	}
+	name := "/a  folder/with\ttabs\nand newlines.txt"
+	response, err = Send(path, "echo", name)
+	if err != nil || response != name+"\n" {
+		t.Fatalf("Argument with whitespace came back as \"%s\", err: %v", response, err)
+	}
+	long := strings.Repeat("x", 1<<20)
+	response, err = Send(path, "echo", long)
+	if err != nil || response != long+"\n" {
+		t.Fatalf("A %d byte response was not read whole, err: %v", len(long)+1, err)
+	}
+	if _, err := Send(path, "nonexistent"); err == nil {
+		t.Fatal("Unknown command did not return an error.")
+	}
+	if _, err := NewServer(path); err == nil {
+		t.Fatal("A second server was allowed to listen on the same socket.")
+	}
+}
@@ -2,6 +2,7 @@ module github.com/jstaf/onedriver
 
 require (
 	github.com/etcd-io/bbolt v1.3.3
+	github.com/godbus/dbus/v5 v5.1.0
 	github.com/hanwen/go-fuse/v2 v2.0.3-0.20200103165319-0e3c45fc4899
 	github.com/kylelemons/godebug v1.1.0 // indirect
 	github.com/rclone/rclone v1.50.0
@@ -0,0 +1,109 @@
+package graph
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/jstaf/onedriver/logger"
+	log "github.com/sirupsen/logrus"
+)
+
+// the activity log records what was done to the files of an account, for users
+// auditing it, and is left alone by clear-cache
+const (
+	activityLogFile    = "activity.log"
+	activityLogMaxSize = 10 * 1024 * 1024
+	activityLogKeep    = 5
+)
+
+// where a change recorded in the activity log was made
+const (
+	activityLocal  = "local"  // on this computer, and sent to the server
+	activityRemote = "remote" // on the server, and applied here
+)
+
+// activityLog appends what happened to files to the activity log. A nil
+// activityLog records nothing.
+type activityLog struct {
+	mutex sync.Mutex
+	out   io.WriteCloser
+}
+
+// ActivityLogPath returns the path of the activity log of the account whose
+// data is stored in cacheDir.
+func ActivityLogPath(cacheDir string) string {
+	return filepath.Join(cacheDir, activityLogFile)
+}
+
+// openActivityLog opens the activity log at path for appending. Without one,
+// nothing is recorded, which is no reason to stop the filesystem from working.
+func openActivityLog(path string) *activityLog {
+	out, err := logger.NewRotatingFile(path, activityLogMaxSize, activityLogKeep)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"path": path,
+			"err":  err,
+		}).Error("Could not open activity log, file activity will not be recorded.")
+		return nil
+	}
+	return &activityLog{out: out}
+}
+
+// record adds a line about something done to the file at path. detail is
+// optional, like the size of an upload or where a file was moved to.
+func (a *activityLog) record(source string, action string, path string, detail string) {
+	if a == nil {
+		return
+	}
+	line := fmt.Sprintf("%s %-6s %-10s %s", time.Now().Format(time.RFC3339), source, action, path)
+	if detail != "" {
+		line += " " + detail
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.out == nil {
+		return
+	}
+	if _, err := io.WriteString(a.out, line+"\n"); err != nil {
+		log.WithField("err", err).Error("Could not write to activity log.")
+	}
+}
+
+// close closes the activity log, nothing is recorded afterwards.
+func (a *activityLog) close() {
+	if a == nil {
+		return
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.out != nil {
+		a.out.Close()
+		a.out = nil
+	}
+}
+
+// activitySize describes the size of a transfer for the activity log.
+func activitySize(size uint64) string {
+	return fmt.Sprintf("(%d bytes)", size)
+}
+
+// activityMove describes where a file was moved to for the activity log.
+func activityMove(dest string) string {
+	return "-> " + dest
+}
+
+// activityPath returns the path an item with changes on their way to the
+// server is recorded under, falling back to its ID for items that are gone
+// without a trace.
+func (c *Cache) activityPath(id string) string {
+	if path := c.changes.path(id); path != "" {
+		return path
+	}
+	if inode := c.GetID(id); inode != nil {
+		return inode.Path()
+	}
+	return id
+}
@@ -0,0 +1,54 @@
+package graph
+
+import (
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// Every line of the activity log should say when, where from, what and to
+// which file, and appending to it should keep what was there.
+func TestActivityLog(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "onedriver-activity-")
+	failOnErr(t, err)
+	defer os.RemoveAll(dir)
+	path := ActivityLogPath(dir)
+
+	activity := openActivityLog(path)
+	activity.record(activityLocal, "uploaded", "/Documents/notes.txt", activitySize(42))
+	activity.close()
+	// nothing is recorded once closed
+	activity.record(activityLocal, "deleted", "/Documents/notes.txt", "")
+
+	activity = openActivityLog(path)
+	activity.record(activityRemote, "renamed", "/a.txt", activityMove("/b.txt"))
+	activity.close()
+
+	data, err := ioutil.ReadFile(path)
+	failOnErr(t, err)
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	expected := []*regexp.Regexp{
+		regexp.MustCompile(`^\S+ local  uploaded   /Documents/notes.txt \(42 bytes\)$`),
+		regexp.MustCompile(`^\S+ remote renamed    /a.txt -> /b.txt$`),
+	}
+	if len(lines) != len(expected) {
+		t.Fatalf("Expected %d lines in the activity log, got:\n%s", len(expected), data)
+	}
+	for i, line := range lines {
+		if !expected[i].MatchString(line) {
+			t.Errorf("Line %d of the activity log does not match %s: %q", i+1, expected[i], line)
+		}
+	}
+}
+
+// Without an activity log, nothing should be recorded, and nothing should
+// break either.
+func TestActivityLogNil(t *testing.T) {
+	t.Parallel()
+	var activity *activityLog
+	activity.record(activityLocal, "uploaded", "/notes.txt", "")
+	activity.close()
+}
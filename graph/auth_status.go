@@ -0,0 +1,62 @@
+package graph
+
+import (
+	"strings"
+	"time"
+)
+
+// AuthStatus describes who a set of stored tokens belongs to and whether they
+// still work.
+type AuthStatus struct {
+	Account    string    `json:"account"`
+	Name       string    `json:"name,omitempty"`
+	Tenant     string    `json:"tenant"`
+	Cloud      string    `json:"cloud"`
+	Expires    time.Time `json:"expires"`
+	Scopes     []string  `json:"scopes,omitempty"`
+	DriveType  string    `json:"driveType,omitempty"`
+	DriveOwner string    `json:"driveOwner,omitempty"`
+	Valid      bool      `json:"valid"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// GetAuthStatus inspects the tokens stored at path. The tokens are checked
+// against the server with a lightweight request, renewing them if they have
+// expired, but the user is never prompted to sign in. An error is only
+// returned if no tokens could be loaded at all.
+func GetAuthStatus(path string) (*AuthStatus, error) {
+	var auth Auth
+	if err := auth.FromFile(path); err != nil {
+		return nil, err
+	}
+	auth.background = true
+
+	status := &AuthStatus{
+		Tenant: auth.tenant(),
+		Cloud:  defaultCloud,
+	}
+	if auth.Cloud != "" {
+		status.Cloud = auth.Cloud
+	}
+	if auth.Scope != "" {
+		status.Scopes = strings.Fields(auth.Scope)
+	}
+
+	user, err := GetUser(&auth)
+	if err != nil {
+		status.Error = err.Error()
+	} else {
+		status.Valid = true
+		status.Account = user.UserPrincipalName
+		status.Name = user.DisplayName
+		if drive, err := GetDrive(&auth); err == nil {
+			status.DriveType = drive.DriveType
+			status.DriveOwner = drive.Owner.User.DisplayName
+		}
+	}
+	// read after the requests above, which may have renewed the tokens
+	authMutex.RLock()
+	status.Expires = time.Unix(auth.ExpiresAt, 0)
+	authMutex.RUnlock()
+	return status, nil
+}
@@ -0,0 +1,100 @@
+package graph
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+
+	"github.com/jstaf/onedriver/control"
+	log "github.com/sirupsen/logrus"
+)
+
+// brokerTokens is what the broker hands out. Renewing tokens rotates the
+// refresh token, so the first instance mounted with some tokens renews them for
+// every process using them. The refresh token and client secret never leave it.
+type brokerTokens struct {
+	AccessToken string `json:"access_token"`
+	ExpiresAt   int64  `json:"expires_at"`
+}
+
+// brokerPath returns the socket the broker for a token file listens on.
+func brokerPath(authPath string) string {
+	return strings.TrimSuffix(authPath, filepath.Ext(authPath)) + ".sock"
+}
+
+// serveTokens makes this process the token broker for its tokens, unless
+// another process already is. The broker stops when ctx is cancelled.
+func (a *Auth) serveTokens(ctx context.Context) {
+	if a.path == "" {
+		return
+	}
+	server, err := control.NewServer(brokerPath(a.path))
+	if err != nil {
+		log.WithField("err", err).Debug("Not acting as token broker.")
+		return
+	}
+	authMutex.Lock()
+	a.broker = true
+	authMutex.Unlock()
+
+	server.Handle("tokens", func(args []string) (string, error) {
+		if len(args) > 0 {
+			a.refreshRejected(args[0])
+		} else {
+			a.Refresh()
+		}
+		if a.ReauthRequired() {
+			return "", ErrReauthRequired
+		}
+		authMutex.RLock()
+		tokens, err := json.Marshal(brokerTokens{
+			AccessToken: a.AccessToken,
+			ExpiresAt:   a.ExpiresAt,
+		})
+		authMutex.RUnlock()
+		return string(tokens) + "\n", err
+	})
+	go server.Serve()
+	go func() {
+		<-ctx.Done()
+		server.Close()
+		authMutex.Lock()
+		a.broker = false
+		authMutex.Unlock()
+	}()
+}
+
+// refreshFromBroker asks the token broker for fresh tokens. stale is the
+// access token that was rejected by the server, if any. Returns false if there
+// is no broker or it could not provide tokens, in which case the caller should
+// renew tokens itself.
+func (a *Auth) refreshFromBroker(stale string) bool {
+	authMutex.RLock()
+	broker := a.broker
+	authMutex.RUnlock()
+	if broker || a.path == "" {
+		return false
+	}
+
+	var args []string
+	if stale != "" {
+		args = append(args, stale)
+	}
+	response, err := control.Send(brokerPath(a.path), "tokens", args...)
+	if err != nil {
+		return false
+	}
+	var fresh brokerTokens
+	if err := json.Unmarshal([]byte(response), &fresh); err != nil || fresh.AccessToken == "" {
+		log.WithField("err", err).Warn("Token broker sent an invalid response.")
+		return false
+	}
+	log.Debug("Received renewed auth tokens from token broker.")
+	authMutex.Lock()
+	a.ExpiresAt = fresh.ExpiresAt
+	a.AccessToken = fresh.AccessToken
+	a.expired = false
+	authMutex.Unlock()
+	return true
+}
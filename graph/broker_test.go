@@ -0,0 +1,60 @@
+package graph
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Processes that are not the broker should get their tokens from it instead of
+// renewing them themselves.
+func TestTokenBroker(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "onedriver-broker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, authFile)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	broker := &Auth{
+		AccessToken:  "fresh",
+		RefreshToken: "fresh-refresh",
+		ExpiresAt:    time.Now().Unix() + 3600,
+		path:         path,
+		background:   true,
+	}
+	broker.serveTokens(ctx)
+	if !broker.broker {
+		t.Fatal("First process did not become the token broker.")
+	}
+
+	// a second broker for the same tokens is refused
+	other := &Auth{path: path}
+	other.serveTokens(ctx)
+	if other.broker {
+		t.Fatal("Two token brokers were started for the same tokens.")
+	}
+
+	client := &Auth{
+		AccessToken:  "stale",
+		RefreshToken: "stale-refresh",
+		ExpiresAt:    time.Now().Unix() - 60,
+		path:         path,
+	}
+	client.Refresh()
+	if client.accessToken() != "fresh" {
+		t.Fatalf("Client did not receive tokens from broker: %s", client.accessToken())
+	}
+	if client.RefreshToken != "stale-refresh" {
+		t.Fatal("Broker handed out its refresh token.")
+	}
+	if client.needsRefresh() {
+		t.Fatal("Client tokens still need a refresh.")
+	}
+}
@@ -0,0 +1,206 @@
+package graph
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// bufferDir is where temporary files for content are created, so huge files
+// don't use up memory. Empty means the system's temporary directory, which may
+// well be in memory itself.
+var bufferDir string
+
+// setBufferDir sets where temporary files for content are created.
+func setBufferDir(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	bufferDir = dir
+	return nil
+}
+
+// buffer holds file content in a temporary file. The file is only created once
+// there is content to put in it. It is safe to use concurrently.
+type buffer struct {
+	mutex sync.RWMutex
+	file  *os.File
+	size  int64
+	path  string // where the content is kept, if it is in a named file
+}
+
+// newBuffer returns a buffer holding content read from r.
+func newBuffer(r io.Reader) (*buffer, error) {
+	b := &buffer{}
+	if err := b.open(); err != nil {
+		return nil, err
+	}
+	size, err := io.Copy(b.file, r)
+	if err != nil {
+		b.Close()
+		return nil, err
+	}
+	b.size = size
+	return b, nil
+}
+
+// bufferOf returns a buffer holding some content.
+func bufferOf(content []byte) (*buffer, error) {
+	return newBuffer(bytes.NewReader(content))
+}
+
+// open creates the temporary file if it does not exist yet. Must be called with
+// the mutex held.
+func (b *buffer) open() error {
+	if b.file != nil {
+		return nil
+	}
+	file, err := ioutil.TempFile(bufferDir, "buffer-")
+	if err != nil {
+		return err
+	}
+	os.Remove(file.Name())
+	b.file = file
+	return nil
+}
+
+// keepAt moves the content into a file at path, which is not removed when the
+// buffer is closed. Content is copied over if it already exists, so this is
+// best done before content is written.
+func (b *buffer) keepAt(path string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if b.file != nil {
+		if _, err = io.Copy(file, io.NewSectionReader(b.file, 0, b.size)); err != nil {
+			file.Close()
+			os.Remove(path)
+			return err
+		}
+		b.file.Close()
+	}
+	b.file = file
+	b.path = path
+	return nil
+}
+
+// keptAt returns the file the content is kept in, if it was moved to one with
+// keepAt and that file has not been removed since.
+func (b *buffer) keptAt() (string, bool) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	if b.path == "" || b.file == nil {
+		return "", false
+	}
+	open, err := b.file.Stat()
+	if err != nil {
+		return "", false
+	}
+	named, err := os.Stat(b.path)
+	if err != nil || !os.SameFile(open, named) {
+		return "", false
+	}
+	return b.path, true
+}
+
+// Sync commits the content to stable storage.
+func (b *buffer) Sync() error {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	if b.file == nil {
+		return nil
+	}
+	return b.file.Sync()
+}
+
+// Size returns the size of the content.
+func (b *buffer) Size() int64 {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	return b.size
+}
+
+// ReadAt reads content at an offset. Returns fewer bytes than asked for at the
+// end of the content.
+func (b *buffer) ReadAt(p []byte, off int64) (int, error) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	if off >= b.size {
+		return 0, nil
+	}
+	if remaining := b.size - off; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	n, err := b.file.ReadAt(p, off)
+	if err == io.EOF {
+		// a hole at the end of the content, it reads as zeroes
+		for i := n; i < len(p); i++ {
+			p[i] = 0
+		}
+		n, err = len(p), nil
+	}
+	return n, err
+}
+
+// WriteAt writes content at an offset, growing the content if needed.
+func (b *buffer) WriteAt(p []byte, off int64) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if err := b.open(); err != nil {
+		return 0, err
+	}
+	n, err := b.file.WriteAt(p, off)
+	if end := off + int64(n); end > b.size {
+		b.size = end
+	}
+	return n, err
+}
+
+// Truncate changes the size of the content. Content that grows is zero-filled.
+func (b *buffer) Truncate(size int64) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if err := b.open(); err != nil {
+		return err
+	}
+	if err := b.file.Truncate(size); err != nil {
+		return err
+	}
+	b.size = size
+	return nil
+}
+
+// Reader returns a reader for the content as it is now.
+func (b *buffer) Reader() io.Reader {
+	return io.NewSectionReader(b, 0, b.Size())
+}
+
+// Copy returns a new buffer holding a snapshot of the content.
+func (b *buffer) Copy() (*buffer, error) {
+	return newBuffer(b.Reader())
+}
+
+// Bytes returns the content in memory. Only meant for content known to be
+// small.
+func (b *buffer) Bytes() ([]byte, error) {
+	return ioutil.ReadAll(b.Reader())
+}
+
+// Close frees the temporary file. The buffer can't be used afterwards. Content
+// kept in a named file stays there.
+func (b *buffer) Close() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.file == nil {
+		return nil
+	}
+	err := b.file.Close()
+	b.file = nil
+	b.size = 0
+	return err
+}
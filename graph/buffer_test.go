@@ -0,0 +1,57 @@
+package graph
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Buffers should behave like the byte slices they replace: writes past the end
+// grow the content, truncation cuts it short or zero-fills it.
+func TestBuffer(t *testing.T) {
+	t.Parallel()
+	b := &buffer{}
+	defer b.Close()
+	if n, err := b.ReadAt(make([]byte, 10), 0); n != 0 || err != nil {
+		t.Fatalf("Empty buffer returned %d bytes: %v", n, err)
+	}
+
+	_, err := b.WriteAt([]byte("hello world"), 0)
+	failOnErr(t, err)
+	_, err = b.WriteAt([]byte("there"), 6)
+	failOnErr(t, err)
+	_, err = b.WriteAt([]byte("!"), 11)
+	failOnErr(t, err)
+	content, err := b.Bytes()
+	failOnErr(t, err)
+	if string(content) != "hello there!" || b.Size() != 12 {
+		t.Fatalf("Unexpected content: \"%s\"", content)
+	}
+
+	// reads are cut short at the end
+	buf := make([]byte, 10)
+	n, err := b.ReadAt(buf, 6)
+	failOnErr(t, err)
+	if string(buf[:n]) != "there!" {
+		t.Fatalf("Unexpected read: \"%s\"", buf[:n])
+	}
+
+	failOnErr(t, b.Truncate(5))
+	failOnErr(t, b.Truncate(7))
+	content, err = b.Bytes()
+	failOnErr(t, err)
+	if !bytes.Equal(content, []byte("hello\x00\x00")) {
+		t.Fatalf("Unexpected content after truncation: %q", content)
+	}
+
+	// a copy is a snapshot
+	snapshot, err := b.Copy()
+	failOnErr(t, err)
+	defer snapshot.Close()
+	_, err = b.WriteAt([]byte("HELLO"), 0)
+	failOnErr(t, err)
+	content, err = snapshot.Bytes()
+	failOnErr(t, err)
+	if !bytes.Equal(content, []byte("hello\x00\x00")) {
+		t.Fatalf("Snapshot changed along with the original: %q", content)
+	}
+}
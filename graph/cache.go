@@ -1,9 +1,11 @@
 package graph
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
@@ -18,21 +20,49 @@ import (
 // Cache caches Inodes for a filesystem. This cache never expires so that local
 // changes can persist. Should be created using the NewCache() constructor.
 type Cache struct {
-	metadata  sync.Map
-	db        *bolt.DB
-	root      string // the id of the filesystem's root item
-	deltaLink string
-	uploads   *UploadManager
+	metadata   *shardedMap
+	db         *bolt.DB
+	contentDir string // file content is stored here, outside the db
+	root       string // the id of the filesystem's root item
+	source     Source // the drive served
+	deltaLink  string
+	uploads    *UploadManager
+	changes    *changeTracker // local changes not yet on the server
+
+	deltaTrigger  chan struct{}   // used to poll for deltas immediately
+	ctx           context.Context // cancelled on shutdown
+	cancel        context.CancelFunc
+	workers       sync.WaitGroup  // background goroutines
+	shutdown      sync.Once       // Shutdown only does its work once
+	resyncSeen    map[string]bool // items seen during a full resync, nil otherwise
+	queueMutex    sync.Mutex      // changes made offline are sent one at a time
+	pinned        *pinSet         // items kept available offline
+	accessed      *accessLog      // when content was last used
+	activity      *activityLog    // what was done to files, for users
+	staleListings staleSet        // folders listed while offline
+	gcMutex       sync.RWMutex    // held to read while adding children, see CollectGarbage
+	counters      cacheCounters   // how well the cache is doing
+	loaded        time.Time       // when the cache was created
 
 	sync.RWMutex
-	auth      *Auth
-	driveType string // personal | business
-	offline   bool
+	auth         *Auth
+	driveType    string    // personal | business
+	drive        *Drive    // drive details and quota, nil until fetched
+	driveTime    time.Time // when drive was last fetched
+	offline      bool
+	offlineSince time.Time     // when offline last changed
+	offlineErr   error         // what took us offline
+	online       chan struct{} // closed when we are back online
+	paused       bool          // no delta polling or uploads while paused
+	pollInterval time.Duration // how often the delta loop polls for changes
+	readOnly     bool          // all changes are refused and nothing is uploaded
+	hooks        []RemoteChangeHook
+	syncHooks    []SyncStatusHook
 }
 
 // boltdb buckets
 var (
-	CONTENT  = []byte("content")
+	CONTENT  = []byte("content") // no longer used, content is stored as files
 	METADATA = []byte("metadata")
 	DELTA    = []byte("delta")
 )
@@ -43,47 +73,109 @@ func CacheDir() string {
 	return filepath.Join(dir, "onedriver")
 }
 
-// NewCache creates a new Cache
-func NewCache(auth *Auth, dbpath string) *Cache {
+// AccountDir returns the cache directory for a named account profile, nested
+// under the default cache directory.
+func AccountDir(cacheDir string, account string) (string, error) {
+	if account == "" || account == "." || account == ".." ||
+		strings.ContainsAny(account, "/\\") {
+		return "", fmt.Errorf("invalid account name \"%s\"", account)
+	}
+	return filepath.Join(cacheDir, "accounts", account), nil
+}
+
+// Logout signs out of the account whose data is stored in cacheDir, deleting
+// its tokens and cached metadata and content. Account profiles nested beneath
+// cacheDir are left alone. Microsoft does not offer a way to revoke a single
+// refresh token, so the tokens are only forgotten, not revoked.
+func Logout(cacheDir string) error {
+	if err := deleteTokens(filepath.Join(cacheDir, authFile)); err != nil {
+		return err
+	}
+	return ClearCache(cacheDir)
+}
+
+// NewCache creates a new Cache of the user's own drive. Background work
+// started by the cache stops when ctx is cancelled or Shutdown is called.
+func NewCache(ctx context.Context, auth *Auth, dbpath string) *Cache {
+	return NewSourceCache(ctx, auth, dbpath, Source{})
+}
+
+// NewSourceCache creates a new Cache of source, like NewCache.
+func NewSourceCache(ctx context.Context, auth *Auth, dbpath string, source Source) *Cache {
 	db, err := bolt.Open(dbpath, 0600, &bolt.Options{Timeout: time.Second * 5})
 	if err != nil {
 		log.WithFields(log.Fields{"err": err}).Fatal("Could not open DB")
 	}
 	db.Update(func(tx *bolt.Tx) error {
-		tx.CreateBucketIfNotExists(CONTENT)
 		tx.CreateBucketIfNotExists(METADATA)
 		tx.CreateBucketIfNotExists(DELTA)
+		tx.CreateBucketIfNotExists(JOURNAL)
+		tx.CreateBucketIfNotExists(UPLOADS)
+		tx.CreateBucketIfNotExists(WAL)
+		tx.CreateBucketIfNotExists(PARTIAL)
+		tx.CreateBucketIfNotExists(ABANDONED)
+		tx.CreateBucketIfNotExists(PINNED)
+		tx.CreateBucketIfNotExists(ACCESSED)
+		tx.CreateBucketIfNotExists(FAILED)
+		tx.CreateBucketIfNotExists(RECYCLED)
 		return nil
 	})
+	contentDir := ContentDir(dbpath)
+	if err := os.MkdirAll(filepath.Join(contentDir, "blobs"), 0700); err != nil {
+		log.WithFields(log.Fields{"err": err}).Fatal("Could not create content directory")
+	}
+	for _, dir := range []string{"dirty", "partial"} {
+		if err := os.MkdirAll(filepath.Join(contentDir, dir), 0700); err != nil {
+			log.WithFields(log.Fields{"err": err}).Fatal("Could not create content directory")
+		}
+	}
+	if err := setBufferDir(filepath.Join(contentDir, "buffers")); err != nil {
+		log.WithFields(log.Fields{"err": err}).Fatal("Could not create buffer directory")
+	}
+	if err := migrateCache(db, contentDir); err != nil {
+		log.WithFields(log.Fields{"err": err}).Fatal("Could not migrate cache. " +
+			"Use --wipe-cache to reset it.")
+	}
+	if auth != nil {
+		// a mounted filesystem can't stop to ask the user to sign in
+		auth.background = true
+	}
 	cache := &Cache{
-		auth: auth,
-		db:   db,
+		auth:       auth,
+		source:     source,
+		db:         db,
+		contentDir: contentDir,
+		metadata:   newShardedMap(),
+		pinned:     newPinSet(db),
+		accessed:   newAccessLog(db),
+		activity:   openActivityLog(ActivityLogPath(filepath.Dir(dbpath))),
+
+		deltaTrigger: make(chan struct{}, 1),
+		changes:      newChangeTracker(),
+		loaded:       time.Now(),
 	}
+	cache.changes.listener = cache.fireSyncStatus
+	cache.changes.db = db
+	cache.ctx, cache.cancel = context.WithCancel(ctx)
+	cache.recoverContent()
 
-	root, err := GetItem("root", auth)
+	root, err := GetRoot(source, auth)
 	if err != nil {
 		if IsOffline(err) {
 			// no network, load from db if possible and go to read-only state
-			cache.Lock()
-			cache.offline = true
-			cache.Unlock()
+			cache.setOffline(true, err)
 			if root = cache.GetID("root"); root == nil {
 				log.Fatal("We are offline and could not fetch the filesystem root item from disk.")
 			}
 			// when offline, we load the cache deltaLink from disk
-			cache.db.View(func(tx *bolt.Tx) error {
-				if link := tx.Bucket(DELTA).Get([]byte("deltaLink")); link != nil {
-					cache.deltaLink = string(link)
-				} else {
-					// Only reached if a previous online session never survived
-					// long enough to save its delta link. We explicitly disallow these
-					// types of startups as it's possible for things to get out of sync
-					// this way.
-					log.Fatal("Cannot perform an offline startup without a valid delta " +
-						"link from a previous session.")
-				}
-				return nil
-			})
+			if cache.deltaLink = cache.loadDeltaLink(); cache.deltaLink == "" {
+				// Only reached if a previous online session never survived
+				// long enough to save its delta link. We explicitly disallow these
+				// types of startups as it's possible for things to get out of sync
+				// this way.
+				log.Fatal("Cannot perform an offline startup without a valid delta " +
+					"link from a previous session.")
+			}
 		} else {
 			log.WithFields(log.Fields{
 				"err": err,
@@ -93,14 +185,33 @@ func NewCache(auth *Auth, dbpath string) *Cache {
 	root.cache = cache
 	cache.root = root.ID()
 	cache.InsertID(cache.root, root)
+	if source == (Source{}) {
+		cache.addSharedFolder()
+	}
+
+	cache.uploads = NewUploadManager(cache.ctx, 2*time.Second, auth, cache.changes, db)
+	cache.uploads.SetOffline(cache.IsOffline())
+	cache.uploads.onOffline = cache.noteOffline
+	cache.uploads.held = cache.IsConflicted
+	cache.uploads.activity = cache.activity
+	cache.resumeUploads()
+	cache.replayChanges()
+	cache.changes.restoreFailures()
+	if auth != nil {
+		auth.serveTokens(cache.ctx)
+	}
 
-	cache.uploads = NewUploadManager(2*time.Second, auth)
+	if auth != nil && !auth.CanWrite() {
+		log.Info("No permission to change files was granted, filesystem is read-only.")
+		cache.SetReadOnly()
+	}
 
 	if !cache.IsOffline() {
 		// .Trash-UID is used by "gio trash" for user trash, create it if it
 		// does not exist
-		trash := fmt.Sprintf(".Trash-%d", os.Getuid())
-		if child, _ := cache.GetChild(cache.root, trash, auth); child == nil {
+		trash := trashDir()
+		child, _ := cache.GetChild(cache.root, trash, auth)
+		if child == nil && !cache.IsReadOnly() {
 			item, err := Mkdir(trash, cache.root, auth)
 			if err != nil {
 				log.WithField("err", err).Error("Could not create trash folder. " +
@@ -110,15 +221,86 @@ func NewCache(auth *Auth, dbpath string) *Cache {
 			}
 		}
 
-		// using token=latest because we don't care about existing items - they'll
-		// be downloaded on-demand by the cache
-		cache.deltaLink = "/me/drive/root/delta?token=latest"
+		// Resume from where the last session left off so that changes made
+		// while we were not running are applied to cached items. Otherwise,
+		// use token=latest because we don't care about existing items -
+		// they'll be downloaded on-demand by the cache.
+		if cache.deltaLink = cache.loadDeltaLink(); cache.deltaLink == "" {
+			cache.deltaLink = source.resource() + "/root/delta?token=latest"
+		} else {
+			log.Info("Resuming delta sync from previous session.")
+		}
 	}
 
 	// deltaloop is started manually
 	return cache
 }
 
+// loadDeltaLink fetches the deltaLink saved by a previous session from disk, or
+// "" if there is none.
+func (c *Cache) loadDeltaLink() string {
+	var link string
+	c.db.View(func(tx *bolt.Tx) error {
+		if saved := tx.Bucket(DELTA).Get([]byte("deltaLink")); saved != nil {
+			link = string(saved)
+		}
+		return nil
+	})
+	return link
+}
+
+// saveDeltaLink persists the current deltaLink to disk so the next session can
+// resume from it.
+func (c *Cache) saveDeltaLink() error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(DELTA).Put([]byte("deltaLink"), []byte(c.deltaLink))
+	})
+}
+
+// start runs a background worker that is waited on during Shutdown.
+func (c *Cache) start(worker func()) {
+	c.workers.Add(1)
+	go worker()
+}
+
+// sleepContext sleeps for a duration, returning false early if ctx is cancelled.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Shutdown stops all background work, waits for in-progress uploads to finish
+// (up to timeout), then flushes metadata to disk and closes the database. The
+// cache must not be used afterwards.
+func (c *Cache) Shutdown(timeout time.Duration) {
+	// the first call does the work, the others wait for it to be done
+	c.shutdown.Do(func() { c.shutdownNow(timeout) })
+}
+
+func (c *Cache) shutdownNow(timeout time.Duration) {
+	log.Info("Shutting down background workers.")
+	c.cancel()
+	c.workers.Wait()
+	if !c.uploads.Wait(timeout) {
+		log.Warn("Timed out waiting for uploads to complete, " +
+			"they will be retried next time.")
+	}
+	if !c.IsOffline() {
+		c.SerializeAll()
+		c.saveDeltaLink()
+	}
+	if err := c.db.Close(); err != nil {
+		log.WithField("err", err).Error("Could not close database cleanly.")
+	}
+	c.activity.close()
+}
+
 // GetAuth returns the current auth
 func (c *Cache) GetAuth() *Auth {
 	c.RLock()
@@ -126,6 +308,18 @@ func (c *Cache) GetAuth() *Auth {
 	return c.auth
 }
 
+// Reauth picks up tokens from a new sign in performed by another process (see
+// Reauthenticate) and resumes syncing if the filesystem went read-only because
+// the old tokens expired.
+func (c *Cache) Reauth() error {
+	if err := c.GetAuth().Reload(); err != nil {
+		return err
+	}
+	log.Info("Reloaded auth tokens after reauthentication.")
+	c.TriggerDeltas()
+	return nil
+}
+
 // IsOffline returns whether or not the cache thinks its offline.
 func (c *Cache) IsOffline() bool {
 	c.RLock()
@@ -133,6 +327,50 @@ func (c *Cache) IsOffline() bool {
 	return c.offline
 }
 
+// Pause stops delta polling and holds any new uploads until Resume is called.
+// The filesystem stays mounted and usable, changes are simply not synced.
+func (c *Cache) Pause() {
+	c.Lock()
+	c.paused = true
+	c.Unlock()
+	c.uploads.SetPaused(true)
+	log.Info("Syncing paused.")
+}
+
+// Resume restarts syncing after a Pause.
+func (c *Cache) Resume() {
+	c.Lock()
+	c.paused = false
+	readOnly := c.readOnly
+	c.Unlock()
+	c.uploads.SetPaused(readOnly)
+	c.TriggerDeltas()
+	log.Info("Syncing resumed.")
+}
+
+// SetReadOnly makes the filesystem refuse all changes and stops uploads for
+// good. Only meant to be called before mounting.
+func (c *Cache) SetReadOnly() {
+	c.Lock()
+	c.readOnly = true
+	c.Unlock()
+	c.uploads.SetPaused(true)
+}
+
+// IsReadOnly returns whether the filesystem refuses changes.
+func (c *Cache) IsReadOnly() bool {
+	c.RLock()
+	defer c.RUnlock()
+	return c.readOnly
+}
+
+// IsPaused returns whether syncing has been paused.
+func (c *Cache) IsPaused() bool {
+	c.RLock()
+	defer c.RUnlock()
+	return c.paused
+}
+
 // DriveType lazily fetches the OneDrive drivetype
 func (c *Cache) DriveType() string {
 	c.RLock()
@@ -140,11 +378,8 @@ func (c *Cache) DriveType() string {
 	c.RUnlock()
 
 	if driveType == "" {
-		drive, err := GetDrive(c.GetAuth())
+		drive, err := c.GetDrive()
 		if err == nil {
-			c.Lock()
-			c.driveType = drive.DriveType
-			c.Unlock()
 			return drive.DriveType
 		}
 		log.Error("Drivetype was empty and could not be fetched!")
@@ -152,6 +387,53 @@ func (c *Cache) DriveType() string {
 	return driveType
 }
 
+// how often drive details (mainly quota) are refetched from the server
+const driveRefreshInterval = 5 * time.Minute
+
+// GetDrive returns the details of the drive served. They are fetched lazily
+// and refreshed at most every driveRefreshInterval, so frequent callers like
+// statfs don't hit the server each time. The last known details are returned
+// if they can't be refreshed, when offline for instance.
+func (c *Cache) GetDrive() (Drive, error) {
+	c.RLock()
+	cached, fetched := c.drive, c.driveTime
+	c.RUnlock()
+	if cached != nil && (time.Since(fetched) < driveRefreshInterval || c.IsOffline()) {
+		return *cached, nil
+	}
+
+	drive, err := c.fetchDrive()
+	if err != nil {
+		if cached != nil {
+			return *cached, nil
+		}
+		return drive, err
+	}
+	if cached == nil && drive.DriveType == "personal" {
+		log.Warn("Personal OneDrive accounts do not show number of files, " +
+			"inode counts reported by onedriver will be bogus.")
+	}
+	c.Lock()
+	c.drive = &drive
+	c.driveTime = time.Now()
+	c.driveType = drive.DriveType
+	c.Unlock()
+	return drive, nil
+}
+
+// fetchDrive fetches the details of the drive served from the server.
+func (c *Cache) fetchDrive() (Drive, error) {
+	if c.source.Drive == "" {
+		return GetDrive(c.GetAuth())
+	}
+	drive := Drive{}
+	resp, err := Get(c.source.resource(), c.GetAuth())
+	if err == nil {
+		err = json.Unmarshal(resp, &drive)
+	}
+	return drive, err
+}
+
 func leadingSlash(path string) string {
 	if !strings.HasPrefix(path, "/") {
 		path = "/" + path
@@ -187,13 +469,15 @@ func (c *Cache) GetID(id string) *Inode {
 		}
 		return found
 	}
-	return entry.(*Inode)
+	return entry
 }
 
 // InsertID inserts a single item into the cache by ID and sets its parent using
 // the Inode.Parent.ID, if set. Must be called after DeleteID, if being used to
 // rename/move an item.
 func (c *Cache) InsertID(id string, inode *Inode) {
+	c.gcMutex.RLock()
+	defer c.gcMutex.RUnlock()
 	// make sure the item knows about the cache itself, then insert
 	inode.mutex.Lock()
 	inode.cache = c
@@ -236,37 +520,52 @@ func (c *Cache) InsertID(id string, inode *Inode) {
 
 // InsertChild adds an item as a child of a specified parent ID.
 func (c *Cache) InsertChild(parentID string, child *Inode) {
+	// the server's path is relative to the root of its drive, which need not
+	// be the root of the filesystem
+	parentPath := ""
+	if parent := c.GetID(parentID); parent != nil {
+		parentPath = parent.Path()
+	}
 	child.mutex.Lock()
 	// should already be set, just double-checking here.
 	child.DriveItem.Parent.ID = parentID
+	if parentPath != "" {
+		child.DriveItem.Parent.Path = parentPath
+	}
 	id := child.IDInternal
 	child.mutex.Unlock()
 	c.InsertID(id, child)
 }
 
-// DeleteID deletes an item from the cache, and removes it from its parent. Must
-// be called before InsertID if being used to rename/move an item.
+// DeleteID deletes an item from the cache (both in memory and on disk), and
+// removes it from its parent. Must be called before InsertID if being used to
+// rename/move an item.
 func (c *Cache) DeleteID(id string) {
 	if inode := c.GetID(id); inode != nil {
-		parent := c.GetID(inode.ParentID())
-		parent.mutex.Lock()
-		for i, childID := range parent.children {
-			if childID == id {
-				parent.children = append(parent.children[:i], parent.children[i+1:]...)
-				if inode.IsDir() {
-					parent.subdir--
+		if parent := c.GetID(inode.ParentID()); parent != nil {
+			parent.mutex.Lock()
+			for i, childID := range parent.children {
+				if childID == id {
+					parent.children = append(parent.children[:i], parent.children[i+1:]...)
+					if inode.IsDir() {
+						parent.subdir--
+					}
+					break
 				}
-				break
 			}
+			parent.mutex.Unlock()
 		}
-		parent.mutex.Unlock()
 	}
 	c.metadata.Delete(id)
+	c.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(METADATA).Delete([]byte(id))
+	})
 }
 
 // only used for parsing
 type driveChildren struct {
 	Children []*Inode `json:"value"`
+	NextLink string   `json:"@odata.nextLink,omitempty"`
 }
 
 // GetChild fetches a named child of an item. Wraps GetChildrenID.
@@ -286,6 +585,9 @@ func (c *Cache) GetChild(id string, name string, auth *Auth) (*Inode, error) {
 // GetChildrenID grabs all DriveItems that are the children of the given ID. If
 // items are not found, they are fetched.
 func (c *Cache) GetChildrenID(id string, auth *Auth) (map[string]*Inode, error) {
+	if isVersions(id) {
+		return c.versionsChildren(id, auth)
+	}
 	// fetch item and catch common errors
 	inode := c.GetID(id)
 	children := make(map[string]*Inode)
@@ -306,33 +608,42 @@ func (c *Cache) GetChildrenID(id string, auth *Auth) (map[string]*Inode, error)
 
 	// If item.children is not nil, it means we have the item's children
 	// already and can fetch them directly from the cache
+	parentPath := inode.Path()
 	inode.mutex.RLock()
-	if inode.children != nil {
-		// can potentially have out-of-date child metadata if started offline, but since
-		// changes are disallowed while offline, the children will be back in sync after
-		// the first successful delta fetch (which also brings the fs back online)
+	if inode.children != nil && !c.staleListings.has(id) {
+		// can potentially have out-of-date child metadata if started offline, but the
+		// children will be back in sync after the first successful delta fetch (which
+		// also brings the fs back online and sends the changes made offline)
 		for _, childID := range inode.children {
 			child := c.GetID(childID)
 			if child == nil {
 				// will be nil if deleted or never existed
 				continue
 			}
+			if excluded(parentPath, child.Name()) {
+				// cached before it was excluded
+				continue
+			}
 			children[strings.ToLower(child.Name())] = child
 		}
 		inode.mutex.RUnlock()
+		c.counters.listing(true)
 		return children, nil
 	}
 	inode.mutex.RUnlock()
 
 	// We haven't fetched the children for this item yet, get them from the
 	// server.
-	body, err := Get(ChildrenPathID(id), auth)
+	if auth == nil || c.IsOffline() {
+		c.counters.listing(true)
+		return c.cachedChildren(inode), nil
+	}
+	c.counters.listing(false)
+	children, err := c.fetchChildren(inode, auth)
 	if err != nil {
 		if IsOffline(err) {
-			log.WithFields(log.Fields{
-				"id": id,
-			}).Warn("We are offline, and no children found in cache. Pretending there are no children.")
-			return children, nil
+			c.noteOffline(err)
+			return c.cachedChildren(inode), nil
 		}
 		// something else happened besides being offline
 		log.WithFields(log.Fields{
@@ -340,27 +651,6 @@ func (c *Cache) GetChildrenID(id string, auth *Auth) (map[string]*Inode, error)
 		}).Error("Error while fetching children.")
 		return nil, err
 	}
-	var fetched driveChildren
-	json.Unmarshal(body, &fetched)
-
-	inode.mutex.Lock()
-	inode.children = make([]string, 0)
-	for _, child := range fetched.Children {
-		// we will always have an id after fetching from the server
-		child.cache = c
-		c.metadata.Store(child.IDInternal, child)
-
-		// store in result map
-		children[strings.ToLower(child.Name())] = child
-
-		// store id in parent item and increment parents subdirectory count
-		inode.children = append(inode.children, child.IDInternal)
-		if child.IsDir() {
-			inode.subdir++
-		}
-	}
-	inode.mutex.Unlock()
-
 	return children, nil
 }
 
@@ -474,12 +764,26 @@ func (c *Cache) MoveID(oldID string, newID string) error {
 
 	inode.mutex.Lock()
 	inode.IDInternal = newID
+	children := append([]string(nil), inode.children...)
 	inode.mutex.Unlock()
+	for _, childID := range children {
+		// folders made offline get their ID after their contents
+		if child := c.GetID(childID); child != nil {
+			child.mutex.Lock()
+			if child.DriveItem.Parent != nil {
+				child.DriveItem.Parent.ID = newID
+			}
+			child.mutex.Unlock()
+		}
+	}
 
 	// now actually perform the metadata+content move
 	c.DeleteID(oldID)
 	c.InsertID(newID, inode)
 	c.MoveContent(oldID, newID)
+	c.changes.move(oldID, newID)
+	walMove(c.db, oldID, newID)
+	c.pinned.move(oldID, newID)
 	return nil
 }
 
@@ -503,60 +807,19 @@ func (c *Cache) MovePath(oldPath string, newPath string, auth *Auth) error {
 	return nil
 }
 
-// GetContent reads a file's content from disk.
-func (c *Cache) GetContent(id string) []byte {
-	var content []byte // nil
-	c.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket(CONTENT)
-		if tmp := b.Get([]byte(id)); tmp != nil {
-			content = make([]byte, len(tmp))
-			copy(content, tmp)
-		}
-		return nil
-	})
-	return content
-}
-
-// InsertContent writes file content to disk.
-func (c *Cache) InsertContent(id string, content []byte) error {
-	return c.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(CONTENT)
-		return b.Put([]byte(id), content)
-	})
-}
-
-// DeleteContent deletes content from disk.
-func (c *Cache) DeleteContent(id string) error {
-	return c.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(CONTENT)
-		return b.Delete([]byte(id))
-	})
-}
-
-// MoveContent moves content from one ID to another
-func (c *Cache) MoveContent(oldID string, newID string) error {
-	return c.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(CONTENT)
-		content := b.Get([]byte(oldID))
-		if content == nil {
-			return errors.New("Content not found for ID: " + oldID)
-		}
-		b.Put([]byte(newID), content)
-		b.Delete([]byte(oldID))
-		return nil
-	})
-}
-
 // SerializeAll dumps all inode metadata currently in the cache to disk. This
 // metadata is only used later if an item could not be found in memory AND the
 // cache is offline. Old metadata is not removed, only overwritten (to avoid an
 // offline session from wiping all metadata on a subsequent serialization).
 func (c *Cache) SerializeAll() {
 	log.Info("Serializing cache metadata to disk.")
-	c.metadata.Range(func(key interface{}, value interface{}) bool {
+	c.metadata.Range(func(id string, inode *Inode) bool {
+		if isVersions(id) {
+			// listed again from the server whenever they are looked at
+			return true
+		}
 		c.db.Batch(func(tx *bolt.Tx) error {
-			id := fmt.Sprint(key)
-			contents := value.(*Inode).AsJSON()
+			contents := inode.AsJSON()
 			b := tx.Bucket(METADATA)
 			b.Put([]byte(id), contents)
 			if id == c.root {
@@ -569,3 +832,126 @@ func (c *Cache) SerializeAll() {
 		return true
 	})
 }
+
+// gcLoop periodically garbage collects orphaned cache entries. Should be called
+// as a goroutine.
+func (c *Cache) gcLoop(interval time.Duration) {
+	defer c.workers.Done()
+	log.Trace("Starting cache garbage collection goroutine.")
+	for sleepContext(c.ctx, interval) {
+		c.CollectGarbage()
+	}
+}
+
+// reachable returns the set of item IDs that can be reached from the
+// filesystem root. Folders that are not in memory, like everything below the
+// root after an offline start, are walked using the metadata stored on disk.
+func (c *Cache) reachable() map[string]bool {
+	// the root is also stored as "root", for offline starts, and the folders
+	// onedriver adds to it are only among its children once it is listed
+	seen := map[string]bool{c.root: true, "root": true}
+	queue := []string{c.root}
+	for _, id := range []string{sharedFolderID, recycleFolderID} {
+		if _, exists := c.metadata.Load(id); exists {
+			seen[id] = true
+			queue = append(queue, id)
+		}
+	}
+	walk := func(metadata *bolt.Bucket) {
+		for len(queue) > 0 {
+			id := queue[0]
+			queue = queue[1:]
+			var children []string
+			if inode, exists := c.metadata.Load(id); exists {
+				inode.mutex.RLock()
+				children = append(children, inode.children...)
+				inode.mutex.RUnlock()
+			} else if metadata != nil {
+				if data := metadata.Get([]byte(id)); data != nil {
+					if stored, err := NewInodeJSON(data); err == nil {
+						children = stored.children
+					}
+				}
+			}
+			for _, childID := range children {
+				if !seen[childID] {
+					seen[childID] = true
+					queue = append(queue, childID)
+				}
+			}
+		}
+	}
+	if c.db == nil {
+		walk(nil)
+		return seen
+	}
+	c.db.View(func(tx *bolt.Tx) error {
+		walk(tx.Bucket(METADATA))
+		return nil
+	})
+	return seen
+}
+
+// CollectGarbage removes items that are no longer reachable from the
+// filesystem root (for instance, the children of a directory deleted by a
+// delta), as well as any cached content that no longer belongs to an item.
+// Items with unsaved local changes are never collected. Returns the number of
+// items removed. Children are added to the cache before their parents list
+// them, so nothing may be added while looking for orphans.
+func (c *Cache) CollectGarbage() int {
+	c.gcMutex.Lock()
+	reachable := c.reachable()
+	orphans := make([]string, 0)
+	c.metadata.Range(func(id string, inode *Inode) bool {
+		if reachable[id] || inode.HasChanges() || inode.HasContent() {
+			return true
+		}
+		orphans = append(orphans, id)
+		return true
+	})
+	for _, id := range orphans {
+		c.metadata.Delete(id)
+	}
+
+	removed := len(orphans)
+	c.db.Update(func(tx *bolt.Tx) error {
+		metadata := tx.Bucket(METADATA)
+		for _, id := range orphans {
+			metadata.Delete([]byte(id))
+		}
+		return nil
+	})
+	c.gcMutex.Unlock()
+
+	// content is only kept if it belongs to an item we still know about
+	stale := make([]string, 0)
+	files, _ := ioutil.ReadDir(c.contentDir)
+	c.db.View(func(tx *bolt.Tx) error {
+		metadata := tx.Bucket(METADATA)
+		for _, file := range files {
+			id := file.Name()
+			if file.IsDir() || strings.HasSuffix(id, ".tmp") {
+				continue // blobs or a write in progress
+			}
+			if _, exists := c.metadata.Load(id); exists || reachable[id] {
+				continue
+			}
+			if metadata.Get([]byte(id)) == nil {
+				stale = append(stale, id)
+			}
+		}
+		return nil
+	})
+	for _, id := range stale {
+		c.DeleteContent(id)
+	}
+	removed += len(stale) + c.collectBlobs()
+
+	if removed > 0 {
+		log.WithFields(log.Fields{
+			"items":   len(orphans),
+			"content": removed - len(orphans),
+		}).Info("Garbage collected orphaned cache entries and content.")
+	}
+	return removed
+}
@@ -2,14 +2,22 @@
 package graph
 
 import (
+	"context"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
+
+	bolt "github.com/etcd-io/bbolt"
+	"github.com/hanwen/go-fuse/v2/fuse"
 )
 
 func TestRootGet(t *testing.T) {
 	t.Parallel()
-	cache := NewCache(auth, "test_root_get.db")
+	cache := NewCache(context.Background(), auth, "test_root_get.db")
 	root, err := cache.GetPath("/", auth)
 	if err != nil {
 		t.Fatal(err)
@@ -22,7 +30,7 @@ func TestRootGet(t *testing.T) {
 
 func TestRootChildrenUpdate(t *testing.T) {
 	t.Parallel()
-	cache := NewCache(auth, "test_root_children_update.db")
+	cache := NewCache(context.Background(), auth, "test_root_children_update.db")
 	children, err := cache.GetChildrenPath("/", auth)
 	if err != nil {
 		t.Fatal(err)
@@ -35,7 +43,7 @@ func TestRootChildrenUpdate(t *testing.T) {
 
 func TestSubdirGet(t *testing.T) {
 	t.Parallel()
-	cache := NewCache(auth, "test_subdir_get.db")
+	cache := NewCache(context.Background(), auth, "test_subdir_get.db")
 	documents, err := cache.GetPath("/Documents", auth)
 	if err != nil {
 		t.Fatal(err)
@@ -47,7 +55,7 @@ func TestSubdirGet(t *testing.T) {
 
 func TestSubdirChildrenUpdate(t *testing.T) {
 	t.Parallel()
-	cache := NewCache(auth, "test_subdir_children_update.db")
+	cache := NewCache(context.Background(), auth, "test_subdir_children_update.db")
 	children, err := cache.GetChildrenPath("/Documents", auth)
 	failOnErr(t, err)
 
@@ -63,7 +71,7 @@ func TestSubdirChildrenUpdate(t *testing.T) {
 
 func TestSamePointer(t *testing.T) {
 	t.Parallel()
-	cache := NewCache(auth, "test_same_pointer.db")
+	cache := NewCache(context.Background(), auth, "test_same_pointer.db")
 	item, _ := cache.GetPath("/Documents", auth)
 	item2, _ := cache.GetPath("/Documents", auth)
 	if item != item2 {
@@ -77,3 +85,216 @@ func TestSamePointer(t *testing.T) {
 //TODO test setting a parent multiple times
 
 //TODO test removing a parent multiple times
+
+// Children of a deleted directory should be garbage collected, along with any
+// content they had cached.
+func TestCollectGarbage(t *testing.T) {
+	t.Parallel()
+	cache := NewCache(context.Background(), auth, "test_collect_garbage.db")
+	root, _ := cache.GetPath("/", auth)
+
+	dir := NewInode("gc_dir", 0755|fuse.S_IFDIR, root)
+	cache.InsertChild(root.ID(), dir)
+	child := NewInode("gc_child", 0644, dir)
+	cache.InsertChild(dir.ID(), child)
+	child.mutex.Lock()
+	child.data = nil
+	child.mutex.Unlock()
+	failOnErr(t, cache.InsertContent(child.ID(), []byte("orphaned content")))
+
+	cache.DeleteID(dir.ID())
+	if removed := cache.CollectGarbage(); removed == 0 {
+		t.Fatal("Nothing was garbage collected.")
+	}
+	if cache.GetID(child.ID()) != nil {
+		t.Fatal("Orphaned child was not garbage collected.")
+	}
+	if cache.GetContent(child.ID()) != nil {
+		t.Fatal("Orphaned content was not garbage collected.")
+	}
+}
+
+// After an offline start only the root is in memory, and items below folders
+// that were never listed must not be collected just because their parents
+// are still on disk. Neither must the copy of the root kept for offline
+// starts.
+func TestCollectGarbageOffline(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "onedriver-gc-offline-")
+	failOnErr(t, err)
+	defer os.RemoveAll(dir)
+	db, err := bolt.Open(filepath.Join(dir, "gc.db"), 0600,
+		&bolt.Options{Timeout: time.Second * 5})
+	failOnErr(t, err)
+	defer db.Close()
+
+	root := NewInode("root", 0755|fuse.S_IFDIR, nil)
+	folder := NewInode("never_listed", 0755|fuse.S_IFDIR, root)
+	folder.IDInternal = "01NEVERLISTED"
+	file := NewInode("deep_file", 0644|fuse.S_IFREG, folder)
+	file.IDInternal = "01DEEPFILE"
+	root.children = []string{folder.ID()}
+	folder.children = []string{file.ID()}
+	failOnErr(t, db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(METADATA)
+		if err != nil {
+			return err
+		}
+		b.Put([]byte("root"), root.AsJSON())
+		b.Put([]byte(root.ID()), root.AsJSON())
+		b.Put([]byte(folder.ID()), folder.AsJSON())
+		return b.Put([]byte(file.ID()), file.AsJSON())
+	}))
+
+	cache := &Cache{db: db, contentDir: dir, metadata: newShardedMap()}
+	offlineRoot := cache.GetID("root")
+	if offlineRoot == nil {
+		t.Fatal("Could not load the root from disk.")
+	}
+	cache.root = offlineRoot.ID()
+	cache.InsertID(cache.root, offlineRoot)
+	// looked up directly, without its parent ever being loaded
+	if cache.GetID(file.ID()) == nil {
+		t.Fatal("Could not load file from disk.")
+	}
+
+	cache.CollectGarbage()
+	if _, exists := cache.metadata.Load(file.ID()); !exists {
+		t.Error("Item below a folder that is only on disk was collected.")
+	}
+	failOnErr(t, db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(METADATA)
+		if b.Get([]byte(file.ID())) == nil {
+			t.Error("Item below a folder that is only on disk was removed from disk.")
+		}
+		if b.Get([]byte("root")) == nil {
+			t.Error("Root kept for offline starts was removed from disk.")
+		}
+		return nil
+	}))
+}
+
+// A child stored by a listing that has yet to add it to its parent must not be
+// collected in the meantime.
+func TestCollectGarbageDuringListing(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "onedriver-gc-listing-")
+	failOnErr(t, err)
+	defer os.RemoveAll(dir)
+	db, err := bolt.Open(filepath.Join(dir, "gc.db"), 0600,
+		&bolt.Options{Timeout: time.Second * 5})
+	failOnErr(t, err)
+	defer db.Close()
+	failOnErr(t, db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(METADATA)
+		return err
+	}))
+	cache := &Cache{db: db, contentDir: dir, metadata: newShardedMap()}
+	root := NewInode("root", 0755|fuse.S_IFDIR, nil)
+	cache.root = root.ID()
+	cache.InsertID(root.ID(), root)
+
+	// what fetchChildren does
+	cache.gcMutex.RLock()
+	child := NewInode("listed.txt", 0644|fuse.S_IFREG, root)
+	child.data = nil
+	child.cache = cache
+	cache.metadata.Store(child.ID(), child)
+	done := make(chan int)
+	go func() {
+		done <- cache.CollectGarbage()
+	}()
+	select {
+	case <-done:
+		t.Fatal("Garbage was collected while a listing was adding children.")
+	case <-time.After(100 * time.Millisecond):
+	}
+	root.mutex.Lock()
+	root.children = append(root.children, child.ID())
+	root.mutex.Unlock()
+	cache.gcMutex.RUnlock()
+
+	<-done
+	if _, exists := cache.metadata.Load(child.ID()); !exists {
+		t.Fatal("Child added by a listing was collected.")
+	}
+}
+
+// Account names must not be able to escape the cache directory.
+func TestAccountDir(t *testing.T) {
+	t.Parallel()
+	if dir, err := AccountDir("/cache", "work"); err != nil || dir != "/cache/accounts/work" {
+		t.Fatalf("Unexpected account dir \"%s\": %v", dir, err)
+	}
+	for _, name := range []string{"", "..", "../other", "a/b"} {
+		if _, err := AccountDir("/cache", name); err == nil {
+			t.Errorf("Account name \"%s\" should have been rejected.", name)
+		}
+	}
+}
+
+func TestLogout(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "onedriver-logout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	other := filepath.Join(dir, "accounts", "work", "onedriver.db")
+	os.MkdirAll(filepath.Join(dir, "onedriver-content", "blobs"), 0700)
+	os.MkdirAll(filepath.Dir(other), 0700)
+	for _, file := range []string{authFile, "onedriver.db"} {
+		ioutil.WriteFile(filepath.Join(dir, file), []byte("{}"), 0600)
+	}
+	ioutil.WriteFile(other, []byte("{}"), 0600)
+
+	if err := Logout(dir); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{authFile, "onedriver.db", "onedriver-content"} {
+		if _, err := os.Stat(filepath.Join(dir, file)); !os.IsNotExist(err) {
+			t.Errorf("%s was not removed.", file)
+		}
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Error("Other accounts should not be touched:", err)
+	}
+	// signing out twice is fine
+	if err := Logout(dir); err != nil {
+		t.Error(err)
+	}
+}
+
+// Drive details should be served from cache between refreshes, so that statfs
+// doesn't make a request every time.
+func TestCacheGetDrive(t *testing.T) {
+	t.Parallel()
+	cached := &Drive{DriveType: "business", Quota: DriveQuota{Total: 1 << 40}}
+	cache := &Cache{drive: cached, driveTime: time.Now()}
+	drive, err := cache.GetDrive()
+	if err != nil || drive.Quota.Total != cached.Quota.Total {
+		t.Fatalf("Cached drive was not used: %+v, %v", drive, err)
+	}
+	if driveType := cache.DriveType(); driveType != "business" {
+		t.Fatalf("Drive type was not taken from cached drive: %s", driveType)
+	}
+}
+
+// Resuming sync must not restart uploads on a read-only filesystem.
+func TestCacheReadOnly(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cache := &Cache{uploads: NewUploadManager(ctx, time.Hour, nil, nil, nil)}
+	cache.SetReadOnly()
+	cache.Pause()
+	cache.Resume()
+	if !cache.IsReadOnly() {
+		t.Fatal("Cache is not read-only.")
+	}
+	cache.uploads.mutex.RLock()
+	defer cache.uploads.mutex.RUnlock()
+	if !cache.uploads.paused {
+		t.Fatal("Uploads were resumed on a read-only filesystem.")
+	}
+}
@@ -0,0 +1,258 @@
+package graph
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	bolt "github.com/etcd-io/bbolt"
+)
+
+// ChangeOp is the kind of local change waiting to be synced to the server.
+type ChangeOp string
+
+// types of local changes
+const (
+	OpCreate ChangeOp = "create"
+	OpWrite  ChangeOp = "write"
+	OpRename ChangeOp = "rename"
+	OpDelete ChangeOp = "delete"
+)
+
+// ChangeState is how far a local change has gotten on its way to the server.
+type ChangeState string
+
+// states of a pending change
+const (
+	StateQueued     ChangeState = "queued"
+	StateInFlight   ChangeState = "in-flight"
+	StateFailed     ChangeState = "failed"
+	StateConflicted ChangeState = "conflicted"
+)
+
+// PendingChange is a locally originated change that has not reached the
+// server yet.
+type PendingChange struct {
+	ID    string      `json:"id"`
+	Path  string      `json:"path"`
+	Op    ChangeOp    `json:"op"`
+	State ChangeState `json:"state"`
+	Error string      `json:"error,omitempty"`
+	// why it failed, if it did
+	Reason  FailureReason `json:"reason,omitempty"`
+	Updated time.Time     `json:"updated"`
+	// upload progress of large files, in bytes
+	Uploaded uint64 `json:"uploaded,omitempty"`
+	Size     uint64 `json:"size,omitempty"`
+}
+
+// changeKey identifies a pending change. An item can have several different
+// kinds of changes pending at once (a rename while a write is still uploading).
+type changeKey struct {
+	id string
+	op ChangeOp
+}
+
+// changeTracker keeps track of local changes to items. Only the most recent
+// change of each kind is kept per item, since that is what will end up on the
+// server.
+type changeTracker struct {
+	mutex   sync.RWMutex
+	changes map[changeKey]*PendingChange
+	db      *bolt.DB // failed changes are saved here, may be nil
+	// called with the path of every item whose changes moved on, without the
+	// mutex held
+	listener func(path string)
+}
+
+func newChangeTracker() *changeTracker {
+	return &changeTracker{changes: make(map[changeKey]*PendingChange)}
+}
+
+// track records a new local change for an item.
+func (t *changeTracker) track(id string, path string, op ChangeOp, state ChangeState) {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	paths := []string{path}
+	defer func() { t.changed(paths...) }()
+	defer t.mutex.Unlock()
+	switch op {
+	case OpWrite:
+		if _, exists := t.changes[changeKey{id, OpCreate}]; exists {
+			// the item doesn't exist on the server yet, it's a create until it does
+			op = OpCreate
+		}
+	case OpDelete:
+		// nothing else matters once an item is gone
+		for key, change := range t.changes {
+			if key.id == id {
+				paths = append(paths, change.Path)
+				t.forgetFailure(key, change)
+				delete(t.changes, key)
+			}
+		}
+	}
+	if old, exists := t.changes[changeKey{id, op}]; exists {
+		t.forgetFailure(changeKey{id, op}, old)
+	}
+	t.changes[changeKey{id, op}] = &PendingChange{
+		ID:      id,
+		Path:    path,
+		Op:      op,
+		State:   state,
+		Updated: time.Now(),
+	}
+}
+
+// setState updates the state of an item's pending changes of a given kind. An
+// empty op matches any kind of change.
+func (t *changeTracker) setState(id string, op ChangeOp, state ChangeState, err error) {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	var paths []string
+	defer func() { t.changed(paths...) }()
+	defer t.mutex.Unlock()
+	for key, change := range t.changes {
+		if key.id != id || (op != "" && key.op != op) {
+			continue
+		}
+		if change.State != state {
+			paths = append(paths, change.Path)
+		}
+		t.forgetFailure(key, change)
+		change.State = state
+		change.Error = ""
+		change.Reason = ""
+		if err != nil {
+			change.Error = err.Error()
+		}
+		change.Updated = time.Now()
+		if state == StateFailed {
+			change.Reason = failureReason(err)
+			t.saveFailure(key, change)
+		}
+	}
+}
+
+// setProgress records how much of an item's content has been uploaded.
+func (t *changeTracker) setProgress(id string, uploaded uint64, size uint64) {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for _, op := range []ChangeOp{OpCreate, OpWrite} {
+		if change, exists := t.changes[changeKey{id, op}]; exists {
+			change.Uploaded = uploaded
+			change.Size = size
+		}
+	}
+}
+
+// hasContentChange returns whether an item has content changes that have not
+// reached the server yet, including ones that failed to upload.
+func (t *changeTracker) hasContentChange(id string) bool {
+	if t == nil {
+		return false
+	}
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	_, created := t.changes[changeKey{id, OpCreate}]
+	_, written := t.changes[changeKey{id, OpWrite}]
+	return created || written
+}
+
+// path returns the path of an item with pending changes, or "" if it has none.
+func (t *changeTracker) path(id string) string {
+	if t == nil {
+		return ""
+	}
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	for key, change := range t.changes {
+		if key.id == id {
+			return change.Path
+		}
+	}
+	return ""
+}
+
+// done removes an item's pending changes of a given kind once they have
+// reached the server. An empty op matches any kind of change.
+func (t *changeTracker) done(id string, op ChangeOp) {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	var paths []string
+	defer func() { t.changed(paths...) }()
+	defer t.mutex.Unlock()
+	for key, change := range t.changes {
+		if key.id == id && (op == "" || key.op == op) {
+			paths = append(paths, change.Path)
+			t.forgetFailure(key, change)
+			delete(t.changes, key)
+		}
+	}
+}
+
+// changed tells the listener the changes to the items at paths moved on.
+func (t *changeTracker) changed(paths ...string) {
+	if t.listener == nil {
+		return
+	}
+	seen := make(map[string]bool, len(paths))
+	for _, path := range paths {
+		if path != "" && !seen[path] {
+			seen[path] = true
+			t.listener(path)
+		}
+	}
+}
+
+// move rekeys pending changes when an item goes from a local to a remote ID.
+func (t *changeTracker) move(oldID string, newID string) {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for key, change := range t.changes {
+		if key.id == oldID {
+			t.forgetFailure(key, change)
+			delete(t.changes, key)
+			change.ID = newID
+			t.changes[changeKey{newID, key.op}] = change
+			if change.State == StateFailed {
+				t.saveFailure(changeKey{newID, key.op}, change)
+			}
+		}
+	}
+}
+
+// list returns a snapshot of all pending changes, oldest first.
+func (t *changeTracker) list() []PendingChange {
+	if t == nil {
+		return nil
+	}
+	t.mutex.RLock()
+	changes := make([]PendingChange, 0, len(t.changes))
+	for _, change := range t.changes {
+		changes = append(changes, *change)
+	}
+	t.mutex.RUnlock()
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Updated.Before(changes[j].Updated)
+	})
+	return changes
+}
+
+// PendingChanges returns every local change that has not made it to the server
+// yet, including ones that failed or are held back by a conflict.
+func (c *Cache) PendingChanges() []PendingChange {
+	return c.changes.list()
+}
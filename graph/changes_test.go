@@ -0,0 +1,42 @@
+package graph
+
+import (
+	"errors"
+	"testing"
+)
+
+// Changes should be tracked through their lifecycle, and follow an item when
+// it gets a new ID from the server.
+func TestChangeTracker(t *testing.T) {
+	t.Parallel()
+	tracker := newChangeTracker()
+	id := localID()
+	tracker.track(id, "/tracked.txt", OpCreate, StateQueued)
+	tracker.track(id, "/tracked.txt", OpWrite, StateQueued)
+	tracker.move(id, "remote-id")
+
+	changes := tracker.list()
+	if len(changes) != 1 {
+		t.Fatalf("Expected 1 pending change, got %d.", len(changes))
+	}
+	if changes[0].ID != "remote-id" || changes[0].Op != OpCreate {
+		t.Fatalf("Unexpected pending change: %+v", changes[0])
+	}
+
+	tracker.setState("remote-id", OpCreate, StateFailed, errors.New("upload failed"))
+	if change := tracker.list()[0]; change.State != StateFailed || change.Error != "upload failed" {
+		t.Fatalf("Change state was not updated: %+v", change)
+	}
+
+	tracker.track("remote-id", "/renamed.txt", OpRename, StateInFlight)
+	tracker.done("remote-id", OpCreate)
+	if changes = tracker.list(); len(changes) != 1 || changes[0].Op != OpRename {
+		t.Fatalf("Completing one change affected another: %+v", changes)
+	}
+
+	tracker.track("remote-id", "/renamed.txt", OpDelete, StateInFlight)
+	tracker.done("remote-id", OpDelete)
+	if len(tracker.list()) != 0 {
+		t.Fatal("Changes were still pending after the item was deleted.")
+	}
+}
@@ -0,0 +1,75 @@
+package graph
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// cloud is a Microsoft cloud deployment. National clouds are run separately
+// from the global service and use their own hosts for both sign in and Graph.
+// https://docs.microsoft.com/en-us/graph/deployments
+type cloud struct {
+	loginURL string
+	graphURL string
+}
+
+const defaultCloud = "global"
+
+var clouds = map[string]cloud{
+	"global": {
+		loginURL: "https://login.microsoftonline.com",
+		graphURL: "https://graph.microsoft.com/v1.0",
+	},
+	// US Government L4 (GCC High)
+	"usgov": {
+		loginURL: "https://login.microsoftonline.us",
+		graphURL: "https://graph.microsoft.us/v1.0",
+	},
+	// US Government L5 (DoD)
+	"usgov-dod": {
+		loginURL: "https://login.microsoftonline.us",
+		graphURL: "https://dod-graph.microsoft.us/v1.0",
+	},
+	"germany": {
+		loginURL: "https://login.microsoftonline.de",
+		graphURL: "https://graph.microsoft.de/v1.0",
+	},
+	// operated by 21Vianet
+	"china": {
+		loginURL: "https://login.chinacloudapi.cn",
+		graphURL: "https://microsoftgraph.chinacloudapi.cn/v1.0",
+	},
+}
+
+// Clouds returns the names of all supported clouds.
+func Clouds() []string {
+	names := make([]string, 0, len(clouds))
+	for name := range clouds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ValidateCloud returns an error if name is not a supported cloud.
+func ValidateCloud(name string) error {
+	if _, exists := clouds[name]; name != "" && !exists {
+		return fmt.Errorf("unknown cloud \"%s\", must be one of: %s",
+			name, strings.Join(Clouds(), ", "))
+	}
+	return nil
+}
+
+// cloud returns the configured cloud, or the global cloud if unset.
+func (c AuthConfig) cloud() cloud {
+	if deployment, exists := clouds[c.Cloud]; exists {
+		return deployment
+	}
+	return clouds[defaultCloud]
+}
+
+// graphURL returns the Graph API base URL for the configured cloud.
+func (c AuthConfig) graphURL() string {
+	return c.cloud().graphURL
+}
@@ -0,0 +1,193 @@
+package graph
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	bolt "github.com/etcd-io/bbolt"
+	log "github.com/sirupsen/logrus"
+)
+
+// CONFLICTS is the boltdb bucket used to record items that were changed both
+// locally and remotely.
+var CONFLICTS = []byte("conflicts")
+
+// Conflict records both sides of an item that was modified locally and on the
+// server at the same time. The local content stays in the content cache and
+// the remote content stays on the server until the conflict is resolved.
+type Conflict struct {
+	ID       string    `json:"id"`
+	Path     string    `json:"path,omitempty"` // where the item is now, or was last seen
+	Local    DriveItem `json:"local"`
+	Remote   DriveItem `json:"remote"`
+	Detected time.Time `json:"detected"`
+}
+
+// errConflictOpen is returned when keeping the server's version of a file that
+// is open, its content can't be swapped out from under whoever has it.
+var errConflictOpen = errors.New("file is open, close it first")
+
+// hasLocalChanges returns whether an item has changes that have not made it to
+// the server yet.
+func (c *Cache) hasLocalChanges(inode *Inode) bool {
+	return inode.HasChanges() || (c.uploads != nil && c.uploads.HasPending(inode.ID()))
+}
+
+// markConflict records a conflict between an item's local state and an
+// incoming remote change. Uploads of the item are held until it is resolved.
+func (c *Cache) markConflict(local *Inode, remote *Inode) error {
+	path := local.Path()
+	c.changes.track(local.ID(), path, OpWrite, StateConflicted)
+	local.mutex.Lock()
+	// local changes are persisted so they survive until resolution
+	if local.data != nil {
+		c.insertBuffer(local.IDInternal, local.data)
+	}
+	conflict := Conflict{
+		ID:       local.IDInternal,
+		Path:     path,
+		Local:    local.DriveItem,
+		Detected: time.Now(),
+	}
+	local.mutex.Unlock()
+	remote.mutex.RLock()
+	conflict.Remote = remote.DriveItem
+	remote.mutex.RUnlock()
+
+	log.WithFields(log.Fields{
+		"id":   conflict.ID,
+		"name": conflict.Local.NameInternal,
+	}).Warn("Item was modified both locally and remotely, marking as conflicted.")
+	data, _ := json.Marshal(conflict)
+	return c.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(CONFLICTS)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(conflict.ID), data)
+	})
+}
+
+// IsConflicted returns whether an item has an unresolved conflict.
+func (c *Cache) IsConflicted(id string) bool {
+	conflicted := false
+	c.db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(CONFLICTS); b != nil {
+			conflicted = b.Get([]byte(id)) != nil
+		}
+		return nil
+	})
+	return conflicted
+}
+
+// conflict returns the unresolved conflict of an item, if it has one.
+func (c *Cache) conflict(id string) (Conflict, bool) {
+	var conflict Conflict
+	found := false
+	c.db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(CONFLICTS); b != nil {
+			if data := b.Get([]byte(id)); data != nil {
+				found = json.Unmarshal(data, &conflict) == nil
+			}
+		}
+		return nil
+	})
+	return conflict, found
+}
+
+// Conflicts returns all unresolved conflicts.
+func (c *Cache) Conflicts() []Conflict {
+	conflicts := make([]Conflict, 0)
+	c.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(CONFLICTS)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var conflict Conflict
+			if err := json.Unmarshal(v, &conflict); err == nil {
+				conflicts = append(conflicts, conflict)
+			}
+			return nil
+		})
+	})
+	for i := range conflicts {
+		if local := c.GetID(conflicts[i].ID); local != nil {
+			conflicts[i].Path = local.Path()
+		}
+	}
+	return conflicts
+}
+
+// ResolveConflict clears the conflicted state of an item. Whatever state the
+// item is in locally afterwards is what will be uploaded on the next flush.
+func (c *Cache) ResolveConflict(id string) error {
+	c.changes.setState(id, "", StateQueued, nil)
+	return c.clearConflict(id)
+}
+
+// Resolve settles the conflict of the item at path, by keeping either its
+// local version, which is then uploaded over the server's, or the server's,
+// which replaces the local changes.
+func (c *Cache) Resolve(path string, keep ConflictPolicy) error {
+	var conflict *Conflict
+	for _, found := range c.Conflicts() {
+		if strings.EqualFold(found.Path, path) {
+			conflict = &found
+			break
+		}
+	}
+	if conflict == nil {
+		return fmt.Errorf("%s has no conflict", path)
+	}
+	id := conflict.ID
+	local := c.GetID(id)
+	logger := log.WithFields(log.Fields{
+		"id":   id,
+		"path": path,
+	})
+	if local == nil {
+		// deleted since, neither version is left to keep
+		logger.Warn("Dropping conflict of item that is no longer cached.")
+		if err := c.ResolveConflict(id); err != nil {
+			return err
+		}
+		return fmt.Errorf("%s is no longer cached, its conflict was dropped", path)
+	}
+	switch keep {
+	case ConflictKeepLocal:
+		logger.Info("Resolving conflict by keeping the local version.")
+		c.activity.record(activityLocal, "resolved", path, "(kept the local version)")
+		return c.ResolveConflict(id)
+	case ConflictKeepRemote:
+		if local.HasContent() {
+			return errConflictOpen
+		}
+		logger.Info("Resolving conflict by keeping the server's version.")
+		remote := &Inode{DriveItem: conflict.Remote}
+		c.dropWrite(id)
+		if remote.Deleted != nil {
+			notifyDelete(c.GetID(local.ParentID()), local.Name(), local)
+			c.DeleteID(id)
+			c.DeleteContent(id)
+		} else {
+			c.overwriteContent(local, &conflict.Remote)
+		}
+		c.activity.record(activityLocal, "resolved", path, "(kept the server's version)")
+		return nil
+	}
+	return fmt.Errorf("can't resolve a conflict with %q", keep)
+}
+
+// clearConflict forgets about an item's conflict.
+func (c *Cache) clearConflict(id string) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(CONFLICTS); b != nil {
+			return b.Delete([]byte(id))
+		}
+		return nil
+	})
+}
@@ -0,0 +1,156 @@
+package graph
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ConflictPolicy is how a clash between an offline change and a server change
+// is settled. Renames and deletes can't be kept both ways, so only
+// ConflictKeepLocal makes them win over the server.
+type ConflictPolicy string
+
+// conflict policies
+const (
+	ConflictKeepBoth   ConflictPolicy = "keep-both"
+	ConflictKeepLocal  ConflictPolicy = "keep-local"
+	ConflictKeepRemote ConflictPolicy = "keep-remote"
+)
+
+// conflictPolicies is the policy for the drive, and for the folders that have
+// their own.
+type conflictPolicies struct {
+	global  ConflictPolicy
+	folders map[string]ConflictPolicy // by lowercased path
+}
+
+var conflictPolicy = conflictPolicies{global: ConflictKeepBoth}
+
+// ParseConflictPolicy checks the name of a conflict policy.
+func ParseConflictPolicy(name string) (ConflictPolicy, error) {
+	switch policy := ConflictPolicy(name); policy {
+	case ConflictKeepBoth, ConflictKeepLocal, ConflictKeepRemote:
+		return policy, nil
+	}
+	return "", errors.New("conflict policy must be one of: " + string(ConflictKeepBoth) +
+		", " + string(ConflictKeepLocal) + ", " + string(ConflictKeepRemote))
+}
+
+// SetConflictPolicy sets how changes made offline that clash with changes on the
+// server are settled. folders overrides the policy for folders and everything
+// in them, as "/path/to/folder=policy". Should be called before the filesystem
+// is mounted.
+func SetConflictPolicy(global string, folders []string) error {
+	policies, err := newConflictPolicies(global, folders)
+	if err != nil {
+		return err
+	}
+	conflictPolicy = policies
+	return nil
+}
+
+func newConflictPolicies(global string, folders []string) (conflictPolicies, error) {
+	policies := conflictPolicies{folders: make(map[string]ConflictPolicy)}
+	var err error
+	if policies.global, err = ParseConflictPolicy(global); err != nil {
+		return policies, err
+	}
+	for _, folder := range folders {
+		eq := strings.LastIndex(folder, "=")
+		if eq < 0 || !strings.HasPrefix(folder, "/") {
+			return policies, errors.New("folder conflict policy \"" + folder +
+				"\" must look like /path/to/folder=policy")
+		}
+		policy, err := ParseConflictPolicy(folder[eq+1:])
+		if err != nil {
+			return policies, err
+		}
+		policies.folders[path.Clean(strings.ToLower(folder[:eq]))] = policy
+	}
+	return policies, nil
+}
+
+// forPath returns the policy for an item, which is that of the closest folder
+// above it that has one.
+func (p conflictPolicies) forPath(itemPath string) ConflictPolicy {
+	dir := path.Clean("/" + strings.ToLower(itemPath))
+	for {
+		if policy, exists := p.folders[dir]; exists {
+			return policy
+		}
+		if dir == "/" {
+			break
+		}
+		dir = path.Dir(dir)
+	}
+	if p.global == "" {
+		return ConflictKeepBoth
+	}
+	return p.global
+}
+
+// conflictCopyName is the name the local version of a file is saved under
+// when both versions are kept.
+func conflictCopyName(name string, when time.Time) string {
+	ext := filepath.Ext(name)
+	if ext == name {
+		// dotfiles have no extension
+		ext = ""
+	}
+	return strings.TrimSuffix(name, ext) + " (conflicted copy " +
+		when.Format("2006-01-02 150405") + ")" + ext
+}
+
+// conflictCopy saves the content written to a file while offline as a new file
+// next to it, and uploads it.
+func (c *Cache) conflictCopy(local *Inode, entry walEntry) (*Inode, error) {
+	parent := c.GetID(local.ParentID())
+	if parent == nil {
+		return nil, errors.New("folder of conflicted file not found in cache")
+	}
+	content, err := c.unsavedContent(entry)
+	if err != nil {
+		return nil, err
+	}
+	copied := NewInode(conflictCopyName(local.Name(), time.Now()), local.Mode(), parent)
+	_, err = walLog(c.db, walEntry{
+		Op:       OpCreate,
+		ID:       copied.ID(),
+		ParentID: parent.ID(),
+		Name:     copied.Name(),
+		Mode:     copied.Mode(),
+		ModTime:  copied.modTime(),
+	})
+	if err != nil {
+		content.Close()
+		return nil, err
+	}
+	c.InsertChild(parent.ID(), copied)
+	notifyEntry(parent, copied.Name())
+	c.changes.track(copied.ID(), copied.Path(), OpCreate, StateQueued)
+
+	copied.mutex.Lock()
+	copied.data = content
+	copied.SizeInternal = uint64(content.Size())
+	copied.FileInternal = contentHashes(c.DriveType(), content)
+	copied.mutex.Unlock()
+	if err = copied.logWrite(); err != nil {
+		log.WithFields(log.Fields{
+			"id":  copied.ID(),
+			"err": err,
+		}).Warn("Could not journal content of conflicted copy.")
+	}
+	c.insertBuffer(copied.ID(), content)
+	c.changes.track(copied.ID(), copied.Path(), OpWrite, StateQueued)
+	c.replayUpload(copied, content)
+	notifyEvent("conflict", "Conflicting changes to "+local.Name(),
+		fmt.Sprintf("%s was changed on OneDrive too. Your version was saved as %s.",
+			local.Path(), copied.Name()))
+	return copied, nil
+}
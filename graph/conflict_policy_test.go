@@ -0,0 +1,53 @@
+package graph
+
+import (
+	"testing"
+	"time"
+)
+
+// Folders use the policy of the closest folder above them that has one, and
+// everything else the policy of the drive.
+func TestConflictPolicies(t *testing.T) {
+	t.Parallel()
+	policies, err := newConflictPolicies("keep-remote", []string{
+		"/Documents=keep-local",
+		"/Documents/Shared/=keep-both",
+	})
+	failOnErr(t, err)
+	tests := map[string]ConflictPolicy{
+		"/notes.txt":                     ConflictKeepRemote,
+		"/Documents":                     ConflictKeepLocal,
+		"/documents/report.docx":         ConflictKeepLocal,
+		"/Documents/Shared/budget.xlsx":  ConflictKeepBoth,
+		"/Documents/SharedNot/other.txt": ConflictKeepLocal,
+	}
+	for path, expected := range tests {
+		if policy := policies.forPath(path); policy != expected {
+			t.Errorf("Policy for %s should be %s, got %s.", path, expected, policy)
+		}
+	}
+
+	if _, err := newConflictPolicies("keep-everything", nil); err == nil {
+		t.Error("Unknown policies should be refused.")
+	}
+	if _, err := newConflictPolicies("keep-both", []string{"Documents=keep-local"}); err == nil {
+		t.Error("Folder policies should have to start with \"/\".")
+	}
+}
+
+// Conflicted copies keep the extension of the original, so they still open
+// with the same application.
+func TestConflictCopyName(t *testing.T) {
+	t.Parallel()
+	when := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	tests := map[string]string{
+		"report.docx": "report (conflicted copy 2021-03-04 050607).docx",
+		"Makefile":    "Makefile (conflicted copy 2021-03-04 050607)",
+		".bashrc":     ".bashrc (conflicted copy 2021-03-04 050607)",
+	}
+	for name, expected := range tests {
+		if copied := conflictCopyName(name, when); copied != expected {
+			t.Errorf("Conflicted copy of %s should be %s, got %s.", name, expected, copied)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package graph
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "github.com/etcd-io/bbolt"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// An incoming remote change for an item with unsaved local changes should mark
+// the item as conflicted instead of overwriting the local copy.
+func TestDeltaConflict(t *testing.T) {
+	t.Parallel()
+	cache := NewCache(context.Background(), auth, "test_delta_conflict.db")
+	root, _ := cache.GetPath("/", auth)
+	local := NewInode("conflicted", 0644, root)
+	cache.InsertChild(root.ID(), local)
+	localContent := []byte("local changes")
+	data, err := bufferOf(localContent)
+	failOnErr(t, err)
+	local.mutex.Lock()
+	local.data = data
+	local.SizeInternal = uint64(len(localContent))
+	local.hasChanges = true
+	local.mutex.Unlock()
+
+	remote := NewInode("conflicted", 0644, root)
+	remote.IDInternal = local.ID()
+	remote.SizeInternal = 100
+	remote.FileInternal = &File{Hashes: Hashes{SHA1Hash: "remote"}}
+	later := local.ModTimeInternal.Add(time.Minute)
+	remote.ModTimeInternal = &later
+	failOnErr(t, cache.applyDelta(remote))
+
+	if !cache.IsConflicted(local.ID()) {
+		t.Fatal("Item was not marked as conflicted.")
+	}
+	if !bytes.Equal(cache.GetContent(local.ID()), localContent) {
+		t.Fatal("Local content was not preserved.")
+	}
+	conflicts := cache.Conflicts()
+	if len(conflicts) != 1 || conflicts[0].Remote.SizeInternal != 100 {
+		t.Fatal("Remote version was not recorded.")
+	}
+
+	failOnErr(t, cache.ResolveConflict(local.ID()))
+	if cache.IsConflicted(local.ID()) {
+		t.Fatal("Conflict was not resolved.")
+	}
+}
+
+// Uploads of a conflicted file are held until the conflict is resolved. Keeping
+// the local version lets them go, keeping the server's drops the local changes.
+func TestResolveConflict(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "onedriver-resolve-")
+	failOnErr(t, err)
+	defer os.RemoveAll(dir)
+	failOnErr(t, os.Mkdir(filepath.Join(dir, "blobs"), 0700))
+	db, err := bolt.Open(filepath.Join(dir, "resolve.db"), 0600,
+		&bolt.Options{Timeout: time.Second * 5})
+	failOnErr(t, err)
+	defer db.Close()
+	failOnErr(t, db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{METADATA, WAL, JOURNAL, ACCESSED, PARTIAL, UPLOADS} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes := newChangeTracker()
+	cache := &Cache{
+		db:         db,
+		contentDir: dir,
+		metadata:   newShardedMap(),
+		changes:    changes,
+		uploads:    NewUploadManager(ctx, time.Hour, nil, changes, nil),
+	}
+	cache.uploads.held = cache.IsConflicted
+	root := NewInode("root", 0755|fuse.S_IFDIR, nil)
+	cache.InsertID(root.ID(), root)
+	cache.root = root.ID()
+
+	conflicted := func(name string) *Inode {
+		local := NewInode(name, 0644|fuse.S_IFREG, root)
+		local.IDInternal = "01" + name
+		cache.InsertChild(root.ID(), local)
+		data, err := bufferOf([]byte("local changes"))
+		failOnErr(t, err)
+		local.data = data
+		remote := NewInode(name, 0644|fuse.S_IFREG, root)
+		remote.IDInternal = local.ID()
+		remote.SizeInternal = 100
+		failOnErr(t, cache.markConflict(local, remote))
+		// closed since
+		local.data.Close()
+		local.data = nil
+		if !cache.uploads.held(local.ID()) {
+			t.Fatalf("Upload of conflicted %s is not held.", name)
+		}
+		return local
+	}
+
+	mine := conflicted("mine.txt")
+	failOnErr(t, cache.Resolve("/MINE.txt", ConflictKeepLocal))
+	if cache.uploads.held(mine.ID()) {
+		t.Error("Upload is still held after keeping the local version.")
+	}
+	if len(cache.GetContent(mine.ID())) == 0 {
+		t.Error("Local version was not kept.")
+	}
+
+	theirs := conflicted("theirs.txt")
+	failOnErr(t, cache.Resolve("/theirs.txt", ConflictKeepRemote))
+	if cache.IsConflicted(theirs.ID()) || cache.hasCachedContent(theirs.ID()) ||
+		theirs.Size() != 100 {
+		t.Error("The server's version was not kept.")
+	}
+	if err := cache.Resolve("/theirs.txt", ConflictKeepLocal); err == nil {
+		t.Error("Resolved a conflict that was resolved already.")
+	}
+
+	// the path is remembered with the conflict, the item may be gone since
+	gone := conflicted("gone.txt")
+	cache.DeleteID(gone.ID())
+	if err := cache.Resolve("/gone.txt", ConflictKeepRemote); err == nil {
+		t.Error("Resolving the conflict of an item that is gone did not say so.")
+	}
+	if cache.IsConflicted(gone.ID()) {
+		t.Error("Conflict of an item that is gone was kept.")
+	}
+}
@@ -0,0 +1,227 @@
+package graph
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	bolt "github.com/etcd-io/bbolt"
+	log "github.com/sirupsen/logrus"
+)
+
+// JOURNAL is the boltdb bucket used to track content writes that are in
+// progress. Any IDs still present on startup were interrupted by a crash.
+var JOURNAL = []byte("journal")
+
+// ContentDir returns the directory used to store file content for a given
+// database path.
+func ContentDir(dbPath string) string {
+	return strings.TrimSuffix(dbPath, filepath.Ext(dbPath)) + "-content"
+}
+
+// contentPath is where an item's content lives on disk
+func (c *Cache) contentPath(id string) string {
+	return filepath.Join(c.contentDir, id)
+}
+
+// GetContent reads a file's content from disk.
+func (c *Cache) GetContent(id string) []byte {
+	content, err := ioutil.ReadFile(c.contentPath(id))
+	if err != nil {
+		return nil
+	}
+	return content
+}
+
+// contentBuffer loads a file's content from disk into a buffer.
+func (c *Cache) contentBuffer(id string) (*buffer, error) {
+	file, err := os.Open(c.contentPath(id))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return newBuffer(file)
+}
+
+// setJournal marks a content write as being in-progress (or not).
+func (c *Cache) setJournal(id string, inProgress bool) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(JOURNAL)
+		if inProgress {
+			return b.Put([]byte(id), []byte{})
+		}
+		return b.Delete([]byte(id))
+	})
+}
+
+// blobPath is where content with a given hash lives on disk. Item content
+// files are hard links to these blobs, so identical files share the same
+// storage and the link count of a blob acts as its reference count.
+func (c *Cache) blobPath(hash string) string {
+	return filepath.Join(c.contentDir, "blobs", hash)
+}
+
+// syncDir makes renames/links within a directory durable
+func syncDir(path string) {
+	if dir, err := os.Open(path); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+}
+
+// writeAtomic writes content to a temporary file and syncs it before
+// atomically renaming it into place, so readers only ever see complete content.
+func writeAtomic(path string, content io.Reader) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(tmp, content); err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	syncDir(filepath.Dir(path))
+	return nil
+}
+
+// linkBlob links an item's content path to the blob for a hash, creating the
+// blob from content if it does not already exist.
+func (c *Cache) linkBlob(id string, hash string, content func() io.Reader) error {
+	blob := c.blobPath(hash)
+	if _, err := os.Stat(blob); os.IsNotExist(err) {
+		if err = writeAtomic(blob, content()); err != nil {
+			return err
+		}
+	}
+
+	// link under a temporary name first so the final rename is atomic
+	tmp := c.contentPath(id) + "." + randString(8) + ".tmp"
+	if err := os.Link(blob, tmp); err != nil {
+		return err
+	}
+	err := os.Rename(tmp, c.contentPath(id))
+	// rename is a no-op if both names already point to the same blob
+	os.Remove(tmp)
+	if err != nil {
+		return err
+	}
+	syncDir(c.contentDir)
+	return nil
+}
+
+// InsertContent writes file content to disk. Content is deduplicated by hash,
+// and writes are atomic: readers only ever see complete content.
+func (c *Cache) InsertContent(id string, content []byte) error {
+	return c.insertContent(id, SHA1Hash(&content), func() io.Reader {
+		return bytes.NewReader(content)
+	})
+}
+
+// insertBuffer is InsertContent for content held in a buffer.
+func (c *Cache) insertBuffer(id string, content *buffer) error {
+	hash, err := hashReader(sha1.New(), content.Reader())
+	if err != nil {
+		return err
+	}
+	return c.insertContent(id, hash, content.Reader)
+}
+
+// insertContent writes content with a given SHA1 hash to disk.
+func (c *Cache) insertContent(id string, hash string, content func() io.Reader) error {
+	if err := c.setJournal(id, true); err != nil {
+		return err
+	}
+	err := c.linkBlob(id, hash, content)
+	if os.IsNotExist(err) {
+		// blob was garbage collected out from underneath us, try again
+		err = c.linkBlob(id, hash, content)
+	}
+	if err != nil {
+		return err
+	}
+	c.accessed.touch(id)
+	return c.setJournal(id, false)
+}
+
+// collectBlobs removes content blobs that are no longer referenced by any
+// item. Returns the number of blobs removed.
+func (c *Cache) collectBlobs() int {
+	blobs, _ := ioutil.ReadDir(filepath.Join(c.contentDir, "blobs"))
+	removed := 0
+	for _, blob := range blobs {
+		if strings.HasSuffix(blob.Name(), ".tmp") {
+			continue
+		}
+		st, ok := blob.Sys().(*syscall.Stat_t)
+		if ok && st.Nlink <= 1 {
+			os.Remove(c.blobPath(blob.Name()))
+			removed++
+		}
+	}
+	return removed
+}
+
+// DeleteContent deletes content from disk. It forgets the partial download and
+// access time of the item in the db as well, so it must not be called while a
+// bolt transaction is open: bolt has a single writer, and it would wait on that
+// transaction forever.
+func (c *Cache) DeleteContent(id string) error {
+	c.dropPartial(id)
+	c.accessed.forget(id)
+	err := os.Remove(c.contentPath(id))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// MoveContent moves content from one ID to another
+func (c *Cache) MoveContent(oldID string, newID string) error {
+	c.accessed.move(oldID, newID)
+	return os.Rename(c.contentPath(oldID), c.contentPath(newID))
+}
+
+// recoverContent cleans up after content writes that were interrupted by a
+// crash. Temporary files are removed, and content for any item whose write was
+// still journaled is discarded so it will be refetched.
+func (c *Cache) recoverContent() {
+	tmps, _ := filepath.Glob(filepath.Join(c.contentDir, "*.tmp"))
+	blobTmps, _ := filepath.Glob(filepath.Join(c.contentDir, "blobs", "*.tmp"))
+	for _, tmp := range append(tmps, blobTmps...) {
+		os.Remove(tmp)
+	}
+
+	interrupted := make([]string, 0)
+	c.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(JOURNAL)
+		b.ForEach(func(k, v []byte) error {
+			interrupted = append(interrupted, string(k))
+			return nil
+		})
+		for _, id := range interrupted {
+			b.Delete([]byte(id))
+		}
+		return nil
+	})
+	// DeleteContent writes to the db itself, which would wait on the
+	// transaction above forever
+	for _, id := range interrupted {
+		log.WithField("id", id).Warn(
+			"Content write was interrupted, discarding cached content.")
+		c.DeleteContent(id)
+	}
+}
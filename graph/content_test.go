@@ -0,0 +1,112 @@
+package graph
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "github.com/etcd-io/bbolt"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// Identical content stored for two items should share a single blob on disk,
+// and that blob should only be collected after both items are gone.
+func TestContentDeduplication(t *testing.T) {
+	t.Parallel()
+	cache := NewCache(context.Background(), auth, "test_content_deduplication.db")
+	content := []byte("some content that is stored twice")
+	failOnErr(t, cache.InsertContent("dedup-a", content))
+	failOnErr(t, cache.InsertContent("dedup-b", content))
+
+	a, err := os.Stat(cache.contentPath("dedup-a"))
+	failOnErr(t, err)
+	b, err := os.Stat(cache.contentPath("dedup-b"))
+	failOnErr(t, err)
+	if !os.SameFile(a, b) {
+		t.Fatal("Identical content was not deduplicated.")
+	}
+	if !bytes.Equal(cache.GetContent("dedup-b"), content) {
+		t.Fatal("Deduplicated content did not match.")
+	}
+
+	blob := cache.blobPath(SHA1Hash(&content))
+	failOnErr(t, cache.DeleteContent("dedup-a"))
+	cache.collectBlobs()
+	if _, err := os.Stat(blob); err != nil {
+		t.Fatal("Blob was collected while still referenced.")
+	}
+	failOnErr(t, cache.DeleteContent("dedup-b"))
+	cache.collectBlobs()
+	if _, err := os.Stat(blob); !os.IsNotExist(err) {
+		t.Fatal("Unreferenced blob was not collected.")
+	}
+}
+
+// Content whose write was interrupted by a crash should be discarded when the
+// cache starts again, without the start hanging on the database.
+func TestRecoverInterruptedContent(t *testing.T) {
+	dbPath := "test_recover_interrupted_content.db"
+	os.RemoveAll(dbPath)
+	os.RemoveAll(ContentDir(dbPath))
+	db, err := bolt.Open(dbPath, 0600, &bolt.Options{Timeout: time.Second * 5})
+	failOnErr(t, err)
+	root := NewInode("root", 0755|fuse.S_IFDIR, nil)
+	root.IDInternal = "01RECOVERROOT"
+	failOnErr(t, db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{METADATA, DELTA, JOURNAL, ACCESSED, PARTIAL} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		tx.Bucket(METADATA).Put([]byte("root"), root.AsJSON())
+		tx.Bucket(METADATA).Put([]byte(root.ID()), root.AsJSON())
+		tx.Bucket(DELTA).Put([]byte("deltaLink"), []byte("/me/drive/root/delta?token=recover"))
+		tx.Bucket(ACCESSED).Put([]byte("01TORN"), []byte("0"))
+		tx.Bucket(PARTIAL).Put([]byte("01TORN"), []byte("{}"))
+		return tx.Bucket(JOURNAL).Put([]byte("01TORN"), []byte("1"))
+	}))
+	db.Close()
+	failOnErr(t, os.MkdirAll(ContentDir(dbPath), 0700))
+	torn := filepath.Join(ContentDir(dbPath), "01TORN")
+	failOnErr(t, ioutil.WriteFile(torn, []byte("half written"), 0600))
+
+	// start offline, whether or not the network is there
+	token := "recover-interrupted-content"
+	proxy := transport.Proxy
+	transport.Proxy = func(req *http.Request) (*url.URL, error) {
+		if req.Header.Get("Authorization") == "bearer "+token {
+			return url.Parse("http://127.0.0.1:1")
+		}
+		return proxy(req)
+	}
+	defer func() { transport.Proxy = proxy }()
+	recoverAuth := &Auth{AccessToken: token, ExpiresAt: time.Now().Add(time.Hour).Unix()}
+
+	started := make(chan *Cache)
+	go func() {
+		started <- NewSourceCache(context.Background(), recoverAuth, dbPath, Source{})
+	}()
+	var cache *Cache
+	select {
+	case cache = <-started:
+	case <-time.After(30 * time.Second):
+		t.Fatal("Starting with an interrupted content write hung.")
+	}
+	defer cache.Shutdown(time.Second)
+
+	if _, err := os.Stat(torn); !os.IsNotExist(err) {
+		t.Error("Content of an interrupted write was not discarded.")
+	}
+	cache.db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(JOURNAL).Get([]byte("01TORN")) != nil {
+			t.Error("Interrupted write is still journaled.")
+		}
+		return nil
+	})
+}
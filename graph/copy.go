@@ -0,0 +1,118 @@
+package graph
+
+import (
+	"context"
+	"math"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	log "github.com/sirupsen/logrus"
+)
+
+// CopyFileRange copies content from this file to another. Only copies of the
+// entire file to the start of an empty file are done on the server, anything
+// else gets EOPNOTSUPP so the kernel copies through reads and writes instead.
+func (i *Inode) CopyFileRange(ctx context.Context, fhIn fs.FileHandle, offIn uint64,
+	out *fs.Inode, fhOut fs.FileHandle, offOut uint64, length uint64,
+	flags uint64) (uint32, syscall.Errno) {
+	defer i.timeOp("COPY_FILE_RANGE", "")()
+	dest, ok := out.Operations().(*Inode)
+	if !ok {
+		return 0, syscall.EOPNOTSUPP
+	}
+	id := i.ID()
+	destID := dest.ID()
+	log.WithFields(log.Fields{
+		"id":     id,
+		"path":   i.Path(),
+		"destID": destID,
+		"dest":   dest.Path(),
+		"offIn":  offIn,
+		"offOut": offOut,
+		"length": length,
+	}).Debug()
+
+	cache := i.GetCache()
+	if cache.IsOffline() || cache.IsReadOnly() {
+		return 0, syscall.EOPNOTSUPP
+	}
+	size := i.Size()
+	if offIn != 0 || offOut != 0 || length < size || size == 0 || size > math.MaxUint32 {
+		// the result of a server side copy is always a whole file
+		return 0, syscall.EOPNOTSUPP
+	}
+	if dest.Size() != 0 || dest.IsDir() || isLocalID(dest.ParentID()) {
+		return 0, syscall.EOPNOTSUPP
+	}
+	if driveOf(id) != driveOf(dest.ParentID()) || isSharedFolder(dest.ParentID()) {
+		// copies stay in the drive of the original
+		return 0, syscall.EOPNOTSUPP
+	}
+	if isLocalID(id) || i.HasChanges() || cache.uploads.HasPending(id) {
+		// the server doesn't have the content we would be copying
+		return 0, syscall.EOPNOTSUPP
+	}
+	if cache.uploads.HasPending(destID) || cache.IsConflicted(destID) {
+		return 0, syscall.EOPNOTSUPP
+	}
+
+	auth := cache.GetAuth()
+	newID, err := Copy(id, dest.Name(), dest.ParentID(), auth)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"id":   id,
+			"dest": dest.Path(),
+			"err":  err,
+		}).Warn("Server side copy failed, falling back to a regular copy.")
+		return 0, syscall.EOPNOTSUPP
+	}
+	item, err := GetItem(newID, auth)
+	if err != nil {
+		// the copy exists, so a fallback would only be overwritten later by
+		// delta sync, assume it matches the original
+		log.WithFields(log.Fields{
+			"id":  newID,
+			"err": err,
+		}).Warn("Could not fetch metadata of copied item.")
+		item = NewInode(dest.Name(), 0644, nil)
+		i.mutex.RLock()
+		item.SizeInternal = i.SizeInternal
+		item.FileInternal = i.FileInternal
+		i.mutex.RUnlock()
+	}
+
+	// the destination now points at the copy, its content will be fetched
+	// like any other remote file's the next time it gets read
+	dest.mutex.Lock()
+	dest.hasChanges = false
+	if dest.stream != nil {
+		dest.stream.Cancel()
+		dest.stream = nil
+	}
+	if dest.data != nil {
+		dest.data.Close()
+		dest.data = nil
+	}
+	dest.SizeInternal = item.SizeInternal
+	dest.FileInternal = item.FileInternal
+	dest.ETag = item.ETag
+	if item.ModTimeInternal != nil {
+		dest.ModTimeInternal = item.ModTimeInternal
+	}
+	dest.mutex.Unlock()
+
+	if destID != newID {
+		if err := cache.MoveID(destID, newID); err != nil {
+			log.WithFields(log.Fields{
+				"id":    destID,
+				"newID": newID,
+				"err":   err,
+			}).Error("Could not move copied item to its new ID.")
+			return 0, syscall.EIO
+		}
+		cache.DeleteContent(newID)
+	}
+	cache.changes.done(newID, "")
+	cache.activity.record(activityLocal, "copied", i.Path(), activityMove(dest.Path()))
+	return uint32(size), 0
+}
@@ -0,0 +1,64 @@
+package graph
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// The server reports a copy in progress a few times before it completes.
+func TestWaitForCopy(t *testing.T) {
+	t.Parallel()
+	polls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" {
+			t.Error("Monitor URL was sent an access token.")
+		}
+		polls++
+		if polls < 3 {
+			fmt.Fprint(w, `{"status":"inProgress","percentageComplete":50}`)
+			return
+		}
+		fmt.Fprint(w, `{"status":"completed","resourceId":"copied-id"}`)
+	}))
+	defer server.Close()
+
+	id, err := waitForCopy(server.URL, time.Minute)
+	failOnErr(t, err)
+	if id != "copied-id" {
+		t.Fatalf("Wrong ID for copy: %s", id)
+	}
+	if polls != 3 {
+		t.Fatalf("Monitor was polled %d times instead of 3.", polls)
+	}
+}
+
+// A monitor that redirects to the finished copy is not followed.
+func TestWaitForCopyRedirect(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", "https://example.com/v1.0/drives/abc/items/copied-id")
+		w.WriteHeader(http.StatusSeeOther)
+	}))
+	defer server.Close()
+
+	id, err := waitForCopy(server.URL, time.Minute)
+	failOnErr(t, err)
+	if id != "copied-id" {
+		t.Fatalf("Wrong ID for copy: %s", id)
+	}
+}
+
+func TestWaitForCopyFailed(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"status":"failed"}`)
+	}))
+	defer server.Close()
+
+	if _, err := waitForCopy(server.URL, time.Minute); err == nil {
+		t.Fatal("A failed copy was not reported as an error.")
+	}
+}
@@ -1,78 +1,173 @@
 package graph
 
 import (
-	"context"
 	"encoding/json"
 	"errors"
+	"math/rand"
+	"path/filepath"
 	"strings"
 	"time"
 
-	bolt "github.com/etcd-io/bbolt"
 	log "github.com/sirupsen/logrus"
 )
 
+// delta polling backoff bounds used when polls fail
+const (
+	minDeltaBackoff = 2 * time.Second
+	maxDeltaBackoff = 5 * time.Minute
+)
+
+// nextBackoff doubles a backoff duration, up to maxDeltaBackoff
+func nextBackoff(backoff time.Duration) time.Duration {
+	if backoff < minDeltaBackoff {
+		return minDeltaBackoff
+	}
+	if backoff *= 2; backoff > maxDeltaBackoff {
+		return maxDeltaBackoff
+	}
+	return backoff
+}
+
+// withJitter randomizes a duration by up to +/- 20% so that multiple clients
+// recovering from the same outage don't all hit the server at once.
+func withJitter(d time.Duration) time.Duration {
+	spread := int64(d) / 5
+	if spread <= 0 {
+		return d
+	}
+	return d + time.Duration(rand.Int63n(2*spread)-spread)
+}
+
+// SetPollInterval sets how often the server is polled for changes. It can be
+// changed while mounted, the next poll happens right away either way.
+func (c *Cache) SetPollInterval(interval time.Duration) {
+	c.Lock()
+	c.pollInterval = interval
+	c.Unlock()
+	c.TriggerDeltas()
+}
+
+// getPollInterval returns how often the server is polled for changes.
+func (c *Cache) getPollInterval() time.Duration {
+	c.RLock()
+	defer c.RUnlock()
+	return c.pollInterval
+}
+
 // deltaLoop should be called as a goroutine
-func (c *Cache) deltaLoop(interval time.Duration) {
+func (c *Cache) deltaLoop() {
+	defer c.workers.Done()
 	log.Trace("Starting delta goroutine.")
-	for { // eva
+	var backoff time.Duration
+	for c.ctx.Err() == nil { // eva (or until shutdown)
+		interval := c.getPollInterval()
+		if c.IsPaused() {
+			// woken early by Resume()
+			c.waitForDeltas(interval)
+			continue
+		}
+
 		// get deltas
 		log.Debug("Fetching deltas from server.")
 		pollSuccess := false
-		deltas := make(map[string]*Inode)
+		var retryAfter time.Duration
+		incomingDeltas := make([]*Inode, 0)
 		for {
 			incoming, cont, err := c.pollDeltas(c.GetAuth())
 			if err != nil {
+				if throttled, wait := IsThrottled(err); throttled {
+					// the server is fine, it just wants us to slow down
+					log.WithFields(log.Fields{
+						"err":        err,
+						"retryAfter": wait,
+					}).Warn("Delta fetch was throttled by the server.")
+					retryAfter = wait
+					break
+				}
 				// the only thing that should be able to bring the FS out
 				// of a read-only state is a successful delta call
 				log.WithField("err", err).Error(
 					"Error during delta fetch, marking fs as offline.",
 				)
-				c.Lock()
-				c.offline = true
-				c.Unlock()
+				c.setOffline(true, err)
 				break
 			}
 
-			for _, delta := range incoming {
-				// As per the API docs, the last delta received from the server
-				// for an item is the one we should use.
-				deltas[delta.ID()] = delta
-			}
+			incomingDeltas = append(incomingDeltas, incoming...)
 			if !cont {
-				log.Infof("Fetched %d deltas.", len(deltas))
+				log.Infof("Fetched %d deltas.", len(incomingDeltas))
 				pollSuccess = true
 				break
 			}
 		}
 
-		// now apply deltas
-		for _, delta := range deltas {
+		// now apply deltas, once per item
+		c.markSeen(incomingDeltas)
+		for _, delta := range dedupeDeltas(incomingDeltas) {
 			c.applyDelta(delta)
 		}
+		if len(incomingDeltas) > 0 {
+			// pinned files may have changed and need downloading again
+			c.triggerPins()
+		}
+		if pollSuccess && c.isResyncing() {
+			c.finishResync()
+		}
+		if pollSuccess {
+			// deltas don't cover other people's drives
+			c.refreshShared(c.GetAuth())
+		}
 
 		if !c.IsOffline() {
 			c.SerializeAll()
 		}
 
 		if pollSuccess {
-			c.Lock()
-			if c.offline {
-				log.Info("Delta fetch success, marking fs as online.")
-			}
-			c.offline = false
-			c.Unlock()
+			c.counters.delta(time.Now())
+			c.setOffline(false, nil)
 
-			c.db.Update(func(tx *bolt.Tx) error {
-				return tx.Bucket(DELTA).Put([]byte("deltaLink"), []byte(c.deltaLink))
-			})
+			c.saveDeltaLink()
 
-			// wait until next interval
-			time.Sleep(interval)
-		} else {
-			// shortened duration while offline
-			time.Sleep(2 * time.Second)
+			// back to normal cadence, wait until next interval (or until a
+			// change notification arrives)
+			backoff = 0
+			c.waitForDeltas(interval)
+			continue
+		}
+
+		// poll failed, back off before trying again (honoring the server's
+		// Retry-After if it sent one)
+		backoff = nextBackoff(backoff)
+		wait := withJitter(backoff)
+		if c.IsOffline() {
+			wait = offlineBackoff(wait)
+		}
+		if retryAfter > wait {
+			wait = retryAfter
 		}
+		log.WithField("wait", wait).Debug("Delta fetch failed, backing off.")
+		sleepContext(c.ctx, wait)
 	}
+	log.Trace("Delta goroutine stopped.")
+}
+
+// dedupeDeltas reduces a polling cycle's worth of deltas to a single delta per
+// item. As per the API docs, the last delta received from the server for an
+// item is the one we should use. Each item keeps the position it was first seen
+// in, so that parents are still applied before their children.
+func dedupeDeltas(deltas []*Inode) []*Inode {
+	index := make(map[string]int)
+	deduped := make([]*Inode, 0, len(deltas))
+	for _, delta := range deltas {
+		id := delta.ID()
+		if i, exists := index[id]; exists {
+			deduped[i] = delta
+			continue
+		}
+		index[id] = len(deduped)
+		deduped = append(deduped, delta)
+	}
+	return deduped
 }
 
 type deltaResponse struct {
@@ -81,28 +176,58 @@ type deltaResponse struct {
 	Values    []*Inode `json:"value,omitempty"`
 }
 
+// GetDeltaLink asks the server for a delta link to follow changes made to
+// source from now on, the same way a new cache starts out.
+func GetDeltaLink(source Source, auth *Auth) (string, error) {
+	resource := source.resource() + "/root/delta?token=latest"
+	for {
+		resp, err := Get(resource, auth)
+		if err != nil {
+			return "", err
+		}
+		page := deltaResponse{}
+		if err = json.Unmarshal(resp, &page); err != nil {
+			return "", err
+		}
+		if page.NextLink == "" {
+			if page.DeltaLink == "" {
+				return "", errors.New("server did not return a delta link")
+			}
+			return strings.TrimPrefix(page.DeltaLink, auth.graphURL()), nil
+		}
+		resource = strings.TrimPrefix(page.NextLink, auth.graphURL())
+	}
+}
+
 // Polls the delta endpoint and return deltas + whether or not to continue
-// polling. Does not perform deduplication. Note that changes from the local
+// polling. Does not perform deduplication (see dedupeDeltas). Note that changes from the local
 // client will actually appear as deltas from the server (there is no
 // distinction between local and remote changes from the server's perspective,
 // everything is a delta, regardless of where it came from).
 func (c *Cache) pollDeltas(auth *Auth) ([]*Inode, bool, error) {
 	resp, err := Get(c.deltaLink, auth)
 	if err != nil {
+		var graphErr *GraphError
+		if errors.As(err, &graphErr) && graphErr.StatusCode == 410 && !c.isResyncing() {
+			// our delta token has expired, start over from scratch
+			c.startResync(graphErr.Location)
+			return c.pollDeltas(auth)
+		}
 		return make([]*Inode, 0), false, err
 	}
 
 	page := deltaResponse{}
 	json.Unmarshal(resp, &page)
+	c.source.adopt(page.Values)
 
 	// If the server does not provide a `@odata.nextLink` item, it means we've
 	// reached the end of this polling cycle and should not continue until the
 	// next poll interval.
 	if page.NextLink != "" {
-		c.deltaLink = strings.TrimPrefix(page.NextLink, graphURL)
+		c.deltaLink = strings.TrimPrefix(page.NextLink, auth.graphURL())
 		return page.Values, true, nil
 	}
-	c.deltaLink = strings.TrimPrefix(page.DeltaLink, graphURL)
+	c.deltaLink = strings.TrimPrefix(page.DeltaLink, auth.graphURL())
 	return page.Values, false, nil
 }
 
@@ -123,7 +248,24 @@ func (c *Cache) applyDelta(delta *Inode) error {
 
 	// do we have it at all?
 	parentID := delta.ParentID()
-	if parent := c.GetID(parentID); parent == nil {
+	parent := c.GetID(parentID)
+	if parent == nil {
+		if local := c.GetID(id); local != nil && id != c.root &&
+			local.ParentID() != parentID && !c.hasLocalChanges(local) {
+			// Moved into a folder we have not cached, or out of the folder
+			// served. It is fetched again from where it is now when that
+			// folder gets listed.
+			log.WithFields(log.Fields{
+				"id":       id,
+				"parentID": parentID,
+				"name":     name,
+				"delta":    "delete",
+			}).Info("Item was moved to a folder that is not cached, removing it.")
+			defer notifyDelete(c.GetID(local.ParentID()), local.Name(), local)
+			c.DeleteID(id)
+			c.DeleteContent(id)
+			return nil
+		}
 		// Nothing needs to be applied, item not in cache, so latest copy will
 		// be pulled down next time it's accessed.
 		log.WithFields(log.Fields{
@@ -134,6 +276,20 @@ func (c *Cache) applyDelta(delta *Inode) error {
 		}).Trace("Skipping delta, item's parent not in cache.")
 		return nil
 	}
+	if excluded(parent.Path(), name) {
+		// moved into an excluded folder is as good as deleted
+		if local := c.GetID(id); local != nil && !c.hasLocalChanges(local) {
+			log.WithFields(log.Fields{
+				"id":    id,
+				"name":  name,
+				"delta": "exclude",
+			}).Info("Item is excluded from the filesystem, removing it.")
+			defer notifyDelete(c.GetID(local.ParentID()), local.Name(), local)
+			c.DeleteID(id)
+			c.DeleteContent(id)
+		}
+		return nil
+	}
 
 	// was it deleted?
 	if delta.Deleted != nil {
@@ -145,7 +301,27 @@ func (c *Cache) applyDelta(delta *Inode) error {
 			"name":  name,
 			"delta": "delete",
 		}).Info("Applying server-side deletion of item.")
+		// any cached descendants are cleaned up by the garbage collector
+		if local := c.GetID(id); local != nil {
+			if c.hasLocalChanges(local) {
+				// changes made offline would be lost, keep them around
+				log.WithFields(log.Fields{
+					"id":    id,
+					"name":  name,
+					"delta": "conflict",
+				}).Info("Local item has unsaved changes, not deleting.")
+				err := c.markConflict(local, delta)
+				c.activity.record(activityRemote, "conflicted", local.Path(), "(deleted on the server)")
+				c.fireRemoteChange(delta, ChangeConflicted)
+				return err
+			}
+			defer notifyDelete(c.GetID(local.ParentID()), local.Name(), local)
+			c.recycle(local)
+		}
+		c.activity.record(activityRemote, "deleted", filepath.Join(parent.Path(), name), "")
 		c.DeleteID(id)
+		c.DeleteContent(id)
+		c.fireRemoteChange(delta, ChangeDeleted)
 		return nil
 	}
 
@@ -153,14 +329,35 @@ func (c *Cache) applyDelta(delta *Inode) error {
 	// appropriate parent
 	local := c.GetID(id)
 	if local == nil {
-		log.WithFields(log.Fields{
-			"id":       id,
-			"parentID": parentID,
-			"name":     name,
-			"delta":    "create",
-		}).Info("Creating inode from delta.")
-		c.InsertChild(parentID, delta)
-		return nil
+		// The item may already be cached under a local ID if it was created
+		// locally and this is the server telling us about our own upload, or
+		// about a folder of the same name as one made while offline.
+		if sibling, _ := c.GetChild(parentID, name, c.GetAuth()); sibling != nil &&
+			isLocalID(sibling.ID()) && sibling.IsDir() == delta.IsDir() {
+			log.WithFields(log.Fields{
+				"id":      id,
+				"localID": sibling.ID(),
+				"name":    name,
+				"delta":   "adopt",
+			}).Info("Item cached under a local ID, moving to server ID.")
+			if err := c.MoveID(sibling.ID(), id); err != nil {
+				return err
+			}
+			local = sibling
+		} else {
+			log.WithFields(log.Fields{
+				"id":       id,
+				"parentID": parentID,
+				"name":     name,
+				"delta":    "create",
+			}).Info("Creating inode from delta.")
+			c.InsertChild(parentID, delta)
+			c.activity.record(activityRemote, "created", filepath.Join(parent.Path(), name), "")
+			// the kernel may have cached the name as nonexistent
+			notifyEntry(parent, name)
+			c.fireRemoteChange(delta, ChangeCreated)
+			return nil
+		}
 	}
 
 	// was the item moved?
@@ -173,9 +370,10 @@ func (c *Cache) applyDelta(delta *Inode) error {
 			"id":        id,
 			"delta":     "rename",
 		}).Info("Applying server-side rename")
-		parent := c.GetID(local.ParentID())
+		oldParent := c.GetID(local.ParentID())
+		oldName := local.Name()
 		newParent := c.GetID(parentID)
-		if parent == nil || newParent == nil {
+		if oldParent == nil || newParent == nil {
 			log.WithFields(log.Fields{
 				"parent":    local.ParentID(),
 				"name":      local.Name(),
@@ -186,7 +384,22 @@ func (c *Cache) applyDelta(delta *Inode) error {
 			}).Error("Either original parent or new parent not found in cache!")
 			return errors.New("Parent not in cache")
 		}
-		parent.Rename(context.Background(), local.Name(), newParent, name, 0)
+		// This is a purely local operation. The server already has the change,
+		// so we must not go through Inode.Rename() (which would perform the
+		// rename remotely a second time).
+		c.DeleteID(id)
+		local.mutex.Lock()
+		local.NameInternal = name
+		local.DriveItem.Parent = &DriveItemParent{
+			ID:   parentID,
+			Path: newParent.Path(),
+		}
+		local.mutex.Unlock()
+		c.InsertID(id, local)
+		notifyMove(oldParent, oldName, newParent, name)
+		c.activity.record(activityRemote, "renamed", filepath.Join(oldParent.Path(), oldName),
+			activityMove(filepath.Join(newParent.Path(), name)))
+		c.fireRemoteChange(delta, ChangeMoved)
 		// do not return, there may be additional changes
 	}
 
@@ -199,20 +412,50 @@ func (c *Cache) applyDelta(delta *Inode) error {
 	//
 	// Do not sync if the file size is 0, as this is likely a file in the
 	// progress of being uploaded (also, no need to sync empty files).
-	if delta.ModTime() > local.ModTime() && delta.Size() > 0 {
-		//TODO check if local has changes and rename the server copy if so
+	if !delta.IsDir() && delta.Size() > 0 && delta.ModTime() > local.ModTime() &&
+		!local.hashesMatch(delta) {
+		if c.hasLocalChanges(local) {
+			// neither side can win automatically, keep both versions
+			log.WithFields(log.Fields{
+				"id":    id,
+				"name":  name,
+				"delta": "conflict",
+			}).Info("Local item has unsaved changes, not overwriting.")
+			err := c.markConflict(local, delta)
+			c.activity.record(activityRemote, "conflicted", local.Path(), "(changed on the server)")
+			c.fireRemoteChange(delta, ChangeConflicted)
+			return err
+		}
+		delta.mutex.RLock()
+		remote := delta.DriveItem
+		delta.mutex.RUnlock()
+
+		local.mutex.Lock()
+		if local.data != nil {
+			// The file is open. Swapping content out from under readers would
+			// let them see a mix of old and new data, so they keep the old
+			// version until the file is closed.
+			local.pendingRemote = &remote
+			local.mutex.Unlock()
+			log.WithFields(log.Fields{
+				"id":    id,
+				"name":  name,
+				"delta": "deferred",
+			}).Info("Local item is open, deferring overwrite until it is closed.")
+			c.activity.record(activityRemote, "modified", local.Path(), "")
+			c.fireRemoteChange(delta, ChangeModified)
+			return nil
+		}
+		local.mutex.Unlock()
+
 		log.WithFields(log.Fields{
 			"id":    id,
 			"name":  name,
 			"delta": "overwrite",
 		}).Info("Overwriting local item, no local changes to preserve.")
-		// update modtime, hashes, purge any local content in memory
-		local.mutex.Lock()
-		defer local.mutex.Unlock()
-		local.ModTimeInternal = delta.ModTimeInternal
-		local.FileInternal = delta.FileInternal
-		local.hasChanges = false
-		local.data = nil
+		c.overwriteContent(local, &remote)
+		c.activity.record(activityRemote, "modified", local.Path(), "")
+		c.fireRemoteChange(delta, ChangeModified)
 		return nil
 	}
 
@@ -223,3 +466,50 @@ func (c *Cache) applyDelta(delta *Inode) error {
 	}).Info("Skipping, no changes relative to local state.")
 	return nil
 }
+
+// overwriteContent replaces a local item's content metadata with the server's
+// version and drops any cached content so it is fetched again on next open.
+func (c *Cache) overwriteContent(local *Inode, remote *DriveItem) {
+	local.mutex.Lock()
+	id := local.IDInternal
+	local.ModTimeInternal = remote.ModTimeInternal
+	local.FileSystemInfo = remote.FileSystemInfo
+	local.SizeInternal = remote.SizeInternal
+	local.FileInternal = remote.FileInternal
+	local.hasChanges = false
+	if local.data != nil {
+		local.data.Close()
+		local.data = nil
+	}
+	local.pendingRemote = nil
+	if local.stream != nil {
+		// the content being streamed in is out of date
+		local.stream.Cancel()
+		local.stream = nil
+	}
+	local.mutex.Unlock()
+	c.DeleteContent(id)
+	notifyContent(local)
+}
+
+// hashesMatch checks whether an item's content hashes are identical to those of
+// another copy of the same item. Hashes that are missing on either side are
+// treated as a mismatch.
+func (i *Inode) hashesMatch(other *Inode) bool {
+	other.mutex.RLock()
+	theirs := other.FileInternal
+	other.mutex.RUnlock()
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+	ours := i.FileInternal
+	if ours == nil || theirs == nil {
+		return false
+	}
+	if ours.Hashes.SHA1Hash != "" && theirs.Hashes.SHA1Hash != "" {
+		return strings.EqualFold(ours.Hashes.SHA1Hash, theirs.Hashes.SHA1Hash)
+	}
+	if ours.Hashes.QuickXorHash != "" && theirs.Hashes.QuickXorHash != "" {
+		return ours.Hashes.QuickXorHash == theirs.Hashes.QuickXorHash
+	}
+	return false
+}
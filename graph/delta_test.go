@@ -3,15 +3,31 @@ package graph
 
 import (
 	"bytes"
+	"context"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"testing"
 	"time"
+
+	bolt "github.com/etcd-io/bbolt"
+	"github.com/hanwen/go-fuse/v2/fuse"
 )
 
 const retrySeconds = 15
 
+// A delta link for changes from now on should be usable right away.
+func TestGetDeltaLink(t *testing.T) {
+	t.Parallel()
+	link, err := GetDeltaLink(Source{}, auth)
+	failOnErr(t, err)
+	if link == "" || link[0] != '/' {
+		t.Fatalf("Expected a delta link relative to the API, got \"%s\".", link)
+	}
+	_, err = Get(link, auth)
+	failOnErr(t, err)
+}
+
 // In this test, we create a directory through the API, and wait to see if
 // the cache picks it up post-creation.
 func TestDeltaMkdir(t *testing.T) {
@@ -131,8 +147,9 @@ func TestDeltaContentChangeRemote(t *testing.T) {
 	failOnErr(t, err)
 	newContent := []byte("because it has been changed remotely!")
 	item.SizeInternal = uint64(len(newContent))
-	item.data = &newContent
-	session, err := NewUploadSession(item, auth)
+	item.data, err = bufferOf(newContent)
+	failOnErr(t, err)
+	session, err := NewUploadSession(item)
 	failOnErr(t, err)
 	failOnErr(t, session.Upload(auth))
 
@@ -169,8 +186,9 @@ func TestDeltaContentChangeBoth(t *testing.T) {
 	item, err := GetItemPath("/onedriver_tests/delta/both_content_changed", auth)
 	failOnErr(t, err)
 	newContent := []byte("remote")
-	item.data = &newContent
-	session, err := NewUploadSession(item, auth)
+	item.data, err = bufferOf(newContent)
+	failOnErr(t, err)
+	session, err := NewUploadSession(item)
 	failOnErr(t, err)
 	failOnErr(t, session.Upload(auth))
 
@@ -218,3 +236,205 @@ func TestDeltaBadContentInCache(t *testing.T) {
 			string(contents))
 	}
 }
+
+// Content downloaded after the item changed on the server, but before the delta
+// for the change arrived, does not match the hashes we have for it. That should
+// not fail the open, the hashes are fetched again instead.
+func TestDownloadStaleHashes(t *testing.T) {
+	t.Parallel()
+	failOnErr(t, ioutil.WriteFile(
+		filepath.Join(DeltaDir, "stale_hashes"),
+		[]byte("current contents"),
+		0644,
+	))
+	var id string
+	for i := 0; i < retrySeconds; i++ {
+		time.Sleep(time.Second)
+		item, err := GetItemPath("/onedriver_tests/delta/stale_hashes", auth)
+		if err == nil && item.FileInternal != nil {
+			id = item.ID()
+			break
+		}
+	}
+	if id == "" {
+		t.Fatal("File was never uploaded.")
+	}
+
+	inode := fsCache.GetID(id)
+	inode.mutex.Lock()
+	inode.FileInternal = &File{Hashes: Hashes{
+		SHA1Hash:     "0000000000000000000000000000000000000000",
+		QuickXorHash: "AAAAAAAAAAAAAAAAAAAAAAAAAAA=",
+	}}
+	inode.data = nil
+	inode.mutex.Unlock()
+	failOnErr(t, fsCache.DeleteContent(id))
+
+	contents, err := ioutil.ReadFile(filepath.Join(DeltaDir, "stale_hashes"))
+	failOnErr(t, err)
+	if string(contents) != "current contents" {
+		t.Fatalf("Got \"%s\", wanted \"current contents\".", string(contents))
+	}
+}
+
+// A delta that moves and renames an item should be applied purely locally,
+// leaving the item under its new parent with its new name.
+func TestApplyDeltaMoveLocal(t *testing.T) {
+	t.Parallel()
+	cache := NewCache(context.Background(), auth, "test_apply_delta_move_local.db")
+	root, _ := cache.GetPath("/", auth)
+	src := NewInode("apply_delta_src", 0755|fuse.S_IFDIR, root)
+	cache.InsertChild(root.ID(), src)
+	dst := NewInode("apply_delta_dst", 0755|fuse.S_IFDIR, root)
+	cache.InsertChild(root.ID(), dst)
+	file := NewInode("before", 0644, src)
+	cache.InsertChild(src.ID(), file)
+
+	delta := NewInode("after", 0644, dst)
+	delta.IDInternal = file.ID()
+	delta.ModTimeInternal = file.ModTimeInternal
+	failOnErr(t, cache.applyDelta(delta))
+
+	if file.Name() != "after" || file.ParentID() != dst.ID() {
+		t.Fatalf("Item was not moved. Name: %s, parent: %s", file.Name(), file.ParentID())
+	}
+	if child, _ := cache.GetChild(dst.ID(), "after", auth); child != file {
+		t.Fatal("Item not found under new parent.")
+	}
+	if child, _ := cache.GetChild(src.ID(), "before", auth); child != nil {
+		t.Fatal("Item still present under old parent.")
+	}
+}
+
+// An item moved into a folder that is not cached should disappear from where
+// it was, rather than linger there.
+func TestApplyDeltaMoveUncached(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "onedriver-delta-move-")
+	failOnErr(t, err)
+	defer os.RemoveAll(dir)
+	db, err := bolt.Open(filepath.Join(dir, "delta.db"), 0600,
+		&bolt.Options{Timeout: time.Second * 5})
+	failOnErr(t, err)
+	defer db.Close()
+	failOnErr(t, db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(METADATA)
+		return err
+	}))
+	cache := &Cache{db: db, contentDir: dir, metadata: newShardedMap()}
+	root := NewInode("root", 0755|fuse.S_IFDIR, nil)
+	cache.InsertID(root.ID(), root)
+	cache.root = root.ID()
+	file := NewInode("moved_away", 0644|fuse.S_IFREG, root)
+	file.IDInternal = "01MOVEDAWAY"
+	cache.InsertChild(root.ID(), file)
+
+	delta := &Inode{DriveItem: DriveItem{
+		IDInternal:   file.ID(),
+		NameInternal: "moved_away",
+		Parent:       &DriveItemParent{ID: "01NEVERLISTED"},
+	}}
+	failOnErr(t, cache.applyDelta(delta))
+	if child, _ := cache.GetChild(root.ID(), "moved_away", nil); child != nil {
+		t.Error("Item is still where it was moved from.")
+	}
+	if cache.GetID(file.ID()) != nil {
+		t.Error("Item is still cached, under a parent that is not.")
+	}
+}
+
+// Only the last delta for an item should be kept, in the position the item was
+// first seen.
+func TestDedupeDeltas(t *testing.T) {
+	t.Parallel()
+	first := &Inode{DriveItem: DriveItem{IDInternal: "a", NameInternal: "first"}}
+	other := &Inode{DriveItem: DriveItem{IDInternal: "b", NameInternal: "other"}}
+	last := &Inode{DriveItem: DriveItem{IDInternal: "a", NameInternal: "last"}}
+
+	deduped := dedupeDeltas([]*Inode{first, other, last})
+	if len(deduped) != 2 {
+		t.Fatalf("Expected 2 deltas after deduplication, got %d.", len(deduped))
+	}
+	if deduped[0] != last || deduped[1] != other {
+		t.Fatalf("Deltas were not deduplicated in order: %s, %s",
+			deduped[0].Name(), deduped[1].Name())
+	}
+}
+
+// Backoff should grow exponentially from the minimum, but never past the max.
+func TestNextBackoff(t *testing.T) {
+	t.Parallel()
+	backoff := nextBackoff(0)
+	if backoff != minDeltaBackoff {
+		t.Fatalf("Initial backoff was %s, expected %s.", backoff, minDeltaBackoff)
+	}
+	if backoff = nextBackoff(backoff); backoff != 2*minDeltaBackoff {
+		t.Fatalf("Backoff did not double, got %s.", backoff)
+	}
+	for i := 0; i < 20; i++ {
+		backoff = nextBackoff(backoff)
+	}
+	if backoff != maxDeltaBackoff {
+		t.Fatalf("Backoff exceeded maximum, got %s.", backoff)
+	}
+}
+
+// Registered hooks should be told about changes applied from the server.
+func TestRemoteChangeHook(t *testing.T) {
+	t.Parallel()
+	cache := NewCache(context.Background(), auth, "test_remote_change_hook.db")
+	root, _ := cache.GetPath("/", auth)
+	changes := make(map[string]ChangeType)
+	cache.OnRemoteChange(func(item DriveItem, change ChangeType) {
+		changes[item.IDInternal] = change
+	})
+
+	created := NewInode("hook_created", 0644, root)
+	created.IDInternal = "hook-created"
+	failOnErr(t, cache.applyDelta(created))
+	if change, exists := changes["hook-created"]; !exists || change != ChangeCreated {
+		t.Fatalf("Expected a create hook, got %s.", change)
+	}
+
+	deleted := NewInode("hook_created", 0644, root)
+	deleted.IDInternal = "hook-created"
+	deleted.Deleted = &Deleted{State: "deleted"}
+	failOnErr(t, cache.applyDelta(deleted))
+	if changes["hook-created"] != ChangeDeleted {
+		t.Fatalf("Expected a delete hook, got %s.", changes["hook-created"])
+	}
+}
+
+// A remote content change to an open file should not be applied until the
+// file is closed, so readers never see a mix of old and new content.
+func TestApplyDeltaOpenFileDeferred(t *testing.T) {
+	t.Parallel()
+	cache := NewCache(context.Background(), auth, "test_apply_delta_open_file.db")
+	root, _ := cache.GetPath("/", auth)
+	file := NewInode("apply_delta_open", 0644, root)
+	content := []byte("old content")
+	data, err := bufferOf(content)
+	failOnErr(t, err)
+	file.data = data
+	file.SizeInternal = uint64(len(content))
+	file.FileInternal = &File{Hashes: Hashes{SHA1Hash: "old", QuickXorHash: "old"}}
+	cache.InsertChild(root.ID(), file)
+
+	delta := NewInode("apply_delta_open", 0644, root)
+	delta.IDInternal = file.ID()
+	later := file.ModTime() + 60
+	mtime := time.Unix(int64(later), 0)
+	delta.ModTimeInternal = &mtime
+	delta.SizeInternal = 100
+	delta.FileInternal = &File{Hashes: Hashes{SHA1Hash: "new", QuickXorHash: "new"}}
+	failOnErr(t, cache.applyDelta(delta))
+
+	if !file.HasContent() || file.Size() != uint64(len(content)) {
+		t.Fatal("Open file was overwritten before it was closed.")
+	}
+
+	file.Flush(context.Background(), nil)
+	if file.HasContent() || file.Size() != 100 {
+		t.Fatalf("Remote change was not applied on close, size is %d.", file.Size())
+	}
+}
@@ -0,0 +1,64 @@
+package graph
+
+import (
+	"sync"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	log "github.com/sirupsen/logrus"
+)
+
+// how often a notification of each kind can be shown, so a folder full of files
+// failing to upload doesn't bury the desktop in them
+const notifyInterval = time.Minute
+
+var desktopNotifications = struct {
+	sync.Mutex
+	disabled bool
+	shown    map[string]time.Time // when each kind of notification was last shown
+}{shown: make(map[string]time.Time)}
+
+// SetDesktopNotifications turns desktop notifications on or off. They are on
+// by default.
+func SetDesktopNotifications(enabled bool) {
+	desktopNotifications.Lock()
+	desktopNotifications.disabled = !enabled
+	desktopNotifications.Unlock()
+}
+
+// notifyDesktop shows a desktop notification, if there is a desktop to show it
+// on. Failure is not an error, the message is logged either way.
+func notifyDesktop(summary string, body string) {
+	desktopNotifications.Lock()
+	disabled := desktopNotifications.disabled
+	desktopNotifications.Unlock()
+	if disabled {
+		return
+	}
+	conn, err := dbus.SessionBus()
+	if err != nil {
+		return
+	}
+	call := conn.Object("org.freedesktop.Notifications", "/org/freedesktop/Notifications").Call(
+		"org.freedesktop.Notifications.Notify", 0,
+		"onedriver", uint32(0), "onedriver", summary, body,
+		[]string{}, map[string]dbus.Variant{}, int32(-1),
+	)
+	if call.Err != nil {
+		log.WithField("err", call.Err).Debug("Could not show desktop notification.")
+	}
+}
+
+// notifyEvent shows a desktop notification in the background, unless one of
+// the same kind was shown less than notifyInterval ago.
+func notifyEvent(kind string, summary string, body string) {
+	now := time.Now()
+	desktopNotifications.Lock()
+	if now.Sub(desktopNotifications.shown[kind]) < notifyInterval {
+		desktopNotifications.Unlock()
+		return
+	}
+	desktopNotifications.shown[kind] = now
+	desktopNotifications.Unlock()
+	go notifyDesktop(summary, body)
+}
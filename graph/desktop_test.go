@@ -0,0 +1,32 @@
+package graph
+
+import (
+	"testing"
+	"time"
+)
+
+// Only the first of a burst of notifications of the same kind should be shown.
+func TestNotifyEventThrottled(t *testing.T) {
+	SetDesktopNotifications(false)
+	defer SetDesktopNotifications(true)
+
+	notifyEvent("test", "first", "")
+	desktopNotifications.Lock()
+	first := desktopNotifications.shown["test"]
+	desktopNotifications.Unlock()
+	if first.IsZero() {
+		t.Fatal("First notification was not shown.")
+	}
+
+	time.Sleep(time.Millisecond)
+	notifyEvent("test", "second", "")
+	notifyEvent("other", "different kind", "")
+	desktopNotifications.Lock()
+	defer desktopNotifications.Unlock()
+	if !desktopNotifications.shown["test"].Equal(first) {
+		t.Fatal("Second notification of the same kind was shown right away.")
+	}
+	if desktopNotifications.shown["other"].IsZero() {
+		t.Fatal("Notification of a different kind was held back.")
+	}
+}
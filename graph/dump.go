@@ -0,0 +1,173 @@
+package graph
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// dumpedItem is what a debug dump shows of an item. Items are only referred to
+// by ID, so users can share dumps without giving away what is on their drive.
+type dumpedItem struct {
+	id       string
+	parent   string
+	dir      bool
+	size     uint64
+	children int
+	open     bool // has its content loaded for reading or writing
+	changed  bool // has changes that were not uploaded yet
+	upload   bool // has an upload session
+	stream   bool // is still being downloaded
+}
+
+// WriteDebugDump writes a snapshot of the state of the cache: whether it is
+// syncing, where the delta loop is, pending changes and transfers, open files,
+// and the tree of items in it. It does not talk to the server.
+func (c *Cache) WriteDebugDump(w io.Writer) {
+	health := c.Health()
+	fmt.Fprintf(w, "Signed in:      %t\n", health.SignedIn)
+	fmt.Fprintf(w, "Paused:         %t\n", health.Paused)
+	fmt.Fprintf(w, "Offline:        %s\n", health.Offline)
+	fmt.Fprintf(w, "Read-only:      %t\n", c.IsReadOnly())
+	fmt.Fprintf(w, "Loaded:         %s\n", health.Loaded.Format(time.RFC3339))
+	fmt.Fprintf(w, "Last delta:     %s\n", formatDumpTime(health.LastDelta))
+	fmt.Fprintf(w, "Poll interval:  %s\n", health.PollInterval)
+	fmt.Fprintf(w, "Delta token:    %s\n", deltaToken(c.loadDeltaLink()))
+
+	changes := c.PendingChanges()
+	fmt.Fprintf(w, "\nPending changes (%d):\n", len(changes))
+	for _, change := range changes {
+		fmt.Fprintf(w, "  %s %s %s since %s", change.ID, change.Op, change.State,
+			change.Updated.Format(time.RFC3339))
+		if change.Size > 0 {
+			fmt.Fprintf(w, ", %d/%d bytes", change.Uploaded, change.Size)
+		}
+		if change.Error != "" {
+			fmt.Fprintf(w, ": %s", change.Error)
+		}
+		fmt.Fprintln(w)
+	}
+
+	transfers := c.Transfers()
+	fmt.Fprintf(w, "\nTransfers (%d, %d queued, paused: %t, metered: %t):\n",
+		len(transfers.Transfers), transfers.Queued, transfers.Paused, transfers.Metered)
+	for _, transfer := range transfers.Transfers {
+		fmt.Fprintf(w, "  %s %s %s %d/%d bytes at %d bytes/s\n", transfer.ID,
+			transfer.Direction, transfer.State, transfer.Done, transfer.Total, transfer.Rate)
+	}
+
+	items := make(map[string]dumpedItem)
+	c.metadata.Range(func(id string, inode *Inode) bool {
+		inode.mutex.RLock()
+		item := dumpedItem{
+			id:       id,
+			parent:   inode.DriveItem.Parent.ID,
+			dir:      inode.DriveItem.Folder != nil,
+			size:     inode.DriveItem.SizeInternal,
+			children: len(inode.children),
+			open:     inode.data != nil,
+			changed:  inode.hasChanges,
+			upload:   inode.uploadSession != nil,
+			stream:   inode.stream != nil,
+		}
+		inode.mutex.RUnlock()
+		items[id] = item
+		return true
+	})
+
+	var open []string
+	for id, item := range items {
+		if item.open || item.stream {
+			open = append(open, id)
+		}
+	}
+	sort.Strings(open)
+	fmt.Fprintf(w, "\nOpen files (%d):\n", len(open))
+	for _, id := range open {
+		fmt.Fprintf(w, "  %s\n", items[id].describe())
+	}
+
+	fmt.Fprintf(w, "\nItems (%d):\n", len(items))
+	byParent := make(map[string][]string)
+	for id, item := range items {
+		byParent[item.parent] = append(byParent[item.parent], id)
+	}
+	for _, ids := range byParent {
+		sort.Strings(ids)
+	}
+	seen := make(map[string]bool)
+	var walk func(id string, depth int)
+	walk = func(id string, depth int) {
+		if seen[id] {
+			return
+		}
+		seen[id] = true
+		fmt.Fprintf(w, "%s%s\n", strings.Repeat("  ", depth+1), items[id].describe())
+		for _, child := range byParent[id] {
+			walk(child, depth+1)
+		}
+	}
+	if _, ok := items[c.root]; ok {
+		walk(c.root, 0)
+	}
+	// anything not reachable from the root is worth knowing about too
+	var orphans []string
+	for id := range items {
+		if !seen[id] {
+			orphans = append(orphans, id)
+		}
+	}
+	sort.Strings(orphans)
+	if len(orphans) > 0 {
+		fmt.Fprintf(w, "\nItems not under the root (%d):\n", len(orphans))
+		for _, id := range orphans {
+			fmt.Fprintf(w, "  %s (parent %s)\n", items[id].describe(), items[id].parent)
+		}
+	}
+}
+
+// describe returns a line about the item for a debug dump.
+func (i dumpedItem) describe() string {
+	description := i.id
+	if i.dir {
+		description += fmt.Sprintf(" folder, %d children", i.children)
+	} else {
+		description += fmt.Sprintf(" file, %d bytes", i.size)
+	}
+	flags := []struct {
+		name string
+		set  bool
+	}{{"open", i.open}, {"changed", i.changed}, {"upload", i.upload}, {"stream", i.stream}}
+	for _, flag := range flags {
+		if flag.set {
+			description += ", " + flag.name
+		}
+	}
+	return description
+}
+
+// deltaToken returns the token of a delta link, which is all of it that says
+// where the delta loop is.
+func deltaToken(link string) string {
+	if link == "" {
+		return "none"
+	}
+	parsed, err := url.Parse(link)
+	if err != nil {
+		return "invalid"
+	}
+	if token := parsed.Query().Get("token"); token != "" {
+		return token
+	}
+	return "none, starting from scratch"
+}
+
+func formatDumpTime(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return t.Format(time.RFC3339)
+}
@@ -0,0 +1,35 @@
+package graph
+
+import (
+	"testing"
+)
+
+// Only the token of a delta link should end up in a debug dump.
+func TestDeltaToken(t *testing.T) {
+	t.Parallel()
+	tests := map[string]string{
+		"":                                  "none",
+		"/me/drive/root/delta?token=abc123": "abc123",
+		"/me/drive/root/delta?token=":       "none, starting from scratch",
+		"%zz":                               "invalid",
+	}
+	for link, expected := range tests {
+		if token := deltaToken(link); token != expected {
+			t.Errorf("Token of %q was %q, expected %q.", link, token, expected)
+		}
+	}
+}
+
+// Items in a debug dump are described by their ID, with no name, and with
+// their flags in a fixed order.
+func TestDumpedItemDescribe(t *testing.T) {
+	t.Parallel()
+	file := dumpedItem{id: "ABC!123", size: 42, open: true, changed: true, stream: true}
+	if description := file.describe(); description != "ABC!123 file, 42 bytes, open, changed, stream" {
+		t.Errorf("Wrong description of a file: %q", description)
+	}
+	folder := dumpedItem{id: "ABC!456", dir: true, children: 3}
+	if description := folder.describe(); description != "ABC!456 folder, 3 children" {
+		t.Errorf("Wrong description of a folder: %q", description)
+	}
+}
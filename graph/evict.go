@@ -0,0 +1,196 @@
+package graph
+
+import (
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "github.com/etcd-io/bbolt"
+	log "github.com/sirupsen/logrus"
+)
+
+// ACCESSED is the boltdb bucket holding when the content of each file was last
+// used.
+var ACCESSED = []byte("accessed")
+
+const (
+	// how often the content cache is checked for files to evict
+	evictInterval = time.Hour
+	// uses of the same content closer together than this are only saved once
+	accessResolution = time.Minute
+)
+
+// how long content can go unused before it is evicted, 0 keeps everything
+var evictAfter = 30 * 24 * time.Hour
+
+// SetEvictAfter sets how long the content of a file is kept after it was last
+// used. 0 turns eviction off. Should be called before the filesystem is
+// mounted.
+func SetEvictAfter(window time.Duration) {
+	if window < 0 {
+		window = 0
+	}
+	evictAfter = window
+}
+
+// accessLog tracks when the content of each file was last used.
+type accessLog struct {
+	db     *bolt.DB // access times are saved here, may be nil
+	mutex  sync.Mutex
+	access map[string]time.Time
+}
+
+// newAccessLog loads the access times saved by a previous session.
+func newAccessLog(db *bolt.DB) *accessLog {
+	a := &accessLog{
+		db:     db,
+		access: make(map[string]time.Time),
+	}
+	if db != nil {
+		db.View(func(tx *bolt.Tx) error {
+			b := tx.Bucket(ACCESSED)
+			if b == nil {
+				return nil
+			}
+			return b.ForEach(func(k, v []byte) error {
+				if unix, err := strconv.ParseInt(string(v), 10, 64); err == nil {
+					a.access[string(k)] = time.Unix(unix, 0)
+				}
+				return nil
+			})
+		})
+	}
+	return a
+}
+
+// set records when an item's content was last used.
+func (a *accessLog) set(id string, when time.Time) {
+	if a == nil {
+		return
+	}
+	a.mutex.Lock()
+	a.access[id] = when
+	a.mutex.Unlock()
+	if a.db == nil {
+		return
+	}
+	a.db.Batch(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(ACCESSED)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(id), []byte(strconv.FormatInt(when.Unix(), 10)))
+	})
+}
+
+// touch records that an item's content is being used right now.
+func (a *accessLog) touch(id string) {
+	if a == nil {
+		return
+	}
+	now := time.Now()
+	a.mutex.Lock()
+	last, exists := a.access[id]
+	a.mutex.Unlock()
+	if exists && now.Sub(last) < accessResolution {
+		return
+	}
+	a.set(id, now)
+}
+
+// get returns when an item's content was last used, if we know.
+func (a *accessLog) get(id string) (time.Time, bool) {
+	if a == nil {
+		return time.Time{}, false
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	when, exists := a.access[id]
+	return when, exists
+}
+
+// forget drops the access time of content that is gone.
+func (a *accessLog) forget(id string) {
+	if a == nil {
+		return
+	}
+	a.mutex.Lock()
+	_, exists := a.access[id]
+	delete(a.access, id)
+	a.mutex.Unlock()
+	if !exists || a.db == nil {
+		return
+	}
+	a.db.Batch(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(ACCESSED); b != nil {
+			return b.Delete([]byte(id))
+		}
+		return nil
+	})
+}
+
+// move carries an access time over when content gets a new ID.
+func (a *accessLog) move(oldID string, newID string) {
+	if when, exists := a.get(oldID); exists {
+		a.forget(oldID)
+		a.set(newID, when)
+	}
+}
+
+// evictLoop periodically evicts content that has not been used for a while.
+// Should be called as a goroutine.
+func (c *Cache) evictLoop(interval time.Duration) {
+	defer c.workers.Done()
+	for sleepContext(c.ctx, interval) {
+		c.evictCold(evictAfter)
+	}
+}
+
+// evictCold turns files whose content has not been used within window back into
+// placeholders. Returns how many bytes of content were dropped.
+func (c *Cache) evictCold(window time.Duration) uint64 {
+	if window <= 0 {
+		return 0
+	}
+	entries, err := ioutil.ReadDir(c.contentDir)
+	if err != nil {
+		return 0
+	}
+	now := time.Now()
+	var freed uint64
+	evicted := 0
+	for _, entry := range entries {
+		id := entry.Name()
+		if entry.IsDir() || strings.HasSuffix(id, ".tmp") {
+			continue
+		}
+		last, known := c.accessed.get(id)
+		if !known {
+			c.accessed.set(id, now)
+			continue
+		}
+		if now.Sub(last) < window || c.IsPinned(id) {
+			continue
+		}
+		inode := c.GetID(id)
+		if inode == nil {
+			// left for garbage collection
+			continue
+		}
+		n, err := c.dehydrate(inode)
+		if err == nil && n > 0 {
+			freed += n
+			evicted++
+		}
+	}
+	if evicted > 0 {
+		c.collectBlobs()
+		log.WithFields(log.Fields{
+			"files": evicted,
+			"bytes": freed,
+		}).Info("Evicted content of files that have not been used for a while.")
+	}
+	return freed
+}
@@ -0,0 +1,76 @@
+package graph
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "github.com/etcd-io/bbolt"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// Only content that went unused for longer than the window is evicted, pinned
+// files are kept, and content we know nothing about gets a fresh start.
+func TestEvictCold(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "onedriver-evict-")
+	failOnErr(t, err)
+	defer os.RemoveAll(dir)
+	failOnErr(t, os.Mkdir(filepath.Join(dir, "blobs"), 0700))
+	db, err := bolt.Open(filepath.Join(dir, "evict.db"), 0600,
+		&bolt.Options{Timeout: time.Second * 5})
+	failOnErr(t, err)
+	defer db.Close()
+	failOnErr(t, db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{METADATA, JOURNAL, ACCESSED} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	cache := &Cache{
+		db:         db,
+		contentDir: dir,
+		metadata:   newShardedMap(),
+		pinned:     newPinSet(db),
+		accessed:   newAccessLog(db),
+	}
+
+	root := NewInode("root", 0755|fuse.S_IFDIR, nil)
+	root.IDInternal = "root"
+	cache.InsertID(root.ID(), root)
+	for _, id := range []string{"cold", "warm", "pinned", "unknown"} {
+		file := NewInode(id, 0644|fuse.S_IFREG, root)
+		file.IDInternal = id
+		file.data = nil
+		cache.InsertChild(root.ID(), file)
+		failOnErr(t, cache.InsertContent(id, []byte(id+" content")))
+	}
+	old := time.Now().Add(-48 * time.Hour)
+	cache.accessed.set("cold", old)
+	cache.accessed.set("pinned", old)
+	cache.accessed.forget("unknown")
+	failOnErr(t, cache.Pin("pinned"))
+
+	freed := cache.evictCold(24 * time.Hour)
+	if freed != uint64(len("cold content")) {
+		t.Fatalf("Freed %d bytes instead of the cold file's content.", freed)
+	}
+	if cache.hasCachedContent("cold") {
+		t.Fatal("Content of the cold file was kept.")
+	}
+	for _, id := range []string{"warm", "pinned", "unknown"} {
+		if !cache.hasCachedContent(id) {
+			t.Fatalf("Content of %s was evicted.", id)
+		}
+	}
+	if _, known := newAccessLog(db).get("unknown"); !known {
+		t.Fatal("Content without an access time should be given one.")
+	}
+	if cache.evictCold(0) != 0 {
+		t.Fatal("Nothing should be evicted when eviction is off.")
+	}
+}
@@ -0,0 +1,275 @@
+package graph
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	bolt "github.com/etcd-io/bbolt"
+	log "github.com/sirupsen/logrus"
+)
+
+// FAILED is the boltdb bucket holding changes that failed for good, until they
+// are retried or overtaken by another change to the same item.
+var FAILED = []byte("failed")
+
+// FailureReason is why the server refused a change, in a word.
+type FailureReason string
+
+// reasons for a change to fail
+const (
+	ReasonQuota       FailureReason = "quota"        // the drive is full
+	ReasonForbidden   FailureReason = "forbidden"    // no permission to change the item
+	ReasonInvalidName FailureReason = "invalid-name" // not a name OneDrive allows
+	ReasonTooLarge    FailureReason = "too-large"    // bigger than OneDrive allows
+	ReasonNotFound    FailureReason = "not-found"    // gone from the server
+	ReasonConflict    FailureReason = "conflict"     // changed on the server as well
+	ReasonOther       FailureReason = "error"
+)
+
+// what changes made offline fail with when the item was changed on the server
+// in the meantime, and the server's version was kept
+var (
+	errChangedOnServer = errors.New("changed on the server while offline")
+	errMovedOnServer   = errors.New("moved on the server while offline")
+)
+
+// failureReason works out why the server refused a change from the error it
+// failed with.
+func failureReason(err error) FailureReason {
+	if IsQuotaExceeded(err) {
+		return ReasonQuota
+	}
+	if errors.Is(err, errChangedOnServer) || errors.Is(err, errMovedOnServer) {
+		return ReasonConflict
+	}
+	var graphErr *GraphError
+	if !errors.As(err, &graphErr) {
+		return ReasonOther
+	}
+	switch {
+	case graphErr.StatusCode == http.StatusForbidden || graphErr.Code == "accessDenied":
+		return ReasonForbidden
+	case graphErr.StatusCode == http.StatusRequestEntityTooLarge:
+		return ReasonTooLarge
+	case graphErr.StatusCode == http.StatusNotFound:
+		return ReasonNotFound
+	case graphErr.StatusCode == http.StatusConflict ||
+		graphErr.StatusCode == http.StatusPreconditionFailed:
+		return ReasonConflict
+	case graphErr.StatusCode == http.StatusBadRequest &&
+		strings.Contains(strings.ToLower(graphErr.Message), "name"):
+		return ReasonInvalidName
+	}
+	return ReasonOther
+}
+
+func failureKey(key changeKey) []byte {
+	return []byte(key.id + "\x00" + string(key.op))
+}
+
+// saveFailure saves a failed change. Must be called with the mutex held.
+func (t *changeTracker) saveFailure(key changeKey, change *PendingChange) {
+	if t.db == nil {
+		return
+	}
+	data, _ := json.Marshal(change)
+	err := t.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(FAILED).Put(failureKey(key), data)
+	})
+	if err != nil {
+		log.WithFields(log.Fields{
+			"id":  key.id,
+			"err": err,
+		}).Error("Could not save failed change.")
+	}
+}
+
+// forgetFailure drops a change from the saved failures, if it was one. Must be
+// called with the mutex held.
+func (t *changeTracker) forgetFailure(key changeKey, change *PendingChange) {
+	if t.db == nil || change.State != StateFailed {
+		return
+	}
+	t.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(FAILED).Delete(failureKey(key))
+	})
+}
+
+// restoreFailures brings back the failures saved by a previous session, unless
+// the same changes are being sent again already.
+func (t *changeTracker) restoreFailures() {
+	if t.db == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	var stale [][]byte
+	t.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(FAILED).ForEach(func(k, v []byte) error {
+			change := &PendingChange{}
+			if err := json.Unmarshal(v, change); err != nil {
+				stale = append(stale, append([]byte(nil), k...))
+				return nil
+			}
+			key := changeKey{change.ID, change.Op}
+			if _, exists := t.changes[key]; exists {
+				stale = append(stale, append([]byte(nil), k...))
+				return nil
+			}
+			t.changes[key] = change
+			return nil
+		})
+	})
+	if len(stale) > 0 {
+		t.db.Update(func(tx *bolt.Tx) error {
+			for _, k := range stale {
+				tx.Bucket(FAILED).Delete(k)
+			}
+			return nil
+		})
+	}
+}
+
+// Failures returns the changes that the server refused for good, oldest first.
+func (c *Cache) Failures() []PendingChange {
+	failures := make([]PendingChange, 0)
+	for _, change := range c.PendingChanges() {
+		if change.State == StateFailed {
+			failures = append(failures, change)
+		}
+	}
+	return failures
+}
+
+// Retry sends the failed changes to the item at path, or to anything beneath
+// it, to the server again. Items are sent as they are now: a file's current
+// content is uploaded, and an item that failed to move is moved to wherever
+// it is locally. Changes to items that are gone are dropped. It returns how
+// many changes were sent, and the errors they failed with again.
+func (c *Cache) Retry(path string) (int, error) {
+	if c.IsOffline() {
+		return 0, errors.New("offline, changes are sent once the connection is back")
+	}
+	if c.IsReadOnly() {
+		return 0, errors.New("filesystem is read-only")
+	}
+	path = filepath.Clean("/" + path)
+	var failures []PendingChange
+	for _, change := range c.Failures() {
+		if path == "/" || change.Path == path || strings.HasPrefix(change.Path, path+"/") {
+			failures = append(failures, change)
+		}
+	}
+	if len(failures) == 0 {
+		return 0, fmt.Errorf("no failed changes to %s", path)
+	}
+	var errs []string
+	retried := 0
+	for _, change := range failures {
+		err := c.retry(change)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s %s: %s", change.Op, change.Path, err))
+		} else {
+			retried++
+		}
+	}
+	if len(errs) > 0 {
+		return retried, errors.New(strings.Join(errs, "\n"))
+	}
+	return retried, nil
+}
+
+// retry sends a single failed change to the server again.
+func (c *Cache) retry(change PendingChange) error {
+	logger := log.WithFields(log.Fields{
+		"id":   change.ID,
+		"path": change.Path,
+		"op":   change.Op,
+	})
+	auth := c.GetAuth()
+	inode := c.GetID(change.ID)
+	if inode == nil && change.Op != OpDelete {
+		logger.Info("Item of failed change is gone, dropping the change.")
+		c.changes.done(change.ID, change.Op)
+		return errors.New("item no longer exists, dropped the change")
+	}
+	logger.Info("Retrying failed change.")
+
+	switch change.Op {
+	case OpCreate, OpWrite:
+		if inode.IsDir() {
+			// only ever made offline, the queue sends it
+			c.changes.setState(change.ID, change.Op, StateQueued, nil)
+			go c.replayQueue()
+			return nil
+		}
+		c.changes.setState(change.ID, change.Op, StateQueued, nil)
+		inode.mutex.RLock()
+		open := inode.data != nil
+		inode.mutex.RUnlock()
+		if open {
+			// the upload takes a snapshot of what is open
+			return c.requeue(inode)
+		}
+		entry, _ := walGet(c.db, change.ID, OpWrite)
+		entry.ID = change.ID
+		content, err := c.unsavedContent(entry)
+		if err != nil {
+			c.changes.setState(change.ID, change.Op, StateFailed, err)
+			return err
+		}
+		c.replayUpload(inode, content)
+		return nil
+
+	case OpRename:
+		id, parentID := inode.ID(), inode.ParentID()
+		if isLocalID(id) || isLocalID(parentID) {
+			// the item or its folder don't exist on the server yet, they are
+			// created where they are now
+			c.changes.done(change.ID, OpRename)
+			return nil
+		}
+		c.changes.setState(id, OpRename, StateInFlight, nil)
+		if err := Rename(id, inode.Name(), parentID, auth); err != nil {
+			c.changes.setState(id, OpRename, StateFailed, err)
+			return err
+		}
+		c.activity.record(activityLocal, "renamed", change.Path, "")
+		c.changes.done(id, OpRename)
+		walClear(c.db, id, OpRename, 0)
+		return nil
+
+	case OpDelete:
+		c.changes.setState(change.ID, OpDelete, StateInFlight, nil)
+		if !isLocalID(change.ID) {
+			if err := Remove(change.ID, auth); err != nil && !isGone(err) {
+				c.changes.setState(change.ID, OpDelete, StateFailed, err)
+				return err
+			}
+		}
+		c.activity.record(activityLocal, "deleted", change.Path, "")
+		c.changes.done(change.ID, OpDelete)
+		walClear(c.db, change.ID, "", 0)
+		if inode != nil {
+			inode.cancelTransfers()
+			notifyDelete(c.GetID(inode.ParentID()), inode.Name(), inode)
+			c.DeleteID(change.ID)
+			c.DeleteContent(change.ID)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown change %q", change.Op)
+}
+
+// requeue queues the content of an open file for upload.
+func (c *Cache) requeue(inode *Inode) error {
+	if err := c.uploads.QueueUpload(inode); err != nil {
+		c.changes.setState(inode.ID(), "", StateFailed, err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package graph
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	bolt "github.com/etcd-io/bbolt"
+)
+
+// The reason a change failed should be worked out from the error the server
+// sent back.
+func TestFailureReason(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		err    error
+		reason FailureReason
+	}{
+		{&GraphError{StatusCode: http.StatusInsufficientStorage}, ReasonQuota},
+		{&GraphError{StatusCode: http.StatusForbidden, Code: "accessDenied"}, ReasonForbidden},
+		{&GraphError{StatusCode: http.StatusBadRequest, Message: "The provided name cannot contain these characters"}, ReasonInvalidName},
+		{&GraphError{StatusCode: http.StatusRequestEntityTooLarge}, ReasonTooLarge},
+		{&GraphError{StatusCode: http.StatusNotFound}, ReasonNotFound},
+		{&GraphError{StatusCode: http.StatusPreconditionFailed}, ReasonConflict},
+		{fmt.Errorf("replaying write: %w", errChangedOnServer), ReasonConflict},
+		{&GraphError{StatusCode: http.StatusInternalServerError}, ReasonOther},
+		{errors.New("connection reset by peer"), ReasonOther},
+	}
+	for _, test := range tests {
+		if reason := failureReason(test.err); reason != test.reason {
+			t.Errorf("Expected %q to fail because of %q, got %q", test.err, test.reason, reason)
+		}
+	}
+}
+
+// Failed changes should survive a restart, and be forgotten once they reach
+// the server after all.
+func TestFailuresRestored(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "onedriver-failures-")
+	failOnErr(t, err)
+	defer os.RemoveAll(dir)
+	db, err := bolt.Open(filepath.Join(dir, "onedriver.db"), 0600, nil)
+	failOnErr(t, err)
+	defer db.Close()
+	failOnErr(t, db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(FAILED)
+		return err
+	}))
+
+	tracker := newChangeTracker()
+	tracker.db = db
+	tracker.track("big", "/big.iso", OpCreate, StateQueued)
+	tracker.setState("big", OpCreate, StateFailed,
+		&GraphError{StatusCode: http.StatusInsufficientStorage})
+	tracker.track("secret", "/secret.txt", OpDelete, StateQueued)
+	tracker.setState("secret", OpDelete, StateFailed, &GraphError{StatusCode: http.StatusForbidden})
+	tracker.track("fine", "/fine.txt", OpWrite, StateQueued)
+
+	restored := newChangeTracker()
+	restored.db = db
+	restored.restoreFailures()
+	changes := restored.list()
+	if len(changes) != 2 {
+		t.Fatalf("Expected the 2 failed changes to be restored, got %+v", changes)
+	}
+	reasons := map[string]FailureReason{}
+	for _, change := range changes {
+		if change.State != StateFailed {
+			t.Errorf("Restored change to %s is not failed: %s", change.Path, change.State)
+		}
+		reasons[change.Path] = change.Reason
+	}
+	if reasons["/big.iso"] != ReasonQuota || reasons["/secret.txt"] != ReasonForbidden {
+		t.Errorf("Reasons were not restored: %v", reasons)
+	}
+
+	restored.done("big", OpCreate)
+	again := newChangeTracker()
+	again.db = db
+	again.restoreFailures()
+	if changes := again.list(); len(changes) != 1 || changes[0].Path != "/secret.txt" {
+		t.Errorf("Expected only /secret.txt to be left failed, got %+v", changes)
+	}
+}
@@ -0,0 +1,141 @@
+package graph
+
+import (
+	"errors"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// SyncFilter decides which items are part of the filesystem. Patterns use
+// filepath.Match syntax and are not case sensitive. Those starting with "/"
+// match the path of an item from the root of the drive, others its name.
+type SyncFilter struct {
+	include [][]string // split into path components
+	exclude []string
+}
+
+var (
+	syncFilterMutex sync.RWMutex
+	syncFilter      *SyncFilter
+)
+
+// SetSyncFilter sets which items are part of the filesystem. If there are any
+// include patterns, only the folders they match (and the folders leading up
+// to them) are included. Include patterns must start with "/". When changed
+// while mounted, items left out disappear right away, but items let in are
+// only fetched by a Resync.
+func SetSyncFilter(include []string, exclude []string) error {
+	filter, err := NewSyncFilter(include, exclude)
+	if err != nil {
+		return err
+	}
+	syncFilterMutex.Lock()
+	syncFilter = filter
+	syncFilterMutex.Unlock()
+	return nil
+}
+
+// NewSyncFilter checks and compiles a set of include and exclude patterns.
+// Returns nil if there are none.
+func NewSyncFilter(include []string, exclude []string) (*SyncFilter, error) {
+	if len(include) == 0 && len(exclude) == 0 {
+		return nil, nil
+	}
+	filter := &SyncFilter{}
+	includeAll := false
+	for _, pattern := range include {
+		if !strings.HasPrefix(pattern, "/") {
+			return nil, errors.New("include pattern \"" + pattern + "\" must start with \"/\"")
+		}
+		parts := splitPath(strings.ToLower(pattern))
+		for _, part := range parts {
+			if _, err := filepath.Match(part, ""); err != nil {
+				return nil, errors.New("invalid include pattern \"" + pattern + "\"")
+			}
+		}
+		if len(parts) == 0 {
+			includeAll = true
+		}
+		filter.include = append(filter.include, parts)
+	}
+	if includeAll {
+		filter.include = nil
+	}
+	for _, pattern := range exclude {
+		pattern = strings.ToLower(pattern)
+		if pattern != "/" {
+			pattern = strings.TrimSuffix(pattern, "/")
+		}
+		if _, err := filepath.Match(pattern, ""); err != nil || pattern == "/" || pattern == "" {
+			return nil, errors.New("invalid exclude pattern \"" + pattern + "\"")
+		}
+		filter.exclude = append(filter.exclude, pattern)
+	}
+	return filter, nil
+}
+
+func splitPath(p string) []string {
+	p = strings.Trim(path.Clean("/"+p), "/")
+	if p == "" {
+		return []string{}
+	}
+	return strings.Split(p, "/")
+}
+
+// Excluded returns whether the item at a path is left out of the filesystem.
+// The root is never left out.
+func (f *SyncFilter) Excluded(p string) bool {
+	if f == nil {
+		return false
+	}
+	parts := splitPath(strings.ToLower(p))
+	if len(parts) == 0 {
+		return false
+	}
+
+	for _, pattern := range f.exclude {
+		if strings.HasPrefix(pattern, "/") {
+			for i := range parts {
+				if matched, _ := filepath.Match(pattern, "/"+strings.Join(parts[:i+1], "/")); matched {
+					return true
+				}
+			}
+			continue
+		}
+		for _, part := range parts {
+			if matched, _ := filepath.Match(pattern, part); matched {
+				return true
+			}
+		}
+	}
+
+	if len(f.include) == 0 {
+		return false
+	}
+	for _, include := range f.include {
+		// either on the way to an included folder, or inside of one
+		n := len(parts)
+		if len(include) < n {
+			n = len(include)
+		}
+		matches := true
+		for i := 0; i < n && matches; i++ {
+			matches, _ = filepath.Match(include[i], parts[i])
+		}
+		if matches {
+			return false
+		}
+	}
+	return true
+}
+
+// excluded returns whether an item named name in the folder at parentPath is
+// left out of the filesystem.
+func excluded(parentPath string, name string) bool {
+	syncFilterMutex.RLock()
+	filter := syncFilter
+	syncFilterMutex.RUnlock()
+	return filter.Excluded(path.Join("/", parentPath, name))
+}
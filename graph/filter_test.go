@@ -0,0 +1,47 @@
+package graph
+
+import "testing"
+
+// Excluded items take everything beneath them along, and include patterns keep
+// the folders leading up to what they include.
+func TestSyncFilter(t *testing.T) {
+	t.Parallel()
+	filter, err := NewSyncFilter(
+		[]string{"/Documents", "/Projects/*/src"},
+		[]string{"node_modules", "*.TMP", "/Documents/Private/"},
+	)
+	failOnErr(t, err)
+	tests := map[string]bool{
+		"/":                                  false,
+		"/Documents":                         false,
+		"/documents/report.docx":             false,
+		"/Documents/Private":                 true,
+		"/Documents/private/diary.txt":       true,
+		"/Documents/notes.tmp":               true,
+		"/Documents/app/node_modules/left":   true,
+		"/Pictures":                          true,
+		"/Projects":                          false,
+		"/Projects/onedriver":                false,
+		"/Projects/onedriver/src/main.go":    false,
+		"/Projects/onedriver/build":          true,
+		"/Projects/onedriver/src/build.tmp":  true,
+		"/Projects/onedriver/src/Private":    false,
+		"/Projects/onedriver/src/private.go": false,
+	}
+	for path, expected := range tests {
+		if filter.Excluded(path) != expected {
+			t.Errorf("Excluded(%s) should be %t.", path, expected)
+		}
+	}
+
+	var none *SyncFilter
+	if none.Excluded("/anything") {
+		t.Error("Nothing should be excluded without a filter.")
+	}
+	if _, err := NewSyncFilter([]string{"Documents"}, nil); err == nil {
+		t.Error("Include patterns should have to start with \"/\".")
+	}
+	if _, err := NewSyncFilter(nil, []string{"[oops"}); err == nil {
+		t.Error("Invalid patterns should be refused.")
+	}
+}
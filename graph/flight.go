@@ -0,0 +1,38 @@
+package graph
+
+import "sync"
+
+// flightGroup runs a function at most once at a time per key. Callers that
+// arrive while a call is already in flight wait for it to finish instead of
+// starting their own.
+type flightGroup struct {
+	mutex sync.Mutex
+	calls map[string]chan struct{}
+}
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{calls: make(map[string]chan struct{})}
+}
+
+// do runs fn, unless a call for the same key is already running, in which case
+// it waits for that call to finish. Returns whether fn was run by this caller.
+func (g *flightGroup) do(key string, fn func()) bool {
+	g.mutex.Lock()
+	if done, exists := g.calls[key]; exists {
+		g.mutex.Unlock()
+		<-done
+		return false
+	}
+	done := make(chan struct{})
+	g.calls[key] = done
+	g.mutex.Unlock()
+
+	defer func() {
+		g.mutex.Lock()
+		delete(g.calls, key)
+		g.mutex.Unlock()
+		close(done)
+	}()
+	fn()
+	return true
+}
@@ -0,0 +1,38 @@
+package graph
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Concurrent callers for the same key should share a single call.
+func TestFlightGroup(t *testing.T) {
+	t.Parallel()
+	group := newFlightGroup()
+	var calls int32
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			group.do("tokens", func() {
+				atomic.AddInt32(&calls, 1)
+				time.Sleep(100 * time.Millisecond)
+			})
+		}()
+	}
+	close(start)
+	wg.Wait()
+	if calls != 1 {
+		t.Fatalf("Expected 1 call, got %d.", calls)
+	}
+
+	// once finished, the next caller gets its own call
+	if !group.do("tokens", func() {}) {
+		t.Fatal("A call after the first finished was not run.")
+	}
+}
@@ -1,13 +1,31 @@
 package graph
 
-import "time"
+import (
+	"context"
+	"time"
+)
+
+// how often orphaned items are purged from the cache
+const gcInterval = 10 * time.Minute
 
 // NewFS is basically a wrapper around NewCache, but with a dedicated thread to
-// poll the server for changes.
-func NewFS(dbPath string, authPath string, deltaInterval time.Duration) *Inode {
+// poll the server for changes, another to garbage collect orphaned items, and
+// one to download the content of pinned items.
+// Cancelling ctx stops all background work.
+func NewFS(ctx context.Context, dbPath string, authPath string, deltaInterval time.Duration) *Inode {
+	return NewSourceFS(ctx, dbPath, authPath, deltaInterval, Source{})
+}
+
+// NewSourceFS is NewFS for a filesystem serving source.
+func NewSourceFS(ctx context.Context, dbPath string, authPath string, deltaInterval time.Duration, source Source) *Inode {
 	auth := Authenticate(authPath)
-	cache := NewCache(auth, dbPath)
+	cache := NewSourceCache(ctx, auth, dbPath, source)
 	root, _ := cache.GetPath("/", auth)
-	go cache.deltaLoop(deltaInterval)
+	cache.SetPollInterval(deltaInterval)
+	cache.start(cache.deltaLoop)
+	cache.start(func() { cache.gcLoop(gcInterval) })
+	cache.start(func() { cache.pinLoop(pinInterval) })
+	cache.start(cache.networkLoop)
+	cache.start(func() { cache.evictLoop(evictInterval) })
 	return root
 }
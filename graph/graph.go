@@ -3,12 +3,15 @@ package graph
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
@@ -17,8 +20,6 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-const graphURL = "https://graph.microsoft.com/v1.0"
-
 // graphError is an internal struct used when decoding Graph's error messages
 type graphError struct {
 	Error struct {
@@ -27,57 +28,199 @@ type graphError struct {
 	} `json:"error"`
 }
 
+// GraphError is returned when the Graph API responds with an error status code.
+type GraphError struct {
+	StatusCode int
+	Code       string
+	Message    string
+	RetryAfter time.Duration // only set if the server sent a Retry-After header
+	Location   string        // only set if the server sent a Location header
+}
+
+func (e *GraphError) Error() string {
+	return fmt.Sprintf("HTTP %d - %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// IsThrottled returns whether an error is the server asking us to slow down
+// (HTTP 429 or 503), and how long it asked us to wait if it said so.
+func IsThrottled(err error) (bool, time.Duration) {
+	var graphErr *GraphError
+	if errors.As(err, &graphErr) &&
+		(graphErr.StatusCode == 429 || graphErr.StatusCode == 503) {
+		return true, graphErr.RetryAfter
+	}
+	return false, 0
+}
+
+// IsQuotaExceeded returns whether an error is the server refusing content
+// because the drive is full.
+func IsQuotaExceeded(err error) bool {
+	var graphErr *GraphError
+	return errors.As(err, &graphErr) &&
+		(graphErr.StatusCode == http.StatusInsufficientStorage ||
+			graphErr.Code == "quotaLimitReached")
+}
+
+// parseRetryAfter parses the value of a Retry-After header, which can either be
+// a number of seconds or an HTTP date.
+func parseRetryAfter(header string) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(header); err == nil {
+		return time.Until(date)
+	}
+	return 0
+}
+
 // Request performs an authenticated request to Microsoft Graph
 func Request(resource string, auth *Auth, method string, content io.Reader) ([]byte, error) {
-	if auth == nil || auth.AccessToken == "" {
+	return request(context.Background(), resource, auth, method, content, nil)
+}
+
+// request is Request with extra headers, that gives up once ctx is cancelled.
+func request(ctx context.Context, resource string, auth *Auth, method string, content io.Reader,
+	headers map[string]string) ([]byte, error) {
+	_, body, err := requestResponse(ctx, resource, auth, method, content, headers)
+	return body, err
+}
+
+// requestResponse is request, but also returns the response itself for callers
+// that need its headers.
+func requestResponse(ctx context.Context, resource string, auth *Auth, method string, content io.Reader,
+	headers map[string]string) (*http.Response, []byte, error) {
+	if auth == nil || auth.accessToken() == "" {
 		// a catch all condition to avoid wiping our auth by accident
 		log.WithFields(log.Fields{
-			"caller":   logger.Caller(3),
-			"calledBy": logger.Caller(4),
+			"caller":   logger.Caller(4),
+			"calledBy": logger.Caller(5),
 		}).Error("Auth was empty and we attempted to make a request with it!")
-		return nil, errors.New("Cannot make a request with empty auth")
+		return nil, nil, errors.New("Cannot make a request with empty auth")
 	}
 
 	auth.Refresh()
+	if auth.ReauthRequired() {
+		return nil, nil, ErrReauthRequired
+	}
 
-	client := &http.Client{Timeout: 15 * time.Second}
-	request, _ := http.NewRequest(method, graphURL+resource, content)
-	request.Header.Add("Authorization", "bearer "+auth.AccessToken)
-	switch method { // request type-specific code here
-	case "PATCH":
-		request.Header.Add("If-Match", "*")
-		request.Header.Add("Content-Type", "application/json")
-	case "POST":
-		request.Header.Add("Content-Type", "application/json")
-	case "PUT":
-		request.Header.Add("Content-Type", "text/plain")
+	// the body may need to be sent more than once if we retry
+	var payload []byte
+	if content != nil {
+		var err error
+		if payload, err = ioutil.ReadAll(content); err != nil {
+			return nil, nil, err
+		}
 	}
 
-	response, err := client.Do(request)
+	timeout := 15 * time.Second
+	if isContentTransfer(resource) && (uploadLimiter.limited() || downloadLimiter.limited()) {
+		// a rate limited transfer can take much longer than a normal request
+		timeout = 0
+	}
+	client := httpClient(timeout)
+	token := auth.accessToken()
+	trace := requestTrace{clientRequestID: newClientRequestID()}
+	send := func() (*http.Response, []byte, error) {
+		trace.attempt++
+		return doRequest(ctx, client, resource, auth, method, payload, headers, trace)
+	}
+	response, body, err := send()
 	if err != nil {
 		// the actual request failed
-		return nil, err
+		return nil, nil, err
 	}
-	body, _ := ioutil.ReadAll(response.Body)
-	response.Body.Close()
 
 	if response.StatusCode >= 500 {
 		// the onedrive API is having issues, retry once
-		response, err = client.Do(request)
-		if err != nil {
-			return nil, err
+		if response, body, err = send(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if response.StatusCode == http.StatusUnauthorized {
+		// our token was rejected before it expired (revoked, clock skew, etc.),
+		// get a new one and try again
+		log.WithField("resource", resource).Info(
+			"Access token was rejected by the server, renewing tokens.")
+		auth.refreshRejected(token)
+		if auth.ReauthRequired() {
+			return nil, nil, ErrReauthRequired
+		}
+		if response, body, err = send(); err != nil {
+			return nil, nil, err
 		}
-		body, _ = ioutil.ReadAll(response.Body)
-		response.Body.Close()
 	}
 
 	if response.StatusCode >= 400 {
 		// something was wrong with the request
 		var err graphError
 		json.Unmarshal(body, &err)
-		return nil, fmt.Errorf("HTTP %d - %s: %s", response.StatusCode, err.Error.Code, err.Error.Message)
+		return nil, nil, &GraphError{
+			StatusCode: response.StatusCode,
+			Code:       err.Error.Code,
+			Message:    err.Error.Message,
+			RetryAfter: parseRetryAfter(response.Header.Get("Retry-After")),
+			Location:   response.Header.Get("Location"),
+		}
 	}
-	return body, nil
+	return response, body, nil
+}
+
+// doRequest performs a single attempt at an authenticated request and reads
+// the full response body.
+func doRequest(ctx context.Context, client *http.Client, resource string, auth *Auth, method string,
+	payload []byte, headers map[string]string, trace requestTrace) (*http.Response, []byte, error) {
+	transfer := isContentTransfer(resource)
+	var content io.Reader
+	if payload != nil {
+		content = bytes.NewReader(payload)
+		if transfer {
+			content = uploadLimiter.reader(content)
+		}
+	}
+	request, _ := http.NewRequestWithContext(ctx, method, auth.graphURL()+resource, content)
+	if payload != nil {
+		request.ContentLength = int64(len(payload))
+	}
+	request.Header.Add("Authorization", "bearer "+auth.accessToken())
+	switch method { // request type-specific code here
+	case "PATCH":
+		request.Header.Add("If-Match", "*")
+		request.Header.Add("Content-Type", "application/json")
+	case "POST":
+		request.Header.Add("Content-Type", "application/json")
+	case "PUT":
+		request.Header.Add("Content-Type", "text/plain")
+	}
+	for key, value := range headers {
+		request.Header.Set(key, value)
+	}
+	trace.setHeaders(request)
+
+	countRequest(method)
+	start := time.Now()
+	response, err := client.Do(request)
+	if err != nil {
+		recordRequest(resource, method, 0, time.Since(start))
+		trace.log(method, resource, nil, err, time.Since(start))
+		return nil, nil, err
+	}
+	var reader io.Reader = response.Body
+	if transfer {
+		reader = downloadLimiter.reader(reader)
+	}
+	// a truncated response must never be mistaken for a complete one
+	body, err := ioutil.ReadAll(reader)
+	response.Body.Close()
+	recordRequest(resource, method, response.StatusCode, time.Since(start))
+	trace.log(method, resource, response, err, time.Since(start))
+	if err != nil {
+		return nil, nil, err
+	}
+	return response, body, nil
 }
 
 // Get is a convenience wrapper around Request
@@ -124,7 +267,7 @@ func ChildrenPath(path string) string {
 
 // ChildrenPathID returns the API resource path of an item's children
 func ChildrenPathID(id string) string {
-	return "/me/drive/items/" + id + "/children"
+	return itemResource(id) + "/children"
 }
 
 // User represents the user. Currently only used to fetch the account email so
@@ -132,6 +275,7 @@ func ChildrenPathID(id string) string {
 // https://docs.microsoft.com/en-ca/graph/api/user-get
 type User struct {
 	UserPrincipalName string `json:"userPrincipalName"`
+	DisplayName       string `json:"displayName,omitempty"`
 }
 
 // GetUser fetches the current user details from the Graph API.
@@ -159,23 +303,57 @@ type DriveQuota struct {
 // https://docs.microsoft.com/en-us/onedrive/developer/rest-api/resources/drive
 type Drive struct {
 	ID        string     `json:"id"`
-	DriveType string     `json:"driveType"` // personal or business
+	Name      string     `json:"name,omitempty"`
+	DriveType string     `json:"driveType"` // personal, business or documentLibrary
 	Quota     DriveQuota `json:"quota,omitempty"`
+	Owner     struct {
+		User struct {
+			DisplayName string `json:"displayName"`
+		} `json:"user"`
+	} `json:"owner,omitempty"`
 }
 
-// GetDrive is used to fetch the details of the user's OneDrive.
+// GetDrive is used to fetch the details of the user's OneDrive. For work and
+// school accounts whose default drive cannot be fetched directly, the drive is
+// discovered from the list of drives the user has access to.
 func GetDrive(auth *Auth) (Drive, error) {
 	resp, err := Get("/me/drive", auth)
 	drive := Drive{}
 	if err != nil {
+		var graphErr *GraphError
+		if !errors.As(err, &graphErr) || graphErr.StatusCode != 404 {
+			return drive, err
+		}
+		drives, listErr := GetDrives(auth)
+		if listErr != nil {
+			return drive, err
+		}
+		for _, candidate := range drives {
+			if candidate.DriveType == "business" {
+				return candidate, nil
+			}
+		}
 		return drive, err
 	}
 	return drive, json.Unmarshal(resp, &drive)
 }
 
+// GetDrives lists all drives available to the user. Personal accounts only
+// ever have one, work and school accounts may have several.
+func GetDrives(auth *Auth) ([]Drive, error) {
+	resp, err := Get("/me/drives", auth)
+	if err != nil {
+		return nil, err
+	}
+	var drives struct {
+		Value []Drive `json:"value"`
+	}
+	return drives.Value, json.Unmarshal(resp, &drives)
+}
+
 // GetItem fetches a DriveItem by ID. ID can also be "root" for the root item.
 func GetItem(id string, auth *Auth) (*Inode, error) {
-	path := "/me/drive/items/" + id
+	path := itemResource(id)
 	if id == "root" {
 		path = "/me/drive/root"
 	}
@@ -186,6 +364,10 @@ func GetItem(id string, auth *Auth) (*Inode, error) {
 	}
 	inode := &Inode{}
 	err = json.Unmarshal(body, inode)
+	inode.IDInternal = sameDrive(id, inode.IDInternal)
+	if inode.DriveItem.Parent != nil {
+		inode.DriveItem.Parent.ID = sameDrive(id, inode.DriveItem.Parent.ID)
+	}
 	return inode, err
 }
 
@@ -201,14 +383,63 @@ func GetItemPath(path string, auth *Auth) (*Inode, error) {
 	return inode, err
 }
 
+// GetChildren lists the children of the item at path, following every page of
+// results the server splits them into.
+func GetChildren(path string, auth *Auth) ([]*Inode, error) {
+	children := make([]*Inode, 0)
+	resource := ChildrenPath(path)
+	for resource != "" {
+		body, err := Get(resource, auth)
+		if err != nil {
+			return nil, err
+		}
+		var page driveChildren
+		if err = json.Unmarshal(body, &page); err != nil {
+			return nil, err
+		}
+		children = append(children, page.Children...)
+		resource = strings.TrimPrefix(page.NextLink, auth.graphURL())
+	}
+	return children, nil
+}
+
 // GetItemContent retrieves an item's content from the Graph endpoint.
 func GetItemContent(id string, auth *Auth) ([]byte, error) {
-	return Get("/me/drive/items/"+id+"/content", auth)
+	return Get(itemResource(id)+"/content", auth)
+}
+
+// GetItemContentRange fetches part of the content of an item. Fewer bytes than
+// asked for are returned if the range extends past the end of the item.
+func GetItemContentRange(id string, auth *Auth, offset uint64, length uint64) ([]byte, error) {
+	body, err := getItemContentRange(context.Background(), id, auth, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(body)) > length {
+		// the server ignored the range and sent everything
+		if offset >= uint64(len(body)) {
+			return []byte{}, nil
+		}
+		body = body[offset:]
+		if uint64(len(body)) > length {
+			body = body[:length]
+		}
+	}
+	return body, nil
+}
+
+// getItemContentRange requests part of the content of an item, giving up if ctx
+// is cancelled. Servers that don't support range requests send the entire
+// content instead, which callers can tell from it being longer than they asked
+// for.
+func getItemContentRange(ctx context.Context, id string, auth *Auth, offset uint64, length uint64) ([]byte, error) {
+	return request(ctx, itemResource(id)+"/content", auth, "GET", nil,
+		map[string]string{"Range": fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)})
 }
 
 // Remove removes a directory or file by ID
 func Remove(id string, auth *Auth) error {
-	return Delete("/me/drive/items/"+id, auth)
+	return Delete(itemResource(id), auth)
 }
 
 // Mkdir creates a directory on the server at the specified parent ID.
@@ -226,41 +457,184 @@ func Mkdir(name string, parentID string, auth *Auth) (*Inode, error) {
 
 	item := NewInode(name, 0755|fuse.S_IFDIR, nil)
 	err = json.Unmarshal(resp, &item)
+	item.IDInternal = sameDrive(parentID, item.IDInternal)
 	return item, err
 }
 
 // Rename moves and/or renames an item on the server. The itemName and parentID
-// arguments correspond to the *new* basename or id of the parent.
+// arguments correspond to the *new* basename or id of the parent. Items can't
+// be moved to another drive.
 func Rename(itemID string, itemName string, parentID string, auth *Auth) error {
+	if driveOf(itemID) != driveOf(parentID) {
+		return errors.New("items cannot be moved between drives")
+	}
+	_, parentItemID := splitDriveItemID(parentID)
 	// start creating patch content for server
 	// mutex does not need to be initialized since it is never used locally
 	patchContent := DriveItem{
 		ConflictBehavior: "replace", // overwrite existing content at new location
 		NameInternal:     itemName,
 		Parent: &DriveItemParent{
-			ID: parentID,
+			ID: parentItemID,
 		},
 	}
 
 	// apply patch to server copy - note that we don't actually care about the
 	// response content, only if it returns an error
 	jsonPatch, _ := json.Marshal(patchContent)
-	_, err := Patch("/me/drive/items/"+itemID, auth, bytes.NewReader(jsonPatch))
+	_, err := Patch(itemResource(itemID), auth, bytes.NewReader(jsonPatch))
 	if err != nil && strings.Contains(err.Error(), "resourceModified") {
 		// Wait a second, then retry the request. The Onedrive servers sometimes
 		// aren't quick enough here if the object has been recently created
 		// (<1 second ago).
 		time.Sleep(time.Second)
-		_, err = Patch("/me/drive/items/"+itemID, auth, bytes.NewReader(jsonPatch))
+		_, err = Patch(itemResource(itemID), auth, bytes.NewReader(jsonPatch))
 	}
 	return err
 }
 
-// IsOffline checks if an error is indicative of being offline.
+// SetModTime sets the modification time of an item, as reported through its
+// fileSystemInfo facet.
+func SetModTime(itemID string, mtime time.Time, auth *Auth) error {
+	mtime = mtime.UTC()
+	patch, _ := json.Marshal(DriveItem{
+		FileSystemInfo: &FileSystemInfo{LastModifiedDateTime: &mtime},
+	})
+	_, err := Patch(itemResource(itemID), auth, bytes.NewReader(patch))
+	return err
+}
+
+// copyTimeout is how long to wait for the server to finish copying an item.
+var copyTimeout = 5 * time.Minute
+
+// copyStatus is the progress of a copy, as reported by its monitor URL.
+// https://docs.microsoft.com/en-us/onedrive/developer/rest-api/resources/asyncjobstatus
+type copyStatus struct {
+	Status     string `json:"status"`
+	ResourceID string `json:"resourceId"`
+}
+
+// Copy copies an item on the server, without its content ever passing through
+// us. The itemName and parentID arguments correspond to the basename and parent
+// id of the copy, which replaces any item already there. Returns the ID of the
+// copy once the server has finished making it. Copies stay in the drive of the
+// original.
+func Copy(itemID string, itemName string, parentID string, auth *Auth) (string, error) {
+	if driveOf(itemID) != driveOf(parentID) {
+		return "", errors.New("items cannot be copied between drives")
+	}
+	_, parentItemID := splitDriveItemID(parentID)
+	body, _ := json.Marshal(DriveItem{
+		NameInternal: itemName,
+		Parent:       &DriveItemParent{ID: parentItemID},
+	})
+	resp, _, err := requestResponse(
+		context.Background(),
+		itemResource(itemID)+"/copy?@microsoft.graph.conflictBehavior=replace",
+		auth, "POST", bytes.NewReader(body), nil,
+	)
+	if err != nil {
+		return "", err
+	}
+	monitor := resp.Header.Get("Location")
+	if monitor == "" {
+		return "", errors.New("server did not return a monitor URL for the copy")
+	}
+	copyID, err := waitForCopy(monitor, copyTimeout)
+	return sameDrive(parentID, copyID), err
+}
+
+// waitForCopy polls the monitor URL of a copy until the server has finished
+// making it, and returns the ID of the copy. Monitor URLs are preauthenticated
+// and must not be sent our access token.
+func waitForCopy(monitor string, timeout time.Duration) (string, error) {
+	client := httpClient(15 * time.Second)
+	// once done, the monitor may redirect to the copy rather than describe it
+	client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	deadline := time.Now().Add(timeout)
+	delay := 250 * time.Millisecond
+	for {
+		resp, err := client.Get(monitor)
+		if err != nil {
+			return "", err
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return "", err
+		}
+
+		var status copyStatus
+		switch {
+		case resp.StatusCode >= 300 && resp.StatusCode < 400:
+			location := resp.Header.Get("Location")
+			if idx := strings.LastIndex(location, "/items/"); idx >= 0 {
+				status.Status = "completed"
+				status.ResourceID = strings.SplitN(location[idx+len("/items/"):], "?", 2)[0]
+			}
+		case resp.StatusCode >= 400:
+			var graphErr graphError
+			json.Unmarshal(body, &graphErr)
+			return "", &GraphError{
+				StatusCode: resp.StatusCode,
+				Code:       graphErr.Error.Code,
+				Message:    graphErr.Error.Message,
+			}
+		default:
+			json.Unmarshal(body, &status)
+		}
+
+		switch status.Status {
+		case "completed":
+			if status.ResourceID == "" {
+				return "", errors.New("copy completed without an item ID")
+			}
+			return status.ResourceID, nil
+		case "failed", "deleteFailed", "cancelled":
+			return "", fmt.Errorf("copy %s", status.Status)
+		}
+
+		if time.Now().After(deadline) {
+			return "", errors.New("timed out waiting for copy to complete")
+		}
+		time.Sleep(delay)
+		if delay < 5*time.Second {
+			delay *= 2
+		}
+	}
+}
+
+// IsOffline checks if an error is indicative of being offline: the network is
+// down, the server can't be resolved or reached, or it is reachable but
+// answering that it can't serve anything right now.
 func IsOffline(err error) bool {
-	if err == nil {
+	if err == nil || errors.Is(err, context.Canceled) {
 		return false
 	}
-	return strings.Contains(err.Error(), "network is unreachable") ||
-		strings.Contains(err.Error(), "connection refused")
+	var graphErr *GraphError
+	if errors.As(err, &graphErr) {
+		// 503 is the server throttling us, see IsThrottled
+		return graphErr.StatusCode == http.StatusBadGateway ||
+			graphErr.StatusCode == http.StatusGatewayTimeout
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		// covers DNS failures, timeouts and refused or reset connections
+		return true
+	}
+	for _, reason := range []string{
+		"network is unreachable",
+		"connection refused",
+		"connection reset",
+		"no route to host",
+		"no such host",
+	} {
+		if strings.Contains(err.Error(), reason) {
+			return true
+		}
+	}
+	return false
 }
@@ -2,8 +2,13 @@ package graph
 
 import (
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"hash"
+	"io"
+	"strings"
 
 	"github.com/rclone/rclone/backend/onedrive/quickxorhash"
 )
@@ -13,6 +18,11 @@ func SHA1Hash(data *[]byte) string {
 	return fmt.Sprintf("%x", sha1.Sum(*data))
 }
 
+// SHA256Hash returns the SHA256 hash of some data as a string
+func SHA256Hash(data *[]byte) string {
+	return fmt.Sprintf("%x", sha256.Sum256(*data))
+}
+
 // QuickXORHash computes the Microsoft-specific QuickXORHash. Reusing rclone's
 // implementation until I get the chance to rewrite/add test cases to remove the
 // dependency.
@@ -20,3 +30,84 @@ func QuickXORHash(data *[]byte) string {
 	hash := quickxorhash.Sum(*data)
 	return base64.StdEncoding.EncodeToString(hash[:])
 }
+
+// how many times a download is attempted when its content does not match the
+// hash the server reported for it
+const transferAttempts = 3
+
+// errHashMismatch means content was corrupted on its way to or from the server.
+var errHashMismatch = errors.New("content does not match the hash reported by the server")
+
+// verifyContent checks content against the hash the server reported for it,
+// using QuickXorHash when available (it is reported for every type of drive),
+// and otherwise SHA256 or SHA1. Content is accepted if there is no hash to
+// check it against.
+func verifyContent(content io.Reader, hashes Hashes) error {
+	var wanted string
+	var h hash.Hash
+	encode := func(sum []byte) string { return fmt.Sprintf("%x", sum) }
+	switch {
+	case hashes.QuickXorHash != "":
+		// base64, so case matters
+		wanted, h = hashes.QuickXorHash, quickxorhash.New()
+		encode = base64.StdEncoding.EncodeToString
+	case hashes.SHA256Hash != "":
+		wanted, h = strings.ToLower(hashes.SHA256Hash), sha256.New()
+	case hashes.SHA1Hash != "":
+		wanted, h = strings.ToLower(hashes.SHA1Hash), sha1.New()
+	default:
+		return nil
+	}
+	if _, err := io.Copy(h, content); err != nil {
+		return err
+	}
+	if actual := encode(h.Sum(nil)); wanted != actual {
+		return fmt.Errorf("%w (wanted %s, got %s)", errHashMismatch, wanted, actual)
+	}
+	return nil
+}
+
+// sameContent returns whether two sets of hashes describe the same content.
+// Only hashes present in both sets are compared, and there must be at least
+// one.
+func sameContent(a Hashes, b Hashes) bool {
+	switch {
+	case a.QuickXorHash != "" && b.QuickXorHash != "":
+		return a.QuickXorHash == b.QuickXorHash
+	case a.SHA256Hash != "" && b.SHA256Hash != "":
+		return strings.EqualFold(a.SHA256Hash, b.SHA256Hash)
+	case a.SHA1Hash != "" && b.SHA1Hash != "":
+		return strings.EqualFold(a.SHA1Hash, b.SHA1Hash)
+	}
+	return false
+}
+
+// hashReader returns a hash of everything read from r, hex encoded like
+// SHA1Hash.
+func hashReader(h hash.Hash, r io.Reader) (string, error) {
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// QuickXORHashReader is QuickXORHash for content read from r.
+func QuickXORHashReader(r io.Reader) (string, error) {
+	h := quickxorhash.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
+// contentHashes returns the hashes the server would report for some content.
+// Personal drives use SHA1, business drives QuickXorHash.
+func contentHashes(driveType string, content *buffer) *File {
+	file := &File{}
+	if driveType == "personal" {
+		file.Hashes.SHA1Hash, _ = hashReader(sha1.New(), content.Reader())
+	} else {
+		file.Hashes.QuickXorHash, _ = QuickXORHashReader(content.Reader())
+	}
+	return file
+}
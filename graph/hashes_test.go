@@ -0,0 +1,56 @@
+package graph
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// Content should be checked against the best hash available, and accepted if
+// there is none.
+func TestVerifyContent(t *testing.T) {
+	t.Parallel()
+	content := []byte("some content")
+	other := []byte("other content")
+	quickXor := Hashes{QuickXorHash: QuickXORHash(&content), SHA1Hash: "ignored"}
+	// the server reports hex hashes in upper case
+	sha256 := Hashes{SHA256Hash: strings.ToUpper(SHA256Hash(&content))}
+	sha1 := Hashes{SHA1Hash: strings.ToUpper(SHA1Hash(&content))}
+
+	for _, hashes := range []Hashes{quickXor, sha256, sha1, {}} {
+		if err := verifyContent(bytes.NewReader(content), hashes); err != nil {
+			t.Errorf("Content did not match %+v: %s", hashes, err)
+		}
+	}
+	for _, hashes := range []Hashes{quickXor, sha256, sha1} {
+		if err := verifyContent(bytes.NewReader(other), hashes); !errors.Is(err, errHashMismatch) {
+			t.Errorf("Wrong content matched %+v", hashes)
+		}
+	}
+}
+
+// Locally computed hashes are compared against whichever hash the server
+// reported in the same format.
+func TestSameContent(t *testing.T) {
+	t.Parallel()
+	content := []byte("some content")
+	other := []byte("other content")
+	remote := Hashes{
+		SHA1Hash:     strings.ToUpper(SHA1Hash(&content)),
+		QuickXorHash: QuickXORHash(&content),
+	}
+
+	if !sameContent(remote, Hashes{SHA1Hash: SHA1Hash(&content)}) {
+		t.Error("SHA1 hashes differing only in case did not match.")
+	}
+	if !sameContent(remote, Hashes{QuickXorHash: QuickXORHash(&content)}) {
+		t.Error("Identical QuickXorHashes did not match.")
+	}
+	if sameContent(remote, Hashes{QuickXorHash: QuickXORHash(&other)}) {
+		t.Error("Different content matched.")
+	}
+	if sameContent(Hashes{SHA1Hash: SHA1Hash(&content)}, Hashes{QuickXorHash: QuickXORHash(&content)}) {
+		t.Error("Hashes with nothing to compare matched.")
+	}
+}
@@ -0,0 +1,48 @@
+package graph
+
+import "time"
+
+// Health is what a running filesystem reports about itself to
+// "onedriver health".
+type Health struct {
+	SignedIn     bool          `json:"signedIn"` // false once the tokens can't be renewed
+	Paused       bool          `json:"paused"`
+	Offline      string        `json:"offline,omitempty"` // why, if offline
+	Loaded       time.Time     `json:"loaded"`
+	LastDelta    time.Time     `json:"lastDelta"` // zero if changes were never fetched
+	PollInterval time.Duration `json:"pollInterval"`
+}
+
+// SyncAge returns how long it has been since changes were last fetched from
+// the server, or since the cache was loaded if they never were.
+func (h Health) SyncAge(now time.Time) time.Duration {
+	if h.LastDelta.IsZero() {
+		return now.Sub(h.Loaded)
+	}
+	return now.Sub(h.LastDelta)
+}
+
+// Health reports whether the filesystem is still signed in and keeping up
+// with changes on the server.
+func (c *Cache) Health() Health {
+	c.counters.mutex.Lock()
+	lastDelta := c.counters.lastDelta
+	c.counters.mutex.Unlock()
+
+	auth := c.GetAuth()
+	connection := c.Connection()
+	c.RLock()
+	health := Health{
+		SignedIn:     auth == nil || !auth.ReauthRequired(),
+		Paused:       c.paused,
+		Offline:      connection.Error,
+		Loaded:       c.loaded,
+		LastDelta:    lastDelta,
+		PollInterval: c.pollInterval,
+	}
+	c.RUnlock()
+	if !connection.Online && health.Offline == "" {
+		health.Offline = "offline"
+	}
+	return health
+}
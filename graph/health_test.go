@@ -0,0 +1,32 @@
+package graph
+
+import (
+	"testing"
+	"time"
+)
+
+// How long a cache has gone without fetching changes should count from when it
+// was loaded until it first does.
+func TestHealth(t *testing.T) {
+	t.Parallel()
+	loaded := time.Now().Add(-time.Hour)
+	cache := &Cache{loaded: loaded, pollInterval: time.Minute}
+	cache.offline = true
+
+	health := cache.Health()
+	if !health.SignedIn {
+		t.Error("A cache without tokens to renew should not need a sign in.")
+	}
+	if health.Offline == "" {
+		t.Error("Being offline should be reported.")
+	}
+	if age := health.SyncAge(loaded.Add(time.Minute)); age != time.Minute {
+		t.Errorf("Expected a sync age of 1m counted from loading, got %s.", age)
+	}
+
+	polled := loaded.Add(30 * time.Minute)
+	cache.counters.delta(polled)
+	if age := cache.Health().SyncAge(polled.Add(time.Second)); age != time.Second {
+		t.Errorf("Expected a sync age of 1s counted from the last poll, got %s.", age)
+	}
+}
@@ -0,0 +1,59 @@
+package graph
+
+// ChangeType describes what kind of server-side change was applied to an item.
+type ChangeType int
+
+// types of remote changes
+const (
+	ChangeCreated ChangeType = iota
+	ChangeModified
+	ChangeMoved
+	ChangeDeleted
+	ChangeConflicted
+)
+
+func (c ChangeType) String() string {
+	switch c {
+	case ChangeCreated:
+		return "created"
+	case ChangeModified:
+		return "modified"
+	case ChangeMoved:
+		return "moved"
+	case ChangeDeleted:
+		return "deleted"
+	case ChangeConflicted:
+		return "conflicted"
+	default:
+		return "unknown"
+	}
+}
+
+// RemoteChangeHook is called whenever a server-side change is applied to the
+// local cache. The DriveItem is a copy of the server's version of the item.
+type RemoteChangeHook func(item DriveItem, change ChangeType)
+
+// OnRemoteChange registers a hook to be called when a server-side change is
+// applied. Hooks are called synchronously from the delta goroutine, so they
+// should return quickly and must not call back into the delta loop.
+func (c *Cache) OnRemoteChange(hook RemoteChangeHook) {
+	c.Lock()
+	c.hooks = append(c.hooks, hook)
+	c.Unlock()
+}
+
+// fireRemoteChange notifies all registered hooks of a remote change.
+func (c *Cache) fireRemoteChange(delta *Inode, change ChangeType) {
+	c.RLock()
+	hooks := c.hooks
+	c.RUnlock()
+	if len(hooks) == 0 {
+		return
+	}
+	delta.mutex.RLock()
+	item := delta.DriveItem
+	delta.mutex.RUnlock()
+	for _, hook := range hooks {
+		hook(item, change)
+	}
+}
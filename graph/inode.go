@@ -1,9 +1,14 @@
 package graph
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha1"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"io"
 	"math/rand"
 	"os"
 	"path/filepath"
@@ -23,8 +28,9 @@ import (
 // https://docs.microsoft.com/en-us/onedrive/developer/rest-api/resources/itemreference
 type DriveItemParent struct {
 	//TODO Path is technically available, but we shouldn't use it
-	Path string `json:"path,omitempty"`
-	ID   string `json:"id,omitempty"`
+	Path    string `json:"path,omitempty"`
+	ID      string `json:"id,omitempty"`
+	DriveID string `json:"driveId,omitempty"`
 }
 
 // Folder is used for parsing only
@@ -37,6 +43,7 @@ type Folder struct {
 // https://docs.microsoft.com/en-us/onedrive/developer/rest-api/resources/hashes
 type Hashes struct {
 	SHA1Hash     string `json:"sha1Hash,omitempty"`
+	SHA256Hash   string `json:"sha256Hash,omitempty"`
 	QuickXorHash string `json:"quickXorHash,omitempty"`
 }
 
@@ -64,6 +71,9 @@ type DriveItem struct {
 	FileInternal     *File            `json:"file,omitempty"`
 	Deleted          *Deleted         `json:"deleted,omitempty"`
 	ConflictBehavior string           `json:"@microsoft.graph.conflictBehavior,omitempty"`
+	FileSystemInfo   *FileSystemInfo  `json:"fileSystemInfo,omitempty"`
+	ETag             string           `json:"eTag,omitempty"`
+	WebURL           string           `json:"webUrl,omitempty"`
 }
 
 // Inode represents a file or folder fetched from the Graph API. All struct
@@ -82,8 +92,10 @@ type Inode struct {
 	cache         *Cache
 	children      []string       // a slice of ids, nil when uninitialized
 	uploadSession *UploadSession // current upload session, or nil
-	data          *[]byte        // empty by default
+	data          *buffer        // content of an open file, nil when closed
 	hasChanges    bool           // used to trigger an upload on flush
+	pendingRemote *DriveItem     // remote content change deferred until close
+	stream        *stream        // content still being streamed in, see stream.go
 	subdir        uint32         // used purely by NLink()
 	mode          uint32         // do not set manually
 }
@@ -105,7 +117,6 @@ func NewInode(name string, mode uint32, parent *Inode) *Inode {
 		itemParent.Path = parent.Path()
 	}
 
-	var empty []byte
 	currentTime := time.Now()
 	return &Inode{
 		DriveItem: DriveItem{
@@ -115,7 +126,7 @@ func NewInode(name string, mode uint32, parent *Inode) *Inode {
 			ModTimeInternal: &currentTime,
 		},
 		children: make([]string, 0),
-		data:     &empty,
+		data:     &buffer{},
 		mode:     mode,
 	}
 }
@@ -186,6 +197,30 @@ func isLocalID(id string) bool {
 	return strings.HasPrefix(id, "local-") || id == ""
 }
 
+// inodeNumber derives an inode number from an item ID, so that an item keeps
+// the same inode number across renames and remounts. Items that have not been
+// uploaded yet keep the number derived from their local ID until remounted.
+func inodeNumber(id string) uint64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(id))
+	// go-fuse hands out numbers from 1<<63 upwards itself, stay below those
+	ino := hash.Sum64() >> 1
+	if ino <= 1 {
+		// 0 means "pick one for me" to go-fuse, and 1 is the root
+		ino += 2
+	}
+	return ino
+}
+
+// stableAttr returns the attributes go-fuse identifies an item's kernel inode
+// by.
+func (i *Inode) stableAttr() fs.StableAttr {
+	return fs.StableAttr{
+		Mode: i.Mode() & fuse.S_IFDIR,
+		Ino:  inodeNumber(i.ID()),
+	}
+}
+
 // ID returns the internal ID of the item
 func (i *Inode) ID() string {
 	i.mutex.RLock()
@@ -213,31 +248,40 @@ func (i *Inode) GetCache() *Cache {
 // Statfs returns information about the filesystem. Mainly useful for checking
 // quotas and storage limits.
 func (i *Inode) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
+	defer i.timeOp("STATFS", "")()
 	log.WithFields(log.Fields{"path": i.Path()}).Debug()
-	drive, err := GetDrive(i.GetCache().GetAuth())
+	drive, err := i.GetCache().GetDrive()
 	if err != nil {
 		return syscall.EREMOTEIO
 	}
+	drive.statfs(out)
+	return 0
+}
 
-	if drive.DriveType == "personal" {
-		log.Warn("Personal OneDrive accounts do not show number of files, " +
-			"inode counts reported by onedriver will be bogus.")
-	}
-
+// statfs fills out filesystem statistics from a drive's quota.
+func (d Drive) statfs(out *fuse.StatfsOut) {
 	// limits are pasted from https://support.microsoft.com/en-us/help/3125202
 	const blkSize uint64 = 4096 // default ext4 block size
+	const maxFiles uint64 = 100000
 	out.Bsize = uint32(blkSize)
-	out.Blocks = drive.Quota.Total / blkSize
-	out.Bfree = drive.Quota.Remaining / blkSize
-	out.Bavail = drive.Quota.Remaining / blkSize
-	out.Files = 100000
-	out.Ffree = 100000 - drive.Quota.FileCount
+	out.Blocks = d.Quota.Total / blkSize
+	// business drives may report used space without a remaining figure
+	remaining := d.Quota.Remaining
+	if remaining == 0 && d.Quota.Total > d.Quota.Used {
+		remaining = d.Quota.Total - d.Quota.Used
+	}
+	out.Bfree = remaining / blkSize
+	out.Bavail = remaining / blkSize
+	out.Files = maxFiles
+	if d.Quota.FileCount < maxFiles {
+		out.Ffree = maxFiles - d.Quota.FileCount
+	}
 	out.NameLen = 260
-	return 0
 }
 
 // Readdir returns a list of directory entries (formerly OpenDir).
 func (i *Inode) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	defer i.timeOp("READDIR", "")()
 	log.WithFields(log.Fields{
 		"path": i.Path(),
 		"id":   i.ID(),
@@ -261,6 +305,7 @@ func (i *Inode) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
 		entry := fuse.DirEntry{
 			Name: child.Name(),
 			Mode: child.Mode(),
+			Ino:  inodeNumber(child.ID()),
 		}
 		entries = append(entries, entry)
 	}
@@ -269,6 +314,7 @@ func (i *Inode) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
 
 // Lookup an individual child of an inode.
 func (i *Inode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	defer i.timeOp("LOOKUP", name)()
 	if ignore(name) {
 		return nil, syscall.ENOENT
 	}
@@ -280,11 +326,31 @@ func (i *Inode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*f
 
 	cache := i.GetCache()
 	child, _ := cache.GetChild(i.ID(), strings.ToLower(name), cache.GetAuth())
+	if child == nil && name == versionsFolderName {
+		// hidden from listings, but there all the same
+		child = cache.versionsFolder(i)
+	}
 	if child == nil {
 		return nil, syscall.ENOENT
 	}
+	node := i.NewInode(ctx, child, child.stableAttr())
+	if known, ok := node.Operations().(*Inode); ok && known != child {
+		// The kernel still knows this item through a copy the cache has since
+		// replaced. go-fuse will only ever use that copy, so put it back.
+		log.WithFields(log.Fields{
+			"path": known.Path(),
+			"id":   known.ID(),
+		}).Debug("Reusing item already known to the kernel.")
+		if isVersions(known.ID()) {
+			// must not end up among the children of the folder it is in
+			cache.metadata.Store(known.ID(), known)
+		} else {
+			cache.InsertID(known.ID(), known)
+		}
+		child = known
+	}
 	out.Attr = child.makeattr()
-	return i.NewInode(ctx, child, fs.StableAttr{Mode: child.Mode() & fuse.S_IFDIR}), 0
+	return node, 0
 }
 
 // RemoteID uploads an empty file to obtain a Onedrive ID if it doesn't already
@@ -300,8 +366,8 @@ func (i *Inode) RemoteID(auth *Auth) (string, error) {
 	}
 
 	originalID := i.ID()
-	if isLocalID(originalID) && auth.AccessToken != "" {
-		uploadPath := fmt.Sprintf("/me/drive/items/%s:/%s:/content", i.ParentID(), i.Name())
+	if isLocalID(originalID) && auth.accessToken() != "" {
+		uploadPath := fmt.Sprintf("%s:/%s:/content", itemResource(i.ParentID()), i.Name())
 		resp, err := Put(uploadPath, auth, strings.NewReader(""))
 		if err != nil {
 			if strings.Contains(err.Error(), "nameAlreadyExists") {
@@ -334,7 +400,7 @@ func (i *Inode) RemoteID(auth *Auth) (string, error) {
 			return originalID, err
 		}
 		// this is all we really wanted from this transaction
-		newID := unsafe.ID()
+		newID := sameDrive(i.ParentID(), unsafe.ID())
 		err = i.GetCache().MoveID(originalID, newID)
 		return newID, err
 	}
@@ -361,77 +427,126 @@ func (i *Inode) Path() string {
 
 // Read from an Inode like a file
 func (i *Inode) Read(ctx context.Context, f fs.FileHandle, buf []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	defer i.timeOp("READ", "")()
 	path := i.Path()
 	if !i.HasContent() {
-		log.WithFields(log.Fields{
-			"id":   i.ID(),
-			"path": path,
-		}).Warn("Read called on a closed file descriptor! Reopening file for op.")
-		i.Open(ctx, 0)
+		// a placeholder, or a file that was closed in the meantime
+		if errno := i.hydrate(); errno != 0 {
+			return fuse.ReadResultData(make([]byte, 0)), errno
+		}
+	}
+
+	i.mutex.RLock()
+	s := i.stream
+	i.mutex.RUnlock()
+	if s != nil {
+		// content is still arriving, must not hold the lock while we wait
+		n, err := s.ReadAt(buf, off)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"id":   i.ID(),
+				"path": path,
+				"err":  err,
+			}).Error("Could not read streamed content.")
+			if errors.Is(err, errHashMismatch) {
+				return fuse.ReadResultData(make([]byte, 0)), syscall.EIO
+			}
+			return fuse.ReadResultData(make([]byte, 0)), syscall.EREMOTEIO
+		}
+		return fuse.ReadResultData(buf[:n]), 0
 	}
 
 	// we are locked for the remainder of this op
 	i.mutex.RLock()
 	defer i.mutex.RUnlock()
+	if i.data == nil {
+		// a stream that just finished was dropped by a concurrent Flush
+		return fuse.ReadResultData(make([]byte, 0)), syscall.EREMOTEIO
+	}
 
-	end := int(off) + int(len(buf))
-	oend := end
-	size := len(*i.data) // worse than using i.size(), but some edge cases require it
-	if int(off) > size {
+	size := i.data.Size() // worse than using i.size(), but some edge cases require it
+	if off > size {
 		log.WithFields(log.Fields{
 			"id":        i.IDInternal,
 			"path":      path,
-			"bufsize":   int64(end) - off,
+			"bufsize":   len(buf),
 			"file_size": size,
 			"offset":    off,
 		}).Error("Offset was beyond file end (Onedrive metadata was wrong!). Refusing op.")
 		return fuse.ReadResultData(make([]byte, 0)), syscall.EINVAL
 	}
-	if end > size {
-		end = size
+	n, err := i.data.ReadAt(buf, off)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"id":   i.IDInternal,
+			"path": path,
+			"err":  err,
+		}).Error("Could not read file content from disk.")
+		return fuse.ReadResultData(make([]byte, 0)), syscall.EIO
 	}
 	log.WithFields(log.Fields{
 		"id":               i.IDInternal,
 		"path":             path,
-		"original_bufsize": int64(oend) - off,
-		"bufsize":          int64(end) - off,
+		"original_bufsize": len(buf),
+		"bufsize":          n,
 		"file_size":        size,
 		"offset":           off,
 	}).Trace("Read file")
-	return fuse.ReadResultData((*i.data)[off:end]), 0
+	return fuse.ReadResultData(buf[:n]), 0
 }
 
 // Write to an Inode like a file. Note that changes are 100% local until
 // Flush() is called.
 func (i *Inode) Write(ctx context.Context, f fs.FileHandle, data []byte, off int64) (uint32, syscall.Errno) {
+	defer i.timeOp("WRITE", "")()
 	nWrite := len(data)
-	offset := int(off)
 	log.WithFields(log.Fields{
 		"id":      i.ID(),
 		"path":    i.Path(),
 		"bufsize": nWrite,
 		"offset":  off,
 	}).Tracef("Write file")
+	if i.GetCache().IsReadOnly() {
+		return 0, syscall.EROFS
+	}
 
 	if !i.HasContent() {
 		log.WithFields(log.Fields{
 			"id":   i.ID(),
 			"path": i.Path(),
 		}).Warn("Write called on a closed file descriptor! Reopening file for write op.")
-		i.Open(ctx, 0)
+		if errno := i.hydrate(); errno != 0 {
+			return 0, errno
+		}
+	}
+	if errno := i.finishStream(); errno != 0 {
+		return 0, errno
 	}
 
 	i.mutex.Lock()
 	defer i.mutex.Unlock()
-	if offset+nWrite > int(i.SizeInternal)-1 {
-		// we've exceeded the file size, overwrite via append
-		*i.data = append((*i.data)[:offset], data...)
-	} else {
-		// writing inside the current file, overwrite in place
-		copy((*i.data)[offset:], data)
-	}
-	// probably a better way to do this, but whatever
-	i.SizeInternal = uint64(len(*i.data))
+	if i.data == nil {
+		return 0, syscall.EREMOTEIO
+	}
+	if !i.hasChanges {
+		if err := i.logWrite(); err != nil {
+			log.WithFields(log.Fields{
+				"id":   i.IDInternal,
+				"name": i.NameInternal,
+				"err":  err,
+			}).Error("Could not journal write.")
+			return 0, syscall.EIO
+		}
+	}
+	if _, err := i.data.WriteAt(data, off); err != nil {
+		log.WithFields(log.Fields{
+			"id":   i.IDInternal,
+			"name": i.NameInternal,
+			"err":  err,
+		}).Error("Could not write file content to disk.")
+		return 0, syscall.EIO
+	}
+	i.SizeInternal = uint64(i.data.Size())
 	i.hasChanges = true
 
 	return uint32(nWrite), 0
@@ -441,7 +556,7 @@ func (i *Inode) Write(ctx context.Context, f fs.FileHandle, data []byte, off int
 func (i *Inode) HasContent() bool {
 	i.mutex.RLock()
 	defer i.mutex.RUnlock()
-	return i.data != nil
+	return i.data != nil || i.stream != nil
 }
 
 // HasChanges returns true if the file has local changes that haven't been
@@ -455,29 +570,83 @@ func (i *Inode) HasChanges() bool {
 // Fsync is a signal to ensure writes to the Inode are flushed to stable
 // storage. This method is used to trigger uploads of file content.
 func (i *Inode) Fsync(ctx context.Context, f fs.FileHandle, flags uint32) syscall.Errno {
+	defer i.timeOp("FSYNC", "")()
 	log.WithFields(log.Fields{
 		"id":   i.ID(),
 		"path": i.Path(),
 	}).Debug()
+	if i.HasChanges() && i.GetCache().IsReadOnly() {
+		// nothing is ever uploaded from a read-only filesystem
+		return syscall.EROFS
+	}
 	if i.HasChanges() {
 		i.mutex.Lock()
 		i.hasChanges = false
 
 		// recompute hashes when saving new content
-		i.FileInternal = &File{}
-		if i.cache.DriveType() == "personal" {
-			i.FileInternal.Hashes.SHA1Hash = SHA1Hash(i.data)
-		} else {
-			i.FileInternal.Hashes.QuickXorHash = QuickXORHash(i.data)
+		previous := i.FileInternal
+		i.FileInternal = contentHashes(i.cache.DriveType(), i.data)
+		if err := i.data.Sync(); err != nil {
+			log.WithFields(log.Fields{
+				"id":   i.IDInternal,
+				"name": i.NameInternal,
+				"err":  err,
+			}).Warn("Could not sync file content to disk.")
 		}
+		pending := i.pendingRemote
+		i.pendingRemote = nil
+		id := i.IDInternal
+		unchanged := pending == nil && previous != nil && !isLocalID(id) &&
+			sameContent(previous.Hashes, i.FileInternal.Hashes)
 		i.mutex.Unlock()
 
+		if pending != nil {
+			// the server changed while we had the file open and we wrote to it
+			i.cache.markConflict(i, &Inode{DriveItem: *pending})
+		}
+
+		// the previous hashes are only the server's if nothing else is on its
+		// way there
+		if unchanged && !i.cache.changes.hasContentChange(id) && !i.cache.uploads.HasPending(id) {
+			log.WithFields(log.Fields{
+				"id":   id,
+				"name": i.Name(),
+			}).Info("Content is identical to the server's, skipping upload.")
+			i.mutex.Lock()
+			i.FileInternal = previous
+			i.mutex.Unlock()
+			walClear(i.cache.db, id, OpWrite, 0)
+			if err := SetModTime(id, i.modTime(), i.cache.GetAuth()); err != nil {
+				log.WithFields(log.Fields{
+					"id":   id,
+					"name": i.Name(),
+					"err":  err,
+				}).Warn("Could not set modification time on server.")
+			}
+			return 0
+		}
+		i.cache.changes.track(i.ID(), i.Path(), OpWrite, StateQueued)
+
+		if i.cache.IsConflicted(i.ID()) {
+			// changes are kept locally until the conflict is resolved
+			log.WithFields(log.Fields{
+				"id":   i.ID(),
+				"name": i.Name(),
+			}).Warn("Item is conflicted, holding upload until resolved.")
+			i.cache.changes.setState(i.ID(), "", StateConflicted, nil)
+			i.mutex.RLock()
+			i.cache.insertBuffer(i.IDInternal, i.data)
+			i.mutex.RUnlock()
+			return 0
+		}
+
 		if err := i.cache.uploads.QueueUpload(i); err != nil {
 			log.WithFields(log.Fields{
 				"id":   i.ID(),
 				"name": i.Name(),
 				"err":  err,
 			}).Error("Error creating upload session.")
+			i.cache.changes.setState(i.ID(), "", StateFailed, err)
 			return syscall.EREMOTEIO
 		}
 		return 0
@@ -488,6 +657,7 @@ func (i *Inode) Fsync(ctx context.Context, f fs.FileHandle, flags uint32) syscal
 // Flush is called when a file descriptor is closed. Uses Fsync to perform file
 // uploads.
 func (i *Inode) Flush(ctx context.Context, f fs.FileHandle) syscall.Errno {
+	defer i.timeOp("FLUSH", "")()
 	log.WithFields(log.Fields{
 		"path": i.Path(),
 		"id":   i.ID(),
@@ -496,14 +666,43 @@ func (i *Inode) Flush(ctx context.Context, f fs.FileHandle) syscall.Errno {
 
 	// wipe data from memory to avoid mem bloat over time
 	i.mutex.Lock()
+	if i.stream != nil {
+		// not worth finishing a download nobody is reading anymore
+		i.stream.Cancel()
+		i.stream = nil
+	}
 	if i.data != nil {
-		i.cache.InsertContent(i.IDInternal, *i.data)
+		if !isVersion(i.IDInternal) {
+			i.cache.insertBuffer(i.IDInternal, i.data)
+		}
+		i.data.Close()
 		i.data = nil
 	}
+	pending := i.pendingRemote
+	i.pendingRemote = nil
 	i.mutex.Unlock()
+
+	if pending != nil {
+		// a remote change arrived while the file was open, apply it now
+		i.cache.overwriteContent(i, pending)
+	}
 	return 0
 }
 
+// who files are shown as belonging to, see SetOwner
+var ownerUID, ownerGID = uint32(os.Getuid()), uint32(os.Getgid())
+
+// SetOwner sets the user and group files are shown as belonging to, instead of
+// the ones onedriver runs as. Negative IDs are left as they are.
+func SetOwner(uid int, gid int) {
+	if uid >= 0 {
+		ownerUID = uint32(uid)
+	}
+	if gid >= 0 {
+		ownerGID = uint32(gid)
+	}
+}
+
 // makeattr a convenience function to create a set of filesystem attrs for use
 // with syscalls that use or modify attrs.
 func (i *Inode) makeattr() fuse.Attr {
@@ -516,8 +715,8 @@ func (i *Inode) makeattr() fuse.Attr {
 		Ctime: mtime,
 		Mode:  i.Mode(),
 		Owner: fuse.Owner{
-			Uid: uint32(os.Getuid()),
-			Gid: uint32(os.Getgid()),
+			Uid: ownerUID,
+			Gid: ownerGID,
 		},
 	}
 }
@@ -525,6 +724,7 @@ func (i *Inode) makeattr() fuse.Attr {
 // Getattr returns a the Inode as a UNIX stat. Holds the read mutex for all of
 // the "metadata fetch" operations.
 func (i *Inode) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	defer i.timeOp("GETATTR", "")()
 	log.WithFields(log.Fields{
 		"path": i.Path(),
 		"id":   i.ID(),
@@ -536,17 +736,42 @@ func (i *Inode) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut)
 // Setattr is the workhorse for setting filesystem attributes. Does the work of
 // operations like Utimens, Chmod, Chown (not implemented), and Truncate.
 func (i *Inode) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	defer i.timeOp("SETATTR", "")()
 	log.WithFields(log.Fields{
 		"path": i.Path(),
 		"id":   i.ID(),
 	}).Trace()
+	if i.GetCache().IsReadOnly() {
+		return syscall.EROFS
+	}
+	if isSharedFolder(i.ID()) || isRecycleFolder(i.ID()) || isRecycled(i.ID()) ||
+		isVersions(i.ID()) {
+		return syscall.EPERM
+	}
+	if size, valid := in.GetSize(); valid {
+		if size == 0 {
+			// none of the old content survives, no need to wait for the rest
+			i.cancelStream()
+		} else if errno := i.finishStream(); errno != 0 {
+			return errno
+		}
+		if i.HasContent() {
+			// the new content gets uploaded once the file is closed
+			i.GetCache().uploads.CancelUpload(i.ID())
+		}
+	}
 
 	isDir := i.IsDir() // holds an rlock
 	i.mutex.Lock()
 
 	// utimens
-	if mtime, valid := in.GetMTime(); valid {
+	mtime, mtimeValid := in.GetMTime()
+	if mtimeValid {
 		i.ModTimeInternal = &mtime
+		if i.FileSystemInfo == nil {
+			i.FileSystemInfo = &FileSystemInfo{}
+		}
+		i.FileSystemInfo.LastModifiedDateTime = &mtime
 	}
 
 	// chmod
@@ -560,18 +785,43 @@ func (i *Inode) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.SetAttrIn
 
 	// truncate
 	if size, valid := in.GetSize(); valid {
-		if size > i.SizeInternal {
-			// unlikely to be hit, but implementing just in case
-			extra := make([]byte, size-i.SizeInternal)
-			*i.data = append(*i.data, extra...)
-		} else {
-			*i.data = (*i.data)[:size]
+		if i.data != nil {
+			if err := i.logWrite(); err != nil {
+				log.WithFields(log.Fields{
+					"id":   i.IDInternal,
+					"name": i.NameInternal,
+					"err":  err,
+				}).Error("Could not journal truncate.")
+				i.mutex.Unlock()
+				return syscall.EIO
+			}
+			if err := i.data.Truncate(int64(size)); err != nil {
+				log.WithFields(log.Fields{
+					"id":   i.IDInternal,
+					"name": i.NameInternal,
+					"err":  err,
+				}).Error("Could not truncate file content.")
+			}
 		}
 		i.SizeInternal = size
 		i.hasChanges = true
 	}
 
+	// content changes carry the new mtime with them when uploaded, otherwise
+	// it has to be pushed by itself
+	id := i.IDInternal
+	pushMtime := mtimeValid && !i.hasChanges && !isLocalID(id)
 	i.mutex.Unlock()
+	if pushMtime {
+		cache := i.GetCache()
+		if err := SetModTime(id, mtime, cache.GetAuth()); err != nil {
+			log.WithFields(log.Fields{
+				"id":   id,
+				"path": i.Path(),
+				"err":  err,
+			}).Warn("Could not set modification time on server.")
+		}
+	}
 	out.Attr = i.makeattr()
 	return 0
 }
@@ -598,9 +848,19 @@ func (i *Inode) Mode() uint32 {
 // ModTime returns the Unix timestamp of last modification (to get a time.Time
 // struct, use time.Unix(int64(d.ModTime()), 0))
 func (i *Inode) ModTime() uint64 {
+	return uint64(i.modTime().Unix())
+}
+
+// modTime returns the time of last modification. The time set by the client
+// that wrote a file is preferred over when the server last changed it, which
+// is also bumped by renames and uploads.
+func (i *Inode) modTime() time.Time {
 	i.mutex.RLock()
 	defer i.mutex.RUnlock()
-	return uint64(i.ModTimeInternal.Unix())
+	if i.FileSystemInfo != nil && i.FileSystemInfo.LastModifiedDateTime != nil {
+		return *i.FileSystemInfo.LastModifiedDateTime
+	}
+	return *i.ModTimeInternal
 }
 
 // NLink gives the number of hard links to an inode (or child count if a
@@ -653,6 +913,7 @@ func Octal(i uint32) string {
 // Create a new local file. The server doesn't have this yet. The uint32 part of
 // the return are fuseflags.
 func (i *Inode) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (*fs.Inode, fs.FileHandle, uint32, syscall.Errno) {
+	defer i.timeOp("CREATE", name)()
 	path := i.Path()
 	id := i.ID()
 	log.WithFields(log.Fields{
@@ -663,46 +924,124 @@ func (i *Inode) Create(ctx context.Context, name string, flags uint32, mode uint
 	}).Debug()
 
 	cache := i.GetCache()
-	if cache.IsOffline() {
-		// nope, we are refusing op to avoid data loss later
+	if cache.IsReadOnly() {
+		return nil, nil, uint32(0), syscall.EROFS
+	}
+	if excluded(path, name) {
+		// it would never be uploaded
+		return nil, nil, uint32(0), syscall.EPERM
+	}
+	if isSharedFolder(id) || isRecycleFolder(id) || isRecycled(id) || isVersions(id) {
+		// only ever holds what others shared, what was deleted, or versions
+		return nil, nil, uint32(0), syscall.EPERM
+	}
+
+	inode := NewInode(name, mode, i)
+	_, err := walLog(cache.db, walEntry{
+		Op:       OpCreate,
+		ID:       inode.ID(),
+		ParentID: id,
+		Name:     name,
+		Mode:     mode,
+		ModTime:  inode.modTime(),
+		Queued:   cache.IsOffline(),
+	})
+	if err != nil {
 		log.WithFields(log.Fields{
 			"id":   id,
 			"path": path,
 			"name": name,
-		}).Warn("We are offline. Refusing Create() to avoid data loss later.")
-		return nil, nil, uint32(0), syscall.EROFS
+			"err":  err,
+		}).Error("Could not journal file creation.")
+		return nil, nil, uint32(0), syscall.EIO
 	}
-
-	inode := NewInode(name, mode, i)
 	cache.InsertChild(id, inode)
-	return i.NewInode(ctx, inode, fs.StableAttr{Mode: fuse.S_IFREG}), nil, uint32(0), 0
+	cache.changes.track(inode.ID(), inode.Path(), OpCreate, StateQueued)
+	return i.NewInode(ctx, inode, inode.stableAttr()), nil, uint32(0), 0
 }
 
 // Mkdir creates a directory.
 func (i *Inode) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	defer i.timeOp("MKDIR", name)()
 	log.WithFields(log.Fields{
 		"path": i.Path(),
 		"name": name,
 		"mode": Octal(mode),
 	}).Debug()
 	cache := i.GetCache()
+	if cache.IsReadOnly() {
+		return nil, syscall.EROFS
+	}
+	if excluded(i.Path(), name) || isSharedFolder(i.ID()) || isRecycleFolder(i.ID()) ||
+		isRecycled(i.ID()) || isVersions(i.ID()) {
+		return nil, syscall.EPERM
+	}
+	if cache.IsOffline() {
+		return i.mkdirOffline(ctx, name, mode)
+	}
 	auth := cache.GetAuth()
 
-	// create a new folder on the server
+	// create a new folder on the server, there's no item to track it by until
+	// the server gives us one
+	pending := localID()
+	cache.changes.track(pending, filepath.Join(i.Path(), name), OpCreate, StateInFlight)
 	item, err := Mkdir(name, i.ID(), auth)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"path": name,
 			"err":  err,
 		}).Error("Error during directory creation:")
+		cache.changes.setState(pending, OpCreate, StateFailed, err)
 		return nil, syscall.EREMOTEIO
 	}
+	cache.changes.done(pending, OpCreate)
+	cache.activity.record(activityLocal, "created", filepath.Join(i.Path(), name), "")
 	cache.InsertChild(i.ID(), item)
-	return i.NewInode(ctx, item, fs.StableAttr{Mode: fuse.S_IFDIR}), 0
+	return i.NewInode(ctx, item, item.stableAttr()), 0
+}
+
+// mkdirOffline creates a directory locally, it is created on the server once
+// we are back online.
+func (i *Inode) mkdirOffline(ctx context.Context, name string, mode uint32) (*fs.Inode, syscall.Errno) {
+	cache := i.GetCache()
+	inode := NewInode(name, mode|fuse.S_IFDIR, i)
+	inode.data = nil
+	_, err := walLog(cache.db, walEntry{
+		Op:       OpCreate,
+		ID:       inode.ID(),
+		ParentID: i.ID(),
+		Name:     name,
+		Mode:     mode | fuse.S_IFDIR,
+		ModTime:  inode.modTime(),
+		Queued:   true,
+	})
+	if err != nil {
+		log.WithFields(log.Fields{
+			"path": i.Path(),
+			"name": name,
+			"err":  err,
+		}).Error("Could not journal directory creation.")
+		return nil, syscall.EIO
+	}
+	cache.InsertChild(i.ID(), inode)
+	cache.changes.track(inode.ID(), inode.Path(), OpCreate, StateQueued)
+	return i.NewInode(ctx, inode, inode.stableAttr()), 0
 }
 
 // Unlink a child file.
 func (i *Inode) Unlink(ctx context.Context, name string) syscall.Errno {
+	defer i.timeOp("UNLINK", name)()
+	return i.remove(name)
+}
+
+// Rmdir deletes a child directory.
+func (i *Inode) Rmdir(ctx context.Context, name string) syscall.Errno {
+	defer i.timeOp("RMDIR", name)()
+	return i.remove(name)
+}
+
+// remove deletes a child file or directory.
+func (i *Inode) remove(name string) syscall.Errno {
 	log.WithFields(log.Fields{
 		"path": i.Path(),
 		"id":   i.ID(),
@@ -715,13 +1054,59 @@ func (i *Inode) Unlink(ctx context.Context, name string) syscall.Errno {
 		// the file we are unlinking never existed
 		return syscall.ENOENT
 	}
-	if cache.IsOffline() {
+	if cache.IsReadOnly() {
 		return syscall.EROFS
 	}
+	if isSharedFolder(i.ID()) || isSharedFolder(child.ID()) {
+		// deleting a shared item would delete it for its owner
+		return syscall.EPERM
+	}
+	if isRecycleFolder(i.ID()) || isRecycleFolder(child.ID()) || isRecycled(i.ID()) {
+		// Graph can't empty the recycle bin
+		return syscall.EPERM
+	}
+	if isVersions(i.ID()) {
+		// the server decides how many versions to keep
+		return syscall.EPERM
+	}
 
 	// if no ID, the item is local-only, and does not need to be deleted on the
 	// server
 	id := child.ID()
+	offline := cache.IsOffline() && !isLocalID(id)
+	child.mutex.RLock()
+	etag := child.ETag
+	child.mutex.RUnlock()
+	seq, err := walLog(cache.db, walEntry{
+		Op:      OpDelete,
+		ID:      id,
+		ModTime: time.Now(),
+		Queued:  offline,
+		ETag:    etag,
+	})
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":  err,
+			"id":   id,
+			"path": i.Path(),
+		}).Error("Could not journal delete.")
+		return syscall.EIO
+	}
+	if offline {
+		// deleted on the server once we are back online, nothing else about
+		// it needs to be sent anymore
+		cache.changes.track(id, child.Path(), OpDelete, StateQueued)
+		child.cancelTransfers()
+		for _, op := range []ChangeOp{OpCreate, OpWrite, OpRename} {
+			walClear(cache.db, id, op, 0)
+		}
+		cache.recycle(child)
+		cache.DeleteID(id)
+		cache.DeleteContent(id)
+		return 0
+	}
+	cache.changes.track(id, child.Path(), OpDelete, StateInFlight)
+	child.cancelTransfers()
 	if !isLocalID(id) {
 		if err := Remove(id, cache.GetAuth()); err != nil {
 			log.WithFields(log.Fields{
@@ -729,22 +1114,27 @@ func (i *Inode) Unlink(ctx context.Context, name string) syscall.Errno {
 				"id":   id,
 				"path": i.Path(),
 			}).Error("Failed to delete item on server. Aborting op.")
+			cache.changes.setState(id, OpDelete, StateFailed, err)
+			walClear(cache.db, id, OpDelete, seq)
 			return syscall.EREMOTEIO
 		}
 	}
+	cache.changes.done(id, OpDelete)
+	if !isLocalID(id) {
+		cache.activity.record(activityLocal, "deleted", child.Path(), "")
+	}
+	// nothing left to replay for an item that is gone
+	walClear(cache.db, id, "", 0)
 
+	cache.recycle(child)
 	cache.DeleteID(id)
 	cache.DeleteContent(id)
 	return 0
 }
 
-// Rmdir deletes a child directory. Reuses Unlink.
-func (i *Inode) Rmdir(ctx context.Context, name string) syscall.Errno {
-	return i.Unlink(ctx, name)
-}
-
 // Rename renames an inode.
 func (i *Inode) Rename(ctx context.Context, name string, newParent fs.InodeEmbedder, newName string, flags uint32) syscall.Errno {
+	defer i.timeOp("RENAME", name)()
 	// we don't fully trust DriveItem.Parent.Path from the Graph API
 	cache := i.GetCache()
 	path := filepath.Join(cache.InodePath(i.EmbeddedInode()), name)
@@ -754,6 +1144,43 @@ func (i *Inode) Rename(ctx context.Context, name string, newParent fs.InodeEmbed
 		"dest": dest,
 		"id":   i.ID(),
 	}).Debug("Renaming inode.")
+	if cache.IsReadOnly() {
+		return syscall.EROFS
+	}
+	if excluded(filepath.Dir(dest), filepath.Base(dest)) {
+		// it would disappear
+		return syscall.EPERM
+	}
+	if to, ok := newParent.(*Inode); ok {
+		child, _ := cache.GetChild(i.ID(), name, nil)
+		if isRecycleFolder(i.ID()) && child != nil {
+			return i.restore(child, to, newName)
+		}
+		if isRecycleFolder(to.ID()) || isRecycled(to.ID()) ||
+			(child != nil && isRecycleFolder(child.ID())) {
+			// deleting puts things in the recycle bin
+			return syscall.EPERM
+		}
+		if isVersions(i.ID()) || isVersions(to.ID()) {
+			// versions can be copied out, or restored in place
+			return syscall.EPERM
+		}
+		if isTrash(to) && child != nil && !isLocalID(child.ID()) && !cache.IsOffline() {
+			return i.trash(name, to, newName)
+		}
+		if isSharedFolder(i.ID()) || isSharedFolder(to.ID()) ||
+			(child != nil && isSharedFolder(child.ID())) {
+			return syscall.EPERM
+		}
+		if driveOf(i.ID()) != driveOf(to.ID()) {
+			// the server can't move items between drives, mv copies them
+			// and deletes the originals instead
+			return syscall.EXDEV
+		}
+	}
+	if cache.IsOffline() {
+		return i.renameOffline(path, dest)
+	}
 
 	auth := cache.GetAuth()
 	inode, _ := cache.GetChild(i.ID(), name, auth)
@@ -789,14 +1216,39 @@ func (i *Inode) Rename(ctx context.Context, name string, newParent fs.InodeEmbed
 		return syscall.EBADF
 	}
 
-	if err = Rename(id, filepath.Base(dest), parentID, auth); err != nil {
+	if existing, _ := cache.GetChild(parentID, newName, nil); existing != nil &&
+		existing.ID() != id {
+		// about to be replaced
+		existing.cancelTransfers()
+	}
+	seq, err := walLog(cache.db, walEntry{
+		Op:       OpRename,
+		ID:       id,
+		ParentID: parentID,
+		Name:     filepath.Base(dest),
+		ModTime:  time.Now(),
+	})
+	if err != nil {
+		log.WithFields(log.Fields{
+			"id":  id,
+			"err": err,
+		}).Error("Could not journal rename.")
+		return syscall.EIO
+	}
+	cache.changes.track(id, dest, OpRename, StateInFlight)
+	err = Rename(id, filepath.Base(dest), parentID, auth)
+	walClear(cache.db, id, OpRename, seq)
+	if err != nil {
 		log.WithFields(log.Fields{
 			"id":       id,
 			"parentID": parentID,
 			"err":      err,
 		}).Error("Failed to rename remote item.")
+		cache.changes.setState(id, OpRename, StateFailed, err)
 		return syscall.EREMOTEIO
 	}
+	cache.changes.done(id, OpRename)
+	cache.activity.record(activityLocal, "renamed", path, activityMove(dest))
 
 	// now rename local copy
 	if err = cache.MovePath(path, dest, auth); err != nil {
@@ -812,21 +1264,127 @@ func (i *Inode) Rename(ctx context.Context, name string, newParent fs.InodeEmbed
 	return 0
 }
 
+// trash deletes a child being moved to the freedesktop trash folder files as
+// trashName, which puts it in the recycle bin instead. What the trash wrote
+// about it goes too.
+func (i *Inode) trash(name string, files *Inode, trashName string) syscall.Errno {
+	if errno := i.remove(name); errno != 0 {
+		return errno
+	}
+	// the kernel thinks it was moved, and holds the folders until it is
+	go notifyEntry(files, trashName)
+	cache := i.GetCache()
+	infoPath := filepath.Join("/", trashDir(), "info", trashName+".trashinfo")
+	if info, _ := cache.GetPath(infoPath, cache.GetAuth()); info != nil {
+		if folder := cache.GetID(info.ParentID()); folder != nil {
+			id := info.ID()
+			folder.remove(info.Name())
+			cache.forgetRecycled(id)
+			go notifyEntry(folder, info.Name())
+		}
+	}
+	log.WithField("path", filepath.Join(i.Path(), name)).Info(
+		"Moved item to the recycle bin instead of the trash.")
+	return 0
+}
+
+// restore restores an item in the recycle bin into newParent as newName.
+func (i *Inode) restore(child *Inode, newParent *Inode, newName string) syscall.Errno {
+	cache := i.GetCache()
+	if cache.IsOffline() {
+		return syscall.EREMOTEIO
+	}
+	if driveOf(newParent.ID()) != cache.source.Drive || isSharedFolder(newParent.ID()) ||
+		isLocalID(newParent.ID()) {
+		return syscall.EXDEV
+	}
+	if _, err := cache.restore(child.ID(), newParent.ID(), newName); err != nil {
+		log.WithFields(log.Fields{
+			"id":   child.ID(),
+			"dest": filepath.Join(newParent.Path(), newName),
+			"err":  err,
+		}).Error("Could not restore item from the recycle bin.")
+		if err == errNotRecycled {
+			return syscall.ENOENT
+		}
+		return syscall.EREMOTEIO
+	}
+	return 0
+}
+
+// renameOffline moves an item locally, it is moved on the server once we are
+// back online. Items that don't exist on the server yet are created wherever
+// they are by then, so only their local copy needs moving.
+func (i *Inode) renameOffline(path string, dest string) syscall.Errno {
+	cache := i.GetCache()
+	inode, _ := cache.GetPath(path, nil)
+	newParentItem, _ := cache.GetPath(filepath.Dir(dest), nil)
+	if inode == nil || newParentItem == nil {
+		return syscall.ENOENT
+	}
+	id := inode.ID()
+	parentID := newParentItem.ID()
+	if existing, _ := cache.GetChild(parentID, filepath.Base(dest), nil); existing != nil &&
+		existing.ID() != id {
+		// about to be replaced
+		existing.cancelTransfers()
+	}
+
+	if !isLocalID(id) {
+		entry := walEntry{
+			Op:           OpRename,
+			ID:           id,
+			ParentID:     parentID,
+			Name:         filepath.Base(dest),
+			ModTime:      time.Now(),
+			Queued:       true,
+			FromParentID: inode.ParentID(),
+			FromName:     inode.Name(),
+		}
+		if old, exists := walGet(cache.db, id, OpRename); exists && old.Queued {
+			// where the server still has it
+			entry.FromParentID = old.FromParentID
+			entry.FromName = old.FromName
+		}
+		if _, err := walLog(cache.db, entry); err != nil {
+			log.WithFields(log.Fields{
+				"id":  id,
+				"err": err,
+			}).Error("Could not journal rename.")
+			return syscall.EIO
+		}
+		cache.changes.track(id, dest, OpRename, StateQueued)
+	}
+	if err := cache.MovePath(path, dest, nil); err != nil {
+		log.WithFields(log.Fields{
+			"path": path,
+			"dest": dest,
+			"err":  err,
+		}).Error("Failed to rename local item.")
+		return syscall.EIO
+	}
+	return 0
+}
+
 // Open fetches a Inodes's content and initializes the .Data field with actual
 // data from the server. Data is loaded into memory on Open, and persisted to
-// disk on Flush.
+// disk on Flush. Files that are only opened for reading and have no content
+// cached stay placeholders until they are read from.
 func (i *Inode) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
+	defer i.timeOp("OPEN", "")()
 	path := i.Path()
 	id := i.ID()
 	f := int(flags)
-	if f&os.O_RDWR+f&os.O_WRONLY > 0 && i.GetCache().offline {
-		log.WithFields(log.Fields{
-			"path":  path,
-			"id":    id,
-			"flags": flags,
-		}).Debug("Refusing Open() with write flag, FS is offline.")
+	if f&os.O_RDWR+f&os.O_WRONLY > 0 && i.GetCache().IsReadOnly() {
 		return nil, uint32(0), syscall.EROFS
 	}
+	if isRecycled(id) {
+		// the server does not hand out the content of deleted items
+		return nil, uint32(0), syscall.EACCES
+	}
+	if isVersion(id) && f&os.O_RDWR+f&os.O_WRONLY > 0 {
+		return nil, uint32(0), syscall.EACCES
+	}
 
 	log.WithFields(log.Fields{
 		"path": path,
@@ -837,11 +1395,27 @@ func (i *Inode) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, fuseF
 		// we already have data, likely the file is already opened somewhere
 		return nil, uint32(0), 0
 	}
+	if f&os.O_RDWR+f&os.O_WRONLY == 0 && !i.GetCache().hasCachedContent(id) {
+		return nil, uint32(0), 0
+	}
+	return nil, uint32(0), i.fetchContent(flags)
+}
+
+// fetchContent loads an item's content from the content cache, or from the
+// server if it isn't cached.
+func (i *Inode) fetchContent(flags uint32) syscall.Errno {
+	path := i.Path()
+	id := i.ID()
+	f := int(flags)
+
+	if isVersion(id) {
+		return i.fetchVersion()
+	}
 
 	// try grabbing from disk
 	cache := i.GetCache()
 	driveType := cache.DriveType()
-	if content := cache.GetContent(id); content != nil {
+	if content, err := cache.contentBuffer(id); err == nil {
 		// verify content against what we're supposed to have
 		var hashWanted, hashActual, hashType string
 		if isLocalID(id) && i.FileInternal == nil {
@@ -852,13 +1426,14 @@ func (i *Inode) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, fuseF
 			i.mutex.RLock()
 			hashWanted = strings.ToLower(i.FileInternal.Hashes.SHA1Hash)
 			i.mutex.RUnlock()
-			hashActual = strings.ToLower(SHA1Hash(&content))
+			hashActual, _ = hashReader(sha1.New(), content.Reader())
 			hashType = "SHA1"
 		} else if driveType == "business" {
 			i.mutex.RLock()
 			hashWanted = strings.ToLower(i.FileInternal.Hashes.QuickXorHash)
 			i.mutex.RUnlock()
-			hashActual = strings.ToLower(QuickXORHash(&content))
+			hashActual, _ = QuickXORHashReader(content.Reader())
+			hashActual = strings.ToLower(hashActual)
 			hashType = "QuickXORHash"
 		} else {
 			log.WithFields(log.Fields{
@@ -874,13 +1449,16 @@ func (i *Inode) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, fuseF
 				"id":   id,
 			}).Info("Found content in cache.")
 
+			cache.accessed.touch(id)
+			cache.counters.content(true)
 			i.mutex.Lock()
 			defer i.mutex.Unlock()
 			// this check is here in case the API file sizes are WRONG (it happens)
-			i.SizeInternal = uint64(len(content))
-			i.data = &content
-			return nil, uint32(0), 0
+			i.SizeInternal = uint64(content.Size())
+			i.data = content
+			return 0
 		}
+		content.Close()
 		log.WithFields(log.Fields{
 			"id":          id,
 			"path":        path,
@@ -891,11 +1469,22 @@ func (i *Inode) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, fuseF
 		}).Info("Not using cached item due to file hash mismatch.")
 	}
 
+	if cache.IsOffline() {
+		if errno := cache.contentUnavailable(); errno != 0 {
+			log.WithFields(log.Fields{
+				"id":   id,
+				"path": path,
+			}).Warn("Content is not cached and we are offline.")
+			return errno
+		}
+	}
+
 	// didn't have it on disk, now try api
 	log.WithFields(log.Fields{
 		"id":   id,
 		"path": path,
 	}).Info("Fetching remote content for item from API.")
+	cache.counters.content(false)
 
 	auth := cache.GetAuth()
 	id, err := i.RemoteID(auth)
@@ -905,23 +1494,272 @@ func (i *Inode) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, fuseF
 			"path": path,
 			"err":  err,
 		}).Error("Could not obtain remote ID.")
-		return nil, uint32(0), syscall.EREMOTEIO
+		return syscall.EREMOTEIO
 	}
 
-	body, err := GetItemContent(id, auth)
+	i.mutex.RLock()
+	size := i.SizeInternal
+	i.mutex.RUnlock()
+	if size >= streamThreshold {
+		// big files are downloaded in parts, and can be read from while they
+		// download
+		i.startStream(id, size)
+		if f&os.O_RDWR+f&os.O_WRONLY != 0 {
+			// writes need all of the content
+			if errno := i.finishStream(); errno != 0 {
+				// drop the failed download so the next open tries again
+				i.mutex.Lock()
+				i.stream = nil
+				i.mutex.Unlock()
+				return errno
+			}
+		}
+		return 0
+	}
+
+	body, err := i.download(id, auth)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"err":  err,
 			"id":   id,
 			"path": path,
 		}).Error("Failed to fetch remote content.")
-		return nil, uint32(0), syscall.EREMOTEIO
+		cache.noteOffline(err)
+		if errors.Is(err, errHashMismatch) {
+			return syscall.EIO
+		}
+		return syscall.EREMOTEIO
+	}
+
+	cache.activity.record(activityRemote, "downloaded", path, activitySize(uint64(body.Size())))
+
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	// this check is here in case the API file sizes are WRONG (it happens)
+	i.SizeInternal = uint64(body.Size())
+	i.data = body
+	return 0
+}
+
+// startStream starts streaming in an item's content from the server.
+func (i *Inode) startStream(id string, size uint64) {
+	cache := i.GetCache()
+	auth := cache.GetAuth()
+	log.WithFields(log.Fields{
+		"id":   id,
+		"path": i.Path(),
+		"size": size,
+	}).Info("Streaming remote content for item from API.")
+
+	// only the server can tell whether the content changed since it was
+	// partially downloaded
+	remoteETag := ""
+	if cache.hasPartial(id) {
+		if item, err := GetItem(id, auth); err == nil {
+			remoteETag = item.ETag
+		}
 	}
 
 	i.mutex.Lock()
 	defer i.mutex.Unlock()
+	if i.stream != nil || i.data != nil {
+		// opened somewhere else while we weren't looking
+		return
+	}
+	etag := i.ETag
+	var partial *buffer
+	if remoteETag != "" {
+		partial = cache.loadPartial(id, remoteETag, size)
+	}
+	var s *stream
+	s = resumeStream(cache.ctx, id, size, downloadWorkers, partial,
+		func(ctx context.Context, offset uint64, length uint64) ([]byte, error) {
+			return getItemContentRange(ctx, id, auth, offset, length)
+		},
+		func(content *buffer) error {
+			return i.streamDone(s, id, auth, content)
+		},
+		func(content *buffer, verified uint64) {
+			if cache.GetID(id) == nil {
+				// deleted while downloading
+				content.Close()
+				return
+			}
+			cache.savePartial(id, etag, size, content, verified)
+		},
+	)
+	i.stream = s
+}
+
+// streamDone takes over the content of a stream once all of it has arrived.
+// Content that got corrupted on the way is downloaded again.
+func (i *Inode) streamDone(s *stream, id string, auth *Auth, content *buffer) error {
+	size := uint64(content.Size())
+	err := i.verifyFresh(id, auth, &size, content.Reader)
+	for attempt := 2; errors.Is(err, errHashMismatch) && attempt <= transferAttempts; attempt++ {
+		log.WithFields(log.Fields{
+			"id":  id,
+			"err": err,
+		}).Warn("Streamed content is corrupt, downloading it again.")
+		content.Close()
+		if content, err = downloadRanges(id, auth, size); err == nil {
+			err = i.verifyFresh(id, auth, &size, content.Reader)
+		}
+	}
+	if err != nil {
+		if content != nil {
+			content.Close()
+		}
+		return err
+	}
+
+	i.mutex.Lock()
+	if i.stream != s {
+		// closed or overwritten while streaming
+		i.mutex.Unlock()
+		content.Close()
+		return nil
+	}
+	i.stream = nil
+	i.data = content
 	// this check is here in case the API file sizes are WRONG (it happens)
-	i.SizeInternal = uint64(len(body))
-	i.data = &body
-	return nil, uint32(0), 0
+	i.SizeInternal = uint64(content.Size())
+	cache := i.cache
+	i.mutex.Unlock()
+	cache.insertBuffer(id, content)
+	cache.activity.record(activityRemote, "downloaded", i.Path(), activitySize(size))
+	return nil
+}
+
+// download fetches an item's content, downloading it again if it does not match
+// the hash the server reported for it. Only meant for files small enough to be
+// downloaded in one go.
+func (i *Inode) download(id string, auth *Auth) (*buffer, error) {
+	for attempt := 1; ; attempt++ {
+		content, err := GetItemContent(id, auth)
+		if err == nil {
+			err = i.verifyFresh(id, auth, nil, func() io.Reader {
+				return bytes.NewReader(content)
+			})
+		}
+		if err == nil {
+			return bufferOf(content)
+		}
+		if !errors.Is(err, errHashMismatch) || attempt == transferAttempts {
+			return nil, err
+		}
+		log.WithFields(log.Fields{
+			"id":  id,
+			"err": err,
+		}).Warn("Downloaded content is corrupt, trying again.")
+	}
+}
+
+// downloadRanges downloads an item's content into a buffer one range at a
+// time, so it never has to be held in memory all at once.
+func downloadRanges(id string, auth *Auth, size uint64) (*buffer, error) {
+	content := &buffer{}
+	for offset := uint64(0); offset < size; {
+		length := downloadChunks.chunkSize()
+		started := time.Now()
+		chunk, err := GetItemContentRange(id, auth, offset, length)
+		if err == nil {
+			downloadChunks.success(uint64(len(chunk)), time.Since(started))
+			_, err = content.WriteAt(chunk, int64(offset))
+		} else {
+			downloadChunks.failure()
+		}
+		if err != nil {
+			content.Close()
+			return nil, err
+		}
+		if uint64(len(chunk)) < length {
+			break
+		}
+		offset += length
+	}
+	return content, nil
+}
+
+// verifyDownload checks downloaded content against the hashes the server
+// reported for the item.
+func (i *Inode) verifyDownload(content io.Reader) error {
+	i.mutex.RLock()
+	file := i.FileInternal
+	i.mutex.RUnlock()
+	if file == nil {
+		return nil
+	}
+	return verifyContent(content, file.Hashes)
+}
+
+// verifyFresh is verifyDownload, except that on a mismatch the item's hashes
+// are fetched from the server again first: the item may have changed there
+// since the last delta, in which case the content is fine and our hashes are
+// stale. If size is not nil, it is updated to the current size of the item.
+func (i *Inode) verifyFresh(id string, auth *Auth, size *uint64, content func() io.Reader) error {
+	err := i.verifyDownload(content())
+	if !errors.Is(err, errHashMismatch) {
+		return err
+	}
+	item, getErr := GetItem(id, auth)
+	if getErr != nil || item.FileInternal == nil {
+		return err
+	}
+	i.mutex.Lock()
+	stale := i.FileInternal == nil || !sameContent(i.FileInternal.Hashes, item.FileInternal.Hashes)
+	i.FileInternal = item.FileInternal
+	i.mutex.Unlock()
+	if size != nil {
+		*size = item.SizeInternal
+	}
+	if !stale {
+		return err
+	}
+	log.WithField("id", id).Info("Item changed on the server, checking content against its new hashes.")
+	return i.verifyDownload(content())
+}
+
+// finishStream waits for content being streamed in to arrive completely, for
+// operations that need all of it.
+func (i *Inode) finishStream() syscall.Errno {
+	i.mutex.RLock()
+	s := i.stream
+	i.mutex.RUnlock()
+	if s == nil {
+		return 0
+	}
+	if err := s.Wait(); err != nil {
+		log.WithFields(log.Fields{
+			"id":   i.ID(),
+			"path": i.Path(),
+			"err":  err,
+		}).Error("Could not finish streaming content.")
+		return syscall.EREMOTEIO
+	}
+	return 0
+}
+
+// cancelStream stops streaming content that is no longer wanted. An open file
+// is left empty.
+func (i *Inode) cancelStream() {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	if i.stream == nil {
+		return
+	}
+	i.stream.Cancel()
+	i.stream = nil
+	if i.data == nil {
+		i.data = &buffer{}
+	}
+}
+
+// cancelTransfers stops any download or upload of an item's content, for when
+// the item is deleted or replaced.
+func (i *Inode) cancelTransfers() {
+	i.cancelStream()
+	if cache := i.GetCache(); cache != nil && cache.uploads != nil {
+		cache.uploads.CancelUpload(i.ID())
+	}
 }
@@ -1,8 +1,13 @@
 package graph
 
 import (
+	"context"
+	"encoding/json"
 	"io/ioutil"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/hanwen/go-fuse/v2/fuse"
 )
@@ -51,3 +56,77 @@ func TestIsDir(t *testing.T) {
 		t.Fatal("file created with mode 644 not detected as a file")
 	}
 }
+
+// OneDrive metadata should be readable through extended attributes, and only
+// attributes with a value should be listed.
+func TestXattrs(t *testing.T) {
+	t.Parallel()
+	inode := NewInode("xattrs.txt", 0644|fuse.S_IFREG, nil)
+	if size, errno := inode.Listxattr(context.Background(), nil); errno != 0 || size != 0 {
+		t.Fatalf("A local-only item should have no attributes: %d, %v", size, errno)
+	}
+
+	inode.IDInternal = "ABC123"
+	inode.ETag = "\"{ABC123},2\""
+	inode.FileInternal = &File{Hashes: Hashes{QuickXorHash: "hash=="}}
+	size, _ := inode.Getxattr(context.Background(), "user.onedriver.etag", nil)
+	value := make([]byte, size)
+	if _, errno := inode.Getxattr(context.Background(), "user.onedriver.etag", value); errno != 0 ||
+		string(value) != inode.ETag {
+		t.Fatalf("Wrong etag attribute \"%s\": %v", value, errno)
+	}
+	if _, errno := inode.Getxattr(context.Background(), "user.onedriver.etag", value[:1]); errno != syscall.ERANGE {
+		t.Errorf("Expected ERANGE for a short buffer, got %v", errno)
+	}
+	if _, errno := inode.Getxattr(context.Background(), "user.onedriver.weburl", value); errno != syscall.ENODATA {
+		t.Errorf("Expected ENODATA for a missing attribute, got %v", errno)
+	}
+
+	list := make([]byte, 256)
+	size, _ = inode.Listxattr(context.Background(), list)
+	names := strings.Split(strings.TrimSuffix(string(list[:size]), "\x00"), "\x00")
+	expected := "user.onedriver.etag user.onedriver.id user.onedriver.quickxorhash"
+	if strings.Join(names, " ") != expected {
+		t.Errorf("Unexpected attribute list: %v", names)
+	}
+}
+
+// Inode numbers must be stable for an ID, and never collide with the numbers
+// go-fuse reserves or allocates itself.
+func TestInodeNumber(t *testing.T) {
+	t.Parallel()
+	ids := []string{"", "local-abc", "8A1F4C0C3B1F2A1D!123", "8A1F4C0C3B1F2A1D!124"}
+	seen := make(map[uint64]string)
+	for _, id := range ids {
+		ino := inodeNumber(id)
+		if ino != inodeNumber(id) {
+			t.Fatalf("Inode number of \"%s\" is not stable.", id)
+		}
+		if ino <= 1 || ino >= 1<<63 {
+			t.Errorf("Inode number %d of \"%s\" is out of range.", ino, id)
+		}
+		if other, exists := seen[ino]; exists {
+			t.Errorf("\"%s\" and \"%s\" have the same inode number.", id, other)
+		}
+		seen[ino] = id
+	}
+}
+
+// The modification time set by the client that wrote a file should win over
+// the time the server last touched it.
+func TestModTimeFileSystemInfo(t *testing.T) {
+	t.Parallel()
+	var inode Inode
+	err := json.Unmarshal([]byte(`{
+		"id": "ABC123",
+		"name": "mtime.txt",
+		"lastModifiedDateTime": "2020-02-02T12:00:00Z",
+		"fileSystemInfo": {"lastModifiedDateTime": "2019-01-01T08:30:00Z"}
+	}`), &inode)
+	failOnErr(t, err)
+	expected := time.Date(2019, 1, 1, 8, 30, 0, 0, time.UTC)
+	if inode.ModTime() != uint64(expected.Unix()) {
+		t.Fatalf("Expected mtime %s, got %s", expected,
+			time.Unix(int64(inode.ModTime()), 0).UTC())
+	}
+}
@@ -0,0 +1,184 @@
+package graph
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	bolt "github.com/etcd-io/bbolt"
+	log "github.com/sirupsen/logrus"
+)
+
+// ABANDONED is the boltdb bucket holding upload sessions that still need to be
+// deleted on the server, instead of holding on to their content for days until
+// they expire.
+var ABANDONED = []byte("abandoned")
+
+// how often sessions that could not be deleted are tried again
+const janitorInterval = 5 * time.Minute
+
+// abandonedSession is an upload session nobody is going to finish.
+type abandonedSession struct {
+	ID                 string    `json:"id"`
+	UploadURL          string    `json:"uploadUrl"`
+	ExpirationDateTime time.Time `json:"expirationDateTime"`
+}
+
+// sessionJanitor deletes abandoned upload sessions on the server.
+type sessionJanitor struct {
+	db      *bolt.DB // abandoned sessions are saved here, may be nil
+	mutex   sync.Mutex
+	pending map[string]abandonedSession // by upload URL
+	trigger chan struct{}
+}
+
+// newSessionJanitor creates a janitor that picks up where the last one left
+// off.
+func newSessionJanitor(db *bolt.DB) *sessionJanitor {
+	j := &sessionJanitor{
+		db:      db,
+		pending: make(map[string]abandonedSession),
+		trigger: make(chan struct{}, 1),
+	}
+	if db != nil {
+		db.View(func(tx *bolt.Tx) error {
+			b := tx.Bucket(ABANDONED)
+			if b == nil {
+				return nil
+			}
+			return b.ForEach(func(k, v []byte) error {
+				var session abandonedSession
+				if err := json.Unmarshal(v, &session); err == nil {
+					j.pending[session.UploadURL] = session
+				}
+				return nil
+			})
+		})
+	}
+	return j
+}
+
+// abandon schedules an upload session to be deleted on the server.
+func (j *sessionJanitor) abandon(id string, uploadURL string, expires time.Time) {
+	if uploadURL == "" {
+		return
+	}
+	session := abandonedSession{
+		ID:                 id,
+		UploadURL:          uploadURL,
+		ExpirationDateTime: expires,
+	}
+	j.mutex.Lock()
+	j.pending[uploadURL] = session
+	j.mutex.Unlock()
+	if j.db != nil {
+		data, _ := json.Marshal(session)
+		j.db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucketIfNotExists(ABANDONED)
+			if err != nil {
+				return err
+			}
+			return b.Put([]byte(uploadURL), data)
+		})
+	}
+	select {
+	case j.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// remove stops tracking a session that is gone from the server.
+func (j *sessionJanitor) remove(uploadURL string) {
+	j.mutex.Lock()
+	delete(j.pending, uploadURL)
+	j.mutex.Unlock()
+	if j.db != nil {
+		j.db.Update(func(tx *bolt.Tx) error {
+			if b := tx.Bucket(ABANDONED); b != nil {
+				return b.Delete([]byte(uploadURL))
+			}
+			return nil
+		})
+	}
+}
+
+// waiting returns how many abandoned sessions are waiting to be deleted.
+func (j *sessionJanitor) waiting() int {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return len(j.pending)
+}
+
+// run sweeps up abandoned sessions as they come in, and every so often in case
+// deleting some of them failed, until ctx is cancelled.
+func (j *sessionJanitor) run(ctx context.Context) {
+	ticker := time.NewTicker(janitorInterval)
+	defer ticker.Stop()
+	j.sweep(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-j.trigger:
+		case <-ticker.C:
+		}
+		j.sweep(ctx)
+	}
+}
+
+// sweep deletes every abandoned session it can. Sessions that have expired are
+// cleaned up by the server on its own.
+func (j *sessionJanitor) sweep(ctx context.Context) {
+	j.mutex.Lock()
+	sessions := make([]abandonedSession, 0, len(j.pending))
+	for _, session := range j.pending {
+		sessions = append(sessions, session)
+	}
+	j.mutex.Unlock()
+
+	now := time.Now()
+	for _, session := range sessions {
+		if ctx.Err() != nil {
+			return
+		}
+		if !session.ExpirationDateTime.IsZero() && now.After(session.ExpirationDateTime) {
+			j.remove(session.UploadURL)
+			continue
+		}
+		if err := deleteUploadSession(ctx, session.UploadURL); err != nil {
+			log.WithFields(log.Fields{
+				"id":  session.ID,
+				"err": err,
+			}).Debug("Could not delete abandoned upload session, will try again later.")
+			continue
+		}
+		log.WithField("id", session.ID).Debug("Deleted abandoned upload session.")
+		j.remove(session.UploadURL)
+	}
+}
+
+// deleteUploadSession deletes an upload session and everything uploaded to it.
+// A session the server no longer knows about counts as deleted.
+func deleteUploadSession(ctx context.Context, uploadURL string) error {
+	// no Authorization header, the upload URL is all the server needs
+	request, err := http.NewRequestWithContext(ctx, "DELETE", uploadURL, nil)
+	if err != nil {
+		// nothing we could ever delete
+		return nil
+	}
+	resp, err := httpClient(30 * time.Second).Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode >= 300 && resp.StatusCode != http.StatusNotFound &&
+		resp.StatusCode != http.StatusGone {
+		return fmt.Errorf("HTTP %d: %s", resp.StatusCode, string(body))
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package graph
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	bolt "github.com/etcd-io/bbolt"
+)
+
+// Abandoned sessions should be deleted on the server, tried again later if that
+// fails, and remembered across restarts until they are gone.
+func TestSessionJanitor(t *testing.T) {
+	t.Parallel()
+	var mutex sync.Mutex
+	deleted := make(map[string]int)
+	available := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "DELETE" {
+			t.Errorf("Unexpected %s request.", r.Method)
+		}
+		if r.Header.Get("Authorization") != "" {
+			t.Error("Upload sessions must be deleted without an Authorization header.")
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		if !available {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		deleted[r.URL.Path]++
+		if r.URL.Path == "/gone" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "onedriver-janitor-")
+	failOnErr(t, err)
+	defer os.RemoveAll(dir)
+	dbPath := filepath.Join(dir, "janitor.db")
+	db, err := bolt.Open(dbPath, 0600, &bolt.Options{Timeout: time.Second * 5})
+	failOnErr(t, err)
+
+	later := time.Now().Add(time.Hour)
+	janitor := newSessionJanitor(db)
+	janitor.abandon("a", server.URL+"/a", later)
+	janitor.abandon("gone", server.URL+"/gone", later)
+	janitor.abandon("expired", server.URL+"/expired", time.Now().Add(-time.Hour))
+	janitor.sweep(context.Background())
+	if waiting := janitor.waiting(); waiting != 2 {
+		t.Fatalf("Expected 2 sessions left to delete, got %d.", waiting)
+	}
+
+	// a restart should not forget about them
+	db.Close()
+	db, err = bolt.Open(dbPath, 0600, &bolt.Options{Timeout: time.Second * 5})
+	failOnErr(t, err)
+	defer db.Close()
+	janitor = newSessionJanitor(db)
+	if waiting := janitor.waiting(); waiting != 2 {
+		t.Fatalf("Expected 2 sessions to be remembered, got %d.", waiting)
+	}
+
+	mutex.Lock()
+	available = true
+	mutex.Unlock()
+	janitor.sweep(context.Background())
+	if waiting := janitor.waiting(); waiting != 0 {
+		t.Fatalf("Expected all sessions to be deleted, %d are left.", waiting)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if deleted["/a"] != 1 || deleted["/gone"] != 1 || deleted["/expired"] != 0 {
+		t.Fatalf("Unexpected deletes: %v", deleted)
+	}
+}
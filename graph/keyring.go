@@ -0,0 +1,193 @@
+package graph
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// encryptedMagic marks a token file as encrypted, plaintext files are JSON.
+var encryptedMagic = []byte("onedriver-tokens-v1\n")
+
+const (
+	keyringApp  = "onedriver"
+	keyringSalt = 16
+)
+
+// keyringAvailable returns whether the Secret Service can be used.
+func keyringAvailable() bool {
+	_, err := exec.LookPath("secret-tool")
+	return err == nil && os.Getenv("DBUS_SESSION_BUS_ADDRESS") != ""
+}
+
+// keyringAttrs are the attributes identifying a set of tokens in the keyring.
+// Tokens are keyed by the absolute path they would otherwise be stored at, so
+// each account profile gets its own entry.
+func keyringAttrs(path string) []string {
+	abs, _ := filepath.Abs(path)
+	return []string{"application", keyringApp, "path", abs}
+}
+
+func keyringLoad(path string) ([]byte, error) {
+	out, err := exec.Command("secret-tool", append([]string{"lookup"}, keyringAttrs(path)...)...).Output()
+	if err != nil || len(out) == 0 {
+		return nil, os.ErrNotExist
+	}
+	return out, nil
+}
+
+func keyringSave(path string, data []byte) error {
+	args := append([]string{"store", "--label=onedriver auth tokens"}, keyringAttrs(path)...)
+	cmd := exec.Command("secret-tool", args...)
+	cmd.Stdin = bytes.NewReader(data)
+	return cmd.Run()
+}
+
+func keyringDelete(path string) error {
+	return exec.Command("secret-tool", append([]string{"clear"}, keyringAttrs(path)...)...).Run()
+}
+
+// fileKey derives the key used to scramble token files on this machine. None
+// of its inputs are secret, it only keeps tokens from being read at a glance or
+// used on another machine. The file being readable only by the user is what
+// protects them.
+func fileKey(salt []byte) []byte {
+	machineID, err := ioutil.ReadFile("/etc/machine-id")
+	if err != nil {
+		machineID, _ = ioutil.ReadFile("/var/lib/dbus/machine-id")
+	}
+	hash := sha256.New()
+	hash.Write(salt)
+	hash.Write(bytes.TrimSpace(machineID))
+	hash.Write([]byte(strconv.Itoa(os.Getuid())))
+	return hash.Sum(nil)
+}
+
+func encryptTokens(data []byte) ([]byte, error) {
+	salt := make([]byte, keyringSalt)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	block, _ := aes.NewCipher(fileKey(salt))
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out := append(append(append([]byte{}, encryptedMagic...), salt...), nonce...)
+	return gcm.Seal(out, nonce, data, nil), nil
+}
+
+func decryptTokens(data []byte) ([]byte, error) {
+	data = bytes.TrimPrefix(data, encryptedMagic)
+	if len(data) < keyringSalt {
+		return nil, errors.New("token file is truncated")
+	}
+	salt, data := data[:keyringSalt], data[keyringSalt:]
+	block, _ := aes.NewCipher(fileKey(salt))
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("token file is truncated")
+	}
+	nonce, data := data[:gcm.NonceSize()], data[gcm.NonceSize():]
+	plain, err := gcm.Open(nil, nonce, data, nil)
+	if err != nil {
+		return nil, errors.New("could not decrypt token file, " +
+			"was it copied from another machine or user?")
+	}
+	return plain, nil
+}
+
+// loadTokens reads serialized tokens from the keyring, or from an encrypted or
+// (legacy) plaintext file at path. Plaintext tokens are migrated to the
+// keyring or an encrypted file.
+func loadTokens(path string) ([]byte, error) {
+	if keyringAvailable() {
+		if data, err := keyringLoad(path); err == nil {
+			return data, nil
+		}
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(data, encryptedMagic) {
+		return decryptTokens(data)
+	}
+
+	// plaintext from an older version, get it off the disk
+	log.WithField("path", path).Info("Migrating plaintext auth tokens to secure storage.")
+	if err := saveTokens(path, data); err != nil {
+		log.WithField("err", err).Warn("Could not migrate plaintext auth tokens.")
+	}
+	return data, nil
+}
+
+// saveTokens stores serialized tokens in the keyring, falling back to a file
+// at path only the user can read.
+func saveTokens(path string, data []byte) error {
+	if keyringAvailable() {
+		err := keyringSave(path, data)
+		if err == nil {
+			// don't leave an older copy lying around
+			if err = os.Remove(path); err != nil && !os.IsNotExist(err) {
+				log.WithField("err", err).Warn("Could not remove old token file.")
+			}
+			return nil
+		}
+		log.WithField("err", err).Warn(
+			"Could not store auth tokens in keyring, using a private file instead.")
+	}
+	encrypted, err := encryptTokens(data)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err = ioutil.WriteFile(tmp, encrypted, 0600); err != nil {
+		return err
+	}
+	// WriteFile keeps the mode of a file left over from an earlier attempt
+	if err = os.Chmod(tmp, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// deleteTokens removes stored tokens from everywhere they might be.
+func deleteTokens(path string) error {
+	if keyringAvailable() {
+		keyringDelete(path)
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// tokensExist returns whether tokens have been stored for path.
+func tokensExist(path string) bool {
+	if _, err := os.Stat(path); err == nil {
+		return true
+	}
+	if keyringAvailable() {
+		_, err := keyringLoad(path)
+		return err == nil
+	}
+	return false
+}
@@ -0,0 +1,52 @@
+package graph
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Encrypted tokens should decrypt to what went in, and never be stored in the
+// clear.
+func TestEncryptTokens(t *testing.T) {
+	t.Parallel()
+	tokens := []byte(`{"access_token":"secret","refresh_token":"also secret"}`)
+	encrypted, err := encryptTokens(tokens)
+	failOnErr(t, err)
+	if bytes.Contains(encrypted, []byte("secret")) {
+		t.Fatal("Tokens were stored in plaintext.")
+	}
+	decrypted, err := decryptTokens(encrypted)
+	failOnErr(t, err)
+	if !bytes.Equal(decrypted, tokens) {
+		t.Fatalf("Decrypted tokens did not match: %s", decrypted)
+	}
+
+	encrypted[len(encrypted)-1] ^= 0xff
+	if _, err = decryptTokens(encrypted); err == nil {
+		t.Fatal("Tampered tokens were decrypted without error.")
+	}
+}
+
+// The token file is only as safe as its permissions, so nobody but the user
+// may read it, whatever was left behind by an earlier attempt.
+func TestTokenFileMode(t *testing.T) {
+	t.Parallel()
+	if keyringAvailable() {
+		t.Skip("Tokens are stored in the keyring here.")
+	}
+	dir, err := ioutil.TempDir("", "onedriver-tokens")
+	failOnErr(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, authFile)
+	failOnErr(t, ioutil.WriteFile(path+".tmp", []byte("leftover"), 0644))
+
+	failOnErr(t, saveTokens(path, []byte(`{"access_token":"secret"}`)))
+	st, err := os.Stat(path)
+	failOnErr(t, err)
+	if st.Mode().Perm() != 0600 {
+		t.Fatalf("Token file has mode %o, not 0600.", st.Mode().Perm())
+	}
+}
@@ -0,0 +1,213 @@
+package graph
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+
+	bolt "github.com/etcd-io/bbolt"
+	log "github.com/sirupsen/logrus"
+)
+
+// staleSet is the set of folders whose listings were made from the cache. The
+// zero value is empty and ready to use.
+type staleSet struct {
+	mutex sync.Mutex
+	ids   map[string]bool
+}
+
+func (s *staleSet) add(id string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.ids == nil {
+		s.ids = make(map[string]bool)
+	}
+	s.ids[id] = true
+}
+
+func (s *staleSet) has(id string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.ids[id]
+}
+
+func (s *staleSet) remove(id string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.ids, id)
+}
+
+func (s *staleSet) list() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	ids := make([]string, 0, len(s.ids))
+	for id := range s.ids {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// fetchChildren lists a folder on the server. Children that are already in
+// memory are kept as they are (deltas keep them up to date), as are children
+// that have not made it to the server yet.
+func (c *Cache) fetchChildren(inode *Inode, auth *Auth) (map[string]*Inode, error) {
+	id := inode.ID()
+	fetched, err := GetChildrenID(id, auth)
+	if err != nil {
+		return nil, err
+	}
+
+	c.gcMutex.RLock()
+	defer c.gcMutex.RUnlock()
+	parentPath := inode.Path()
+	children := make(map[string]*Inode)
+	ids := make([]string, 0, len(fetched))
+	var subdir uint32
+	for _, child := range fetched {
+		if excluded(parentPath, child.Name()) {
+			continue
+		}
+		if existing, exists := c.metadata.Load(child.IDInternal); exists {
+			child = existing
+		} else {
+			// we will always have an id after fetching from the server
+			child.cache = c
+			child.DriveItem.Parent = &DriveItemParent{ID: id, Path: parentPath}
+			c.metadata.Store(child.IDInternal, child)
+		}
+		children[strings.ToLower(child.Name())] = child
+		ids = append(ids, child.ID())
+		if child.IsDir() {
+			subdir++
+		}
+	}
+
+	inode.mutex.Lock()
+	for _, childID := range inode.children {
+		if !isLocalID(childID) {
+			continue
+		}
+		if child := c.GetID(childID); child != nil {
+			children[strings.ToLower(child.Name())] = child
+			ids = append(ids, childID)
+			if child.IsDir() {
+				subdir++
+			}
+		}
+	}
+	for _, virtualID := range []string{sharedFolderID, recycleFolderID} {
+		virtual := c.GetID(virtualID)
+		if virtual == nil || id != c.root {
+			continue
+		}
+		if _, taken := children[strings.ToLower(virtual.Name())]; taken {
+			log.WithField("name", virtual.Name()).Warn("A folder at the root has the " +
+				"name of a folder onedriver adds there, hiding the one onedriver adds.")
+		} else {
+			children[strings.ToLower(virtual.Name())] = virtual
+			ids = append(ids, virtualID)
+			subdir++
+		}
+	}
+	inode.children = ids
+	inode.subdir = subdir
+	inode.mutex.Unlock()
+	c.staleListings.remove(id)
+	return children, nil
+}
+
+// insertVirtual adds a folder onedriver makes up, like the Shared folder, at
+// the root. It only joins the root's children if those were listed already,
+// otherwise the root would look listed with only it in it. fetchChildren adds
+// it once the root is listed.
+func (c *Cache) insertVirtual(folder *Inode) {
+	if root := c.GetID(c.root); root != nil {
+		root.mutex.RLock()
+		listed := root.children != nil
+		root.mutex.RUnlock()
+		if listed {
+			c.InsertID(folder.ID(), folder)
+			return
+		}
+	}
+	folder.mutex.Lock()
+	folder.cache = c
+	folder.mutex.Unlock()
+	c.metadata.Store(folder.ID(), folder)
+}
+
+// cachedChildren lists a folder from whatever of its children is cached, and
+// marks the listing to be fetched again once we are back online.
+func (c *Cache) cachedChildren(inode *Inode) map[string]*Inode {
+	id := inode.ID()
+	parentPath := inode.Path()
+	log.WithFields(log.Fields{
+		"id":   id,
+		"path": parentPath,
+	}).Warn("We are offline and this folder was never listed, showing only the children we have cached.")
+	c.staleListings.add(id)
+
+	found := make(map[string]bool)
+	inode.mutex.RLock()
+	for _, childID := range inode.children {
+		found[childID] = true
+	}
+	inode.mutex.RUnlock()
+	c.metadata.Range(func(childID string, child *Inode) bool {
+		if child.ParentID() == id {
+			found[childID] = true
+		}
+		return true
+	})
+	if c.db != nil {
+		c.db.View(func(tx *bolt.Tx) error {
+			return tx.Bucket(METADATA).ForEach(func(k, v []byte) error {
+				var item struct {
+					Parent *DriveItemParent `json:"parentReference"`
+				}
+				if json.Unmarshal(v, &item) == nil && item.Parent != nil && item.Parent.ID == id {
+					found[string(k)] = true
+				}
+				return nil
+			})
+		})
+	}
+
+	children := make(map[string]*Inode)
+	for childID := range found {
+		child := c.GetID(childID)
+		if child == nil || child.ParentID() != id || excluded(parentPath, child.Name()) {
+			continue
+		}
+		children[strings.ToLower(child.Name())] = child
+	}
+	return children
+}
+
+// revalidateListings fetches folders whose listings were made while offline
+// again.
+func (c *Cache) revalidateListings() {
+	auth := c.GetAuth()
+	if auth == nil {
+		return
+	}
+	for _, id := range c.staleListings.list() {
+		inode := c.GetID(id)
+		if inode == nil {
+			c.staleListings.remove(id)
+			continue
+		}
+		if _, err := c.fetchChildren(inode, auth); err != nil {
+			log.WithFields(log.Fields{
+				"id":  id,
+				"err": err,
+			}).Warn("Could not fetch listing of folder made while offline.")
+			if IsOffline(err) {
+				c.noteOffline(err)
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package graph
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "github.com/etcd-io/bbolt"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// Folders that were never listed should show what is cached of them while
+// offline, and keep doing so after something is made in them.
+func TestCachedChildren(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "onedriver-listing-")
+	failOnErr(t, err)
+	defer os.RemoveAll(dir)
+	db, err := bolt.Open(filepath.Join(dir, "listing.db"), 0600,
+		&bolt.Options{Timeout: time.Second * 5})
+	failOnErr(t, err)
+	defer db.Close()
+	failOnErr(t, db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(METADATA)
+		return err
+	}))
+	cache := &Cache{
+		db:       db,
+		metadata: newShardedMap(),
+		offline:  true,
+	}
+
+	root := NewInode("root", 0755|fuse.S_IFDIR, nil)
+	cache.InsertID(root.ID(), root)
+	folder := NewInode("folder", 0755|fuse.S_IFDIR, root)
+	folder.IDInternal = "folder"
+	cache.InsertChild(root.ID(), folder)
+	folder.children = nil // never listed
+
+	inMemory := NewInode("memory.txt", 0644|fuse.S_IFREG, folder)
+	inMemory.IDInternal = "memory"
+	cache.metadata.Store(inMemory.ID(), inMemory)
+	onDisk := NewInode("disk.txt", 0644|fuse.S_IFREG, folder)
+	onDisk.IDInternal = "disk"
+	failOnErr(t, db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(METADATA).Put([]byte(onDisk.ID()), onDisk.AsJSON())
+	}))
+
+	children, err := cache.GetChildrenID(folder.ID(), nil)
+	failOnErr(t, err)
+	if len(children) != 2 || children["memory.txt"] == nil || children["disk.txt"] == nil {
+		t.Fatalf("Expected the cached children, got %v.", children)
+	}
+	if !cache.staleListings.has(folder.ID()) {
+		t.Fatal("Listing should be fetched again once online.")
+	}
+
+	made := NewInode("made offline.txt", 0644|fuse.S_IFREG, folder)
+	cache.InsertChild(folder.ID(), made)
+	children, err = cache.GetChildrenID(folder.ID(), nil)
+	failOnErr(t, err)
+	if len(children) != 3 {
+		t.Fatalf("Expected the cached children and the new one, got %v.", children)
+	}
+}
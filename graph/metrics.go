@@ -0,0 +1,254 @@
+package graph
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the latency histograms.
+var latencyBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+// histogram counts how long something took, in latencyBuckets.
+type histogram struct {
+	buckets []uint64 // cumulative counts are worked out when written
+	count   uint64
+	sum     float64
+	max     float64
+}
+
+// histogramVec is a histogram for each value of a label. It can record the
+// latencies of FUSE operations for go-fuse.
+type histogramVec struct {
+	mutex   sync.Mutex
+	byLabel map[string]*histogram
+}
+
+func newHistogramVec() *histogramVec {
+	return &histogramVec{byLabel: make(map[string]*histogram)}
+}
+
+// Add records that something labelled name took dt.
+func (h *histogramVec) Add(name string, dt time.Duration) {
+	seconds := dt.Seconds()
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	hist, ok := h.byLabel[name]
+	if !ok {
+		hist = &histogram{buckets: make([]uint64, len(latencyBuckets))}
+		h.byLabel[name] = hist
+	}
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			hist.buckets[i]++
+			break
+		}
+	}
+	hist.count++
+	hist.sum += seconds
+	if seconds > hist.max {
+		hist.max = seconds
+	}
+}
+
+// quantile estimates the q-quantile of the histogram, in seconds, as the
+// upper bound of the bucket it falls in, or the largest value recorded if
+// that is smaller.
+func (hist *histogram) quantile(q float64) float64 {
+	rank := uint64(math.Ceil(q * float64(hist.count)))
+	cumulative := uint64(0)
+	for i, bound := range latencyBuckets {
+		cumulative += hist.buckets[i]
+		if cumulative >= rank {
+			return math.Min(bound, hist.max)
+		}
+	}
+	return hist.max
+}
+
+// write writes the histograms in the Prometheus text format.
+func (h *histogramVec) write(w io.Writer, name string, help string, label string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	values := make([]string, 0, len(h.byLabel))
+	for value := range h.byLabel {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+	for _, value := range values {
+		hist := h.byLabel[value]
+		labels := label + "=" + quoteLabel(value)
+		cumulative := uint64(0)
+		for i, bound := range latencyBuckets {
+			cumulative += hist.buckets[i]
+			fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", name, labels,
+				strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, hist.count)
+		fmt.Fprintf(w, "%s_sum{%s} %g\n", name, labels, hist.sum)
+		fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, hist.count)
+	}
+}
+
+// quoteLabel quotes a label value for the Prometheus text format.
+func quoteLabel(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value) + `"`
+}
+
+// requestKey is what requests to the server are counted by.
+type requestKey struct {
+	endpoint string
+	method   string
+	status   string
+}
+
+var (
+	requestMetrics = struct {
+		sync.Mutex
+		counts map[requestKey]uint64
+	}{counts: make(map[requestKey]uint64)}
+	requestLatencies = newHistogramVec()
+	fuseLatencies    = newHistogramVec()
+)
+
+var (
+	driveIDPattern  = regexp.MustCompile(`/drives/[^/]+`)
+	itemIDPattern   = regexp.MustCompile(`/items/[^/:]+`)
+	itemPathPattern = regexp.MustCompile(`:/.*?(:|$)`)
+)
+
+// endpointLabel turns the resource a request was made for into the endpoint
+// it was made to, without IDs and paths, so there aren't more of them than
+// Prometheus can handle.
+func endpointLabel(resource string) string {
+	if i := strings.IndexByte(resource, '?'); i >= 0 {
+		resource = resource[:i]
+	}
+	resource = driveIDPattern.ReplaceAllString(resource, "/drives/{id}")
+	resource = itemIDPattern.ReplaceAllString(resource, "/items/{id}")
+	return itemPathPattern.ReplaceAllString(resource, ":{path}$1")
+}
+
+// recordRequest records a request to the server that took dt and got status
+// back, or failed without a response if status is 0.
+func recordRequest(resource string, method string, status int, dt time.Duration) {
+	key := requestKey{endpoint: endpointLabel(resource), method: method, status: "error"}
+	if status != 0 {
+		key.status = strconv.Itoa(status)
+	}
+	requestMetrics.Lock()
+	requestMetrics.counts[key]++
+	requestMetrics.Unlock()
+	requestLatencies.Add(method, dt)
+}
+
+// RecordFuseLatencies measures how long the FUSE operations of a mounted
+// filesystem take, for WriteMetrics and Stats.
+func RecordFuseLatencies(server *fuse.Server) {
+	server.RecordLatencies(fuseLatencies)
+}
+
+// WriteMetrics writes metrics for the process and for each of caches, by the
+// mountpoint they are mounted at, in the Prometheus text format.
+func WriteMetrics(w io.Writer, caches map[string]*Cache) {
+	requestMetrics.Lock()
+	keys := make([]requestKey, 0, len(requestMetrics.counts))
+	for key := range requestMetrics.counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.endpoint != b.endpoint {
+			return a.endpoint < b.endpoint
+		}
+		if a.method != b.method {
+			return a.method < b.method
+		}
+		return a.status < b.status
+	})
+	fmt.Fprint(w, "# HELP onedriver_graph_requests_total Requests made to the Graph API.\n"+
+		"# TYPE onedriver_graph_requests_total counter\n")
+	for _, key := range keys {
+		fmt.Fprintf(w, "onedriver_graph_requests_total{endpoint=%s,method=%s,status=%s} %d\n",
+			quoteLabel(key.endpoint), quoteLabel(key.method), quoteLabel(key.status),
+			requestMetrics.counts[key])
+	}
+	requestMetrics.Unlock()
+	requestLatencies.write(w, "onedriver_graph_request_duration_seconds",
+		"How long requests to the Graph API took.", "method")
+	fuseLatencies.write(w, "onedriver_fuse_operation_duration_seconds",
+		"How long FUSE operations took.", "operation")
+
+	mountpoints := make([]string, 0, len(caches))
+	for mountpoint := range caches {
+		mountpoints = append(mountpoints, mountpoint)
+	}
+	sort.Strings(mountpoints)
+	gauge := func(name string, kind string, help string, value func(c *Cache) string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+		for _, mountpoint := range mountpoints {
+			fmt.Fprintf(w, "%s{mountpoint=%s} %s\n", name, quoteLabel(mountpoint),
+				value(caches[mountpoint]))
+		}
+	}
+	now := time.Now()
+	counted := func(get func(c *cacheCounters) uint64) func(c *Cache) string {
+		return func(c *Cache) string {
+			c.counters.mutex.Lock()
+			defer c.counters.mutex.Unlock()
+			return strconv.FormatUint(get(&c.counters), 10)
+		}
+	}
+	gauge("onedriver_content_cache_hits_total", "counter",
+		"Files opened with their content already in the cache.",
+		counted(func(c *cacheCounters) uint64 { return c.contentHits }))
+	gauge("onedriver_content_cache_misses_total", "counter",
+		"Files opened whose content had to be downloaded.",
+		counted(func(c *cacheCounters) uint64 { return c.contentMisses }))
+	gauge("onedriver_listing_cache_hits_total", "counter",
+		"Folders listed from the cache.",
+		counted(func(c *cacheCounters) uint64 { return c.listingHits }))
+	gauge("onedriver_listing_cache_misses_total", "counter",
+		"Folders that had to be listed by the server.",
+		counted(func(c *cacheCounters) uint64 { return c.listingMisses }))
+	gauge("onedriver_upload_queue_length", "gauge",
+		"Uploads waiting or in progress.",
+		func(c *Cache) string {
+			if c.uploads == nil {
+				return "0"
+			}
+			uploads, _ := c.uploads.transfers(now)
+			return strconv.Itoa(len(uploads))
+		})
+	gauge("onedriver_pending_changes", "gauge",
+		"Local changes that are not on the server yet.",
+		func(c *Cache) string {
+			if c.changes == nil {
+				return "0"
+			}
+			return strconv.Itoa(len(c.PendingChanges()))
+		})
+	gauge("onedriver_delta_lag_seconds", "gauge",
+		"Time since changes were last fetched from the server.",
+		func(c *Cache) string {
+			age := c.Health().SyncAge(now).Seconds()
+			return strconv.FormatFloat(math.Max(age, 0), 'f', 3, 64)
+		})
+	gauge("onedriver_offline", "gauge",
+		"Whether the server can't be reached.",
+		func(c *Cache) string {
+			if c.IsOffline() {
+				return "1"
+			}
+			return "0"
+		})
+}
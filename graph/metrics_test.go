@@ -0,0 +1,83 @@
+package graph
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEndpointLabel(t *testing.T) {
+	t.Parallel()
+	tests := map[string]string{
+		"/me":                                        "/me",
+		"/me/drive/root/delta?token=latest":          "/me/drive/root/delta",
+		"/me/drive/items/AB12!34/children":           "/me/drive/items/{id}/children",
+		"/me/drive/root:/Documents/a.txt":            "/me/drive/root:{path}",
+		"/me/drive/root:/Documents/a.txt:/content":   "/me/drive/root:{path}:/content",
+		"/me/drive/items/AB12!34:/a.txt:/content":    "/me/drive/items/{id}:{path}:/content",
+		"/me/drive/items/AB12!34/content?format=pdf": "/me/drive/items/{id}/content",
+		"/drives/b!x-Y_z/items/01AB/children":        "/drives/{id}/items/{id}/children",
+	}
+	for resource, expected := range tests {
+		if got := endpointLabel(resource); got != expected {
+			t.Errorf("endpointLabel(%q) = %q, expected %q", resource, got, expected)
+		}
+	}
+}
+
+// Histograms must count every observation in each bucket above it, as the
+// Prometheus text format expects.
+func TestHistogramCumulative(t *testing.T) {
+	t.Parallel()
+	h := newHistogramVec()
+	h.Add("GETATTR", 2*time.Millisecond)
+	h.Add("GETATTR", 20*time.Millisecond)
+	h.Add("GETATTR", time.Minute)
+
+	var out bytes.Buffer
+	h.write(&out, "test_seconds", "Test.", "operation")
+	for _, line := range []string{
+		`test_seconds_bucket{operation="GETATTR",le="0.001"} 0`,
+		`test_seconds_bucket{operation="GETATTR",le="0.005"} 1`,
+		`test_seconds_bucket{operation="GETATTR",le="0.025"} 2`,
+		`test_seconds_bucket{operation="GETATTR",le="30"} 2`,
+		`test_seconds_bucket{operation="GETATTR",le="+Inf"} 3`,
+		`test_seconds_count{operation="GETATTR"} 3`,
+	} {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Errorf("Missing %q in:\n%s", line, out.String())
+		}
+	}
+}
+
+func TestQuoteLabel(t *testing.T) {
+	t.Parallel()
+	if got := quoteLabel("a\"b\\c\nd"); got != `"a\"b\\c\nd"` {
+		t.Errorf("Label was not escaped: %s", got)
+	}
+}
+
+// Quantiles are estimated by the bucket they fall in, but never beyond the
+// largest latency seen.
+func TestHistogramQuantile(t *testing.T) {
+	t.Parallel()
+	h := newHistogramVec()
+	for i := 0; i < 98; i++ {
+		h.Add("READ", 3*time.Millisecond)
+	}
+	h.Add("READ", 200*time.Millisecond)
+	h.Add("READ", 42*time.Second)
+
+	hist := h.byLabel["READ"]
+	tests := map[float64]float64{.5: .005, .99: .25, 1: 42}
+	for q, expected := range tests {
+		if got := hist.quantile(q); got != expected {
+			t.Errorf("Quantile %g was %g, expected %g.", q, got, expected)
+		}
+	}
+	h.Add("GETATTR", 300*time.Microsecond)
+	if got := h.byLabel["GETATTR"].quantile(.5); got != .0003 {
+		t.Errorf("Quantile of a single fast operation was %g, expected the operation itself.", got)
+	}
+}
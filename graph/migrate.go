@@ -0,0 +1,95 @@
+package graph
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	bolt "github.com/etcd-io/bbolt"
+	log "github.com/sirupsen/logrus"
+)
+
+// VERSION is the boltdb bucket storing the on-disk cache schema version
+var VERSION = []byte("version")
+
+// a migration upgrades the on-disk cache by exactly one schema version.
+// Migrations are run in order inside a single transaction, so a failed
+// migration leaves the database untouched. contentDir is where file content is
+// stored outside of the database.
+type migration func(tx *bolt.Tx, contentDir string) error
+
+// migrations contains every migration ever written, in order. migrations[n]
+// upgrades a cache from schema version n to n+1. Never reorder or remove
+// entries from this list, only append.
+var migrations = []migration{
+	// 0 -> 1: caches created before schema versioning existed. Layout is
+	// unchanged, they simply get stamped with a version.
+	func(tx *bolt.Tx, contentDir string) error { return nil },
+
+	// 1 -> 2: file content moves out of the database and into individual
+	// files that can be written atomically.
+	func(tx *bolt.Tx, contentDir string) error {
+		b := tx.Bucket(CONTENT)
+		if b == nil {
+			return nil
+		}
+		err := b.ForEach(func(k, v []byte) error {
+			return ioutil.WriteFile(filepath.Join(contentDir, string(k)), v, 0600)
+		})
+		if err != nil {
+			return err
+		}
+		return tx.DeleteBucket(CONTENT)
+	},
+}
+
+// schemaVersion is the cache schema version used by this release of onedriver
+var schemaVersion = uint64(len(migrations))
+
+// getSchemaVersion returns the schema version of the cache. Caches without a
+// version are assumed to be version 0.
+func getSchemaVersion(tx *bolt.Tx) uint64 {
+	b := tx.Bucket(VERSION)
+	if b == nil {
+		return 0
+	}
+	if version := b.Get([]byte("schema")); len(version) == 8 {
+		return binary.BigEndian.Uint64(version)
+	}
+	return 0
+}
+
+func setSchemaVersion(tx *bolt.Tx, version uint64) error {
+	b, err := tx.CreateBucketIfNotExists(VERSION)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, version)
+	return b.Put([]byte("schema"), buf)
+}
+
+// migrateCache upgrades an on-disk cache in place to the current schema
+// version. Caches written by a newer version of onedriver are refused, since we
+// have no idea what their layout is.
+func migrateCache(db *bolt.DB, contentDir string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		version := getSchemaVersion(tx)
+		if version > schemaVersion {
+			return fmt.Errorf("cache schema version %d is newer than the "+
+				"latest version supported by this release (%d)", version, schemaVersion)
+		}
+		for ; version < schemaVersion; version++ {
+			log.WithFields(log.Fields{
+				"from": version,
+				"to":   version + 1,
+			}).Info("Migrating cache schema.")
+			if err := migrations[version](tx, contentDir); err != nil {
+				return fmt.Errorf("cache migration from schema version %d failed: %w",
+					version, err)
+			}
+		}
+		return setSchemaVersion(tx, schemaVersion)
+	})
+}
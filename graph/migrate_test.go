@@ -0,0 +1,32 @@
+package graph
+
+import (
+	"testing"
+	"time"
+
+	bolt "github.com/etcd-io/bbolt"
+)
+
+// An unversioned cache should be upgraded to the current schema version, and a
+// cache from the future should be refused.
+func TestMigrateCache(t *testing.T) {
+	t.Parallel()
+	db, err := bolt.Open("test_migrate_cache.db", 0600, &bolt.Options{Timeout: time.Second * 5})
+	failOnErr(t, err)
+	defer db.Close()
+
+	failOnErr(t, migrateCache(db, "test_migrate_cache-content"))
+	db.View(func(tx *bolt.Tx) error {
+		if version := getSchemaVersion(tx); version != schemaVersion {
+			t.Fatalf("Cache schema version was %d, expected %d.", version, schemaVersion)
+		}
+		return nil
+	})
+
+	db.Update(func(tx *bolt.Tx) error {
+		return setSchemaVersion(tx, schemaVersion+1)
+	})
+	if migrateCache(db, "test_migrate_cache-content") == nil {
+		t.Fatal("Migrating a cache from a newer release should fail.")
+	}
+}
@@ -0,0 +1,171 @@
+package graph
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	nmBus                  = "org.freedesktop.NetworkManager"
+	nmPath dbus.ObjectPath = "/org/freedesktop/NetworkManager"
+
+	// NMState values, see NetworkManager's D-Bus API documentation
+	nmStateAsleep        = 10
+	nmStateDisconnected  = 20
+	nmStateDisconnecting = 30
+
+	// NMMetered values
+	nmMeteredYes      = 1
+	nmMeteredGuessYes = 3
+
+	// how long to wait before following NetworkManager again if the system bus
+	// can't be reached
+	networkRetry = time.Minute
+)
+
+var errNoNetwork = errors.New("NetworkManager reports no network connection")
+
+// networkState is what NetworkManager tells us about the network.
+type networkState struct {
+	connected bool
+	metered   bool
+}
+
+// newNetworkState interprets NetworkManager's State and Metered properties.
+// Unknown states count as connected, failed requests will tell us otherwise.
+func newNetworkState(state uint32, metered uint32) networkState {
+	return networkState{
+		connected: state != nmStateAsleep &&
+			state != nmStateDisconnected &&
+			state != nmStateDisconnecting,
+		metered: metered == nmMeteredYes || metered == nmMeteredGuessYes,
+	}
+}
+
+// variantUint reads the value of a uint32 property.
+func variantUint(variant dbus.Variant) (uint32, error) {
+	value, ok := variant.Value().(uint32)
+	if !ok {
+		return 0, fmt.Errorf("not a uint32: %s", variant)
+	}
+	return value, nil
+}
+
+// networkManagerProperty fetches a property of NetworkManager itself.
+func networkManagerProperty(conn *dbus.Conn, name string) (uint32, error) {
+	variant, err := conn.Object(nmBus, nmPath).GetProperty(nmBus + "." + name)
+	if err != nil {
+		return 0, err
+	}
+	return variantUint(variant)
+}
+
+// queryNetwork asks NetworkManager for the current state of the network.
+func queryNetwork(conn *dbus.Conn) (networkState, error) {
+	state, err := networkManagerProperty(conn, "State")
+	if err != nil {
+		return networkState{}, err
+	}
+	metered, err := networkManagerProperty(conn, "Metered")
+	if err != nil {
+		return networkState{}, err
+	}
+	return newNetworkState(state, metered), nil
+}
+
+// networkLoop follows NetworkManager until the cache is shut down, so the
+// filesystem goes offline as soon as the machine is disconnected and large
+// transfers are held while the connection is metered.
+func (c *Cache) networkLoop() {
+	for {
+		if err := c.followNetwork(); err != nil && c.ctx.Err() == nil {
+			log.WithField("err", err).Debug("Stopped following NetworkManager.")
+		}
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-time.After(networkRetry):
+		}
+	}
+}
+
+// followNetwork watches NetworkManager's signals and applies the state of the
+// network whenever it changes. Returns once the cache is shut down or the
+// connection to the system bus is lost.
+func (c *Cache) followNetwork() error {
+	conn, err := dbus.ConnectSystemBus()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	err = conn.AddMatchSignal(
+		dbus.WithMatchObjectPath(nmPath),
+		dbus.WithMatchInterface(nmBus),
+		dbus.WithMatchMember("StateChanged"),
+	)
+	if err != nil {
+		return err
+	}
+	err = conn.AddMatchSignal(
+		dbus.WithMatchObjectPath(nmPath),
+		dbus.WithMatchInterface("org.freedesktop.DBus.Properties"),
+		dbus.WithMatchMember("PropertiesChanged"),
+	)
+	if err != nil {
+		return err
+	}
+	signals := make(chan *dbus.Signal, 16)
+	conn.Signal(signals)
+
+	// signals only arrive on changes
+	if state, err := queryNetwork(conn); err == nil {
+		c.applyNetwork(state)
+	}
+	for {
+		select {
+		case <-c.ctx.Done():
+			return nil
+		case signal, ok := <-signals:
+			if !ok {
+				return errors.New("connection to the system bus was closed")
+			}
+			if signal.Path != nmPath {
+				continue
+			}
+			state, err := queryNetwork(conn)
+			if err != nil {
+				log.WithField("err", err).Debug("Could not query NetworkManager.")
+				continue
+			}
+			c.applyNetwork(state)
+		}
+	}
+}
+
+// applyNetwork moves the filesystem offline or back online, and holds or
+// releases large transfers, to match the state of the network.
+func (c *Cache) applyNetwork(state networkState) {
+	if state.metered != transfers.isMetered() {
+		transfers.setMetered(state.metered)
+		if state.metered {
+			log.Info("Connection is metered, holding large transfers.")
+		} else {
+			log.Info("Connection is no longer metered, resuming large transfers.")
+		}
+	}
+	if !state.connected {
+		if !c.IsOffline() {
+			c.setOffline(true, errNoNetwork)
+		}
+		return
+	}
+	if c.IsOffline() {
+		// connected to a network doesn't mean the server can be reached,
+		// fetching deltas brings us online if it can
+		c.TriggerDeltas()
+	}
+}
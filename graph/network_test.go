@@ -0,0 +1,39 @@
+package graph
+
+import (
+	"testing"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// NetworkManager's properties should be understood, and only
+// states that are clearly disconnected should take the filesystem offline.
+func TestNetworkState(t *testing.T) {
+	t.Parallel()
+	value, err := variantUint(dbus.MakeVariant(uint32(70)))
+	failOnErr(t, err)
+	if value != 70 {
+		t.Fatalf("Parsed %d instead of 70.", value)
+	}
+	if _, err := variantUint(dbus.MakeVariant("connected")); err == nil {
+		t.Fatal("Only uint32 values should be parsed.")
+	}
+
+	tests := []struct {
+		state, metered uint32
+		expected       networkState
+	}{
+		{70, 4, networkState{connected: true}},
+		{20, 2, networkState{}},
+		{10, 0, networkState{}},
+		{0, 0, networkState{connected: true}},
+		{50, 1, networkState{connected: true, metered: true}},
+		{70, 3, networkState{connected: true, metered: true}},
+	}
+	for _, test := range tests {
+		if state := newNetworkState(test.state, test.metered); state != test.expected {
+			t.Errorf("State %d and metered %d gave %+v instead of %+v.",
+				test.state, test.metered, state, test.expected)
+		}
+	}
+}
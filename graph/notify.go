@@ -0,0 +1,79 @@
+package graph
+
+import (
+	"github.com/hanwen/go-fuse/v2/fs"
+	log "github.com/sirupsen/logrus"
+)
+
+// kernelInode returns the go-fuse inode for an item, or nil if the kernel has
+// never been told about it (in which case there is nothing to invalidate).
+func kernelInode(inode *Inode) *fs.Inode {
+	if inode == nil {
+		return nil
+	}
+	embedded := inode.EmbeddedInode()
+	if embedded.StableAttr().Ino == 0 {
+		// never looked up, or not mounted at all
+		return nil
+	}
+	return embedded
+}
+
+// notifyEntry tells the kernel to forget any cached dentry (positive or
+// negative) for a name inside a directory.
+func notifyEntry(parent *Inode, name string) {
+	if kernelParent := kernelInode(parent); kernelParent != nil {
+		if errno := kernelParent.NotifyEntry(name); errno != 0 {
+			log.WithFields(log.Fields{
+				"name":  name,
+				"errno": errno,
+			}).Trace("Kernel entry invalidation failed.")
+		}
+	}
+}
+
+// notifyDelete removes an item from the kernel's view of a directory and drops
+// it from the go-fuse inode tree.
+func notifyDelete(parent *Inode, name string, child *Inode) {
+	kernelParent := kernelInode(parent)
+	if kernelParent == nil {
+		return
+	}
+	kernelChild := kernelInode(child)
+	if kernelChild == nil {
+		notifyEntry(parent, name)
+		return
+	}
+	if errno := kernelParent.NotifyDelete(name, kernelChild); errno != 0 {
+		log.WithFields(log.Fields{
+			"name":  name,
+			"errno": errno,
+		}).Trace("Kernel delete notification failed.")
+	}
+	kernelParent.RmChild(name)
+}
+
+// notifyMove updates the go-fuse inode tree after an item was moved/renamed and
+// invalidates the kernel's dentries for both the old and new names.
+func notifyMove(oldParent *Inode, oldName string, newParent *Inode, newName string) {
+	kernelOld := kernelInode(oldParent)
+	kernelNew := kernelInode(newParent)
+	if kernelOld != nil && kernelNew != nil {
+		kernelOld.MvChild(oldName, kernelNew, newName, true)
+	}
+	notifyEntry(oldParent, oldName)
+	notifyEntry(newParent, newName)
+}
+
+// notifyContent tells the kernel to drop any cached pages and attributes for an
+// item.
+func notifyContent(inode *Inode) {
+	if kernelFile := kernelInode(inode); kernelFile != nil {
+		if errno := kernelFile.NotifyContent(0, 0); errno != 0 {
+			log.WithFields(log.Fields{
+				"id":    inode.ID(),
+				"errno": errno,
+			}).Trace("Kernel content invalidation failed.")
+		}
+	}
+}
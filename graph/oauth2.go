@@ -2,44 +2,135 @@ package graph
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
 const (
-	authCodeURL     = "https://login.microsoftonline.com/common/oauth2/v2.0/authorize"
-	authTokenURL    = "https://login.microsoftonline.com/common/oauth2/v2.0/token"
 	authRedirectURL = "https://login.live.com/oauth20_desktop.srf"
 	authClientID    = "3470c3fa-bc10-45ab-a0a9-2d30836485d1"
+	authTenant      = "common"
 	authFile        = "auth_tokens.json"
+	authScope       = "user.read files.readwrite.all offline_access"
 )
 
+// AuthConfig controls how onedriver signs in. It is saved alongside the tokens
+// it was used to obtain, since tokens can only be renewed with the same
+// settings they were issued with.
+type AuthConfig struct {
+	// Tenant is the Azure AD authority to sign in against: "common" (any
+	// account), "organizations" (work/school only), "consumers" (personal
+	// only), or a specific tenant ID or domain.
+	Tenant string `json:"tenant,omitempty"`
+	// Cloud is the national cloud to use, see Clouds(). Defaults to the
+	// global service.
+	Cloud string `json:"cloud,omitempty"`
+	// Distributors and tenants that block third party apps can use their own
+	// Azure app registration instead of the built-in one.
+	ClientID     string `json:"client_id,omitempty"`
+	RedirectURL  string `json:"redirect_uri,omitempty"`
+	ClientSecret string `json:"client_secret,omitempty"` // confidential clients only
+	DeviceCode   bool   `json:"device_code,omitempty"`   // reauth with the device code flow
+	Browser      bool   `json:"browser,omitempty"`       // reauth with the default browser
+	// Scopes are the Graph permissions to request, space separated. Read-only
+	// deployments can request only "files.read" for instance.
+	Scopes string `json:"scopes,omitempty"`
+}
+
+// scope returns the scopes to request. offline_access is always requested,
+// without it no refresh token is issued.
+func (c AuthConfig) scope() string {
+	if c.Scopes == "" {
+		return authScope
+	}
+	for _, scope := range strings.Fields(c.Scopes) {
+		if strings.EqualFold(scope, "offline_access") {
+			return c.Scopes
+		}
+	}
+	return c.Scopes + " offline_access"
+}
+
+// clientID returns the configured app registration, or the built-in one.
+func (c AuthConfig) clientID() string {
+	if c.ClientID == "" {
+		return authClientID
+	}
+	return c.ClientID
+}
+
+// redirectURL returns the configured redirect URI, or the built-in one.
+func (c AuthConfig) redirectURL() string {
+	if c.RedirectURL == "" {
+		return authRedirectURL
+	}
+	return c.RedirectURL
+}
+
+// postToken makes a request to the token endpoint. The client ID (and secret,
+// if any) are added to the form automatically.
+func (c AuthConfig) postToken(form url.Values) (*http.Response, error) {
+	form.Set("client_id", c.clientID())
+	if c.ClientSecret != "" {
+		form.Set("client_secret", c.ClientSecret)
+	}
+	return httpClient(30*time.Second).PostForm(c.endpoint("token"), form)
+}
+
+// tenant returns the configured tenant, or the default if unset.
+func (c AuthConfig) tenant() string {
+	if c.Tenant == "" {
+		return authTenant
+	}
+	return c.Tenant
+}
+
+// endpoint returns the URL of an OAuth2 endpoint ("authorize", "token",
+// "devicecode") for the configured tenant.
+func (c AuthConfig) endpoint(name string) string {
+	return c.cloud().loginURL + "/" + url.PathEscape(c.tenant()) + "/oauth2/v2.0/" + name
+}
+
 // Auth represents a set of oauth2 authentication tokens
 type Auth struct {
+	AuthConfig
 	ExpiresIn    int64  `json:"expires_in"` // only used for parsing
 	ExpiresAt    int64  `json:"expires_at"`
 	AccessToken  string `json:"access_token"`
 	RefreshToken string `json:"refresh_token"`
+	Scope        string `json:"scope,omitempty"` // scopes actually granted
 	path         string // auth tokens remember their path for use by Refresh()
+	background   bool   // never prompt to sign in, nobody may be watching
+	expired      bool   // tokens can't be renewed, a new sign in is required
+	broker       bool   // this process renews tokens for others, see broker.go
 }
 
-// ToFile writes auth tokens to a file
+// ErrReauthRequired is returned for requests made after the refresh token has
+// been revoked or expired, until the user signs in again.
+var ErrReauthRequired = errors.New("authentication expired, " +
+	"run \"onedriver --reauth\" to sign in again")
+
+// ToFile saves auth tokens. They are stored in the system keyring if possible,
+// otherwise in a file only the user can read.
 func (a Auth) ToFile(file string) error {
 	a.path = file
 	byteData, _ := json.Marshal(a)
-	return ioutil.WriteFile(file, byteData, 0600)
+	return saveTokens(file, byteData)
 }
 
-// FromFile populates an auth struct from a file
+// FromFile populates an auth struct from tokens saved with ToFile. Plaintext
+// token files from older versions are migrated to secure storage.
 func (a *Auth) FromFile(file string) error {
-	contents, err := ioutil.ReadFile(file)
+	contents, err := loadTokens(file)
 	if err != nil {
 		return err
 	}
@@ -47,75 +138,224 @@ func (a *Auth) FromFile(file string) error {
 	return json.Unmarshal(contents, a)
 }
 
-// Refresh auth tokens if expired.
+// Tokens are renewed this many seconds before they actually expire, so that
+// requests in flight never go out with a token that expires along the way.
+const authRefreshMargin = 5 * 60
+
+// authMutex guards the token fields of every Auth. Tokens are read on every
+// request but written rarely, so one lock for all of them is plenty.
+var authMutex sync.RWMutex
+
+// refreshes makes sure only one refresh happens at a time for a set of tokens,
+// no matter how many requests discover they need one at once.
+var refreshes = newFlightGroup()
+
+// accessToken returns the current access token.
+func (a *Auth) accessToken() string {
+	authMutex.RLock()
+	defer authMutex.RUnlock()
+	return a.AccessToken
+}
+
+// needsRefresh returns whether the access token has expired or is about to.
+func (a *Auth) needsRefresh() bool {
+	authMutex.RLock()
+	defer authMutex.RUnlock()
+	return a.ExpiresAt-authRefreshMargin <= time.Now().Unix()
+}
+
+// Refresh auth tokens if expired or about to expire.
 func (a *Auth) Refresh() {
-	if a.ExpiresAt <= time.Now().Unix() {
-		oldTime := a.ExpiresAt
-		postData := strings.NewReader("client_id=" + authClientID +
-			"&redirect_uri=" + authRedirectURL +
-			"&refresh_token=" + a.RefreshToken +
-			"&grant_type=refresh_token")
-		resp, err := http.Post(authTokenURL,
-			"application/x-www-form-urlencoded",
-			postData)
-
-		var reauth bool
-		if err != nil {
-			if IsOffline(err) {
-				log.WithFields(log.Fields{
-					"err": err,
-				}).Trace("Network unreachable during token renewal, ignoring.")
-				return
+	if a.needsRefresh() {
+		refreshes.do(a.path, func() {
+			// someone else may have refreshed while we were waiting
+			if a.needsRefresh() && !a.refreshFromBroker("") {
+				a.refresh()
 			}
-			log.WithFields(log.Fields{
-				"err": err,
-			}).Error("Could not POST to renew tokens, forcing reauth.")
-			reauth = true
-		} else {
-			// put here so as to avoid spamming the log when offline
-			log.Info("Auth tokens expired, attempting renewal.")
+		})
+	}
+}
+
+// refreshRejected renews tokens after the server rejected stale as invalid.
+// Requests that fail with the same token at the same time share one refresh.
+func (a *Auth) refreshRejected(stale string) {
+	refreshes.do(a.path, func() {
+		if a.accessToken() == stale && !a.refreshFromBroker(stale) {
+			a.refresh()
 		}
-		defer resp.Body.Close()
+	})
+}
 
-		body, _ := ioutil.ReadAll(resp.Body)
-		json.Unmarshal(body, &a)
-		if a.ExpiresAt == oldTime {
-			a.ExpiresAt = time.Now().Unix() + a.ExpiresIn
+// refresh renews the access token using the refresh token, regardless of
+// whether the access token is expired. Should only be called through
+// Refresh/refreshRejected, never concurrently.
+func (a *Auth) refresh() {
+	authMutex.RLock()
+	config := a.AuthConfig
+	refreshToken := a.RefreshToken
+	broker := a.broker
+	authMutex.RUnlock()
+	if !broker && a.path != "" {
+		// a broker that went away since may have rotated the refresh token,
+		// it only hands out access tokens but saves the rest
+		var saved Auth
+		if contents, err := loadTokens(a.path); err == nil &&
+			json.Unmarshal(contents, &saved) == nil && saved.RefreshToken != "" {
+			refreshToken = saved.RefreshToken
 		}
-		if a.AccessToken == "" || a.RefreshToken == "" {
-			log.Errorf("Failed to renew access tokens. Response from server:\n%s\n", string(body))
-			reauth = true
+	}
+	var fresh Auth
+	var err error
+	backoff := refreshBackoff
+	for attempt := 1; ; attempt++ {
+		fresh, err = config.renewTokens(refreshToken)
+		if err == nil || err == errRefreshRevoked || IsOffline(err) ||
+			attempt == refreshAttempts {
+			break
 		}
+		log.WithFields(log.Fields{
+			"err":     err,
+			"attempt": attempt,
+		}).Warnf("Could not renew auth tokens, retrying in %s.", backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	if IsOffline(err) {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Trace("Network unreachable during token renewal, ignoring.")
+		return
+	}
+	if err != nil && err != errRefreshRevoked {
+		// the refresh token may still be good, the next request tries again
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("Could not renew auth tokens.")
+		return
+	}
 
-		if reauth {
-			// one of the above calls failed and we were not offline,
-			// give the user a chance to reauthenticate before exiting
-			new := getAuthTokens(getAuthCode())
-			a = &new
+	reauth := err == errRefreshRevoked
+	if reauth && a.background {
+		// can't prompt from inside a mounted filesystem, wait for the user to
+		// sign in again with --reauth
+		authMutex.Lock()
+		wasExpired := a.expired
+		a.expired = true
+		authMutex.Unlock()
+		if !wasExpired {
+			// the notification can take a while to go through D-Bus, and
+			// every request waits on authMutex
+			log.Error("Auth tokens could not be renewed, filesystem will be " +
+				"read-only until \"onedriver --reauth\" is run.")
+			notifyEvent("reauth", "OneDrive sign in required",
+				"Your session has expired. Run \"onedriver --reauth\" to "+
+					"sign in again and resume syncing.")
 		}
-		a.ToFile(a.path)
+		return
+	}
+	if reauth {
+		// the refresh token was rejected, give the user a chance to
+		// reauthenticate before exiting
+		fresh = signIn(config)
+	}
+	if fresh.ExpiresAt == 0 {
+		fresh.ExpiresAt = time.Now().Unix() + fresh.ExpiresIn
+	}
+	authMutex.Lock()
+	a.ExpiresIn = fresh.ExpiresIn
+	a.ExpiresAt = fresh.ExpiresAt
+	a.AccessToken = fresh.AccessToken
+	a.RefreshToken = fresh.RefreshToken
+	if fresh.Scope != "" {
+		a.Scope = fresh.Scope
+	}
+	saved := *a
+	authMutex.Unlock()
+	saved.ToFile(a.path)
+}
+
+// Token renewals that fail for any other reason than the refresh token being
+// rejected are attempted this many times, with the wait in between doubling.
+const (
+	refreshAttempts = 4
+	refreshBackoff  = time.Second
+)
+
+// errRefreshRevoked means the refresh token can no longer be used, and the user
+// has to sign in again.
+var errRefreshRevoked = errors.New("refresh token was rejected")
+
+// renewTokens exchanges a refresh token for a new set of tokens.
+func (c AuthConfig) renewTokens(refreshToken string) (Auth, error) {
+	resp, err := c.postToken(url.Values{
+		"redirect_uri":  {c.redirectURL()},
+		"refresh_token": {refreshToken},
+		"grant_type":    {"refresh_token"},
+	})
+	if err != nil {
+		return Auth{}, err
+	}
+	// put here so as to avoid spamming the log when offline
+	log.Info("Auth tokens expired, attempting renewal.")
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	var fresh Auth
+	json.Unmarshal(body, &fresh)
+	if fresh.AccessToken != "" && fresh.RefreshToken != "" {
+		return fresh, nil
+	}
+	if needsReauth(body) {
+		log.Errorf("Failed to renew access tokens. Response from server:\n%s\n", string(body))
+		return Auth{}, errRefreshRevoked
+	}
+	return Auth{}, fmt.Errorf("no tokens in response from server (HTTP %d): %s",
+		resp.StatusCode, strings.TrimSpace(string(body)))
+}
+
+// needsReauth returns whether an error response from the token endpoint means
+// the refresh token is revoked or expired. Anything else, like the service
+// being temporarily unavailable, is worth retrying.
+func needsReauth(body []byte) bool {
+	var failure struct {
+		Error string `json:"error"`
+	}
+	json.Unmarshal(body, &failure)
+	return failure.Error == "invalid_grant" || failure.Error == "interaction_required"
+}
+
+// signIn interactively signs in using whichever flow the config asks for.
+func signIn(config AuthConfig) Auth {
+	switch {
+	case config.DeviceCode:
+		return getDeviceCodeTokens(config)
+	case config.Browser:
+		return getLoopbackTokens(config)
+	default:
+		return getAuthTokens(config, getAuthCode(config), "")
 	}
 }
 
 // Get the appropriate authentication URL for the Graph OAuth2 challenge.
-func getAuthURL() string {
-	return authCodeURL +
-		"?client_id=" + authClientID +
-		"&scope=" + url.PathEscape("user.read files.readwrite.all offline_access") +
+func getAuthURL(config AuthConfig) string {
+	return config.endpoint("authorize") +
+		"?client_id=" + url.QueryEscape(config.clientID()) +
+		"&scope=" + url.PathEscape(config.scope()) +
 		"&response_type=code" +
-		"&redirect_uri=" + authRedirectURL
-}
-
-// Exchange an auth code for a set of access tokens
-func getAuthTokens(authCode string) Auth {
-	postData := strings.NewReader(
-		"client_id=" + authClientID +
-			"&redirect_uri=" + authRedirectURL +
-			"&code=" + authCode +
-			"&grant_type=authorization_code")
-	resp, err := http.Post(authTokenURL,
-		"application/x-www-form-urlencoded",
-		postData)
+		"&redirect_uri=" + url.QueryEscape(config.redirectURL())
+}
+
+// Exchange an auth code for a set of access tokens. verifier is the PKCE code
+// verifier, if one was used to obtain the code.
+func getAuthTokens(config AuthConfig, authCode string, verifier string) Auth {
+	form := url.Values{
+		"redirect_uri": {config.redirectURL()},
+		"code":         {authCode},
+		"grant_type":   {"authorization_code"},
+	}
+	if verifier != "" {
+		form.Set("code_verifier", verifier)
+	}
+	resp, err := config.postToken(form)
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
@@ -123,7 +363,7 @@ func getAuthTokens(authCode string) Auth {
 	defer resp.Body.Close()
 
 	body, _ := ioutil.ReadAll(resp.Body)
-	var auth Auth
+	auth := Auth{AuthConfig: config}
 	json.Unmarshal(body, &auth)
 	if auth.ExpiresAt == 0 {
 		auth.ExpiresAt = time.Now().Unix() + auth.ExpiresIn
@@ -134,14 +374,84 @@ func getAuthTokens(authCode string) Auth {
 	return auth
 }
 
-// Authenticate performs first-time authentication to Graph
+// writeScopes are the scopes that allow changing files in OneDrive.
+var writeScopes = []string{"files.readwrite", "files.readwrite.all", "sites.readwrite.all"}
+
+// CanWrite returns whether the tokens were granted permission to change files.
+// Without it, the filesystem should be mounted read-only.
+func (a *Auth) CanWrite() bool {
+	authMutex.RLock()
+	granted := a.Scope
+	if granted == "" {
+		// older tokens did not record what they were granted
+		granted = a.scope()
+	}
+	authMutex.RUnlock()
+	for _, scope := range strings.Fields(granted) {
+		// scopes are sometimes returned as full URLs
+		scope = scope[strings.LastIndex(scope, "/")+1:]
+		for _, write := range writeScopes {
+			if strings.EqualFold(scope, write) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ReauthRequired returns whether the tokens could not be renewed and the user
+// needs to sign in again.
+func (a *Auth) ReauthRequired() bool {
+	authMutex.RLock()
+	defer authMutex.RUnlock()
+	return a.expired
+}
+
+// Reload replaces the tokens in use with whatever is currently stored, so a
+// running instance picks up a sign in performed by Reauthenticate.
+func (a *Auth) Reload() error {
+	var stored Auth
+	if err := stored.FromFile(a.path); err != nil {
+		return err
+	}
+	authMutex.Lock()
+	defer authMutex.Unlock()
+	a.AuthConfig = stored.AuthConfig
+	a.ExpiresIn = stored.ExpiresIn
+	a.ExpiresAt = stored.ExpiresAt
+	a.AccessToken = stored.AccessToken
+	a.RefreshToken = stored.RefreshToken
+	a.Scope = stored.Scope
+	a.expired = false
+	return nil
+}
+
+// Reauthenticate forces a new interactive sign in, reusing the settings of any
+// tokens already stored at path.
+func Reauthenticate(path string, config AuthConfig) *Auth {
+	var stored Auth
+	if err := stored.FromFile(path); err == nil {
+		config = stored.AuthConfig
+	}
+	auth := signIn(config)
+	auth.ToFile(path)
+	return &auth
+}
+
+// Authenticate performs first-time authentication to Graph with the default
+// settings.
 func Authenticate(path string) *Auth {
+	return AuthenticateConfig(path, AuthConfig{})
+}
+
+// AuthenticateConfig performs first-time authentication to Graph. The config
+// is only used when signing in for the first time, existing tokens are always
+// renewed with the settings they were obtained with.
+func AuthenticateConfig(path string, config AuthConfig) *Auth {
 	var auth Auth
-	_, err := os.Stat(path)
-	if os.IsNotExist(err) {
+	if !tokensExist(path) {
 		// no tokens found, gotta start oauth flow from beginning
-		code := getAuthCode()
-		auth = getAuthTokens(code)
+		auth = signIn(config)
 		auth.ToFile(path)
 	} else {
 		// we already have tokens, no need to force a new auth flow
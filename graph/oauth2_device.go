@@ -0,0 +1,119 @@
+package graph
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// deviceCode is the response to a device authorization request
+type deviceCode struct {
+	DeviceCode      string `json:"device_code"`
+	UserCode        string `json:"user_code"`
+	VerificationURI string `json:"verification_uri"`
+	ExpiresIn       int64  `json:"expires_in"`
+	Interval        int64  `json:"interval"`
+	Message         string `json:"message"`
+}
+
+// deviceTokenError is returned by the token endpoint while the user has not
+// finished signing in yet.
+type deviceTokenError struct {
+	Error       string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+// requestDeviceCode starts the device code flow, returning a code for the user
+// to enter on another device.
+func requestDeviceCode(config AuthConfig) (*deviceCode, error) {
+	resp, err := httpClient(30*time.Second).PostForm(config.endpoint("devicecode"), url.Values{
+		"client_id": {config.clientID()},
+		"scope":     {config.scope()},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var code deviceCode
+	if err = json.Unmarshal(body, &code); err != nil || code.DeviceCode == "" {
+		return nil, fmt.Errorf("could not start device code authentication: %s", string(body))
+	}
+	if code.Interval <= 0 {
+		code.Interval = 5
+	}
+	return &code, nil
+}
+
+// pollDeviceCode polls the token endpoint until the user completes sign in on
+// another device, the code expires, or the user declines.
+func pollDeviceCode(config AuthConfig, code *deviceCode) (Auth, error) {
+	interval := time.Duration(code.Interval) * time.Second
+	deadline := time.Now().Add(time.Duration(code.ExpiresIn) * time.Second)
+	for time.Now().Before(deadline) {
+		time.Sleep(interval)
+		resp, err := config.postToken(url.Values{
+			"grant_type":  {"urn:ietf:params:oauth:grant-type:device_code"},
+			"device_code": {code.DeviceCode},
+		})
+		if err != nil {
+			log.WithField("err", err).Warn("Could not poll for device code completion, retrying.")
+			continue
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode == http.StatusOK {
+			auth := Auth{AuthConfig: config}
+			json.Unmarshal(body, &auth)
+			if auth.AccessToken == "" || auth.RefreshToken == "" {
+				return auth, fmt.Errorf("failed to retrieve access tokens: %s", string(body))
+			}
+			auth.ExpiresAt = time.Now().Unix() + auth.ExpiresIn
+			return auth, nil
+		}
+
+		var pending deviceTokenError
+		json.Unmarshal(body, &pending)
+		switch pending.Error {
+		case "authorization_pending":
+		case "slow_down":
+			interval += 5 * time.Second
+		default:
+			return Auth{}, errors.New(strings.TrimSpace(pending.Error + ": " + pending.Description))
+		}
+	}
+	return Auth{}, errors.New("device code expired before sign in was completed")
+}
+
+// getDeviceCodeTokens performs device code authentication from start to finish.
+// Instructions for the user are printed to stdout.
+func getDeviceCodeTokens(config AuthConfig) Auth {
+	config.DeviceCode = true
+	code, err := requestDeviceCode(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if code.Message != "" {
+		fmt.Println(code.Message)
+	} else {
+		fmt.Printf("To sign in, visit %s and enter the code %s\n",
+			code.VerificationURI, code.UserCode)
+	}
+	auth, err := pollDeviceCode(config, code)
+	if err != nil {
+		log.Fatalf("Device code authentication failed: %s", err)
+	}
+	return auth
+}
@@ -8,18 +8,25 @@
  */
 static void destroy_window(GtkWidget *widget, gpointer data) { gtk_main_quit(); }
 
+/**
+ * Where to watch for the final redirect, and where to put it once we see it.
+ */
+struct auth_redirect {
+    const char *complete_url;
+    char value[2048];
+};
+
 /**
  * Catch redirects once authentication completes.
  */
 static void web_view_load_changed(WebKitWebView *web_view, WebKitLoadEvent load_event,
-                                  char *auth_redirect_url_ptr) {
-    static const char *auth_complete_url = "https://login.live.com/oauth20_desktop.srf";
+                                  struct auth_redirect *redirect) {
     const char *url = webkit_web_view_get_uri(web_view);
 
     if (load_event == WEBKIT_LOAD_REDIRECTED &&
-        strncmp(auth_complete_url, url, strlen(auth_complete_url)) == 0) {
+        strncmp(redirect->complete_url, url, strlen(redirect->complete_url)) == 0) {
         // catch redirects to the oauth2 redirect only and destroy the window
-        strncpy(auth_redirect_url_ptr, url, 2047);
+        strncpy(redirect->value, url, 2047);
         GtkWidget *parent = gtk_widget_get_parent(GTK_WIDGET(web_view));
         gtk_widget_destroy(parent);
     }
@@ -28,7 +35,7 @@ static void web_view_load_changed(WebKitWebView *web_view, WebKitLoadEvent load_
 /**
  * Open a popup GTK auth window and return the final redirect location.
  */
-char *webkit_auth_window(char *auth_url) {
+char *webkit_auth_window(char *auth_url, char *redirect_url) {
     gtk_init(NULL, NULL);
     GtkWidget *auth_window = gtk_window_new(GTK_WINDOW_TOPLEVEL);
     gtk_window_set_default_size(GTK_WINDOW(auth_window), 450, 600);
@@ -38,10 +45,11 @@ char *webkit_auth_window(char *auth_url) {
     gtk_container_add(GTK_CONTAINER(auth_window), GTK_WIDGET(web_view));
     webkit_web_view_load_uri(web_view, auth_url);
 
-    char auth_redirect_value[2048];
-    auth_redirect_value[0] = '\0';
+    struct auth_redirect redirect;
+    redirect.complete_url = redirect_url;
+    redirect.value[0] = '\0';
     g_signal_connect(web_view, "load-changed", G_CALLBACK(web_view_load_changed),
-                     &auth_redirect_value);
+                     &redirect);
     g_signal_connect(auth_window, "destroy", G_CALLBACK(destroy_window), web_view);
 
     // show and grab focus
@@ -49,5 +57,5 @@ char *webkit_auth_window(char *auth_url) {
     gtk_widget_show_all(auth_window);
     gtk_main();
 
-    return strdup(auth_redirect_value);
+    return strdup(redirect.value);
 }
@@ -18,11 +18,13 @@ import (
 
 // Fetch the auth code required as the first part of oauth2 authentication. Uses
 // webkit2gtk to create a popup browser.
-func getAuthCode() string {
-	cAuthURL := C.CString(getAuthURL())
-	cResponse := C.webkit_auth_window(cAuthURL)
+func getAuthCode(config AuthConfig) string {
+	cAuthURL := C.CString(getAuthURL(config))
+	cRedirectURL := C.CString(config.redirectURL())
+	cResponse := C.webkit_auth_window(cAuthURL, cRedirectURL)
 	response := C.GoString(cResponse)
 	C.free(unsafe.Pointer(cAuthURL))
+	C.free(unsafe.Pointer(cRedirectURL))
 	C.free(unsafe.Pointer(cResponse))
 
 	rexp := regexp.MustCompile("code=([a-zA-Z0-9-_])+")
@@ -9,8 +9,8 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-func getAuthCode() string {
-	fmt.Printf("Please visit the following URL:\n%s\n\n", getAuthURL())
+func getAuthCode(config AuthConfig) string {
+	fmt.Printf("Please visit the following URL:\n%s\n\n", getAuthURL(config))
 	fmt.Println("Please enter the redirect URL once you are redirected to a " +
 		"blank page (after \"Let this app access your info?\"):")
 	var response string
@@ -0,0 +1,139 @@
+package graph
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// How long to wait for the user to finish signing in in their browser.
+const loopbackTimeout = 5 * time.Minute
+
+// loopbackResult is what the browser gets redirected back to us with
+type loopbackResult struct {
+	code string
+	err  error
+}
+
+// randomURLSafe returns a random base64url string for use as a PKCE verifier
+// or OAuth state.
+func randomURLSafe(n int) string {
+	buf := make([]byte, n)
+	rand.Read(buf)
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// pkceChallenge derives the S256 code challenge for a verifier (RFC 7636).
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// loopbackHandler receives the redirect from the authorization endpoint and
+// passes on the code (or error) it carries.
+func loopbackHandler(state string, results chan<- loopbackResult) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if query.Get("state") != state {
+			// not a response to our request, ignore it
+			http.Error(w, "Invalid state.", http.StatusBadRequest)
+			return
+		}
+		var result loopbackResult
+		if errCode := query.Get("error"); errCode != "" {
+			result.err = fmt.Errorf("%s: %s", errCode, query.Get("error_description"))
+			fmt.Fprintln(w, "Sign in failed, you can close this window and try again.")
+		} else if result.code = query.Get("code"); result.code == "" {
+			result.err = fmt.Errorf("no authorization code was returned")
+			fmt.Fprintln(w, "Sign in failed, you can close this window and try again.")
+		} else {
+			fmt.Fprintln(w, "Signed in to onedriver, you can close this window.")
+		}
+		select {
+		case results <- result:
+		default:
+		}
+	}
+}
+
+// loopbackRedirect returns the address to listen on and the redirect URI to
+// send to the authorization endpoint. A localhost redirect URI from the config
+// is used as is, otherwise a random port is picked.
+func loopbackRedirect(config AuthConfig) (string, string, error) {
+	if redirect, err := url.Parse(config.RedirectURL); err == nil && config.RedirectURL != "" {
+		host := redirect.Hostname()
+		if redirect.Scheme != "http" || (host != "localhost" && host != "127.0.0.1") {
+			return "", "", fmt.Errorf("redirect URI %s is not a loopback address", config.RedirectURL)
+		}
+		port := redirect.Port()
+		if port == "" {
+			port = "80"
+		}
+		return net.JoinHostPort("127.0.0.1", port), config.RedirectURL, nil
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", "", err
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	_, port, _ := net.SplitHostPort(addr)
+	return addr, "http://localhost:" + port, nil
+}
+
+// openBrowser opens a URL in the user's default browser.
+func openBrowser(target string) error {
+	return exec.Command("xdg-open", target).Start()
+}
+
+// getLoopbackTokens signs in with the user's default browser, receiving the
+// result on a temporary HTTP listener on localhost. Unlike the embedded
+// webview, this needs no GUI toolkit and works anywhere a browser does.
+func getLoopbackTokens(config AuthConfig) Auth {
+	addr, redirect, err := loopbackRedirect(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	config.RedirectURL = redirect
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatalf("Could not listen for sign in redirect: %s", err)
+	}
+
+	state := randomURLSafe(16)
+	verifier := randomURLSafe(32)
+	results := make(chan loopbackResult, 1)
+	server := &http.Server{Handler: loopbackHandler(state, results)}
+	go server.Serve(listener)
+	defer server.Shutdown(context.Background())
+
+	authURL := getAuthURL(config) +
+		"&state=" + state +
+		"&code_challenge=" + pkceChallenge(verifier) +
+		"&code_challenge_method=S256"
+	fmt.Printf("Opening your browser to sign in. If it does not open, visit:\n%s\n\n", authURL)
+	if err := openBrowser(authURL); err != nil {
+		log.WithField("err", err).Debug("Could not open browser.")
+	}
+
+	select {
+	case result := <-results:
+		if result.err != nil {
+			log.Fatalf("Sign in failed: %s", strings.TrimSpace(result.err.Error()))
+		}
+		return getAuthTokens(config, result.code, verifier)
+	case <-time.After(loopbackTimeout):
+		log.Fatal("Timed out waiting for sign in to complete in the browser.")
+	}
+	return Auth{}
+}
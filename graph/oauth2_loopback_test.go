@@ -0,0 +1,36 @@
+package graph
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// The loopback listener should only accept redirects carrying our state.
+func TestLoopbackHandler(t *testing.T) {
+	t.Parallel()
+	results := make(chan loopbackResult, 1)
+	handler := loopbackHandler("expected-state", results)
+
+	recorder := httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest("GET", "/?code=abc&state=forged", nil))
+	if recorder.Code != http.StatusBadRequest || len(results) != 0 {
+		t.Fatal("A redirect with the wrong state was accepted.")
+	}
+
+	recorder = httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest("GET", "/?code=abc&state=expected-state", nil))
+	result := <-results
+	if result.err != nil || result.code != "abc" {
+		t.Fatalf("Unexpected result: %+v", result)
+	}
+}
+
+// Test vector from RFC 7636 appendix B.
+func TestPKCEChallenge(t *testing.T) {
+	t.Parallel()
+	challenge := pkceChallenge("dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk")
+	if challenge != "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM" {
+		t.Fatalf("Unexpected code challenge: %s", challenge)
+	}
+}
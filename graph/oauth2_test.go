@@ -1,6 +1,7 @@
 package graph
 
 import (
+	"strings"
 	"testing"
 	"time"
 )
@@ -25,3 +26,106 @@ func TestAuthRefresh(t *testing.T) {
 		t.Fatal("Auth could not be refreshed successfully!")
 	}
 }
+
+// Tokens should be renewed a little before they actually expire.
+func TestAuthNeedsRefresh(t *testing.T) {
+	t.Parallel()
+	auth := Auth{ExpiresAt: time.Now().Unix() + 3600}
+	if auth.needsRefresh() {
+		t.Fatal("Tokens valid for another hour should not need a refresh.")
+	}
+	auth.ExpiresAt = time.Now().Unix() + 60
+	if !auth.needsRefresh() {
+		t.Fatal("Tokens about to expire should be refreshed early.")
+	}
+}
+
+// National clouds use their own hosts for both sign in and Graph requests.
+func TestAuthConfigCloud(t *testing.T) {
+	t.Parallel()
+	config := AuthConfig{Cloud: "china"}
+	if url := config.endpoint("token"); url != "https://login.chinacloudapi.cn/common/oauth2/v2.0/token" {
+		t.Fatalf("Unexpected token endpoint: %s", url)
+	}
+	if url := config.graphURL(); url != "https://microsoftgraph.chinacloudapi.cn/v1.0" {
+		t.Fatalf("Unexpected Graph URL: %s", url)
+	}
+	if err := ValidateCloud("mars"); err == nil {
+		t.Fatal("An unknown cloud was not rejected.")
+	}
+}
+
+// A custom app registration should be used everywhere the built-in one would.
+func TestAuthConfigCustomClient(t *testing.T) {
+	t.Parallel()
+	config := AuthConfig{
+		ClientID:    "00000000-0000-0000-0000-000000000000",
+		RedirectURL: "http://localhost/callback",
+	}
+	authURL := getAuthURL(config)
+	if !strings.Contains(authURL, "client_id=00000000-0000-0000-0000-000000000000") ||
+		!strings.Contains(authURL, "redirect_uri=http%3A%2F%2Flocalhost%2Fcallback") {
+		t.Fatalf("Custom client was not used in auth URL: %s", authURL)
+	}
+	if (AuthConfig{}).clientID() != authClientID {
+		t.Fatal("Built-in client ID was not used by default.")
+	}
+}
+
+// Background auth that can't be renewed should fail requests instead of
+// prompting for a new sign in.
+func TestAuthReauthRequired(t *testing.T) {
+	t.Parallel()
+	expired := &Auth{
+		AccessToken:  "expired",
+		RefreshToken: "revoked",
+		ExpiresAt:    time.Now().Unix() + 3600,
+		background:   true,
+		expired:      true,
+	}
+	if _, err := Get("/me", expired); err != ErrReauthRequired {
+		t.Fatalf("Expected ErrReauthRequired, got %v", err)
+	}
+}
+
+// Only a rejected refresh token should require signing in again, other failures
+// to renew tokens are retried.
+func TestNeedsReauth(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		body     string
+		expected bool
+	}{
+		{`{"error":"invalid_grant","error_description":"AADSTS70008: expired"}`, true},
+		{`{"error":"interaction_required"}`, true},
+		{`{"error":"temporarily_unavailable"}`, false},
+		{`{"error":"server_error"}`, false},
+		{`{"token_type":"Bearer"}`, false},
+		{`<html>502 Bad Gateway</html>`, false},
+		{``, false},
+	}
+	for _, test := range tests {
+		if reauth := needsReauth([]byte(test.body)); reauth != test.expected {
+			t.Errorf("Expected %v for %q, got %v.", test.expected, test.body, reauth)
+		}
+	}
+}
+
+// Tokens without a write scope should result in a read-only filesystem.
+func TestAuthCanWrite(t *testing.T) {
+	t.Parallel()
+	if !(&Auth{}).CanWrite() {
+		t.Error("The default scopes should allow writes.")
+	}
+	readOnly := &Auth{AuthConfig: AuthConfig{Scopes: "user.read files.read"}}
+	if readOnly.CanWrite() {
+		t.Error("Read-only scopes should not allow writes.")
+	}
+	if scope := readOnly.scope(); scope != "user.read files.read offline_access" {
+		t.Errorf("offline_access was not requested: %s", scope)
+	}
+	granted := &Auth{Scope: "https://graph.microsoft.com/Files.ReadWrite.All User.Read"}
+	if !granted.CanWrite() {
+		t.Error("A granted write scope was not recognized.")
+	}
+}
@@ -0,0 +1,158 @@
+package graph
+
+import (
+	"errors"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// how often we check whether we are back online
+const maxOfflineBackoff = 30 * time.Second
+
+// what reading content that isn't cached does while offline
+const (
+	OfflineContentError  = "error"  // fail with EIO
+	OfflineContentNoData = "nodata" // fail with ENODATA
+	OfflineContentWait   = "wait"   // wait for the connection, then EIO
+)
+
+var (
+	offlineContent     = OfflineContentError
+	offlineContentWait = 30 * time.Second
+)
+
+// SetOfflineContent sets what reading a file whose content isn't cached does
+// while offline, and how long the "wait" mode waits for the connection to come
+// back. Should be called before the filesystem is mounted.
+func SetOfflineContent(mode string, wait time.Duration) error {
+	switch mode {
+	case OfflineContentError, OfflineContentNoData, OfflineContentWait:
+	default:
+		return errors.New("unavailable content behavior must be one of: " +
+			OfflineContentError + ", " + OfflineContentNoData + ", " + OfflineContentWait)
+	}
+	offlineContent = mode
+	offlineContentWait = wait
+	return nil
+}
+
+// ConnectionStatus is whether the server can currently be reached.
+type ConnectionStatus struct {
+	Online bool      `json:"online"`
+	Since  time.Time `json:"since"`           // when we last went online or offline
+	Error  string    `json:"error,omitempty"` // why we are offline
+}
+
+// Connection reports whether the filesystem is online.
+func (c *Cache) Connection() ConnectionStatus {
+	c.RLock()
+	defer c.RUnlock()
+	status := ConnectionStatus{
+		Online: !c.offline,
+		Since:  c.offlineSince,
+	}
+	if c.offline && c.offlineErr != nil {
+		status.Error = c.offlineErr.Error()
+	}
+	return status
+}
+
+// setOffline moves the filesystem between its online and offline states. err
+// is what took it offline.
+func (c *Cache) setOffline(offline bool, err error) {
+	c.Lock()
+	changed := offline != c.offline
+	c.offline = offline
+	if changed || c.offlineSince.IsZero() {
+		c.offlineSince = time.Now()
+	}
+	if changed && offline {
+		c.online = make(chan struct{})
+	} else if changed && c.online != nil {
+		close(c.online)
+		c.online = nil
+	}
+	if offline {
+		c.offlineErr = err
+	} else {
+		c.offlineErr = nil
+	}
+	c.Unlock()
+
+	if changed && !offline {
+		log.Info("Connection to the server restored, filesystem is back online.")
+		// changes made offline go first, uploads may depend on them
+		c.replayQueue()
+		c.revalidateListings()
+		if c.IsOffline() {
+			return
+		}
+	}
+	if c.uploads != nil {
+		c.uploads.SetOffline(offline)
+	}
+	if changed && offline {
+		log.WithField("err", err).Warn(
+			"Lost connection to the server, filesystem is now offline. " +
+				"Changes will be sent once it is back.")
+		// find out as soon as possible when we're back
+		c.TriggerDeltas()
+	}
+}
+
+// waitOnline blocks until the filesystem is online, for up to timeout. Returns
+// whether it is online.
+func (c *Cache) waitOnline(timeout time.Duration) bool {
+	c.RLock()
+	offline, online := c.offline, c.online
+	c.RUnlock()
+	if !offline {
+		return true
+	}
+	if online == nil || timeout <= 0 {
+		return false
+	}
+	c.TriggerDeltas()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-online:
+		return true
+	case <-timer.C:
+	case <-c.ctx.Done():
+	}
+	return !c.IsOffline()
+}
+
+// contentUnavailable decides what a read of content that isn't cached runs
+// into while offline. Returns 0 if the connection came back and the content
+// can be downloaded after all.
+func (c *Cache) contentUnavailable() syscall.Errno {
+	switch offlineContent {
+	case OfflineContentNoData:
+		return syscall.ENODATA
+	case OfflineContentWait:
+		if c.waitOnline(offlineContentWait) {
+			return 0
+		}
+	}
+	return syscall.EIO
+}
+
+// noteOffline takes the filesystem offline if err is a sign that the server
+// can't be reached.
+func (c *Cache) noteOffline(err error) {
+	if IsOffline(err) {
+		c.setOffline(true, err)
+	}
+}
+
+// offlineBackoff limits how long fetching deltas backs off while offline.
+func offlineBackoff(backoff time.Duration) time.Duration {
+	if backoff > maxOfflineBackoff {
+		return maxOfflineBackoff
+	}
+	return backoff
+}
@@ -0,0 +1,132 @@
+package graph
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Only errors that mean the server can't be reached should take us offline.
+func TestIsOffline(t *testing.T) {
+	t.Parallel()
+	dnsFailure := &url.Error{
+		Op:  "Get",
+		URL: "https://graph.microsoft.com/v1.0/me/drive/root",
+		Err: &net.DNSError{Err: "no such host", Name: "graph.microsoft.com"},
+	}
+	cancelled := &url.Error{Op: "Get", URL: "https://graph.microsoft.com", Err: context.Canceled}
+	tests := map[error]bool{
+		nil:                                  false,
+		dnsFailure:                           true,
+		cancelled:                            false,
+		errors.New("connection refused"):     true,
+		errors.New("itemNotFound"):           false,
+		&GraphError{StatusCode: 502}:         true,
+		&GraphError{StatusCode: 503}:         false, // throttled
+		&GraphError{StatusCode: 404}:         false,
+		&GraphError{StatusCode: 504}:         true,
+		errors.New("resourceModified"):       false,
+		errors.New("no route to host"):       true,
+		errors.New("unexpected end of JSON"): false,
+	}
+	for err, expected := range tests {
+		if IsOffline(err) != expected {
+			t.Errorf("IsOffline(%v) should be %t.", err, expected)
+		}
+	}
+}
+
+// Going offline should be reported along with why, and hold uploads until we
+// are back online.
+func TestSetOffline(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cache := &Cache{
+		deltaTrigger: make(chan struct{}, 1),
+		uploads:      NewUploadManager(ctx, 10*time.Millisecond, nil, nil, nil),
+	}
+	cache.uploads.delay = 0
+	if !cache.Connection().Online {
+		t.Fatal("Cache should start out online.")
+	}
+
+	failure := errors.New("network is unreachable")
+	cache.noteOffline(errors.New("itemNotFound"))
+	if !cache.Connection().Online {
+		t.Fatal("An error unrelated to connectivity took the cache offline.")
+	}
+	cache.noteOffline(failure)
+	status := cache.Connection()
+	if status.Online || status.Error != failure.Error() || status.Since.IsZero() {
+		t.Fatalf("Unexpected connection status: %+v", status)
+	}
+	select {
+	case <-cache.deltaTrigger:
+	default:
+		t.Fatal("Going offline should check for the connection coming back right away.")
+	}
+
+	inode := NewInode("held.txt", 0644, nil)
+	_, err := inode.data.WriteAt([]byte("held"), 0)
+	failOnErr(t, err)
+	failOnErr(t, cache.uploads.QueueUpload(inode))
+	time.Sleep(50 * time.Millisecond)
+	cache.uploads.mutex.RLock()
+	session := cache.uploads.sessions[inode.ID()]
+	cache.uploads.mutex.RUnlock()
+	if session == nil || session.getState() != notStarted {
+		t.Fatal("Upload should be held while offline.")
+	}
+	// nothing to upload it to
+	cache.uploads.CancelUpload(inode.ID())
+
+	cache.setOffline(false, nil)
+	if status := cache.Connection(); !status.Online || status.Error != "" {
+		t.Fatalf("Unexpected connection status: %+v", status)
+	}
+	cache.uploads.mutex.RLock()
+	defer cache.uploads.mutex.RUnlock()
+	if cache.uploads.offline {
+		t.Fatal("Uploads are still held after going back online.")
+	}
+}
+
+// Reads of content that isn't cached should fail the way they were configured
+// to while offline, or wait for the connection to come back.
+func TestOfflineContent(t *testing.T) {
+	defer SetOfflineContent(OfflineContentError, 30*time.Second)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cache := &Cache{deltaTrigger: make(chan struct{}, 1)}
+	cache.ctx = ctx
+	cache.setOffline(true, errors.New("network is unreachable"))
+
+	if errno := cache.contentUnavailable(); errno != syscall.EIO {
+		t.Fatalf("Expected EIO by default, got %v.", errno)
+	}
+	failOnErr(t, SetOfflineContent(OfflineContentNoData, 0))
+	if errno := cache.contentUnavailable(); errno != syscall.ENODATA {
+		t.Fatalf("Expected ENODATA, got %v.", errno)
+	}
+	if SetOfflineContent("hang", 0) == nil {
+		t.Fatal("Unknown behaviors should be refused.")
+	}
+
+	failOnErr(t, SetOfflineContent(OfflineContentWait, 20*time.Millisecond))
+	if errno := cache.contentUnavailable(); errno != syscall.EIO {
+		t.Fatalf("Expected EIO once done waiting, got %v.", errno)
+	}
+	failOnErr(t, SetOfflineContent(OfflineContentWait, 5*time.Second))
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cache.setOffline(false, nil)
+	}()
+	if errno := cache.contentUnavailable(); errno != 0 {
+		t.Fatalf("Coming back online should end the wait, got %v.", errno)
+	}
+}
@@ -0,0 +1,151 @@
+package graph
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DownloadFile downloads the file at remotePath on the server to localPath,
+// without a mounted filesystem or a cache. The content is checked against the
+// hashes the server has for it, and only written to localPath once it is
+// complete. If localPath is a directory, the file is put in it under its own
+// name.
+func DownloadFile(remotePath string, localPath string, auth *Auth) error {
+	item, err := GetItemPath(remotePath, auth)
+	if err != nil {
+		return err
+	}
+	if item.IsDir() {
+		return fmt.Errorf("%s is a folder", remotePath)
+	}
+	if st, err := os.Stat(localPath); err == nil && st.IsDir() {
+		localPath = filepath.Join(localPath, item.Name())
+	}
+
+	id := item.ID()
+	size := item.Size()
+	var content *buffer
+	if size >= streamThreshold {
+		// big files are downloaded in parts so they never have to fit in memory
+		for attempt := 1; ; attempt++ {
+			if content, err = downloadRanges(id, auth, size); err == nil {
+				if err = item.verifyDownload(content.Reader()); err != nil {
+					content.Close()
+				}
+			}
+			if !errors.Is(err, errHashMismatch) || attempt == transferAttempts {
+				break
+			}
+			log.WithFields(log.Fields{
+				"path": remotePath,
+				"err":  err,
+			}).Warn("Downloaded content is corrupt, trying again.")
+		}
+	} else {
+		content, err = item.download(id, auth)
+	}
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	if err = writeAtomic(localPath, content.Reader()); err != nil {
+		return err
+	}
+	modTime := item.modTime()
+	return os.Chtimes(localPath, modTime, modTime)
+}
+
+// UploadFile uploads the file at localPath to remotePath on the server, without
+// a mounted filesystem or a cache. A file already at remotePath is replaced,
+// and if remotePath is a folder, the file is put in it under its own name.
+// Large files are uploaded in chunks, and failed uploads are retried the same
+// way the filesystem retries them.
+func UploadFile(localPath string, remotePath string, auth *Auth) error {
+	file, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	st, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if st.IsDir() {
+		return fmt.Errorf("%s is a directory", localPath)
+	}
+
+	id, err := uploadTarget(filepath.Base(localPath), remotePath, auth)
+	if err != nil {
+		return err
+	}
+	data, err := newBuffer(file)
+	if err != nil {
+		return err
+	}
+	session := &UploadSession{
+		ID:      id,
+		ModTime: st.ModTime(),
+		Size:    uint64(data.Size()),
+		data:    data,
+	}
+	defer session.close()
+	if session.hash, err = hashReader(sha1.New(), data.Reader()); err != nil {
+		return err
+	}
+
+	for {
+		err = session.Upload(auth)
+		if err == nil || IsOffline(err) {
+			return err
+		}
+		delay, retry := uploadRetryDelay(session.attempts, err)
+		if !retry {
+			return err
+		}
+		log.WithFields(log.Fields{
+			"path": remotePath,
+			"err":  err,
+		}).Warnf("Upload failed, retrying in %s.", delay)
+		session.retryLater(delay)
+		time.Sleep(delay)
+	}
+}
+
+// uploadTarget returns the ID of the file an upload to remotePath should
+// replace, creating an empty file there first if there is none.
+func uploadTarget(name string, remotePath string, auth *Auth) (string, error) {
+	item, err := GetItemPath(remotePath, auth)
+	if err == nil && item.IsDir() {
+		remotePath = path.Join(remotePath, name)
+		item, err = GetItemPath(remotePath, auth)
+	}
+	if err == nil {
+		if item.IsDir() {
+			return "", fmt.Errorf("%s is a folder", remotePath)
+		}
+		return item.ID(), nil
+	}
+	if !isGone(err) {
+		return "", err
+	}
+
+	resp, err := Put(ResourcePath(remotePath)+":/content", auth, strings.NewReader(""))
+	if err != nil {
+		return "", err
+	}
+	created := &Inode{}
+	if err = json.Unmarshal(resp, created); err != nil {
+		return "", err
+	}
+	return created.ID(), nil
+}
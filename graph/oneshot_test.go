@@ -0,0 +1,39 @@
+package graph
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// A file put on the server without a mounted filesystem should come back
+// unchanged, and be put in a folder under its own name.
+func TestUploadDownloadFile(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "onedriver-oneshot-")
+	failOnErr(t, err)
+	defer os.RemoveAll(dir)
+
+	content := bytes.Repeat([]byte("oneshot transfer\n"), 1024)
+	local := filepath.Join(dir, "oneshot.txt")
+	failOnErr(t, ioutil.WriteFile(local, content, 0644))
+	failOnErr(t, UploadFile(local, "/onedriver_tests", auth))
+
+	item, err := GetItemPath("/onedriver_tests/oneshot.txt", auth)
+	failOnErr(t, err)
+	if item.Size() != uint64(len(content)) {
+		t.Errorf("Expected %d bytes on the server, got %d.", len(content), item.Size())
+	}
+
+	downloaded := filepath.Join(dir, "downloaded.txt")
+	failOnErr(t, DownloadFile("/onedriver_tests/oneshot.txt", downloaded, auth))
+	if data, err := ioutil.ReadFile(downloaded); err != nil || !bytes.Equal(data, content) {
+		t.Errorf("Downloaded content did not match what was uploaded: %v", err)
+	}
+
+	if err := DownloadFile("/onedriver_tests", dir, auth); err == nil {
+		t.Error("Downloading a folder should fail.")
+	}
+}
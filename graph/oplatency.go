@@ -0,0 +1,97 @@
+package graph
+
+import (
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// slowOpThreshold is how long an operation takes before it is logged as slow,
+// in nanoseconds. 0 turns the logging off.
+var slowOpThreshold int64
+
+// slowOps counts slow operations by the name go-fuse gives them.
+var slowOps = struct {
+	sync.Mutex
+	counts map[string]uint64
+}{counts: make(map[string]uint64)}
+
+// SetSlowOpThreshold sets how long a FUSE operation can take before it is
+// logged as slow, or turns that off if threshold is 0. It can be changed at
+// any time.
+func SetSlowOpThreshold(threshold time.Duration) {
+	atomic.StoreInt64(&slowOpThreshold, int64(threshold))
+}
+
+// OperationLatency is how long a kind of FUSE operation has been taking. The
+// percentiles are estimates, rounded up to the bounds of the histogram.
+type OperationLatency struct {
+	Count uint64        `json:"count"`
+	Mean  time.Duration `json:"mean"`
+	P50   time.Duration `json:"p50"`
+	P99   time.Duration `json:"p99"`
+	Max   time.Duration `json:"max"`
+	Slow  uint64        `json:"slow"` // took longer than the slow operation threshold
+}
+
+// operationLatencies summarizes how long the FUSE operations of the process
+// have been taking, by the name go-fuse gives them.
+func operationLatencies() map[string]OperationLatency {
+	seconds := func(s float64) time.Duration {
+		return time.Duration(s * float64(time.Second))
+	}
+	latencies := make(map[string]OperationLatency)
+	fuseLatencies.mutex.Lock()
+	for op, hist := range fuseLatencies.byLabel {
+		if hist.count == 0 {
+			continue
+		}
+		latencies[op] = OperationLatency{
+			Count: hist.count,
+			Mean:  seconds(hist.sum / float64(hist.count)),
+			P50:   seconds(hist.quantile(.5)),
+			P99:   seconds(hist.quantile(.99)),
+			Max:   seconds(hist.max),
+		}
+	}
+	fuseLatencies.mutex.Unlock()
+	slowOps.Lock()
+	for op, count := range slowOps.counts {
+		latency := latencies[op]
+		latency.Slow = count
+		latencies[op] = latency
+	}
+	slowOps.Unlock()
+	return latencies
+}
+
+// timeOp times an operation on the item, or on its child called name if name
+// is given, and logs it if it turns out to be slow. op is the name go-fuse
+// gives the operation. Meant to be deferred:
+//
+//	defer i.timeOp("READ", "")()
+func (i *Inode) timeOp(op string, name string) func() {
+	started := time.Now()
+	return func() {
+		elapsed := time.Since(started)
+		threshold := time.Duration(atomic.LoadInt64(&slowOpThreshold))
+		if threshold <= 0 || elapsed < threshold {
+			return
+		}
+		slowOps.Lock()
+		slowOps.counts[op]++
+		slowOps.Unlock()
+		path := i.Path()
+		if name != "" {
+			path = filepath.Join(path, name)
+		}
+		log.WithFields(log.Fields{
+			"op":       op,
+			"path":     path,
+			"duration": elapsed.Round(time.Millisecond),
+		}).Warn("Slow filesystem operation.")
+	}
+}
@@ -0,0 +1,34 @@
+package graph
+
+import (
+	"testing"
+	"time"
+)
+
+// Only operations slower than the threshold should be counted as slow, and
+// none at all with the threshold turned off.
+func TestTimeOpSlow(t *testing.T) {
+	inode := NewInode("slow.txt", 0644, nil)
+	defer SetSlowOpThreshold(0)
+
+	SetSlowOpThreshold(time.Hour)
+	inode.timeOp("TEST_FAST", "")()
+	SetSlowOpThreshold(time.Nanosecond)
+	done := inode.timeOp("TEST_SLOW", "child")
+	time.Sleep(time.Millisecond)
+	done()
+	SetSlowOpThreshold(0)
+	done = inode.timeOp("TEST_OFF", "")
+	time.Sleep(time.Millisecond)
+	done()
+
+	latencies := operationLatencies()
+	if latencies["TEST_SLOW"].Slow != 1 {
+		t.Errorf("Slow operation was counted %d times, expected once.", latencies["TEST_SLOW"].Slow)
+	}
+	for _, op := range []string{"TEST_FAST", "TEST_OFF"} {
+		if latencies[op].Slow != 0 {
+			t.Errorf("%s was counted as slow.", op)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package graph
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	bolt "github.com/etcd-io/bbolt"
+	log "github.com/sirupsen/logrus"
+)
+
+// PARTIAL is the boltdb bucket tracking partially downloaded content, so an
+// interrupted stream can pick up where it left off.
+var PARTIAL = []byte("partial")
+
+// partialRecord describes partially downloaded content kept on disk.
+type partialRecord struct {
+	ID     string `json:"id"`
+	ETag   string `json:"eTag"`   // of the item the content belongs to
+	Size   uint64 `json:"size"`   // of the entire file
+	Offset uint64 `json:"offset"` // everything before this has arrived
+}
+
+// partialPath is where an item's partially downloaded content is kept.
+func (c *Cache) partialPath(id string) string {
+	return filepath.Join(c.contentDir, "partial", id)
+}
+
+// savePartial keeps the first offset bytes of content that could not be
+// downloaded in full, so the download can resume later. Takes over the buffer.
+func (c *Cache) savePartial(id string, etag string, size uint64, content *buffer, offset uint64) {
+	defer content.Close()
+	if c.db == nil || etag == "" || offset == 0 {
+		return
+	}
+	logger := log.WithFields(log.Fields{
+		"id":     id,
+		"offset": offset,
+		"size":   size,
+	})
+	err := content.Truncate(int64(offset))
+	if err == nil {
+		err = content.keepAt(c.partialPath(id))
+	}
+	if err == nil {
+		data, _ := json.Marshal(partialRecord{ID: id, ETag: etag, Size: size, Offset: offset})
+		err = c.db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucketIfNotExists(PARTIAL)
+			if err != nil {
+				return err
+			}
+			return b.Put([]byte(id), data)
+		})
+	}
+	if err != nil {
+		logger.WithField("err", err).Warn("Could not keep partially downloaded content.")
+		os.Remove(c.partialPath(id))
+		return
+	}
+	logger.Info("Kept partially downloaded content to resume from later.")
+}
+
+// loadPartial returns the partially downloaded content of an item, if there is
+// any that can be resumed from. The content can't be resumed if the item has
+// changed on the server since, which is checked by comparing the ETag it had
+// with etag. Partial content is only ever used once.
+func (c *Cache) loadPartial(id string, etag string, size uint64) *buffer {
+	if c.db == nil {
+		return nil
+	}
+	var record partialRecord
+	found := false
+	c.db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(PARTIAL); b != nil {
+			if data := b.Get([]byte(id)); data != nil {
+				found = json.Unmarshal(data, &record) == nil
+			}
+		}
+		return nil
+	})
+	if !found {
+		return nil
+	}
+
+	path := c.partialPath(id)
+	defer c.dropPartial(id)
+	if record.ETag != etag || record.Size != size {
+		log.WithField("id", id).Info(
+			"File changed on the server since it was partially downloaded, starting over.")
+		return nil
+	}
+	file, err := os.OpenFile(path, os.O_RDWR, 0600)
+	if err != nil {
+		return nil
+	}
+	stat, err := file.Stat()
+	if err != nil || uint64(stat.Size()) < record.Offset {
+		file.Close()
+		return nil
+	}
+	// unlinked like any other buffer, the content is now the stream's
+	os.Remove(path)
+	log.WithFields(log.Fields{
+		"id":     id,
+		"offset": record.Offset,
+	}).Info("Resuming interrupted download.")
+	return &buffer{file: file, size: int64(record.Offset)}
+}
+
+// dropPartial discards an item's partially downloaded content.
+func (c *Cache) dropPartial(id string) {
+	if c.db == nil {
+		return
+	}
+	os.Remove(c.partialPath(id))
+	c.db.Update(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(PARTIAL); b != nil {
+			return b.Delete([]byte(id))
+		}
+		return nil
+	})
+}
+
+// hasPartial returns whether an item has partially downloaded content.
+func (c *Cache) hasPartial(id string) bool {
+	if c.db == nil {
+		return false
+	}
+	found := false
+	c.db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(PARTIAL); b != nil {
+			found = b.Get([]byte(id)) != nil
+		}
+		return nil
+	})
+	return found
+}
@@ -0,0 +1,56 @@
+package graph
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "github.com/etcd-io/bbolt"
+)
+
+// Partially downloaded content should only be resumed from once, and only if
+// the item did not change on the server in the meantime.
+func TestPartialContent(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "onedriver-partial-")
+	failOnErr(t, err)
+	defer os.RemoveAll(dir)
+	failOnErr(t, os.Mkdir(filepath.Join(dir, "partial"), 0700))
+	db, err := bolt.Open(filepath.Join(dir, "partial.db"), 0600,
+		&bolt.Options{Timeout: time.Second * 5})
+	failOnErr(t, err)
+	defer db.Close()
+	cache := &Cache{db: db, contentDir: dir}
+
+	content := streamContent(1000)
+	save := func() {
+		b, err := bufferOf(content)
+		failOnErr(t, err)
+		cache.savePartial("item", "etag-1", 2000, b, 600)
+	}
+	save()
+	if !cache.hasPartial("item") {
+		t.Fatal("Partial content was not kept.")
+	}
+	partial := cache.loadPartial("item", "etag-1", 2000)
+	if partial == nil {
+		t.Fatal("Partial content could not be resumed from.")
+	}
+	if kept := bufferBytes(t, partial); !bytes.Equal(kept, content[:600]) {
+		t.Fatalf("Expected the first 600 bytes to be kept, got %d.", len(kept))
+	}
+	if cache.hasPartial("item") {
+		t.Fatal("Partial content should only be resumed from once.")
+	}
+
+	save()
+	if cache.loadPartial("item", "etag-2", 2000) != nil {
+		t.Fatal("Partial content of an item that changed was resumed from.")
+	}
+	if _, err := os.Stat(cache.partialPath("item")); !os.IsNotExist(err) {
+		t.Fatal("Partial content of an item that changed was not removed.")
+	}
+}
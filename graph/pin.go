@@ -0,0 +1,257 @@
+package graph
+
+import (
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	bolt "github.com/etcd-io/bbolt"
+	log "github.com/sirupsen/logrus"
+)
+
+// PINNED is the boltdb bucket holding the IDs of pinned items.
+var PINNED = []byte("pinned")
+
+// how often pinned items are checked for content that is missing, in case a
+// download failed or a change was missed
+const pinInterval = 15 * time.Minute
+
+// pinSet is the set of pinned items.
+type pinSet struct {
+	db      *bolt.DB // pins are saved here, may be nil
+	mutex   sync.RWMutex
+	pinned  map[string]bool
+	trigger chan struct{}
+}
+
+// newPinSet loads the pins saved by a previous session.
+func newPinSet(db *bolt.DB) *pinSet {
+	p := &pinSet{
+		db:      db,
+		pinned:  make(map[string]bool),
+		trigger: make(chan struct{}, 1),
+	}
+	if db != nil {
+		db.View(func(tx *bolt.Tx) error {
+			b := tx.Bucket(PINNED)
+			if b == nil {
+				return nil
+			}
+			return b.ForEach(func(k, v []byte) error {
+				p.pinned[string(k)] = true
+				return nil
+			})
+		})
+	}
+	return p
+}
+
+// set pins or unpins an item.
+func (p *pinSet) set(id string, pinned bool) error {
+	p.mutex.Lock()
+	if pinned {
+		p.pinned[id] = true
+	} else {
+		delete(p.pinned, id)
+	}
+	p.mutex.Unlock()
+	if p.db == nil {
+		return nil
+	}
+	return p.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(PINNED)
+		if err != nil {
+			return err
+		}
+		if pinned {
+			return b.Put([]byte(id), []byte{})
+		}
+		return b.Delete([]byte(id))
+	})
+}
+
+// has returns whether an item itself is pinned.
+func (p *pinSet) has(id string) bool {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return p.pinned[id]
+}
+
+// move carries a pin over when an item gets a new ID.
+func (p *pinSet) move(oldID string, newID string) {
+	if p.has(oldID) {
+		p.set(oldID, false)
+		p.set(newID, true)
+	}
+}
+
+// list returns every pinned item.
+func (p *pinSet) list() []string {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	ids := make([]string, 0, len(p.pinned))
+	for id := range p.pinned {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Pin keeps an item, and everything beneath it, available offline.
+func (c *Cache) Pin(id string) error {
+	if err := c.pinned.set(id, true); err != nil {
+		return err
+	}
+	log.WithField("id", id).Info("Pinned item for offline use.")
+	c.triggerPins()
+	return nil
+}
+
+// Unpin stops keeping an item available offline. Its content stays cached
+// for now, but is no longer exempt from being evicted.
+func (c *Cache) Unpin(id string) error {
+	log.WithField("id", id).Info("Unpinned item.")
+	return c.pinned.set(id, false)
+}
+
+// pinState returns whether an item was pinned itself, and whether it is pinned
+// because one of the folders it is in was.
+func (c *Cache) pinState(id string) (pinned bool, inherited bool) {
+	if c.pinned.has(id) {
+		return true, false
+	}
+	for inode := c.GetID(id); inode != nil; {
+		parentID := inode.ParentID()
+		if parentID == "" {
+			break
+		}
+		if c.pinned.has(parentID) {
+			return false, true
+		}
+		inode = c.GetID(parentID)
+	}
+	return false, false
+}
+
+// IsPinned returns whether an item is kept available offline, either because
+// it was pinned or because a folder it is in was.
+func (c *Cache) IsPinned(id string) bool {
+	pinned, inherited := c.pinState(id)
+	return pinned || inherited
+}
+
+// triggerPins makes pinned items get checked for missing content right away.
+func (c *Cache) triggerPins() {
+	select {
+	case c.pinned.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// pinLoop downloads the content of pinned items whenever it may be missing.
+// Should be called as a goroutine.
+func (c *Cache) pinLoop(interval time.Duration) {
+	defer c.workers.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		c.syncPins()
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-c.pinned.trigger:
+		case <-ticker.C:
+		}
+	}
+}
+
+// syncPins downloads the content of every file beneath a pinned item that is
+// not cached yet. Pins of items that no longer exist are dropped.
+func (c *Cache) syncPins() {
+	if c.IsOffline() || c.IsPaused() || transfers.isPaused() {
+		return
+	}
+	auth := c.GetAuth()
+	for _, id := range c.pinned.list() {
+		if c.GetID(id) == nil {
+			log.WithField("id", id).Info("Pinned item is gone, unpinning it.")
+			c.pinned.set(id, false)
+			continue
+		}
+		queue := []string{id}
+		for len(queue) > 0 {
+			if c.ctx.Err() != nil || c.IsOffline() {
+				return
+			}
+			inode := c.GetID(queue[0])
+			queue = queue[1:]
+			if inode == nil {
+				continue
+			}
+			if !inode.IsDir() {
+				c.keepContent(inode, auth)
+				continue
+			}
+			children, err := c.GetChildrenID(inode.ID(), auth)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"id":  inode.ID(),
+					"err": err,
+				}).Warn("Could not list pinned folder.")
+				c.noteOffline(err)
+				continue
+			}
+			for _, child := range children {
+				queue = append(queue, child.ID())
+			}
+		}
+	}
+}
+
+// keepContent downloads the content of a pinned file into the content cache,
+// unless it is there already.
+func (c *Cache) keepContent(inode *Inode, auth *Auth) {
+	id := inode.ID()
+	size := inode.Size()
+	if isLocalID(id) || inode.HasContent() || inode.HasChanges() {
+		// not on the server yet, or open and will be saved when closed
+		return
+	}
+	if stat, err := os.Stat(c.contentPath(id)); err == nil && uint64(stat.Size()) == size {
+		return
+	}
+	if size >= streamThreshold && transfers.holds(true) {
+		// picked up again once off the metered connection
+		return
+	}
+
+	logger := log.WithFields(log.Fields{
+		"id":   id,
+		"path": inode.Path(),
+		"size": size,
+	})
+	logger.Info("Downloading content of pinned file.")
+	var content *buffer
+	var err error
+	if size >= streamThreshold {
+		if content, err = downloadRanges(id, auth, size); err == nil {
+			if err = inode.verifyDownload(content.Reader()); err != nil {
+				content.Close()
+			}
+		}
+	} else {
+		content, err = inode.download(id, auth)
+	}
+	if err != nil {
+		logger.WithField("err", err).Warn("Could not download content of pinned file.")
+		c.noteOffline(err)
+		return
+	}
+	defer content.Close()
+	if err = c.insertBuffer(id, content); err != nil {
+		logger.WithField("err", err).Error("Could not save content of pinned file.")
+		return
+	}
+	c.activity.record(activityRemote, "downloaded", inode.Path(), activitySize(uint64(content.Size())))
+}
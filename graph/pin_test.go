@@ -0,0 +1,77 @@
+package graph
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "github.com/etcd-io/bbolt"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// Pins apply to everything beneath a pinned folder, follow items to their new
+// ID, and survive a restart.
+func TestPins(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "onedriver-pins-")
+	failOnErr(t, err)
+	defer os.RemoveAll(dir)
+	db, err := bolt.Open(filepath.Join(dir, "pins.db"), 0600,
+		&bolt.Options{Timeout: time.Second * 5})
+	failOnErr(t, err)
+	defer db.Close()
+	failOnErr(t, db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(METADATA)
+		return err
+	}))
+	cache := &Cache{
+		db:       db,
+		metadata: newShardedMap(),
+		pinned:   newPinSet(db),
+	}
+
+	root := NewInode("root", 0755|fuse.S_IFDIR, nil)
+	cache.InsertID(root.ID(), root)
+	folder := NewInode("folder", 0755|fuse.S_IFDIR, root)
+	cache.InsertChild(root.ID(), folder)
+	file := NewInode("file", 0644|fuse.S_IFREG, folder)
+	cache.InsertChild(folder.ID(), file)
+
+	failOnErr(t, cache.Pin(folder.ID()))
+	if pinned, _ := cache.pinState(folder.ID()); !pinned {
+		t.Fatal("Folder was not pinned.")
+	}
+	if pinned, inherited := cache.pinState(file.ID()); pinned || !inherited {
+		t.Fatal("File in a pinned folder should be pinned through it.")
+	}
+	if cache.IsPinned(root.ID()) {
+		t.Fatal("Pins should not apply to the folders above.")
+	}
+
+	value := make([]byte, 16)
+	size, errno := file.Getxattr(context.Background(), pinXattr, value)
+	if errno != 0 || string(value[:size]) != "inherited" {
+		t.Fatalf("Unexpected pin attribute: %s (%d)", value[:size], errno)
+	}
+	if errno := file.Removexattr(context.Background(), pinXattr); errno == 0 {
+		t.Fatal("Inherited pins should only be removable from the folder.")
+	}
+
+	cache.MoveID(folder.ID(), "folder")
+	if !cache.pinned.has("folder") || !cache.IsPinned(file.ID()) {
+		t.Fatal("Pin did not follow the folder to its new ID.")
+	}
+	if !newPinSet(db).has("folder") {
+		t.Fatal("Pin was not saved.")
+	}
+
+	if errno := folder.Setxattr(context.Background(), pinXattr, []byte("0"), 0); errno != 0 {
+		t.Fatalf("Could not unpin through the extended attribute: %d", errno)
+	}
+	if cache.IsPinned(file.ID()) || newPinSet(db).has("folder") {
+		t.Fatal("Folder was not unpinned.")
+	}
+}
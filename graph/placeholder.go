@@ -0,0 +1,108 @@
+package graph
+
+import (
+	"errors"
+	"os"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	errContentBusy    = errors.New("file is open or has changes that have not been uploaded")
+	errPinnedByParent = errors.New("file is in a pinned folder")
+)
+
+// readers of the same placeholder wait for a single download
+var hydrations = newFlightGroup()
+
+// hasCachedContent returns whether an item's content is in the content cache.
+func (c *Cache) hasCachedContent(id string) bool {
+	_, err := os.Stat(c.contentPath(id))
+	return err == nil
+}
+
+// hydrate fetches the content of a placeholder when it is first read from.
+func (i *Inode) hydrate() syscall.Errno {
+	var errno syscall.Errno
+	hydrations.do(i.ID(), func() {
+		if !i.HasContent() {
+			errno = i.fetchContent(0)
+		}
+	})
+	return errno
+}
+
+// Dehydrate frees up the space used by the content of a file, or of every file
+// beneath a folder, turning them back into placeholders. Returns how many
+// bytes of content were dropped. Files in a folder that can't be freed are
+// skipped.
+func (c *Cache) Dehydrate(id string) (uint64, error) {
+	inode := c.GetID(id)
+	if inode == nil {
+		return 0, errors.New("item not found in cache")
+	}
+	pinned, inherited := c.pinState(id)
+	if inherited {
+		return 0, errPinnedByParent
+	}
+	if pinned {
+		if err := c.Unpin(id); err != nil {
+			return 0, err
+		}
+	}
+	if !inode.IsDir() {
+		freed, err := c.dehydrate(inode)
+		c.collectBlobs()
+		return freed, err
+	}
+
+	// only what is cached can be freed, no need to ask the server for more
+	var freed uint64
+	queue := []string{id}
+	for len(queue) > 0 {
+		current := c.GetID(queue[0])
+		queue = queue[1:]
+		if current == nil {
+			continue
+		}
+		if !current.IsDir() {
+			n, _ := c.dehydrate(current)
+			freed += n
+			continue
+		}
+		if current.ID() != id && c.pinned.has(current.ID()) {
+			c.Unpin(current.ID())
+		}
+		current.mutex.RLock()
+		queue = append(queue, current.children...)
+		current.mutex.RUnlock()
+	}
+	c.collectBlobs()
+	return freed, nil
+}
+
+// dehydrate drops the cached content of a single file.
+func (c *Cache) dehydrate(inode *Inode) (uint64, error) {
+	id := inode.ID()
+	if inode.HasContent() || c.hasLocalChanges(inode) || isLocalID(id) {
+		return 0, errContentBusy
+	}
+	if _, written := walGet(c.db, id, OpWrite); written || c.IsConflicted(id) {
+		return 0, errContentBusy
+	}
+	stat, err := os.Stat(c.contentPath(id))
+	if err != nil {
+		// a placeholder already
+		c.dropPartial(id)
+		return 0, nil
+	}
+	if err = c.DeleteContent(id); err != nil {
+		return 0, err
+	}
+	log.WithFields(log.Fields{
+		"id":   id,
+		"path": inode.Path(),
+	}).Info("Freed up space used by file content.")
+	return uint64(stat.Size()), nil
+}
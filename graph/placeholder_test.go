@@ -0,0 +1,82 @@
+package graph
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "github.com/etcd-io/bbolt"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// Freeing up space drops cached content, but never that of open files or of
+// files in a pinned folder.
+func TestDehydrate(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "onedriver-dehydrate-")
+	failOnErr(t, err)
+	defer os.RemoveAll(dir)
+	failOnErr(t, os.Mkdir(filepath.Join(dir, "blobs"), 0700))
+	db, err := bolt.Open(filepath.Join(dir, "dehydrate.db"), 0600,
+		&bolt.Options{Timeout: time.Second * 5})
+	failOnErr(t, err)
+	defer db.Close()
+	failOnErr(t, db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{METADATA, JOURNAL} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	cache := &Cache{
+		db:         db,
+		contentDir: dir,
+		metadata:   newShardedMap(),
+		pinned:     newPinSet(db),
+	}
+
+	root := NewInode("root", 0755|fuse.S_IFDIR, nil)
+	root.IDInternal = "root"
+	cache.InsertID(root.ID(), root)
+	folder := NewInode("folder", 0755|fuse.S_IFDIR, root)
+	folder.IDInternal = "folder"
+	cache.InsertChild(root.ID(), folder)
+	closed := NewInode("closed", 0644|fuse.S_IFREG, folder)
+	closed.IDInternal = "closed"
+	closed.data = nil
+	cache.InsertChild(folder.ID(), closed)
+	open := NewInode("open", 0644|fuse.S_IFREG, folder)
+	open.IDInternal = "open"
+	cache.InsertChild(folder.ID(), open)
+	failOnErr(t, cache.InsertContent("closed", []byte("closed content")))
+	failOnErr(t, cache.InsertContent("open", []byte("open content")))
+
+	failOnErr(t, cache.Pin("folder"))
+	if _, err := cache.Dehydrate("closed"); err != errPinnedByParent {
+		t.Fatalf("Files in a pinned folder should be kept, got %v.", err)
+	}
+	if _, err := cache.Dehydrate("open"); err != errPinnedByParent {
+		t.Fatalf("Files in a pinned folder should be kept, got %v.", err)
+	}
+
+	freed, err := cache.Dehydrate("folder")
+	failOnErr(t, err)
+	if freed != uint64(len("closed content")) {
+		t.Fatalf("Freed %d bytes instead of the closed file's content.", freed)
+	}
+	if cache.IsPinned("folder") {
+		t.Fatal("Freeing up space on a pinned folder should unpin it.")
+	}
+	if cache.hasCachedContent("closed") {
+		t.Fatal("Content of the closed file was kept.")
+	}
+	if !cache.hasCachedContent("open") {
+		t.Fatal("Content of the open file was dropped.")
+	}
+	if _, err := cache.Dehydrate("open"); err != errContentBusy {
+		t.Fatalf("Open files should not be freed, got %v.", err)
+	}
+}
@@ -0,0 +1,192 @@
+package graph
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// TransferDirection is whether content is going to or coming from the server.
+type TransferDirection string
+
+// directions of a transfer
+const (
+	DirectionUpload   TransferDirection = "upload"
+	DirectionDownload TransferDirection = "download"
+)
+
+// TransferState is whether a transfer is moving.
+type TransferState string
+
+// states of a transfer
+const (
+	TransferQueued TransferState = "queued"
+	TransferActive TransferState = "active"
+	TransferPaused TransferState = "paused"
+)
+
+// Transfer is the progress of an upload or download of file content.
+type Transfer struct {
+	ID        string            `json:"id"`
+	Path      string            `json:"path"`
+	Direction TransferDirection `json:"direction"`
+	State     TransferState     `json:"state"`
+	Done      uint64            `json:"done"`  // bytes
+	Total     uint64            `json:"total"` // bytes
+	Rate      uint64            `json:"rate"`  // bytes per second
+	ETA       uint64            `json:"eta"`   // seconds, 0 when unknown
+}
+
+// TransferStatus lists every transfer in progress or waiting to start.
+type TransferStatus struct {
+	Paused    bool       `json:"paused"`
+	Metered   bool       `json:"metered"` // large transfers are held
+	Queued    int        `json:"queued"`  // uploads waiting to start
+	Transfers []Transfer `json:"transfers"`
+}
+
+// Transfers reports the progress of all uploads and downloads. Uploads come
+// first, in the order they were queued in.
+func (c *Cache) Transfers() TransferStatus {
+	status := TransferStatus{
+		Paused:    TransfersPaused() || c.IsPaused(),
+		Metered:   TransfersMetered(),
+		Transfers: make([]Transfer, 0),
+	}
+	now := time.Now()
+
+	uploads, queued := c.uploads.transfers(now)
+	for _, upload := range uploads {
+		if upload.Path == "" {
+			if inode := c.GetID(upload.ID); inode != nil {
+				upload.Path = inode.Path()
+			}
+		}
+		status.Transfers = append(status.Transfers, upload)
+	}
+	status.Queued = queued
+
+	downloads := make([]Transfer, 0)
+	c.metadata.Range(func(id string, inode *Inode) bool {
+		inode.mutex.RLock()
+		s := inode.stream
+		inode.mutex.RUnlock()
+		if s != nil {
+			done, total, rate := s.progress(now)
+			downloads = append(downloads, Transfer{
+				ID:        id,
+				Path:      inode.Path(),
+				Direction: DirectionDownload,
+				State:     TransferActive,
+				Done:      done,
+				Total:     total,
+				Rate:      rate,
+				ETA:       eta(done, total, rate),
+			})
+		}
+		return true
+	})
+	sort.Slice(downloads, func(i, j int) bool { return downloads[i].Path < downloads[j].Path })
+	status.Transfers = append(status.Transfers, downloads...)
+
+	if status.Paused {
+		for i := range status.Transfers {
+			if status.Transfers[i].State == TransferActive {
+				status.Transfers[i].State = TransferPaused
+			}
+		}
+	}
+	return status
+}
+
+// transfers reports the progress of every upload, and how many of them have
+// not started yet.
+func (u *UploadManager) transfers(now time.Time) ([]Transfer, int) {
+	u.mutex.RLock()
+	sessions := make([]*UploadSession, 0, len(u.sessions))
+	for _, session := range u.sessions {
+		sessions = append(sessions, session)
+	}
+	u.mutex.RUnlock()
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].seq < sessions[j].seq })
+
+	transfers := make([]Transfer, 0, len(sessions))
+	queued := 0
+	for _, session := range sessions {
+		state := TransferActive
+		switch session.getState() {
+		case notStarted:
+			state = TransferQueued
+			queued++
+		case complete, errored:
+			// about to be removed
+			continue
+		}
+		transfer := Transfer{
+			ID:        session.ID,
+			Direction: DirectionUpload,
+			State:     state,
+			Done:      session.Progress(),
+			Total:     session.Size,
+		}
+		if session.inode != nil {
+			transfer.Path = session.inode.Path()
+		}
+		if state == TransferActive {
+			transfer.Rate = session.meter.rate(now)
+			transfer.ETA = eta(transfer.Done, transfer.Total, transfer.Rate)
+		}
+		transfers = append(transfers, transfer)
+	}
+	return transfers, queued
+}
+
+// how far back the rate of a transfer is measured over
+const rateWindow = 10 * time.Second
+
+// rateMeter estimates how fast a transfer is going from its progress over the
+// last few seconds, so a stalled transfer shows as slowing down.
+type rateMeter struct {
+	mutex   sync.Mutex
+	samples []rateSample
+}
+
+type rateSample struct {
+	at   time.Time
+	done uint64
+}
+
+// record notes how many bytes have been transferred so far.
+func (m *rateMeter) record(done uint64, now time.Time) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.samples = append(m.samples, rateSample{at: now, done: done})
+	// keep the newest sample from before the window to measure from
+	for len(m.samples) > 2 && now.Sub(m.samples[1].at) > rateWindow {
+		m.samples = m.samples[1:]
+	}
+}
+
+// rate returns the bytes per second transferred recently.
+func (m *rateMeter) rate(now time.Time) uint64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if len(m.samples) < 2 {
+		return 0
+	}
+	first, last := m.samples[0], m.samples[len(m.samples)-1]
+	elapsed := now.Sub(first.at).Seconds()
+	if elapsed <= 0 || last.done <= first.done {
+		return 0
+	}
+	return uint64(float64(last.done-first.done) / elapsed)
+}
+
+// eta returns how many seconds a transfer should take to finish, or 0 if there
+// is no telling.
+func eta(done uint64, total uint64, rate uint64) uint64 {
+	if rate == 0 || done >= total {
+		return 0
+	}
+	return (total - done + rate - 1) / rate
+}
@@ -0,0 +1,72 @@
+package graph
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// Rates should be measured over recent progress only, so they drop off when a
+// transfer stalls.
+func TestRateMeter(t *testing.T) {
+	t.Parallel()
+	start := time.Now()
+	meter := rateMeter{}
+	if rate := meter.rate(start); rate != 0 {
+		t.Fatalf("Rate without progress should be 0, got %d", rate)
+	}
+	for second := 0; second <= 20; second++ {
+		meter.record(uint64(second)*1000, start.Add(time.Duration(second)*time.Second))
+	}
+	now := start.Add(20 * time.Second)
+	if rate := meter.rate(now); rate < 900 || rate > 1100 {
+		t.Fatalf("Expected a rate of about 1000 B/s, got %d", rate)
+	}
+	if len(meter.samples) > 13 {
+		t.Fatalf("Old samples were not dropped, %d left", len(meter.samples))
+	}
+
+	// nothing more arrives for a while
+	if rate := meter.rate(now.Add(30 * time.Second)); rate > 500 {
+		t.Fatalf("Rate of a stalled transfer did not drop, got %d", rate)
+	}
+}
+
+func TestETA(t *testing.T) {
+	t.Parallel()
+	if eta := eta(500, 1000, 100); eta != 5 {
+		t.Fatalf("Expected 5 seconds left, got %d", eta)
+	}
+	if eta := eta(500, 1000, 0); eta != 0 {
+		t.Fatalf("ETA without a rate should be unknown, got %d", eta)
+	}
+}
+
+// Queued uploads should be reported in the order they will start in.
+func TestUploadTransfers(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	manager := NewUploadManager(ctx, 10*time.Millisecond, nil, nil, nil)
+	manager.delay = time.Hour
+
+	names := []string{"first.txt", "second.txt", "third.txt"}
+	for _, name := range names {
+		inode := NewInode(name, 0644, nil)
+		_, err := inode.data.WriteAt([]byte(name), 0)
+		failOnErr(t, err)
+		failOnErr(t, manager.QueueUpload(inode))
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	transfers, queued := manager.transfers(time.Now())
+	if queued != len(names) || len(transfers) != len(names) {
+		t.Fatalf("Expected %d queued uploads, got %d", len(names), queued)
+	}
+	for i, transfer := range transfers {
+		if transfer.Path != "/"+names[i] || transfer.State != TransferQueued {
+			t.Fatalf("Upload %d is %s (%s), expected %s to be queued",
+				i, transfer.Path, transfer.State, names[i])
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package graph
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	bolt "github.com/etcd-io/bbolt"
+	log "github.com/sirupsen/logrus"
+)
+
+// loadSerialized fetches an item's on-disk metadata by ID, or nil if not found
+func loadSerialized(tx *bolt.Tx, id string) *SerializeableInode {
+	data := tx.Bucket(METADATA).Get([]byte(id))
+	if data == nil {
+		return nil
+	}
+	var inode SerializeableInode
+	if err := json.Unmarshal(data, &inode); err != nil {
+		return nil
+	}
+	return &inode
+}
+
+// resolveDiskPath resolves a path to an item ID using only the on-disk
+// metadata.
+func resolveDiskPath(tx *bolt.Tx, path string) (string, error) {
+	current := loadSerialized(tx, "root")
+	if current == nil {
+		return "", errors.New("root item not found in cache")
+	}
+	path = strings.Trim(strings.ToLower(path), "/")
+	if path == "" {
+		return current.IDInternal, nil
+	}
+
+	for _, name := range strings.Split(path, "/") {
+		var next *SerializeableInode
+		for _, childID := range current.Children {
+			child := loadSerialized(tx, childID)
+			if child != nil && strings.ToLower(child.NameInternal) == name {
+				next = child
+				break
+			}
+		}
+		if next == nil {
+			return "", errors.New(path + " not found in cache")
+		}
+		current = next
+	}
+	return current.IDInternal, nil
+}
+
+// PurgeCache evicts a single item and all of its descendants from an on-disk
+// cache, forcing them to be re-fetched from the server on next access. The
+// target may be either an absolute path (starting with "/") or an item ID. The
+// filesystem must not be mounted while this runs. Nothing is evicted if any of
+// the items have changes that have not been uploaded yet, unless force is set.
+// Returns the number of items evicted.
+func PurgeCache(dbPath string, target string, force bool) (int, error) {
+	db, err := bolt.Open(dbPath, 0600, &bolt.Options{Timeout: time.Second * 5})
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	purged := 0
+	err = db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(METADATA) == nil {
+			return errors.New("cache has not been initialized")
+		}
+
+		id := target
+		if strings.HasPrefix(target, "/") {
+			if id, err = resolveDiskPath(tx, target); err != nil {
+				return err
+			}
+		}
+		item := loadSerialized(tx, id)
+		if item == nil {
+			return errors.New(target + " not found in cache")
+		}
+
+		purging := []string{id}
+		for i := 0; i < len(purging); i++ {
+			if inode := loadSerialized(tx, purging[i]); inode != nil {
+				purging = append(purging, inode.Children...)
+			}
+		}
+		if unsynced := unsyncedIn(tx, purging); unsynced > 0 && !force {
+			return fmt.Errorf("%d item(s) have changes that have not been "+
+				"uploaded yet, mount the account to upload them or use --force "+
+				"to delete them anyway", unsynced)
+		}
+
+		// the parent's list of children must be refetched, otherwise the
+		// purged item would simply disappear from it
+		if item.Parent != nil && item.Parent.ID != "" {
+			if parent := loadSerialized(tx, item.Parent.ID); parent != nil {
+				parent.Children = nil
+				data, _ := json.Marshal(parent)
+				tx.Bucket(METADATA).Put([]byte(parent.IDInternal), data)
+				if root := loadSerialized(tx, "root"); root != nil &&
+					root.IDInternal == parent.IDInternal {
+					tx.Bucket(METADATA).Put([]byte("root"), data)
+				}
+			}
+		}
+
+		// root is stored twice
+		if root := loadSerialized(tx, "root"); root != nil && root.IDInternal == id {
+			tx.Bucket(METADATA).Delete([]byte("root"))
+		}
+
+		// forced, the changes go as well, there is nothing left to apply them to
+		dropUnsynced(tx, purging)
+		for _, current := range purging {
+			log.WithField("id", current).Info("Purging item from cache.")
+			tx.Bucket(METADATA).Delete([]byte(current))
+			os.Remove(filepath.Join(ContentDir(dbPath), current))
+			purged++
+		}
+		return nil
+	})
+	return purged, err
+}
+
+// unsyncedIn counts the items among ids with local changes that have not made
+// it to the server yet: changes in the WAL, uploads and unresolved conflicts.
+func unsyncedIn(tx *bolt.Tx, ids []string) int {
+	among := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		among[id] = true
+	}
+	unsynced := make(map[string]bool)
+	if b := tx.Bucket(WAL); b != nil {
+		b.ForEach(func(k, v []byte) error {
+			var entry walEntry
+			if json.Unmarshal(v, &entry) == nil && among[entry.ID] {
+				unsynced[entry.ID] = true
+			}
+			return nil
+		})
+	}
+	for _, bucket := range [][]byte{UPLOADS, CONFLICTS} {
+		if b := tx.Bucket(bucket); b != nil {
+			b.ForEach(func(k, v []byte) error {
+				if among[string(k)] {
+					unsynced[string(k)] = true
+				}
+				return nil
+			})
+		}
+	}
+	return len(unsynced)
+}
+
+// dropUnsynced forgets the changes to ids that have not made it to the server.
+func dropUnsynced(tx *bolt.Tx, ids []string) {
+	among := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		among[id] = true
+	}
+	if b := tx.Bucket(WAL); b != nil {
+		stale := make([][]byte, 0)
+		b.ForEach(func(k, v []byte) error {
+			var entry walEntry
+			if json.Unmarshal(v, &entry) == nil && among[entry.ID] {
+				stale = append(stale, append([]byte{}, k...))
+			}
+			return nil
+		})
+		for _, k := range stale {
+			b.Delete(k)
+		}
+	}
+	for _, bucket := range [][]byte{UPLOADS, CONFLICTS} {
+		if b := tx.Bucket(bucket); b != nil {
+			for _, id := range ids {
+				b.Delete([]byte(id))
+			}
+		}
+	}
+}
+
+// UnsyncedChanges counts the items in an on-disk cache with local changes that
+// have not made it to the server yet, which clearing the cache would lose. The
+// filesystem must not be mounted while this runs.
+func UnsyncedChanges(dbPath string) (int, error) {
+	if _, err := os.Stat(dbPath); os.IsNotExist(err) {
+		return 0, nil
+	}
+	db, err := bolt.Open(dbPath, 0600, &bolt.Options{Timeout: time.Second * 5, ReadOnly: true})
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	unsynced := make(map[string]bool)
+	for _, entry := range walEntries(db) {
+		unsynced[entry.ID] = true
+	}
+	db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(UPLOADS); b != nil {
+			b.ForEach(func(k, v []byte) error {
+				unsynced[string(k)] = true
+				return nil
+			})
+		}
+		return nil
+	})
+	return len(unsynced), nil
+}
+
+// ClearCache deletes the metadata and content cached for the account whose
+// data is stored in cacheDir, including changes that have not been uploaded
+// yet. Unlike Logout, the account stays signed in. The filesystem must not be
+// mounted while this runs.
+func ClearCache(cacheDir string) error {
+	dbPath := filepath.Join(cacheDir, "onedriver.db")
+	if err := os.RemoveAll(ContentDir(dbPath)); err != nil {
+		return err
+	}
+	if err := os.Remove(dbPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
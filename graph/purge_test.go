@@ -0,0 +1,102 @@
+package graph
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "github.com/etcd-io/bbolt"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// Changes that have not been uploaded should be counted before the cache is
+// cleared, and clearing it should leave the account signed in.
+func TestClearCache(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "onedriver-clear-")
+	failOnErr(t, err)
+	defer os.RemoveAll(dir)
+	dbPath := filepath.Join(dir, "onedriver.db")
+	failOnErr(t, os.MkdirAll(filepath.Join(ContentDir(dbPath), "blobs"), 0700))
+	failOnErr(t, ioutil.WriteFile(filepath.Join(dir, authFile), []byte("{}"), 0600))
+
+	db, err := bolt.Open(dbPath, 0600, &bolt.Options{Timeout: time.Second})
+	failOnErr(t, err)
+	db.Update(func(tx *bolt.Tx) error {
+		tx.CreateBucketIfNotExists(WAL)
+		b, _ := tx.CreateBucketIfNotExists(UPLOADS)
+		return b.Put([]byte("uploading"), []byte("{}"))
+	})
+	_, err = walLog(db, walEntry{Op: OpWrite, ID: "written"})
+	failOnErr(t, err)
+	_, err = walLog(db, walEntry{Op: OpRename, ID: "written"})
+	failOnErr(t, err)
+	db.Close()
+
+	unsynced, err := UnsyncedChanges(dbPath)
+	failOnErr(t, err)
+	if unsynced != 2 {
+		t.Errorf("Expected 2 items with unsynced changes, got %d.", unsynced)
+	}
+
+	failOnErr(t, ClearCache(dir))
+	for _, path := range []string{dbPath, ContentDir(dbPath)} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s was not removed.", path)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, authFile)); err != nil {
+		t.Error("Tokens should be kept:", err)
+	}
+	if unsynced, err = UnsyncedChanges(dbPath); err != nil || unsynced != 0 {
+		t.Errorf("A cleared cache has no unsynced changes, got %d: %v", unsynced, err)
+	}
+}
+
+// Purging must not throw away changes that have not been uploaded yet, unless
+// forced to.
+func TestPurgeCacheUnsynced(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "onedriver-purge-")
+	failOnErr(t, err)
+	defer os.RemoveAll(dir)
+	dbPath := filepath.Join(dir, "onedriver.db")
+
+	root := NewInode("root", 0755|fuse.S_IFDIR, nil)
+	folder := NewInode("purged", 0755|fuse.S_IFDIR, root)
+	folder.IDInternal = "01PURGED"
+	file := NewInode("written", 0644|fuse.S_IFREG, folder)
+	file.IDInternal = "01WRITTEN"
+	root.children = []string{folder.ID()}
+	folder.children = []string{file.ID()}
+	db, err := bolt.Open(dbPath, 0600, &bolt.Options{Timeout: time.Second})
+	failOnErr(t, err)
+	failOnErr(t, db.Update(func(tx *bolt.Tx) error {
+		tx.CreateBucketIfNotExists(WAL)
+		b, err := tx.CreateBucketIfNotExists(METADATA)
+		if err != nil {
+			return err
+		}
+		b.Put([]byte("root"), root.AsJSON())
+		b.Put([]byte(root.ID()), root.AsJSON())
+		b.Put([]byte(folder.ID()), folder.AsJSON())
+		return b.Put([]byte(file.ID()), file.AsJSON())
+	}))
+	_, err = walLog(db, walEntry{Op: OpWrite, ID: file.ID()})
+	failOnErr(t, err)
+	db.Close()
+
+	if _, err = PurgeCache(dbPath, "/purged", false); err == nil {
+		t.Fatal("Purged an item with changes that were not uploaded yet.")
+	}
+	purged, err := PurgeCache(dbPath, "/purged", true)
+	failOnErr(t, err)
+	if purged != 2 {
+		t.Fatalf("Expected 2 items to be purged when forced, got %d.", purged)
+	}
+	if unsynced, err := UnsyncedChanges(dbPath); err != nil || unsynced != 0 {
+		t.Errorf("Changes to purged items were kept, %d: %v", unsynced, err)
+	}
+}
@@ -0,0 +1,101 @@
+package graph
+
+import (
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// each direction has one limiter, shared by every transfer in it
+var (
+	uploadLimiter   = &rateLimiter{}
+	downloadLimiter = &rateLimiter{}
+)
+
+// SetMaxUploadRate limits content uploads to a number of bytes per second. 0
+// means no limit.
+func SetMaxUploadRate(bytesPerSecond uint64) {
+	uploadLimiter.setRate(bytesPerSecond)
+}
+
+// SetMaxDownloadRate limits content downloads to a number of bytes per second.
+// 0 means no limit.
+func SetMaxDownloadRate(bytesPerSecond uint64) {
+	downloadLimiter.setRate(bytesPerSecond)
+}
+
+// rateLimiter is a token bucket holding up to a second's worth of bytes.
+type rateLimiter struct {
+	mutex  sync.Mutex
+	rate   float64 // bytes per second, 0 is unlimited
+	tokens float64
+	last   time.Time
+}
+
+func (l *rateLimiter) setRate(bytesPerSecond uint64) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.rate = float64(bytesPerSecond)
+	l.tokens = l.rate
+	l.last = time.Now()
+}
+
+// limited returns whether a limit is set.
+func (l *rateLimiter) limited() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.rate > 0
+}
+
+// reserve takes n bytes worth of tokens and returns how long to wait before
+// using them. The bucket can go into debt, which later callers wait off.
+func (l *rateLimiter) reserve(n int, now time.Time) time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.rate <= 0 {
+		return 0
+	}
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// wait blocks until n bytes may be transferred.
+func (l *rateLimiter) wait(n int) {
+	if delay := l.reserve(n, time.Now()); delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// limitedReader is a reader that transfers no faster than its limiter allows.
+type limitedReader struct {
+	reader  io.Reader
+	limiter *rateLimiter
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		r.limiter.wait(n)
+	}
+	return n, err
+}
+
+// reader wraps a reader so it is subject to the limit.
+func (l *rateLimiter) reader(r io.Reader) io.Reader {
+	return &limitedReader{reader: r, limiter: l}
+}
+
+// isContentTransfer returns whether an API resource transfers file content, as
+// opposed to metadata.
+func isContentTransfer(resource string) bool {
+	return strings.HasSuffix(strings.SplitN(resource, "?", 2)[0], "/content")
+}
@@ -0,0 +1,45 @@
+package graph
+
+import (
+	"testing"
+	"time"
+)
+
+// Transfers within the burst go through immediately, anything beyond that has
+// to wait for the bucket to refill.
+func TestRateLimiterReserve(t *testing.T) {
+	t.Parallel()
+	limiter := &rateLimiter{}
+	if delay := limiter.reserve(1<<30, time.Now()); delay != 0 {
+		t.Fatalf("An unlimited transfer was made to wait %s", delay)
+	}
+
+	limiter.setRate(1000)
+	now := limiter.last
+	if delay := limiter.reserve(1000, now); delay != 0 {
+		t.Fatalf("A transfer within the burst was made to wait %s", delay)
+	}
+	if delay := limiter.reserve(500, now); delay != 500*time.Millisecond {
+		t.Fatalf("Expected to wait 500ms, got %s", delay)
+	}
+	// the debt is paid off after half a second
+	if delay := limiter.reserve(100, now.Add(500*time.Millisecond)); delay != 100*time.Millisecond {
+		t.Fatalf("Expected to wait 100ms, got %s", delay)
+	}
+}
+
+func TestIsContentTransfer(t *testing.T) {
+	t.Parallel()
+	transfers := map[string]bool{
+		"/me/drive/items/123/content":            true,
+		"/me/drive/items/123:/file.txt:/content": true,
+		"/me/drive/items/123/content?format=pdf": true,
+		"/me/drive/items/123":                    false,
+		"/me/drive/items/123/children":           false,
+	}
+	for resource, expected := range transfers {
+		if isContentTransfer(resource) != expected {
+			t.Errorf("isContentTransfer(%s) should be %t", resource, expected)
+		}
+	}
+}
@@ -0,0 +1,316 @@
+package graph
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	bolt "github.com/etcd-io/bbolt"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	log "github.com/sirupsen/logrus"
+)
+
+// RECYCLED is the boltdb bucket holding the items known to be in the recycle
+// bin. Graph can't list it, so these are the items we saw being deleted.
+var RECYCLED = []byte("recycled")
+
+// recycleFolderID is the ID of the virtual folder listing the recycle bin, and
+// recycleFolderName its name.
+const (
+	recycleFolderID   = "virtual-recycle-bin"
+	recycleFolderName = "Recycle Bin"
+)
+
+// recycledPrefix starts the IDs items in the recycle bin are listed under, so
+// they are not mistaken for the items they were.
+const recycledPrefix = "recycled:"
+
+// how long the server keeps deleted items, for personal accounts at least
+const recycleRetention = 30 * 24 * time.Hour
+
+const restoreXattr = xattrPrefix + "restore"
+
+// errNotRecycled is returned when restoring something that is not in the
+// recycle bin, or not anymore.
+var errNotRecycled = errors.New("item is not in the recycle bin")
+
+// recycledItem is an item known to be in the recycle bin.
+type recycledItem struct {
+	ID       string    `json:"id"`
+	Name     string    `json:"name"`
+	ParentID string    `json:"parentId"`
+	Path     string    `json:"path"` // where it was deleted from
+	Size     uint64    `json:"size"`
+	Dir      bool      `json:"dir,omitempty"`
+	Deleted  time.Time `json:"deleted"`
+}
+
+// isRecycleFolder returns whether id is the virtual folder listing the recycle
+// bin. Nothing can be added to it.
+func isRecycleFolder(id string) bool {
+	return id == recycleFolderID
+}
+
+// isRecycled returns whether id is an item listed in the recycle bin. Those
+// can only be restored, their content is gone from the server.
+func isRecycled(id string) bool {
+	return strings.HasPrefix(id, recycledPrefix)
+}
+
+// trashDir returns the name of the folder "gio trash" puts trashed items in.
+func trashDir() string {
+	return fmt.Sprintf(".Trash-%d", ownerUID)
+}
+
+// isTrash returns whether a folder is where the freedesktop trash keeps
+// trashed items.
+func isTrash(folder *Inode) bool {
+	return strings.EqualFold(folder.Path(), "/"+trashDir()+"/files")
+}
+
+// recycle remembers that an item was deleted, and lists it in the recycle bin.
+// Items that never made it to the server, and items in other drives, are not
+// in the user's recycle bin.
+func (c *Cache) recycle(inode *Inode) {
+	id := inode.ID()
+	if isLocalID(id) || c.source.foreign(id) || isRecycled(id) || c.db == nil {
+		return
+	}
+	item := recycledItem{
+		ID:       id,
+		Name:     inode.Name(),
+		ParentID: inode.ParentID(),
+		Path:     inode.Path(),
+		Size:     inode.Size(),
+		Dir:      inode.IsDir(),
+		Deleted:  time.Now(),
+	}
+	data, _ := json.Marshal(item)
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(RECYCLED)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.Put([]byte(id), data)
+	})
+	if err != nil {
+		log.WithFields(log.Fields{
+			"id":   id,
+			"path": item.Path,
+			"err":  err,
+		}).Warn("Could not remember item in the recycle bin.")
+		return
+	}
+	if folder := c.GetID(recycleFolderID); folder != nil {
+		c.listRecycleBin(folder)
+	}
+}
+
+// recycled returns the items known to be in the recycle bin, newest first.
+// Ones the server has let go of by now are forgotten.
+func (c *Cache) recycled() []recycledItem {
+	items := make([]recycledItem, 0)
+	c.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(RECYCLED)
+		if bucket == nil {
+			return nil
+		}
+		expired := make([][]byte, 0)
+		bucket.ForEach(func(key []byte, value []byte) error {
+			var item recycledItem
+			if json.Unmarshal(value, &item) != nil ||
+				time.Since(item.Deleted) > recycleRetention {
+				expired = append(expired, key)
+			} else {
+				items = append(items, item)
+			}
+			return nil
+		})
+		for _, key := range expired {
+			bucket.Delete(key)
+		}
+		return nil
+	})
+	sort.Slice(items, func(a, b int) bool {
+		return items[a].Deleted.After(items[b].Deleted)
+	})
+	return items
+}
+
+// recycledItem looks up an item in the recycle bin by the ID it is listed
+// under there.
+func (c *Cache) recycledItem(listedID string) (recycledItem, error) {
+	id := strings.TrimPrefix(listedID, recycledPrefix)
+	for _, item := range c.recycled() {
+		if item.ID == id {
+			return item, nil
+		}
+	}
+	return recycledItem{}, errNotRecycled
+}
+
+// forgetRecycled forgets an item in the recycle bin, once it was restored or
+// turned out to be gone for good.
+func (c *Cache) forgetRecycled(id string) {
+	c.db.Update(func(tx *bolt.Tx) error {
+		if bucket := tx.Bucket(RECYCLED); bucket != nil {
+			return bucket.Delete([]byte(id))
+		}
+		return nil
+	})
+	if folder := c.GetID(recycleFolderID); folder != nil {
+		c.listRecycleBin(folder)
+	}
+}
+
+// recycledChildren turns the items in the recycle bin into children of the
+// virtual folder listing it. Items of the same name are numbered, the most
+// recently deleted one keeps its name.
+func recycledChildren(items []recycledItem) []*Inode {
+	children := make([]*Inode, 0, len(items))
+	taken := make(map[string]bool)
+	for _, item := range items {
+		name := item.Name
+		ext := filepath.Ext(name)
+		for n := 2; taken[strings.ToLower(name)]; n++ {
+			name = fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(item.Name, ext), n, ext)
+		}
+		taken[strings.ToLower(name)] = true
+
+		deleted := item.Deleted
+		child := &Inode{
+			DriveItem: DriveItem{
+				IDInternal:      recycledPrefix + item.ID,
+				NameInternal:    name,
+				Parent:          &DriveItemParent{ID: recycleFolderID, Path: "/" + recycleFolderName},
+				SizeInternal:    item.Size,
+				ModTimeInternal: &deleted,
+			},
+			mode: fuse.S_IFREG | 0444,
+		}
+		if item.Dir {
+			child.Folder = &Folder{}
+			child.mode = fuse.S_IFDIR | 0555
+			// what was in it can't be listed
+			child.children = make([]string, 0)
+		}
+		children = append(children, child)
+	}
+	return children
+}
+
+// listRecycleBin lists what is in the recycle bin in its virtual folder. The
+// kernel is told in the background, as it may be holding the folder while
+// something is restored from it.
+func (c *Cache) listRecycleBin(folder *Inode) {
+	folder.mutex.RLock()
+	previous := append([]string(nil), folder.children...)
+	folder.mutex.RUnlock()
+	names := make([]string, 0, len(previous))
+	for _, id := range previous {
+		if child := c.GetID(id); child != nil {
+			c.DeleteID(id)
+			names = append(names, child.Name())
+		}
+	}
+
+	children := recycledChildren(c.recycled())
+	ids := make([]string, 0, len(children))
+	var subdir uint32
+	c.gcMutex.RLock()
+	for _, child := range children {
+		child.cache = c
+		c.metadata.Store(child.ID(), child)
+		ids = append(ids, child.ID())
+		if child.IsDir() {
+			subdir++
+		}
+		names = append(names, child.Name())
+	}
+	folder.mutex.Lock()
+	folder.children = ids
+	folder.subdir = subdir
+	folder.mutex.Unlock()
+	c.gcMutex.RUnlock()
+	go func() {
+		for _, name := range names {
+			notifyEntry(folder, name)
+		}
+	}()
+}
+
+// ShowRecycleBin adds the virtual folder listing the recycle bin to the root
+// of the filesystem.
+func (c *Cache) ShowRecycleBin() {
+	if c.GetID(recycleFolderID) != nil {
+		return
+	}
+	now := time.Now()
+	folder := &Inode{
+		DriveItem: DriveItem{
+			IDInternal:      recycleFolderID,
+			NameInternal:    recycleFolderName,
+			Parent:          &DriveItemParent{ID: c.root, Path: "/"},
+			Folder:          &Folder{},
+			ModTimeInternal: &now,
+		},
+		mode: fuse.S_IFDIR | 0555,
+	}
+	c.insertVirtual(folder)
+	c.listRecycleBin(folder)
+}
+
+// restore restores an item in the recycle bin, listed under listedID, into
+// the folder with ID parentID as name. It goes back to where it was deleted
+// from if parentID is empty.
+func (c *Cache) restore(listedID string, parentID string, name string) (*Inode, error) {
+	item, err := c.recycledItem(listedID)
+	if err != nil {
+		return nil, err
+	}
+	request := make(map[string]interface{})
+	if parentID != "" {
+		_, rawParentID := splitDriveItemID(parentID)
+		request["parentReference"] = map[string]string{"id": rawParentID}
+		request["name"] = name
+	}
+	payload, _ := json.Marshal(request)
+	resp, err := Post(itemResource(item.ID)+"/restore", c.GetAuth(), bytes.NewReader(payload))
+	if err != nil {
+		var graphErr *GraphError
+		if errors.As(err, &graphErr) && graphErr.StatusCode == http.StatusNotFound {
+			// emptied from the recycle bin, or deleted for good some other way
+			c.forgetRecycled(item.ID)
+			return nil, errNotRecycled
+		}
+		return nil, err
+	}
+	restored := &Inode{}
+	if err = json.Unmarshal(resp, restored); err != nil {
+		return nil, err
+	}
+	c.source.adopt([]*Inode{restored})
+	c.forgetRecycled(item.ID)
+
+	dest := filepath.Join(item.Path, "..", restored.Name())
+	if parent := c.GetID(restored.ParentID()); parent != nil {
+		dest = filepath.Join(parent.Path(), restored.Name())
+		if c.GetID(restored.ID()) == nil {
+			restored.cache = c
+			c.InsertChild(parent.ID(), restored)
+		}
+		go notifyEntry(parent, restored.Name())
+	}
+	c.activity.record(activityLocal, "restored", item.Path, activityMove(dest))
+	log.WithFields(log.Fields{
+		"id":   item.ID,
+		"path": dest,
+	}).Info("Restored item from the recycle bin.")
+	return restored, nil
+}
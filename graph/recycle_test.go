@@ -0,0 +1,135 @@
+package graph
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "github.com/etcd-io/bbolt"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// Deleted items of the same name are told apart in the recycle bin, the most
+// recently deleted one keeping its name, and none of them can be changed.
+func TestRecycledChildren(t *testing.T) {
+	t.Parallel()
+	now := time.Now()
+	children := recycledChildren([]recycledItem{
+		{ID: "3", Name: "notes.txt", Deleted: now},
+		{ID: "2", Name: "Notes.txt", Deleted: now.Add(-time.Hour)},
+		{ID: "1", Name: "Photos", Dir: true, Deleted: now.Add(-2 * time.Hour)},
+	})
+	expected := map[string]string{
+		recycledPrefix + "3": "notes.txt",
+		recycledPrefix + "2": "Notes (2).txt",
+		recycledPrefix + "1": "Photos",
+	}
+	if len(children) != len(expected) {
+		t.Fatalf("Expected %d items in the recycle bin, got %d.", len(expected), len(children))
+	}
+	for _, child := range children {
+		if name := expected[child.ID()]; child.Name() != name {
+			t.Errorf("Expected %s to be called %q, got %q.", child.ID(), name, child.Name())
+		}
+		if child.Mode()&0222 != 0 || child.ParentID() != recycleFolderID {
+			t.Errorf("%s is writable or not in the recycle bin: %o", child.Name(), child.Mode())
+		}
+	}
+	if photos := children[2]; !photos.IsDir() || photos.children == nil {
+		t.Error("Deleted folder should be shown as an empty folder.")
+	}
+}
+
+// Items should be remembered in the recycle bin until the server lets go of
+// them, or they are restored.
+func TestRecycleRemembered(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "onedriver-recycle-")
+	failOnErr(t, err)
+	defer os.RemoveAll(dir)
+	db, err := bolt.Open(filepath.Join(dir, "recycle.db"), 0600,
+		&bolt.Options{Timeout: time.Second * 5})
+	failOnErr(t, err)
+	defer db.Close()
+	failOnErr(t, db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(METADATA); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(RECYCLED)
+		return err
+	}))
+	cache := &Cache{
+		db:       db,
+		metadata: newShardedMap(),
+		offline:  true,
+	}
+	root := NewInode("root", 0755|fuse.S_IFDIR, nil)
+	cache.InsertID(root.ID(), root)
+	cache.root = root.ID()
+
+	file := NewInode("report.docx", 0644|fuse.S_IFREG, root)
+	file.IDInternal = "01REPORT"
+	cache.InsertChild(root.ID(), file)
+	cache.recycle(file)
+	local := NewInode("draft.txt", 0644|fuse.S_IFREG, root)
+	cache.recycle(local)
+
+	// deleted long enough ago to be gone from the server
+	expired, _ := json.Marshal(recycledItem{ID: "01OLD", Name: "old.txt",
+		Deleted: time.Now().Add(-recycleRetention - time.Hour)})
+	failOnErr(t, db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(RECYCLED).Put([]byte("01OLD"), expired)
+	}))
+
+	cache.ShowRecycleBin()
+	children, err := cache.GetChildrenID(recycleFolderID, nil)
+	failOnErr(t, err)
+	if len(children) != 1 {
+		t.Fatalf("Expected only report.docx in the recycle bin, got %v", children)
+	}
+	item, err := cache.recycledItem(recycledPrefix + "01REPORT")
+	if err != nil || item.Path != "/report.docx" {
+		t.Errorf("Did not remember where report.docx was deleted from: %+v, %v", item, err)
+	}
+
+	cache.forgetRecycled("01REPORT")
+	if children, _ := cache.GetChildrenID(recycleFolderID, nil); len(children) != 0 {
+		t.Errorf("Restored item is still in the recycle bin: %v", children)
+	}
+}
+
+// Showing the recycle bin must not make a root that was never listed look
+// listed, which would hide the whole drive.
+func TestShowRecycleBinUnlistedRoot(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "onedriver-recycle-root-")
+	failOnErr(t, err)
+	defer os.RemoveAll(dir)
+	db, err := bolt.Open(filepath.Join(dir, "recycle.db"), 0600,
+		&bolt.Options{Timeout: time.Second * 5})
+	failOnErr(t, err)
+	defer db.Close()
+	failOnErr(t, db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(METADATA)
+		return err
+	}))
+	cache := &Cache{db: db, metadata: newShardedMap()}
+	root := NewInode("root", 0755|fuse.S_IFDIR, nil)
+	cache.root = root.ID()
+	cache.InsertID(root.ID(), root)
+	root.children = nil // as fetched from the server
+
+	cache.ShowRecycleBin()
+	root.mutex.RLock()
+	listed := root.children != nil
+	root.mutex.RUnlock()
+	if listed {
+		t.Fatal("Root looks listed after showing the recycle bin.")
+	}
+	if cache.GetID(recycleFolderID) == nil {
+		t.Fatal("Recycle bin was not added.")
+	}
+}
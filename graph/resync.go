@@ -0,0 +1,107 @@
+package graph
+
+import (
+	"strings"
+
+	bolt "github.com/etcd-io/bbolt"
+	log "github.com/sirupsen/logrus"
+)
+
+// startResync restarts delta polling with a full enumeration of the drive. This
+// happens when the server tells us our delta token is no longer valid (HTTP 410
+// Gone), in which case it may also provide a link to restart from.
+func (c *Cache) startResync(location string) {
+	c.Lock()
+	defer c.Unlock()
+	if location != "" {
+		c.deltaLink = strings.TrimPrefix(location, c.auth.graphURL())
+	} else {
+		// no token at all means "enumerate everything"
+		c.deltaLink = c.source.resource() + "/root/delta"
+	}
+	c.resyncSeen = make(map[string]bool)
+	log.WithField("deltaLink", c.deltaLink).Warn(
+		"Delta token is no longer valid, performing a full resync.")
+}
+
+// isResyncing returns whether a full resync is in progress.
+func (c *Cache) isResyncing() bool {
+	c.RLock()
+	defer c.RUnlock()
+	return c.resyncSeen != nil
+}
+
+// markSeen records items returned by the server during a full resync.
+func (c *Cache) markSeen(deltas []*Inode) {
+	c.Lock()
+	defer c.Unlock()
+	if c.resyncSeen == nil {
+		return
+	}
+	for _, delta := range deltas {
+		c.resyncSeen[delta.ID()] = true
+	}
+}
+
+// finishResync is called once a full enumeration has completed. Since every
+// item on the server has now been applied as a delta, any cached item the
+// server did not mention no longer exists remotely. These are removed, unless
+// they have local changes that have yet to be uploaded.
+func (c *Cache) finishResync() {
+	c.Lock()
+	seen := c.resyncSeen
+	c.resyncSeen = nil
+	c.Unlock()
+	if seen == nil {
+		return
+	}
+
+	removed := 0
+	c.metadata.Range(func(id string, inode *Inode) bool {
+		if seen[id] || id == c.root || isLocalID(id) || c.hasLocalChanges(inode) {
+			return true
+		}
+		if c.source.foreign(id) || isRecycleFolder(id) || isRecycled(id) || isVersions(id) {
+			// not in this drive, or not one of its items, so never part of
+			// its enumeration
+			return true
+		}
+		log.WithFields(log.Fields{
+			"id":   id,
+			"name": inode.Name(),
+		}).Info("Item no longer exists on server, removing after resync.")
+		parent := c.GetID(inode.ParentID())
+		name := inode.Name()
+		c.DeleteID(id)
+		c.DeleteContent(id)
+		notifyDelete(parent, name, inode)
+		removed++
+		return true
+	})
+	log.WithField("removed", removed).Info("Full resync complete.")
+}
+
+// Resync forces a full resync with the server. Metadata that only exists on
+// disk is discarded, every cached item is revalidated against a full
+// enumeration of the drive, and a fresh delta token is obtained. Items with
+// local changes that have not been uploaded yet are preserved.
+func (c *Cache) Resync() {
+	c.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(METADATA)
+		stale := make([][]byte, 0)
+		b.ForEach(func(k, v []byte) error {
+			id := string(k)
+			if _, exists := c.metadata.Load(id); !exists && id != "root" && !isLocalID(id) {
+				stale = append(stale, k)
+			}
+			return nil
+		})
+		for _, k := range stale {
+			b.Delete(k)
+		}
+		log.WithField("discarded", len(stale)).Info("Discarded on-disk metadata for resync.")
+		return nil
+	})
+	c.startResync("")
+	c.TriggerDeltas()
+}
@@ -0,0 +1,42 @@
+package graph
+
+import (
+	"context"
+	"testing"
+)
+
+// After a full resync, cached items the server didn't mention should be removed
+// unless they have local changes.
+func TestFinishResync(t *testing.T) {
+	t.Parallel()
+	cache := NewCache(context.Background(), auth, "test_finish_resync.db")
+	root, _ := cache.GetPath("/", auth)
+
+	seen := NewInode("resync_seen", 0644, root)
+	seen.IDInternal = "resync-seen"
+	cache.InsertChild(root.ID(), seen)
+	gone := NewInode("resync_gone", 0644, root)
+	gone.IDInternal = "resync-gone"
+	cache.InsertChild(root.ID(), gone)
+	dirty := NewInode("resync_dirty", 0644, root)
+	dirty.IDInternal = "resync-dirty"
+	dirty.hasChanges = true
+	cache.InsertChild(root.ID(), dirty)
+
+	cache.startResync("")
+	cache.markSeen([]*Inode{seen})
+	cache.finishResync()
+
+	if cache.isResyncing() {
+		t.Fatal("Cache still thinks it is resyncing.")
+	}
+	if cache.GetID(seen.ID()) == nil {
+		t.Fatal("Item seen during resync was removed.")
+	}
+	if cache.GetID(gone.ID()) != nil {
+		t.Fatal("Item missing from the server was not removed.")
+	}
+	if cache.GetID(dirty.ID()) == nil {
+		t.Fatal("Item with local changes was removed.")
+	}
+}
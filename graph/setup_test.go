@@ -1,6 +1,7 @@
 package graph
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"os/exec"
@@ -39,6 +40,7 @@ func TestMain(m *testing.M) {
 	toDelete, _ := filepath.Glob("test*.db")
 	for _, db := range toDelete {
 		os.Remove(db)
+		os.RemoveAll(ContentDir(db))
 	}
 
 	logFile, _ := os.OpenFile("fusefs_tests.log", os.O_TRUNC|os.O_CREATE|os.O_RDWR, 0644)
@@ -48,7 +50,7 @@ func TestMain(m *testing.M) {
 	log.SetFormatter(logger.LogrusFormatter())
 	log.SetLevel(log.DebugLevel)
 
-	root := NewFS("test.db", "auth_tokens.json", 5*time.Second)
+	root := NewFS(context.Background(), "test.db", "auth_tokens.json", 5*time.Second)
 	fsCache = root.GetCache()
 	auth = fsCache.GetAuth()
 	second := time.Second
@@ -58,7 +60,6 @@ func TestMain(m *testing.M) {
 		MountOptions: fuse.MountOptions{
 			Name:          "onedriver",
 			FsName:        "onedriver",
-			DisableXAttrs: true,
 			MaxBackground: 1024,
 		},
 	})
@@ -66,7 +67,7 @@ func TestMain(m *testing.M) {
 	// setup sigint handler for graceful unmount on interrupt/terminate
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	go UnmountHandler(sigChan, server)
+	go UnmountHandler(sigChan, server, fsCache)
 
 	// mount fs in background thread
 	go server.Serve()
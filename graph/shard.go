@@ -0,0 +1,93 @@
+package graph
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// number of shards used by shardedMap, must be a power of 2
+const shardCount = 32
+
+// metadataShard is a single lockable slice of a shardedMap
+type metadataShard struct {
+	sync.RWMutex
+	items map[string]*Inode
+}
+
+// shardedMap is a concurrent map of item IDs to Inodes. Items are spread across
+// a number of independently locked shards based on the hash of their ID, so
+// that parallel directory traversals don't all contend on the same lock.
+type shardedMap struct {
+	shards [shardCount]*metadataShard
+}
+
+// newShardedMap initializes an empty shardedMap
+func newShardedMap() *shardedMap {
+	m := &shardedMap{}
+	for i := range m.shards {
+		m.shards[i] = &metadataShard{items: make(map[string]*Inode)}
+	}
+	return m
+}
+
+// shard picks the shard responsible for a given ID
+func (m *shardedMap) shard(id string) *metadataShard {
+	hash := fnv.New32a()
+	hash.Write([]byte(id))
+	return m.shards[hash.Sum32()&(shardCount-1)]
+}
+
+// Load fetches an item by ID. The bool is false if the item was not found.
+func (m *shardedMap) Load(id string) (*Inode, bool) {
+	shard := m.shard(id)
+	shard.RLock()
+	inode, exists := shard.items[id]
+	shard.RUnlock()
+	return inode, exists
+}
+
+// Store inserts or overwrites an item.
+func (m *shardedMap) Store(id string, inode *Inode) {
+	shard := m.shard(id)
+	shard.Lock()
+	shard.items[id] = inode
+	shard.Unlock()
+}
+
+// Delete removes an item. Deleting a non-existent item is a no-op.
+func (m *shardedMap) Delete(id string) {
+	shard := m.shard(id)
+	shard.Lock()
+	delete(shard.items, id)
+	shard.Unlock()
+}
+
+// Range calls f for every item in the map, stopping if f returns false. Each
+// shard is snapshotted before iteration, so f is free to modify the map.
+func (m *shardedMap) Range(f func(id string, inode *Inode) bool) {
+	for _, shard := range m.shards {
+		shard.RLock()
+		snapshot := make(map[string]*Inode, len(shard.items))
+		for id, inode := range shard.items {
+			snapshot[id] = inode
+		}
+		shard.RUnlock()
+
+		for id, inode := range snapshot {
+			if !f(id, inode) {
+				return
+			}
+		}
+	}
+}
+
+// Len returns the number of items in the map.
+func (m *shardedMap) Len() int {
+	total := 0
+	for _, shard := range m.shards {
+		shard.RLock()
+		total += len(shard.items)
+		shard.RUnlock()
+	}
+	return total
+}
@@ -0,0 +1,171 @@
+package graph
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// Items stored in a shardedMap should be retrievable, and gone after deletion.
+func TestShardedMapStoreLoadDelete(t *testing.T) {
+	t.Parallel()
+	m := newShardedMap()
+	inode := NewInode("sharded", 0644, nil)
+	m.Store(inode.ID(), inode)
+	if found, exists := m.Load(inode.ID()); !exists || found != inode {
+		t.Fatal("Could not load item after storing it.")
+	}
+	if m.Len() != 1 {
+		t.Fatalf("Expected 1 item in map, got %d.", m.Len())
+	}
+
+	m.Delete(inode.ID())
+	if _, exists := m.Load(inode.ID()); exists {
+		t.Fatal("Item still present after deletion.")
+	}
+}
+
+// Range should visit every item, even if items are deleted during iteration.
+func TestShardedMapRange(t *testing.T) {
+	t.Parallel()
+	m := newShardedMap()
+	for i := 0; i < 100; i++ {
+		m.Store(strconv.Itoa(i), NewInode(strconv.Itoa(i), 0644, nil))
+	}
+
+	visited := 0
+	m.Range(func(id string, inode *Inode) bool {
+		visited++
+		m.Delete(id)
+		return true
+	})
+	if visited != 100 || m.Len() != 0 {
+		t.Fatalf("Range visited %d items, %d items remain.", visited, m.Len())
+	}
+}
+
+// compares the sharded map against a single sync.Map under parallel reads
+func BenchmarkShardedMapLoad(b *testing.B) {
+	m := newShardedMap()
+	ids := make([]string, 1024)
+	for i := range ids {
+		ids[i] = localID()
+		m.Store(ids[i], NewInode(ids[i], 0644, nil))
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			m.Load(ids[i%len(ids)])
+		}
+	})
+}
+
+func BenchmarkSyncMapLoad(b *testing.B) {
+	var m sync.Map
+	ids := make([]string, 1024)
+	for i := range ids {
+		ids[i] = localID()
+		m.Store(ids[i], NewInode(ids[i], 0644, nil))
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			m.Load(ids[i%len(ids)])
+		}
+	})
+}
+
+// mixed workload closer to a parallel directory traversal (mostly reads,
+// occasional inserts as new children are fetched)
+func BenchmarkShardedMapMixed(b *testing.B) {
+	m := newShardedMap()
+	ids := make([]string, 1024)
+	for i := range ids {
+		ids[i] = localID()
+		m.Store(ids[i], NewInode(ids[i], 0644, nil))
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			id := ids[i%len(ids)]
+			if i%10 == 0 {
+				inode, _ := m.Load(id)
+				m.Store(id, inode)
+			} else {
+				m.Load(id)
+			}
+		}
+	})
+}
+
+func BenchmarkSyncMapMixed(b *testing.B) {
+	var m sync.Map
+	ids := make([]string, 1024)
+	for i := range ids {
+		ids[i] = localID()
+		m.Store(ids[i], NewInode(ids[i], 0644, nil))
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			id := ids[i%len(ids)]
+			if i%10 == 0 {
+				inode, _ := m.Load(id)
+				m.Store(id, inode)
+			} else {
+				m.Load(id)
+			}
+		}
+	})
+}
+
+// populatedCache returns a cache holding folders of files under its root, all
+// of them listed already, like after browsing around a mounted drive for a
+// while. Returns the IDs of the folders.
+func populatedCache(folders int, files int) (*Cache, []string) {
+	cache := &Cache{metadata: newShardedMap()}
+	root := NewInode("root", 0755|fuse.S_IFDIR, nil)
+	cache.root = root.ID()
+	cache.InsertID(root.ID(), root)
+	ids := make([]string, folders)
+	for i := range ids {
+		folder := NewInode("folder"+strconv.Itoa(i), 0755|fuse.S_IFDIR, root)
+		cache.InsertChild(root.ID(), folder)
+		ids[i] = folder.ID()
+		for j := 0; j < files; j++ {
+			cache.InsertChild(folder.ID(),
+				NewInode("file"+strconv.Itoa(j)+".txt", 0644|fuse.S_IFREG, folder))
+		}
+	}
+	return cache, ids
+}
+
+// the path taken by Lookup on a cached folder, from several threads at once
+func BenchmarkCacheLookup(b *testing.B) {
+	cache, folders := populatedCache(64, 64)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			name := "file" + strconv.Itoa(i%64) + ".txt"
+			if child, _ := cache.GetChild(folders[i%len(folders)], name, nil); child == nil {
+				b.Fatal("Cached child not found.")
+			}
+		}
+	})
+}
+
+// the path taken by Readdir on a cached folder, from several threads at once
+func BenchmarkCacheReaddir(b *testing.B) {
+	cache, folders := populatedCache(64, 64)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			children, err := cache.GetChildrenID(folders[i%len(folders)], nil)
+			if err != nil || len(children) != 64 {
+				b.Fatalf("Listed %d cached children: %v", len(children), err)
+			}
+		}
+	})
+}
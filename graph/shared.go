@@ -0,0 +1,260 @@
+package graph
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	log "github.com/sirupsen/logrus"
+)
+
+// sharedFolderID is the ID of the virtual folder holding items shared with
+// the user, and sharedFolderName its name.
+const (
+	sharedFolderID   = "virtual-shared"
+	sharedFolderName = "Shared"
+)
+
+// separates the drive from the item in the IDs of items in other drives
+const driveSeparator = "|"
+
+// driveItemID returns the ID an item in another drive is cached under.
+func driveItemID(driveID string, itemID string) string {
+	return driveID + driveSeparator + itemID
+}
+
+// splitDriveItemID splits an ID into the drive the item is in and its ID
+// within that drive. The drive is "" for items in the user's own drive.
+func splitDriveItemID(id string) (string, string) {
+	if i := strings.Index(id, driveSeparator); i >= 0 {
+		return id[:i], id[i+len(driveSeparator):]
+	}
+	return "", id
+}
+
+// driveOf returns the drive an item is in, "" for the user's own drive.
+func driveOf(id string) string {
+	drive, _ := splitDriveItemID(id)
+	return drive
+}
+
+// sameDrive returns the ID an item the server knows as itemID is cached
+// under, given that it is in the same drive as the item with ID id.
+func sameDrive(id string, itemID string) string {
+	if drive := driveOf(id); drive != "" && itemID != "" {
+		return driveItemID(drive, itemID)
+	}
+	return itemID
+}
+
+// itemResource returns the API resource path of an item by ID.
+func itemResource(id string) string {
+	drive, itemID := splitDriveItemID(id)
+	if drive != "" {
+		return "/drives/" + drive + "/items/" + itemID
+	}
+	return "/me/drive/items/" + id
+}
+
+// sharedItem is an item in the list of items shared with the user, which
+// describes the actual item in remoteItem.
+// https://docs.microsoft.com/en-us/graph/api/drive-sharedwithme
+type sharedItem struct {
+	Name   string `json:"name"`
+	Remote *struct {
+		DriveItem
+		Shared *struct {
+			Owner struct {
+				User struct {
+					DisplayName string `json:"displayName"`
+				} `json:"user"`
+			} `json:"owner"`
+		} `json:"shared,omitempty"`
+	} `json:"remoteItem,omitempty"`
+}
+
+// getSharedWithMe lists the items shared with the user, as children of the
+// virtual shared folder.
+func getSharedWithMe(auth *Auth) ([]*Inode, error) {
+	var shared []sharedItem
+	resource := "/me/drive/sharedWithMe"
+	for resource != "" {
+		body, err := Get(resource, auth)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Value    []sharedItem `json:"value"`
+			NextLink string       `json:"@odata.nextLink,omitempty"`
+		}
+		if err = json.Unmarshal(body, &page); err != nil {
+			return nil, err
+		}
+		shared = append(shared, page.Value...)
+		resource = strings.TrimPrefix(page.NextLink, auth.graphURL())
+	}
+	return sharedChildren(shared), nil
+}
+
+// sharedChildren turns the items shared with the user into children of the
+// virtual shared folder. Items of the same name are told apart by the name of
+// whoever shared them.
+func sharedChildren(shared []sharedItem) []*Inode {
+	// the same names every time, whatever order the server lists them in
+	sort.Slice(shared, func(a, b int) bool {
+		if shared[a].Name != shared[b].Name {
+			return shared[a].Name < shared[b].Name
+		}
+		return shared[a].Remote != nil && shared[b].Remote != nil &&
+			shared[a].Remote.IDInternal < shared[b].Remote.IDInternal
+	})
+	items := make([]*Inode, 0, len(shared))
+	taken := make(map[string]bool)
+	for _, item := range shared {
+		remote := item.Remote
+		if remote == nil || remote.Parent == nil || remote.Parent.DriveID == "" {
+			continue
+		}
+		name := item.Name
+		if taken[strings.ToLower(name)] && remote.Shared != nil {
+			name = fmt.Sprintf("%s (%s)", name, remote.Shared.Owner.User.DisplayName)
+		}
+		if taken[strings.ToLower(name)] {
+			log.WithFields(log.Fields{
+				"name":  item.Name,
+				"drive": remote.Parent.DriveID,
+				"id":    remote.IDInternal,
+			}).Warn("Skipping shared item, another one has the same name.")
+			continue
+		}
+		taken[strings.ToLower(name)] = true
+
+		inode := &Inode{DriveItem: remote.DriveItem}
+		inode.IDInternal = driveItemID(remote.Parent.DriveID, remote.IDInternal)
+		inode.NameInternal = name
+		inode.DriveItem.Parent = &DriveItemParent{ID: sharedFolderID}
+		items = append(items, inode)
+	}
+	return items
+}
+
+// GetChildrenID fetches the children of a folder from the server, following
+// every page of results. Children of folders in other drives get IDs from
+// their drive.
+func GetChildrenID(id string, auth *Auth) ([]*Inode, error) {
+	if id == sharedFolderID {
+		return getSharedWithMe(auth)
+	}
+	drive := driveOf(id)
+	children := make([]*Inode, 0)
+	resource := ChildrenPathID(id)
+	for resource != "" {
+		body, err := Get(resource, auth)
+		if err != nil {
+			return nil, err
+		}
+		var page driveChildren
+		if err = json.Unmarshal(body, &page); err != nil {
+			return nil, err
+		}
+		for _, child := range page.Children {
+			if drive != "" {
+				child.IDInternal = driveItemID(drive, child.IDInternal)
+				child.DriveItem.Parent = &DriveItemParent{ID: id, DriveID: drive}
+			}
+		}
+		children = append(children, page.Children...)
+		resource = strings.TrimPrefix(page.NextLink, auth.graphURL())
+	}
+	return children, nil
+}
+
+// addSharedFolder adds the virtual folder for items shared with the user to
+// the root of the filesystem, unless it is there already.
+func (c *Cache) addSharedFolder() {
+	if c.GetID(sharedFolderID) != nil {
+		return
+	}
+	now := time.Now()
+	c.insertVirtual(&Inode{
+		DriveItem: DriveItem{
+			IDInternal:      sharedFolderID,
+			NameInternal:    sharedFolderName,
+			Parent:          &DriveItemParent{ID: c.root},
+			Folder:          &Folder{},
+			ModTimeInternal: &now,
+		},
+		mode: fuse.S_IFDIR | 0755,
+	})
+}
+
+// isSharedFolder returns whether id is the virtual folder holding items shared
+// with the user. Those items can't be added to it, nor removed from it.
+func isSharedFolder(id string) bool {
+	return id == sharedFolderID
+}
+
+// refreshShared lists the shared folders that were listed before again, and
+// applies whatever changed in them the way deltas are applied.
+func (c *Cache) refreshShared(auth *Auth) {
+	folders := make([]*Inode, 0)
+	c.metadata.Range(func(id string, inode *Inode) bool {
+		if c.source.foreign(id) && inode.IsDir() && !isVersions(id) {
+			inode.mutex.RLock()
+			listed := inode.children != nil
+			inode.mutex.RUnlock()
+			if listed {
+				folders = append(folders, inode)
+			}
+		}
+		return true
+	})
+	for _, folder := range folders {
+		if err := c.refreshListing(folder, auth); err != nil {
+			log.WithFields(log.Fields{
+				"id":   folder.ID(),
+				"path": folder.Path(),
+				"err":  err,
+			}).Warn("Could not fetch changes to shared folder.")
+			if IsOffline(err) {
+				c.noteOffline(err)
+				return
+			}
+		}
+	}
+}
+
+// refreshListing lists a folder again and applies the changes to its children.
+// Children that are no longer listed were deleted on the server.
+func (c *Cache) refreshListing(folder *Inode, auth *Auth) error {
+	id := folder.ID()
+	fetched, err := GetChildrenID(id, auth)
+	if err != nil {
+		return err
+	}
+	listed := make(map[string]bool, len(fetched))
+	for _, child := range fetched {
+		listed[child.ID()] = true
+		c.applyDelta(child)
+	}
+	folder.mutex.RLock()
+	children := append([]string(nil), folder.children...)
+	folder.mutex.RUnlock()
+	for _, childID := range children {
+		if listed[childID] || isLocalID(childID) {
+			continue
+		}
+		if child := c.GetID(childID); child != nil {
+			c.applyDelta(&Inode{DriveItem: DriveItem{
+				IDInternal:   childID,
+				NameInternal: child.Name(),
+				Parent:       &DriveItemParent{ID: id},
+				Deleted:      &Deleted{State: "deleted"},
+			}})
+		}
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package graph
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "github.com/etcd-io/bbolt"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// Items in other drives must be requested from their drive, and IDs the
+// server hands out for them must say which drive they are in.
+func TestDriveItemID(t *testing.T) {
+	t.Parallel()
+	id := driveItemID("b!drive", "01ITEM")
+	if drive, item := splitDriveItemID(id); drive != "b!drive" || item != "01ITEM" {
+		t.Errorf("Split %q into drive %q and item %q.", id, drive, item)
+	}
+	if resource := itemResource(id); resource != "/drives/b!drive/items/01ITEM" {
+		t.Errorf("Wrong resource for item in another drive: %s", resource)
+	}
+	if resource := itemResource("AB12!34"); resource != "/me/drive/items/AB12!34" {
+		t.Errorf("Wrong resource for item in own drive: %s", resource)
+	}
+	if child := sameDrive(id, "01CHILD"); child != driveItemID("b!drive", "01CHILD") {
+		t.Errorf("Child of item in another drive was not put in that drive: %s", child)
+	}
+	if child := sameDrive("AB12!34", "AB12!35"); child != "AB12!35" {
+		t.Errorf("Child of item in own drive was put in another drive: %s", child)
+	}
+	if driveOf(sharedFolderID) != "" {
+		t.Error("The shared folder must not be mistaken for an item in another drive.")
+	}
+}
+
+// Items shared with the user become children of the shared folder, and ones
+// of the same name are told apart by who shared them.
+func TestSharedChildren(t *testing.T) {
+	t.Parallel()
+	var shared []sharedItem
+	failOnErr(t, json.Unmarshal([]byte(`[
+		{"name": "Budget", "remoteItem": {"id": "2", "folder": {},
+			"parentReference": {"driveId": "bob"},
+			"shared": {"owner": {"user": {"displayName": "Bob"}}}}},
+		{"name": "Budget", "remoteItem": {"id": "1", "folder": {},
+			"parentReference": {"driveId": "alice"},
+			"shared": {"owner": {"user": {"displayName": "Alice"}}}}},
+		{"name": "notes.txt", "remoteItem": {"id": "3", "size": 42,
+			"parentReference": {"driveId": "alice"}}},
+		{"name": "broken"}
+	]`), &shared))
+
+	children := sharedChildren(shared)
+	expected := map[string]string{
+		"Budget":       driveItemID("alice", "1"),
+		"Budget (Bob)": driveItemID("bob", "2"),
+		"notes.txt":    driveItemID("alice", "3"),
+	}
+	if len(children) != len(expected) {
+		t.Fatalf("Expected %d shared items, got %d.", len(expected), len(children))
+	}
+	for _, child := range children {
+		if id, exists := expected[child.Name()]; !exists || child.ID() != id {
+			t.Errorf("Unexpected shared item %q with ID %q.", child.Name(), child.ID())
+		}
+		if child.ParentID() != sharedFolderID {
+			t.Errorf("Shared item %q is not in the shared folder.", child.Name())
+		}
+		if child.Name() == "notes.txt" && (child.IsDir() || child.Size() != 42) {
+			t.Error("Shared file did not keep its metadata.")
+		}
+	}
+}
+
+// Adding the Shared folder must not make a root that was never listed look
+// listed, with nothing but the Shared folder in it.
+func TestSharedFolderUnlistedRoot(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "onedriver-shared-")
+	failOnErr(t, err)
+	defer os.RemoveAll(dir)
+	db, err := bolt.Open(filepath.Join(dir, "shared.db"), 0600,
+		&bolt.Options{Timeout: time.Second * 5})
+	failOnErr(t, err)
+	defer db.Close()
+	failOnErr(t, db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(METADATA)
+		return err
+	}))
+	cache := &Cache{db: db, metadata: newShardedMap()}
+	root := NewInode("root", 0755|fuse.S_IFDIR, nil)
+	cache.root = root.ID()
+	cache.InsertID(root.ID(), root)
+	root.children = nil // as fetched from the server
+	cache.addSharedFolder()
+
+	root.mutex.RLock()
+	listed := root.children != nil
+	root.mutex.RUnlock()
+	if listed {
+		t.Fatal("Root looks listed after adding the Shared folder.")
+	}
+	if !cache.reachable()[sharedFolderID] {
+		t.Fatal("Shared folder would be garbage collected before the root is listed.")
+	}
+	documents := NewInode("Documents", 0755|fuse.S_IFDIR, root)
+	cache.metadata.Store(documents.ID(), documents)
+	children, err := cache.GetChildrenID(root.ID(), nil)
+	failOnErr(t, err)
+	if children["documents"] == nil || children["shared"] == nil {
+		t.Fatalf("Expected the root's own children and the Shared folder, got %v.", children)
+	}
+
+	// once listed, folders added later join it right away
+	recycle := &Inode{DriveItem: DriveItem{
+		IDInternal:   recycleFolderID,
+		NameInternal: recycleFolderName,
+		Parent:       &DriveItemParent{ID: root.ID()},
+		Folder:       &Folder{},
+	}, mode: fuse.S_IFDIR | 0555}
+	root.children = []string{documents.ID(), sharedFolderID}
+	cache.insertVirtual(recycle)
+	if child, _ := cache.GetChild(root.ID(), recycleFolderName, nil); child == nil {
+		t.Fatal("Folder added to a listed root is missing from it.")
+	}
+}
@@ -2,14 +2,28 @@ package graph
 
 import (
 	"os"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/hanwen/go-fuse/v2/fuse"
 	log "github.com/sirupsen/logrus"
 )
 
-// UnmountHandler should be used as goroutine that will handle sigint then exit gracefully
-func UnmountHandler(signal <-chan os.Signal, server *fuse.Server) {
+// how long to wait for in-progress uploads when shutting down
+const shutdownTimeout = 30 * time.Second
+
+// UnmountHandler should be used as goroutine that will handle sigint then exit
+// gracefully. Background work is stopped and state flushed to disk before exit.
+func UnmountHandler(signal <-chan os.Signal, server *fuse.Server, cache *Cache) {
+	UnmountAllHandler(signal, []*fuse.Server{server}, []*Cache{cache}, nil)
+}
+
+// UnmountAllHandler is UnmountHandler for a process serving several
+// filesystems, each server with the cache at the same index. They are all
+// unmounted at once. cleanup, if set, is run once they are, before exiting.
+func UnmountAllHandler(signal <-chan os.Signal, servers []*fuse.Server, caches []*Cache,
+	cleanup func()) {
 	sig := <-signal // block until sigint
 
 	// signals don't automatically format well
@@ -23,13 +37,31 @@ func UnmountHandler(signal <-chan os.Signal, server *fuse.Server) {
 		code = int(syscall.SIGTERM)
 	}
 	log.Infof("%s received, unmounting filesystem.\n", text)
+	var wg sync.WaitGroup
+	for i := range servers {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			Unmount(servers[i], caches[i])
+		}(i)
+	}
+	wg.Wait()
+	if cleanup != nil {
+		cleanup()
+	}
+
+	// convention when exiting via signal is 128 + signal value
+	os.Exit(128 + code)
+}
+
+// Unmount unmounts a filesystem, then stops the background work of its cache
+// and flushes its state to disk.
+func Unmount(server *fuse.Server, cache *Cache) {
 	err := server.Unmount()
 	if err != nil {
 		log.WithFields(log.Fields{
 			"err": err,
 		}).Error("Failed to unmount filesystem cleanly!")
 	}
-
-	// convention when exiting via signal is 128 + signal value
-	os.Exit(128 + code)
+	cache.Shutdown(shutdownTimeout)
 }
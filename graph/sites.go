@@ -0,0 +1,86 @@
+package graph
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Site is a SharePoint site, each of which has one or more document libraries.
+// https://docs.microsoft.com/en-us/graph/api/resources/site
+type Site struct {
+	ID          string `json:"id"`
+	DisplayName string `json:"displayName,omitempty"`
+	WebURL      string `json:"webUrl,omitempty"`
+}
+
+// siteResource returns the API resource path of a site, given either its ID
+// or its URL, like https://contoso.sharepoint.com/sites/team.
+func siteResource(site string) (string, error) {
+	if !strings.Contains(site, "://") {
+		if site == "" {
+			return "", fmt.Errorf("no site given")
+		}
+		return "/sites/" + site, nil
+	}
+	parsed, err := url.Parse(site)
+	if err != nil {
+		return "", err
+	}
+	if parsed.Host == "" {
+		return "", fmt.Errorf("no host in site URL %q", site)
+	}
+	path := strings.Trim(parsed.Path, "/")
+	if path == "" {
+		// the root site of the tenant
+		return "/sites/" + parsed.Host, nil
+	}
+	return "/sites/" + parsed.Host + ":/" + path, nil
+}
+
+// GetSite fetches a site by its ID or URL.
+func GetSite(site string, auth *Auth) (Site, error) {
+	resource, err := siteResource(site)
+	if err != nil {
+		return Site{}, err
+	}
+	resp, err := Get(resource, auth)
+	found := Site{}
+	if err == nil {
+		err = json.Unmarshal(resp, &found)
+	}
+	return found, err
+}
+
+// GetLibrary fetches the drive of the document library of a site called name,
+// or of its default library ("Documents") if name is empty.
+func GetLibrary(siteID string, name string, auth *Auth) (Drive, error) {
+	if name == "" {
+		resp, err := Get("/sites/"+siteID+"/drive", auth)
+		drive := Drive{}
+		if err == nil {
+			err = json.Unmarshal(resp, &drive)
+		}
+		return drive, err
+	}
+	resp, err := Get("/sites/"+siteID+"/drives", auth)
+	if err != nil {
+		return Drive{}, err
+	}
+	var drives struct {
+		Value []Drive `json:"value"`
+	}
+	if err = json.Unmarshal(resp, &drives); err != nil {
+		return Drive{}, err
+	}
+	names := make([]string, 0, len(drives.Value))
+	for _, drive := range drives.Value {
+		if strings.EqualFold(drive.Name, name) {
+			return drive, nil
+		}
+		names = append(names, fmt.Sprintf("%q", drive.Name))
+	}
+	return Drive{}, fmt.Errorf("site has no document library called %q, only %s",
+		name, strings.Join(names, ", "))
+}
@@ -0,0 +1,25 @@
+package graph
+
+import "testing"
+
+// Sites can be given by URL, the way users see them, or by ID.
+func TestSiteResource(t *testing.T) {
+	t.Parallel()
+	tests := map[string]string{
+		"https://contoso.sharepoint.com/sites/team":  "/sites/contoso.sharepoint.com:/sites/team",
+		"https://contoso.sharepoint.com/sites/team/": "/sites/contoso.sharepoint.com:/sites/team",
+		"https://contoso.sharepoint.com":             "/sites/contoso.sharepoint.com",
+		"contoso.sharepoint.com,1a2b,3c4d":           "/sites/contoso.sharepoint.com,1a2b,3c4d",
+	}
+	for site, expected := range tests {
+		resource, err := siteResource(site)
+		if err != nil || resource != expected {
+			t.Errorf("Expected %s for site %q, got %q (%v)", expected, site, resource, err)
+		}
+	}
+	for _, site := range []string{"", "https:///sites/team"} {
+		if _, err := siteResource(site); err == nil {
+			t.Errorf("Site %q should have been refused.", site)
+		}
+	}
+}
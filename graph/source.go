@@ -0,0 +1,84 @@
+package graph
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Source is what a filesystem serves. The zero value is the whole of the
+// user's own drive.
+type Source struct {
+	Drive string `json:"drive,omitempty"` // ID of another drive to serve instead
+	Root  string `json:"root,omitempty"`  // path of the folder served as the root
+}
+
+// String describes the source for logs.
+func (s Source) String() string {
+	drive := "own drive"
+	if s.Drive != "" {
+		drive = "drive " + s.Drive
+	}
+	if s.Root == "" {
+		return drive
+	}
+	return s.Root + " in " + drive
+}
+
+// rootResource returns the API resource path of the item served as the root.
+func (s Source) rootResource() string {
+	if s.Root == "" {
+		return s.resource() + "/root"
+	}
+	return s.resource() + "/root:" + s.Root
+}
+
+// GetRoot fetches the item source serves as the root of the filesystem. A
+// folder served as the root looks like the root of a drive, whatever it is
+// called and wherever it is.
+func GetRoot(source Source, auth *Auth) (*Inode, error) {
+	body, err := Get(source.rootResource(), auth)
+	if err != nil {
+		return nil, err
+	}
+	root := &Inode{}
+	if err = json.Unmarshal(body, root); err != nil {
+		return nil, err
+	}
+	source.adopt([]*Inode{root})
+	if source.Root != "" {
+		if !root.IsDir() {
+			return nil, fmt.Errorf("%s is not a folder", source.Root)
+		}
+		root.NameInternal = "root"
+		root.DriveItem.Parent = nil
+	}
+	return root, nil
+}
+
+// resource returns the API resource path of the drive served.
+func (s Source) resource() string {
+	if s.Drive == "" {
+		return "/me/drive"
+	}
+	return "/drives/" + s.Drive
+}
+
+// foreign returns whether the item with ID id lives in a drive other than the
+// one served. Those never show up in its deltas.
+func (s Source) foreign(id string) bool {
+	return isSharedFolder(id) || driveOf(id) != s.Drive
+}
+
+// adopt gives items fetched from the drive served the IDs they are cached
+// under, which say what drive they are in unless it is the user's own.
+func (s Source) adopt(items []*Inode) {
+	if s.Drive == "" {
+		return
+	}
+	for _, item := range items {
+		item.IDInternal = driveItemID(s.Drive, item.IDInternal)
+		if parent := item.DriveItem.Parent; parent != nil && parent.ID != "" {
+			parent.ID = driveItemID(s.Drive, parent.ID)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package graph
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "github.com/etcd-io/bbolt"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// The root of a filesystem is the root of a drive, or a folder in it.
+func TestRootResource(t *testing.T) {
+	t.Parallel()
+	tests := map[Source]string{
+		{}:                                 "/me/drive/root",
+		{Drive: "b!lib"}:                   "/drives/b!lib/root",
+		{Root: "/Projects/2024"}:           "/me/drive/root:/Projects/2024",
+		{Drive: "b!lib", Root: "/Finance"}: "/drives/b!lib/root:/Finance",
+	}
+	for source, expected := range tests {
+		if resource := source.rootResource(); resource != expected {
+			t.Errorf("Expected the root of %s to be %s, got %s", source, expected, resource)
+		}
+	}
+}
+
+// Items fetched from a drive other than the user's own must be cached under
+// IDs that say which drive they are in, so requests for them go there.
+func TestSourceAdopt(t *testing.T) {
+	t.Parallel()
+	library := Source{Drive: "b!lib"}
+	items := []*Inode{{DriveItem: DriveItem{
+		IDInternal: "01FILE",
+		Parent:     &DriveItemParent{ID: "01FOLDER", DriveID: "b!lib"},
+	}}}
+	library.adopt(items)
+	if items[0].ID() != driveItemID("b!lib", "01FILE") ||
+		items[0].ParentID() != driveItemID("b!lib", "01FOLDER") {
+		t.Errorf("Item was not adopted: %s in %s", items[0].ID(), items[0].ParentID())
+	}
+	if library.foreign(items[0].ID()) || !library.foreign("01OWN") || !library.foreign(sharedFolderID) {
+		t.Error("Items of the library were mistaken for ones in other drives, or the other way around.")
+	}
+
+	own := []*Inode{{DriveItem: DriveItem{IDInternal: "AB!12"}}}
+	Source{}.adopt(own)
+	if own[0].ID() != "AB!12" {
+		t.Errorf("Item in own drive was given another ID: %s", own[0].ID())
+	}
+}
+
+// Paths the server gives are relative to the root of a drive, which is not
+// always the root of the filesystem. Items must get their paths from where
+// they are in the filesystem instead.
+func TestInsertChildPath(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "onedriver-source-")
+	failOnErr(t, err)
+	defer os.RemoveAll(dir)
+	db, err := bolt.Open(filepath.Join(dir, "source.db"), 0600,
+		&bolt.Options{Timeout: time.Second * 5})
+	failOnErr(t, err)
+	defer db.Close()
+	failOnErr(t, db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(METADATA)
+		return err
+	}))
+	cache := &Cache{
+		db:       db,
+		metadata: newShardedMap(),
+		offline:  true,
+	}
+
+	root := NewInode("root", 0755|fuse.S_IFDIR, nil)
+	cache.InsertID(root.ID(), root)
+	folder := NewInode("Budget", 0755|fuse.S_IFDIR, root)
+	folder.IDInternal = driveItemID("b!lib", "01FOLDER")
+	cache.InsertChild(root.ID(), folder)
+
+	child := &Inode{DriveItem: DriveItem{
+		IDInternal:   driveItemID("b!lib", "01FILE"),
+		NameInternal: "2021.xlsx",
+		Parent:       &DriveItemParent{Path: "/drives/b!lib/root:/Finance/Budget"},
+	}}
+	cache.InsertChild(folder.ID(), child)
+	if path := child.Path(); path != "/Budget/2021.xlsx" {
+		t.Errorf("Expected child to be at /Budget/2021.xlsx, got %s", path)
+	}
+}
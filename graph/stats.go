@@ -0,0 +1,108 @@
+package graph
+
+import (
+	"sync"
+	"time"
+)
+
+// Stats describes how a cache has been doing since it was loaded.
+type Stats struct {
+	ContentHits    uint64            `json:"contentHits"`    // files opened from the cache
+	ContentMisses  uint64            `json:"contentMisses"`  // files downloaded when opened
+	ListingHits    uint64            `json:"listingHits"`    // folders listed from the cache
+	ListingMisses  uint64            `json:"listingMisses"`  // folders listed by the server
+	PendingChanges int               `json:"pendingChanges"` // local changes not on the server yet
+	PendingUploads int               `json:"pendingUploads"`
+	LastDelta      time.Time         `json:"lastDelta"` // zero if changes were never fetched
+	Requests       map[string]uint64 `json:"requests"`  // by method, for the whole process
+	// how long FUSE operations took, by operation, for the whole process
+	Operations map[string]OperationLatency `json:"operations"`
+	Quota      DriveQuota                  `json:"quota"`
+	QuotaError string                      `json:"quotaError,omitempty"`
+}
+
+// cacheCounters counts what a cache has been up to. Its zero value is ready to
+// use.
+type cacheCounters struct {
+	mutex         sync.Mutex
+	contentHits   uint64
+	contentMisses uint64
+	listingHits   uint64
+	listingMisses uint64
+	lastDelta     time.Time
+}
+
+func (c *cacheCounters) content(hit bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if hit {
+		c.contentHits++
+	} else {
+		c.contentMisses++
+	}
+}
+
+func (c *cacheCounters) listing(hit bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if hit {
+		c.listingHits++
+	} else {
+		c.listingMisses++
+	}
+}
+
+func (c *cacheCounters) delta(when time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.lastDelta = when
+}
+
+// requestCounts counts requests made to the server by method. Every cache in
+// the process shares it, the same way they share connections.
+var requestCounts = struct {
+	sync.Mutex
+	byMethod map[string]uint64
+}{byMethod: make(map[string]uint64)}
+
+func countRequest(method string) {
+	requestCounts.Lock()
+	defer requestCounts.Unlock()
+	requestCounts.byMethod[method]++
+}
+
+// Stats reports how the cache has been doing since it was loaded. Quota usage
+// comes from the server if the cached figures are out of date.
+func (c *Cache) Stats() Stats {
+	c.counters.mutex.Lock()
+	stats := Stats{
+		ContentHits:   c.counters.contentHits,
+		ContentMisses: c.counters.contentMisses,
+		ListingHits:   c.counters.listingHits,
+		ListingMisses: c.counters.listingMisses,
+		LastDelta:     c.counters.lastDelta,
+		Requests:      make(map[string]uint64),
+	}
+	c.counters.mutex.Unlock()
+
+	requestCounts.Lock()
+	for method, count := range requestCounts.byMethod {
+		stats.Requests[method] = count
+	}
+	requestCounts.Unlock()
+	stats.Operations = operationLatencies()
+
+	if c.changes != nil {
+		stats.PendingChanges = len(c.PendingChanges())
+	}
+	if c.uploads != nil {
+		uploads, _ := c.uploads.transfers(time.Now())
+		stats.PendingUploads = len(uploads)
+	}
+	if drive, err := c.GetDrive(); err != nil {
+		stats.QuotaError = err.Error()
+	} else {
+		stats.Quota = drive.Quota
+	}
+	return stats
+}
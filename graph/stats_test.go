@@ -0,0 +1,43 @@
+package graph
+
+import (
+	"testing"
+	"time"
+)
+
+// Stats should add up what the cache counted along with the quota of the
+// drive.
+func TestStats(t *testing.T) {
+	t.Parallel()
+	cache := &Cache{
+		drive:     &Drive{Quota: DriveQuota{Total: 1 << 30, Used: 1 << 20}},
+		driveTime: time.Now(),
+	}
+	cache.counters.content(true)
+	cache.counters.content(true)
+	cache.counters.content(false)
+	cache.counters.listing(false)
+	polled := time.Now()
+	cache.counters.delta(polled)
+	countRequest("GET")
+
+	stats := cache.Stats()
+	if stats.ContentHits != 2 || stats.ContentMisses != 1 {
+		t.Errorf("Expected 2 content hits and 1 miss, got %d and %d.",
+			stats.ContentHits, stats.ContentMisses)
+	}
+	if stats.ListingHits != 0 || stats.ListingMisses != 1 {
+		t.Errorf("Expected 0 listing hits and 1 miss, got %d and %d.",
+			stats.ListingHits, stats.ListingMisses)
+	}
+	if !stats.LastDelta.Equal(polled) {
+		t.Errorf("Expected last delta at %s, got %s.", polled, stats.LastDelta)
+	}
+	if stats.Requests["GET"] == 0 {
+		t.Error("GET request was not counted.")
+	}
+	if stats.Quota.Used != 1<<20 || stats.QuotaError != "" {
+		t.Errorf("Quota was not taken from the cached drive: %+v %s",
+			stats.Quota, stats.QuotaError)
+	}
+}
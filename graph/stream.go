@@ -0,0 +1,359 @@
+package graph
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// how much content is requested at a time, unless chunk sizes are tuned
+	streamChunkSize uint64 = 4 * 1024 * 1024
+	// files smaller than this are downloaded in one go
+	streamThreshold = 2 * streamChunkSize
+)
+
+// how many chunks of a file are downloaded at once
+var downloadWorkers = 4
+
+// SetDownloadWorkers sets how many parts of a large file are downloaded at
+// once. 1 downloads files from start to end in a single stream. Should be
+// called before the filesystem is mounted.
+func SetDownloadWorkers(workers int) {
+	if workers < 1 {
+		workers = 1
+	}
+	downloadWorkers = workers
+}
+
+var errStreamCancelled = errors.New("stream was cancelled")
+
+// stream downloads a file's content in the background.
+type stream struct {
+	id      string
+	fetch   func(ctx context.Context, offset uint64, length uint64) ([]byte, error)
+	workers int
+	chunk   uint64 // size of each chunk
+
+	mutex    sync.Mutex
+	cond     *sync.Cond // signalled whenever a chunk arrives or the stream ends
+	held     *sync.Cond // wakes workers held while transfers are paused
+	data     *buffer
+	size     uint64 // how much content there is, as far as we know
+	have     []bool // chunks that have arrived
+	fetching []bool // chunks being fetched right now
+	want     int    // a chunk a reader is waiting on, or -1
+	next     int    // the chunk after the last one fetched
+	failed   error  // the first fetch that failed, stops the workers
+	onFail   func(content *buffer, verified uint64)
+	received uint64 // bytes that have arrived
+	meter    rateMeter
+	done     bool
+	err      error
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// newStream starts streaming size bytes of content for an item, fetching up to
+// workers chunks at once. fetch is used to download each chunk, and should give
+// up once its context is cancelled. onDone is called with the complete content
+// once everything has arrived, and takes over the buffer holding it. If onDone
+// returns an error, the stream fails with it.
+func newStream(ctx context.Context, id string, size uint64, workers int,
+	fetch func(ctx context.Context, offset uint64, length uint64) ([]byte, error),
+	onDone func(*buffer) error) *stream {
+	return resumeStream(ctx, id, size, workers, nil, fetch, onDone, nil)
+}
+
+// resumeStream is newStream for a download that already has the start of the
+// content in partial, which the stream takes over. If the stream fails,
+// onFail, if set, takes over the content and is told how much of it arrived in
+// full from the start.
+func resumeStream(ctx context.Context, id string, size uint64, workers int, partial *buffer,
+	fetch func(ctx context.Context, offset uint64, length uint64) ([]byte, error),
+	onDone func(*buffer) error, onFail func(content *buffer, verified uint64)) *stream {
+	chunk := downloadChunks.chunkSize()
+	chunks := (size + chunk - 1) / chunk
+	s := &stream{
+		id:       id,
+		fetch:    fetch,
+		workers:  workers,
+		chunk:    chunk,
+		data:     &buffer{},
+		size:     size,
+		have:     make([]bool, chunks),
+		fetching: make([]bool, chunks),
+		want:     -1,
+		onFail:   onFail,
+	}
+	if partial != nil {
+		s.data = partial
+		offset := uint64(partial.Size())
+		for n := range s.have {
+			if end := uint64(n+1) * chunk; end <= offset || (end >= size && offset >= size) {
+				s.have[n] = true
+				s.received += chunk
+			}
+		}
+		if s.received > offset {
+			s.received = offset
+		}
+	}
+	if s.workers < 1 {
+		s.workers = 1
+	}
+	if err := s.data.Truncate(int64(size)); err != nil {
+		s.failed = err
+	}
+	s.cond = sync.NewCond(&s.mutex)
+	s.held = sync.NewCond(&s.mutex)
+	s.ctx, s.cancel = context.WithCancel(ctx)
+	transfers.notify(s.held)
+	s.meter.record(s.received, time.Now())
+	go s.run(onDone)
+	return s
+}
+
+// nextChunk picks the chunk to fetch next, or returns -1 if there are none
+// left. Must be called with the mutex held.
+func (s *stream) nextChunk() int {
+	if s.wanted() {
+		return s.want
+	}
+	for n := range s.have {
+		chunk := (s.next + n) % len(s.have)
+		if !s.have[chunk] && !s.fetching[chunk] {
+			return chunk
+		}
+	}
+	return -1
+}
+
+// wanted returns whether a reader is waiting on a chunk nobody is fetching yet.
+// Must be called with the mutex held.
+func (s *stream) wanted() bool {
+	return s.want >= 0 && !s.have[s.want] && !s.fetching[s.want]
+}
+
+// run fetches chunks until the stream is complete, fails, or is cancelled.
+func (s *stream) run(onDone func(*buffer) error) {
+	var workers sync.WaitGroup
+	for n := 0; n < s.workers; n++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			s.work()
+		}()
+	}
+	workers.Wait()
+
+	s.mutex.Lock()
+	failed := s.failed
+	s.mutex.Unlock()
+	if failed == nil && s.ctx.Err() != nil {
+		failed = errStreamCancelled
+	}
+	if failed != nil {
+		s.finish(failed)
+		if s.onFail != nil {
+			s.onFail(s.data, s.verified())
+		} else {
+			s.data.Close()
+		}
+		return
+	}
+	if err := s.data.Truncate(int64(s.size)); err != nil {
+		s.finish(err)
+		s.data.Close()
+		return
+	}
+	// hand over the content before anyone waiting for completion returns
+	s.finish(onDone(s.data))
+}
+
+// work fetches chunks one after the other until there are none left to fetch.
+func (s *stream) work() {
+	for {
+		s.mutex.Lock()
+		for transfers.holds(true) && s.failed == nil && s.ctx.Err() == nil && !s.wanted() {
+			s.held.Wait()
+		}
+		chunk := -1
+		if s.failed == nil && s.ctx.Err() == nil {
+			chunk = s.nextChunk()
+		}
+		if chunk < 0 {
+			s.mutex.Unlock()
+			return
+		}
+		s.fetching[chunk] = true
+		s.next = chunk + 1
+		offset := uint64(chunk) * s.chunk
+		length := s.chunk
+		if size := s.size; offset >= size {
+			// the file turned out to be shorter than expected
+			length = 0
+		} else if offset+length > size {
+			length = size - offset
+		}
+		s.mutex.Unlock()
+
+		var content []byte
+		var err error
+		if length > 0 {
+			started := time.Now()
+			content, err = s.fetch(s.ctx, offset, length)
+			if err == nil {
+				downloadChunks.success(uint64(len(content)), time.Since(started))
+			} else if s.ctx.Err() == nil {
+				downloadChunks.failure()
+			}
+		}
+
+		s.mutex.Lock()
+		s.fetching[chunk] = false
+		if err != nil {
+			log.WithFields(log.Fields{
+				"id":     s.id,
+				"offset": offset,
+				"err":    err,
+			}).Error("Failed to stream content.")
+			if s.failed == nil {
+				s.failed = err
+			}
+			s.held.Broadcast()
+			s.mutex.Unlock()
+			s.cond.Broadcast()
+			return
+		}
+		if uint64(len(content)) > length {
+			// the server ignored the range and sent everything
+			offset, length = 0, uint64(len(content))
+			s.size = length
+			for n := range s.have {
+				s.have[n] = true
+			}
+		}
+		if offset < s.size {
+			if _, err = s.data.WriteAt(content, int64(offset)); err != nil && s.failed == nil {
+				s.failed = err
+			}
+		}
+		s.have[chunk] = true
+		s.received += uint64(len(content))
+		s.meter.record(s.received, time.Now())
+		if uint64(len(content)) < length && offset+uint64(len(content)) < s.size {
+			// the file is shorter than the server said it was (it happens)
+			s.size = offset + uint64(len(content))
+			for n := chunk + 1; n < len(s.have); n++ {
+				s.have[n] = true
+			}
+		}
+		s.mutex.Unlock()
+		s.cond.Broadcast()
+	}
+}
+
+// verified returns how much of the content has arrived in full, counting from
+// the start.
+func (s *stream) verified() uint64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var verified uint64
+	for _, have := range s.have {
+		if !have {
+			break
+		}
+		verified += s.chunk
+	}
+	if verified > s.size {
+		verified = s.size
+	}
+	return verified
+}
+
+// progress returns how much content has arrived, out of how much, and how fast
+// it is arriving.
+func (s *stream) progress(now time.Time) (uint64, uint64, uint64) {
+	s.mutex.Lock()
+	done, total := s.received, s.size
+	s.mutex.Unlock()
+	if done > total {
+		done = total
+	}
+	return done, total, s.meter.rate(now)
+}
+
+// finish ends the stream, waking up anyone waiting on it.
+func (s *stream) finish(err error) {
+	s.mutex.Lock()
+	s.done = true
+	s.err = err
+	s.mutex.Unlock()
+	s.cond.Broadcast()
+	s.cancel()
+	transfers.forget(s.held)
+}
+
+// ReadAt reads content at an offset, blocking until the chunks needed have
+// arrived. Returns fewer bytes than asked for at the end of the file.
+func (s *stream) ReadAt(buf []byte, off int64) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for {
+		if s.done && s.err != nil {
+			// whatever arrived can't be trusted
+			return 0, s.err
+		}
+		size := int64(s.size)
+		if off >= size {
+			return 0, nil
+		}
+		end := off + int64(len(buf))
+		if end > size {
+			end = size
+		}
+		missing := -1
+		for chunk := off / int64(s.chunk); chunk*int64(s.chunk) < end; chunk++ {
+			if !s.have[chunk] {
+				missing = int(chunk)
+				break
+			}
+		}
+		if missing < 0 {
+			return s.data.ReadAt(buf[:end-off], off)
+		}
+		if s.done {
+			return 0, s.err
+		}
+		if s.failed != nil {
+			return 0, s.failed
+		}
+		s.want = missing
+		s.held.Signal()
+		s.cond.Wait()
+	}
+}
+
+// Wait blocks until the stream has finished.
+func (s *stream) Wait() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for !s.done {
+		s.cond.Wait()
+	}
+	return s.err
+}
+
+// Cancel stops the stream. Readers waiting on it are woken up.
+func (s *stream) Cancel() {
+	s.cancel()
+	s.mutex.Lock()
+	s.cond.Broadcast()
+	s.held.Broadcast()
+	s.mutex.Unlock()
+}
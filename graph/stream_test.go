@@ -0,0 +1,305 @@
+package graph
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeContent serves ranges of content like GetItemContentRange, recording
+// which offsets were requested.
+type fakeContent struct {
+	content []byte
+	mutex   sync.Mutex
+	fetched []uint64
+	gate    chan struct{} // if set, each fetch waits for a value
+}
+
+func (f *fakeContent) fetch(ctx context.Context, offset uint64, length uint64) ([]byte, error) {
+	if f.gate != nil {
+		<-f.gate
+	}
+	f.mutex.Lock()
+	f.fetched = append(f.fetched, offset)
+	f.mutex.Unlock()
+	if offset >= uint64(len(f.content)) {
+		return []byte{}, nil
+	}
+	end := offset + length
+	if end > uint64(len(f.content)) {
+		end = uint64(len(f.content))
+	}
+	return f.content[offset:end], nil
+}
+
+// bufferBytes returns the content of a buffer, and frees it.
+func bufferBytes(t *testing.T, b *buffer) []byte {
+	content, err := b.Bytes()
+	failOnErr(t, err)
+	b.Close()
+	return content
+}
+
+func streamContent(size uint64) []byte {
+	content := make([]byte, size)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	return content
+}
+
+// Reads must return the right content, and the complete content must be handed
+// over once everything has arrived.
+func TestStreamReadAt(t *testing.T) {
+	t.Parallel()
+	fake := &fakeContent{content: streamContent(3*streamChunkSize + 1234)}
+	done := make(chan *buffer, 1)
+	s := newStream(context.Background(), "stream", uint64(len(fake.content)), 4, fake.fetch,
+		func(content *buffer) error { done <- content; return nil })
+
+	buf := make([]byte, 4096)
+	off := int64(2*streamChunkSize - 100) // spans two chunks
+	n, err := s.ReadAt(buf, off)
+	failOnErr(t, err)
+	if n != len(buf) || !bytes.Equal(buf, fake.content[off:off+int64(n)]) {
+		t.Fatalf("Read returned wrong content (%d bytes).", n)
+	}
+
+	// reads at the end are cut short
+	n, err = s.ReadAt(buf, int64(len(fake.content))-10)
+	failOnErr(t, err)
+	if n != 10 {
+		t.Fatalf("Expected a short read of 10 bytes, got %d.", n)
+	}
+
+	failOnErr(t, s.Wait())
+	if content := bufferBytes(t, <-done); !bytes.Equal(content, fake.content) {
+		t.Fatal("Completed content does not match.")
+	}
+}
+
+// A read far ahead of the download should have its chunk fetched next.
+func TestStreamSeek(t *testing.T) {
+	t.Parallel()
+	fake := &fakeContent{
+		content: streamContent(8 * streamChunkSize),
+		gate:    make(chan struct{}),
+	}
+	s := newStream(context.Background(), "seek", uint64(len(fake.content)), 1, fake.fetch,
+		func(*buffer) error { return nil })
+	defer s.Cancel()
+
+	read := make(chan error)
+	go func() {
+		_, err := s.ReadAt(make([]byte, 10), int64(6*streamChunkSize))
+		read <- err
+	}()
+	// wait for the reader to ask for its chunk before letting fetches through
+	for {
+		s.mutex.Lock()
+		want := s.want
+		s.mutex.Unlock()
+		if want >= 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for {
+		select {
+		case err := <-read:
+			failOnErr(t, err)
+			fake.mutex.Lock()
+			defer fake.mutex.Unlock()
+			// only the chunk that was already being fetched can come first
+			for n, offset := range fake.fetched {
+				if offset == 6*streamChunkSize {
+					if n > 1 {
+						t.Fatalf("Seeking did not skip ahead, fetched %v", fake.fetched)
+					}
+					return
+				}
+			}
+			t.Fatal("Chunk that was read was never fetched.")
+		case fake.gate <- struct{}{}:
+		}
+	}
+}
+
+// A failed fetch should fail reads instead of blocking them forever.
+func TestStreamError(t *testing.T) {
+	t.Parallel()
+	failure := errors.New("network down")
+	s := newStream(context.Background(), "error", 3*streamChunkSize, 2,
+		func(context.Context, uint64, uint64) ([]byte, error) { return nil, failure },
+		func(*buffer) error {
+			t.Error("A failed stream should never complete.")
+			return nil
+		})
+	if _, err := s.ReadAt(make([]byte, 10), 0); err != failure {
+		t.Fatalf("Expected the fetch error, got %v", err)
+	}
+	if err := s.Wait(); err != failure {
+		t.Fatalf("Expected the fetch error, got %v", err)
+	}
+}
+
+// Content that turns out shorter than expected should end the file early.
+func TestStreamShort(t *testing.T) {
+	t.Parallel()
+	fake := &fakeContent{content: streamContent(streamChunkSize + 10)}
+	done := make(chan *buffer, 1)
+	s := newStream(context.Background(), "short", 3*streamChunkSize, 2, fake.fetch,
+		func(content *buffer) error { done <- content; return nil })
+	failOnErr(t, s.Wait())
+	if content := bufferBytes(t, <-done); len(content) != len(fake.content) {
+		t.Fatalf("Expected %d bytes, got %d", len(fake.content), len(content))
+	}
+}
+
+// Several chunks should be fetched at once when there are several workers.
+func TestStreamParallel(t *testing.T) {
+	t.Parallel()
+	fake := &fakeContent{content: streamContent(8 * streamChunkSize)}
+	var mutex sync.Mutex
+	inFlight, maxInFlight := 0, 0
+	fetch := func(ctx context.Context, offset uint64, length uint64) ([]byte, error) {
+		mutex.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mutex.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mutex.Lock()
+		inFlight--
+		mutex.Unlock()
+		return fake.fetch(ctx, offset, length)
+	}
+	done := make(chan *buffer, 1)
+	s := newStream(context.Background(), "parallel", uint64(len(fake.content)), 4, fetch,
+		func(content *buffer) error { done <- content; return nil })
+	failOnErr(t, s.Wait())
+	if content := bufferBytes(t, <-done); !bytes.Equal(content, fake.content) {
+		t.Fatal("Completed content does not match.")
+	}
+	if maxInFlight != 4 {
+		t.Fatalf("Expected 4 chunks to be fetched at once, got %d", maxInFlight)
+	}
+}
+
+// A server that ignores range requests and sends the whole file should have its
+// content used as is, instead of fetching it over and over.
+func TestStreamRangeUnsupported(t *testing.T) {
+	t.Parallel()
+	content := streamContent(3*streamChunkSize + 10)
+	var mutex sync.Mutex
+	fetches := 0
+	fetch := func(context.Context, uint64, uint64) ([]byte, error) {
+		mutex.Lock()
+		fetches++
+		mutex.Unlock()
+		return content, nil
+	}
+	done := make(chan *buffer, 1)
+	s := newStream(context.Background(), "norange", uint64(len(content)), 1, fetch,
+		func(content *buffer) error { done <- content; return nil })
+	failOnErr(t, s.Wait())
+	if result := bufferBytes(t, <-done); !bytes.Equal(result, content) {
+		t.Fatal("Completed content does not match.")
+	}
+	if fetches != 1 {
+		t.Fatalf("Content was fetched %d times.", fetches)
+	}
+}
+
+// Content rejected once it has all arrived should fail the stream.
+func TestStreamRejected(t *testing.T) {
+	t.Parallel()
+	fake := &fakeContent{content: streamContent(streamChunkSize + 10)}
+	rejected := errors.New("corrupt")
+	s := newStream(context.Background(), "rejected", uint64(len(fake.content)), 2, fake.fetch,
+		func(*buffer) error { return rejected })
+	if err := s.Wait(); err != rejected {
+		t.Fatalf("Expected the stream to fail, got %v", err)
+	}
+	if _, err := s.ReadAt(make([]byte, 10), 0); err != rejected {
+		t.Fatalf("Rejected content could still be read: %v", err)
+	}
+}
+
+// Cancelling a stream should cancel the requests fetching its content.
+func TestStreamCancelFetch(t *testing.T) {
+	t.Parallel()
+	started := make(chan struct{}, 1)
+	stopped := make(chan struct{}, 1)
+	s := newStream(context.Background(), "cancel", 2*streamChunkSize, 1,
+		func(ctx context.Context, offset uint64, length uint64) ([]byte, error) {
+			started <- struct{}{}
+			<-ctx.Done()
+			stopped <- struct{}{}
+			return nil, ctx.Err()
+		},
+		func(*buffer) error {
+			t.Error("A cancelled stream should never complete.")
+			return nil
+		},
+	)
+	<-started
+	s.Cancel()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Fetch was not cancelled along with the stream.")
+	}
+}
+
+// A resumed stream should only fetch what is missing from its partial content,
+// and a failed one should report how much arrived from the start.
+func TestStreamResume(t *testing.T) {
+	t.Parallel()
+	fake := &fakeContent{content: streamContent(4*streamChunkSize + 10)}
+	failure := errors.New("network down")
+	kept := make(chan uint64, 1)
+	s := resumeStream(context.Background(), "interrupted", uint64(len(fake.content)), 1, nil,
+		func(ctx context.Context, offset uint64, length uint64) ([]byte, error) {
+			if offset >= 2*streamChunkSize {
+				return nil, failure
+			}
+			return fake.fetch(ctx, offset, length)
+		},
+		func(*buffer) error {
+			t.Error("A failed stream should never complete.")
+			return nil
+		},
+		func(content *buffer, verified uint64) {
+			failOnErr(t, content.Truncate(int64(verified)))
+			kept <- verified
+			content.Close()
+		},
+	)
+	if err := s.Wait(); err != failure {
+		t.Fatalf("Expected the fetch error, got %v", err)
+	}
+	if verified := <-kept; verified != 2*streamChunkSize {
+		t.Fatalf("Expected %d bytes to be kept, got %d.", 2*streamChunkSize, verified)
+	}
+
+	partial, err := bufferOf(fake.content[:2*streamChunkSize])
+	failOnErr(t, err)
+	resumed := &fakeContent{content: fake.content}
+	done := make(chan *buffer, 1)
+	s = resumeStream(context.Background(), "resumed", uint64(len(fake.content)), 2, partial,
+		resumed.fetch, func(content *buffer) error { done <- content; return nil }, nil)
+	failOnErr(t, s.Wait())
+	if content := bufferBytes(t, <-done); !bytes.Equal(content, fake.content) {
+		t.Fatal("Resumed content does not match.")
+	}
+	for _, offset := range resumed.fetched {
+		if offset < 2*streamChunkSize {
+			t.Fatalf("Content at %d was fetched again.", offset)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package graph
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Subscriptions for drive items can last at most a little under 3 days, we
+// renew well before then.
+const (
+	subscriptionLifetime = 48 * time.Hour
+	subscriptionRenewal  = 24 * time.Hour
+)
+
+// Subscription is a Graph change notification subscription
+// https://docs.microsoft.com/en-us/graph/api/resources/subscription
+type Subscription struct {
+	ID                 string    `json:"id,omitempty"`
+	ChangeType         string    `json:"changeType,omitempty"`
+	NotificationURL    string    `json:"notificationUrl,omitempty"`
+	Resource           string    `json:"resource,omitempty"`
+	ExpirationDateTime time.Time `json:"expirationDateTime,omitempty"`
+	ClientState        string    `json:"clientState,omitempty"`
+}
+
+// notification is the payload posted to our listener by the Graph API
+type notification struct {
+	Value []struct {
+		SubscriptionID string `json:"subscriptionId"`
+		ClientState    string `json:"clientState"`
+	} `json:"value"`
+}
+
+// TriggerDeltas wakes up the delta loop so that it polls for changes
+// immediately instead of waiting for the next polling interval. Triggers that
+// arrive while a poll is already pending are coalesced.
+func (c *Cache) TriggerDeltas() {
+	select {
+	case c.deltaTrigger <- struct{}{}:
+	default:
+	}
+}
+
+// waitForDeltas blocks until either the polling interval has passed, an
+// immediate poll has been requested with TriggerDeltas, or the cache is shutting
+// down.
+func (c *Cache) waitForDeltas(interval time.Duration) {
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-c.deltaTrigger:
+		log.Debug("Delta poll triggered by change notification.")
+	case <-c.ctx.Done():
+	}
+}
+
+// createSubscription registers a change notification subscription with the
+// Graph API. The Graph API will validate notificationURL before returning, so
+// the listener must already be up. resource is the item to watch for changes.
+func createSubscription(notificationURL string, clientState string, resource string, auth *Auth) (*Subscription, error) {
+	payload, _ := json.Marshal(Subscription{
+		ChangeType:         "updated",
+		NotificationURL:    notificationURL,
+		Resource:           resource,
+		ExpirationDateTime: time.Now().Add(subscriptionLifetime).UTC(),
+		ClientState:        clientState,
+	})
+	resp, err := Post("/subscriptions", auth, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	subscription := &Subscription{}
+	return subscription, json.Unmarshal(resp, subscription)
+}
+
+// renewSubscription pushes back the expiration of an existing subscription.
+func renewSubscription(id string, auth *Auth) error {
+	payload, _ := json.Marshal(Subscription{
+		ExpirationDateTime: time.Now().Add(subscriptionLifetime).UTC(),
+	})
+	_, err := Patch("/subscriptions/"+id, auth, bytes.NewReader(payload))
+	return err
+}
+
+// notificationHandler responds to Graph change notifications by triggering a
+// delta poll. It also answers the validation handshake performed when a
+// subscription is created.
+func (c *Cache) notificationHandler(clientState string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if token := r.URL.Query().Get("validationToken"); token != "" {
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte(token))
+			return
+		}
+
+		body, _ := ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		var payload notification
+		if err := json.Unmarshal(body, &payload); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		// Graph wants a response within a few seconds, do the real work later
+		w.WriteHeader(http.StatusAccepted)
+		for _, n := range payload.Value {
+			if n.ClientState != clientState {
+				log.WithField("subscription", n.SubscriptionID).Warn(
+					"Ignoring change notification with an invalid client state.")
+				continue
+			}
+			c.TriggerDeltas()
+			return
+		}
+	}
+}
+
+// StartNotifications listens on listenAddr for Graph change notifications and
+// subscribes to changes on the drive, so server-side changes are picked up as
+// soon as they happen rather than on the next poll. notificationURL is the
+// publicly reachable HTTPS URL that forwards to listenAddr. Regular polling
+// continues as a fallback in case notifications are missed.
+func (c *Cache) StartNotifications(listenAddr string, notificationURL string) error {
+	clientState := randString(32)
+	server := &http.Server{
+		Addr:    listenAddr,
+		Handler: c.notificationHandler(clientState),
+	}
+	listenErr := make(chan error, 1)
+	go func() {
+		listenErr <- server.ListenAndServe()
+	}()
+
+	// give the listener a moment to come up (or fail) before Graph validates it
+	select {
+	case err := <-listenErr:
+		return err
+	case <-time.After(time.Second):
+	}
+
+	subscription, err := createSubscription(notificationURL, clientState, c.source.resource()+"/root", c.GetAuth())
+	if err != nil {
+		server.Close()
+		return err
+	}
+	log.WithFields(log.Fields{
+		"id":      subscription.ID,
+		"expires": subscription.ExpirationDateTime,
+	}).Info("Subscribed to change notifications.")
+
+	c.start(func() {
+		defer c.workers.Done()
+		ticker := time.NewTicker(subscriptionRenewal)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.ctx.Done():
+				// be polite and tell the server to stop sending notifications
+				Delete("/subscriptions/"+subscription.ID, c.GetAuth())
+				server.Close()
+				return
+			case <-ticker.C:
+			}
+
+			err := renewSubscription(subscription.ID, c.GetAuth())
+			if err == nil {
+				continue
+			}
+			log.WithField("err", err).Warn(
+				"Could not renew change notification subscription, resubscribing.")
+			if fresh, err := createSubscription(notificationURL, clientState, c.source.resource()+"/root", c.GetAuth()); err == nil {
+				subscription = fresh
+			} else {
+				log.WithField("err", err).Error("Could not resubscribe to change " +
+					"notifications, falling back to polling only.")
+			}
+		}
+	})
+	return nil
+}
@@ -0,0 +1,36 @@
+package graph
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// The notification listener must echo back validation tokens, and only trigger
+// a delta poll for notifications with the correct client state.
+func TestNotificationHandler(t *testing.T) {
+	t.Parallel()
+	cache := &Cache{deltaTrigger: make(chan struct{}, 1)}
+	handler := cache.notificationHandler("secret")
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("POST", "/?validationToken=abc123", nil))
+	if w.Body.String() != "abc123" {
+		t.Fatalf("Validation token was not echoed back, got \"%s\".", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest("POST", "/",
+		strings.NewReader(`{"value":[{"subscriptionId":"a","clientState":"wrong"}]}`)))
+	if len(cache.deltaTrigger) != 0 {
+		t.Fatal("Notification with invalid client state triggered a poll.")
+	}
+
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest("POST", "/",
+		strings.NewReader(`{"value":[{"subscriptionId":"a","clientState":"secret"}]}`)))
+	if w.Code != http.StatusAccepted || len(cache.deltaTrigger) != 1 {
+		t.Fatal("Valid notification did not trigger a poll.")
+	}
+}
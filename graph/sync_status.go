@@ -0,0 +1,140 @@
+package graph
+
+import "strings"
+
+// SyncStatus is how far the local changes to a file or folder have gotten on
+// their way to the server.
+type SyncStatus string
+
+// sync statuses of files and folders, from best to worst
+const (
+	StatusSynced     SyncStatus = "synced"
+	StatusPending    SyncStatus = "pending"
+	StatusSyncing    SyncStatus = "syncing"
+	StatusConflicted SyncStatus = "conflicted"
+	StatusError      SyncStatus = "error"
+)
+
+// statuses only the filesystem as a whole can be in, see SyncState
+const (
+	StatusPaused  SyncStatus = "paused"
+	StatusOffline SyncStatus = "offline"
+)
+
+var statusRanks = map[SyncStatus]int{
+	StatusSynced:     0,
+	StatusPending:    1,
+	StatusSyncing:    2,
+	StatusConflicted: 3,
+	StatusError:      4,
+}
+
+// worse returns whether s is further from being synced than other.
+func (s SyncStatus) worse(other SyncStatus) bool {
+	return statusRanks[s] > statusRanks[other]
+}
+
+// statusOf returns the status a pending change in state leaves its item in.
+func statusOf(state ChangeState) SyncStatus {
+	switch state {
+	case StateInFlight:
+		return StatusSyncing
+	case StateFailed:
+		return StatusError
+	case StateConflicted:
+		return StatusConflicted
+	default:
+		return StatusPending
+	}
+}
+
+// status returns the sync status of the item at path, and the error its
+// changes last failed with, if they did. A folder is as far behind as the
+// worst of the items in it.
+func (t *changeTracker) status(path string) (SyncStatus, string) {
+	status, message := StatusSynced, ""
+	if t == nil {
+		return status, message
+	}
+	path = strings.ToLower(path)
+	prefix := strings.TrimSuffix(path, "/") + "/"
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	for _, change := range t.changes {
+		changed := strings.ToLower(change.Path)
+		if changed != path && !strings.HasPrefix(changed, prefix) {
+			continue
+		}
+		if s := statusOf(change.State); s.worse(status) {
+			status, message = s, change.Error
+		}
+	}
+	return status, message
+}
+
+// SyncStatus returns the sync status of the file or folder at path, relative
+// to the root of the filesystem, and the error its changes last failed with.
+// Only local changes are taken into account: anything without any is synced.
+func (c *Cache) SyncStatus(path string) (SyncStatus, string) {
+	return c.changes.status(path)
+}
+
+// itemSyncStatus returns the sync status of an item, like SyncStatus. Files
+// whose changes are not tracked under their path, like conflicts left from
+// before a restart, are looked up among the conflicts and in the upload queue.
+func (c *Cache) itemSyncStatus(inode *Inode) (SyncStatus, string) {
+	status, message := c.changes.status(inode.Path())
+	if status != StatusSynced || inode.IsDir() {
+		return status, message
+	}
+	id := inode.ID()
+	if c.db != nil && c.IsConflicted(id) {
+		return StatusConflicted, ""
+	}
+	if c.uploads != nil && c.uploads.HasPending(id) {
+		return StatusPending, ""
+	}
+	return StatusSynced, ""
+}
+
+// SyncState returns the status of the filesystem as a whole: paused or
+// offline if it is, otherwise the worst status of any of its files.
+func (c *Cache) SyncState() SyncStatus {
+	if c.IsPaused() {
+		return StatusPaused
+	}
+	if c.IsOffline() {
+		return StatusOffline
+	}
+	status, _ := c.changes.status("/")
+	return status
+}
+
+// SyncStatusHook is called with the path of a file or folder, relative to the
+// root of the filesystem, whenever its sync status may have changed.
+type SyncStatusHook func(path string, status SyncStatus)
+
+// OnSyncStatus registers a hook to be called when the sync status of a file
+// changes. Folders are not reported when the status of what is in them
+// changes. Hooks are called synchronously from whatever is syncing the file,
+// so they should return quickly.
+func (c *Cache) OnSyncStatus(hook SyncStatusHook) {
+	c.Lock()
+	c.syncHooks = append(c.syncHooks, hook)
+	c.Unlock()
+}
+
+// fireSyncStatus notifies all registered hooks that the changes to the item at
+// path moved on.
+func (c *Cache) fireSyncStatus(path string) {
+	c.RLock()
+	hooks := c.syncHooks
+	c.RUnlock()
+	if len(hooks) == 0 {
+		return
+	}
+	status, _ := c.changes.status(path)
+	for _, hook := range hooks {
+		hook(path, status)
+	}
+}
@@ -0,0 +1,99 @@
+package graph
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "github.com/etcd-io/bbolt"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// Folders should report the worst status of what is in them, and files the
+// status of their own changes.
+func TestSyncStatus(t *testing.T) {
+	t.Parallel()
+	tracker := newChangeTracker()
+	var notified []string
+	tracker.listener = func(path string) { notified = append(notified, path) }
+
+	tracker.track("a", "/Folder/a.txt", OpWrite, StateQueued)
+	tracker.track("b", "/Folder/Sub/b.txt", OpCreate, StateInFlight)
+	if status, _ := tracker.status("/folder"); status != StatusSyncing {
+		t.Fatalf("Folder was %s, expected %s.", status, StatusSyncing)
+	}
+	if status, _ := tracker.status("/Folder/a.txt"); status != StatusPending {
+		t.Fatalf("File was %s, expected %s.", status, StatusPending)
+	}
+	if status, _ := tracker.status("/Folder/Su"); status != StatusSynced {
+		t.Fatalf("Unrelated folder was %s, expected %s.", status, StatusSynced)
+	}
+
+	tracker.setState("a", "", StateFailed, errors.New("quota exceeded"))
+	if status, message := tracker.status("/"); status != StatusError || message != "quota exceeded" {
+		t.Fatalf("Root was %s (%s), expected %s.", status, message, StatusError)
+	}
+
+	tracker.done("a", "")
+	tracker.done("b", "")
+	if status, _ := tracker.status("/"); status != StatusSynced {
+		t.Fatalf("Root was %s once everything was done, expected %s.", status, StatusSynced)
+	}
+	expected := []string{"/Folder/a.txt", "/Folder/Sub/b.txt", "/Folder/a.txt",
+		"/Folder/a.txt", "/Folder/Sub/b.txt"}
+	if len(notified) != len(expected) {
+		t.Fatalf("Listener was called for %v, expected %v.", notified, expected)
+	}
+	for i := range expected {
+		if notified[i] != expected[i] {
+			t.Fatalf("Listener was called for %v, expected %v.", notified, expected)
+		}
+	}
+}
+
+// The sync status of a file, and why its changes failed, should be readable as
+// extended attributes.
+func TestSyncStatusXattr(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "onedriver-sync-status-")
+	failOnErr(t, err)
+	defer os.RemoveAll(dir)
+	db, err := bolt.Open(filepath.Join(dir, "status.db"), 0600,
+		&bolt.Options{Timeout: time.Second * 5})
+	failOnErr(t, err)
+	defer db.Close()
+	cache := &Cache{
+		db:       db,
+		metadata: newShardedMap(),
+		changes:  newChangeTracker(),
+	}
+	root := NewInode("root", 0755|fuse.S_IFDIR, nil)
+	cache.InsertID(root.ID(), root)
+	file := NewInode("file.txt", 0644|fuse.S_IFREG, root)
+	cache.InsertChild(root.ID(), file)
+
+	getxattr := func(attr string) string {
+		value := make([]byte, 64)
+		size, errno := file.Getxattr(context.Background(), attr, value)
+		if errno != 0 {
+			return ""
+		}
+		return string(value[:size])
+	}
+	if status := getxattr(syncStatusXattr); status != string(StatusSynced) {
+		t.Fatalf("Untouched file was %q, expected %q.", status, StatusSynced)
+	}
+
+	cache.changes.track(file.ID(), file.Path(), OpWrite, StateInFlight)
+	cache.changes.setState(file.ID(), OpWrite, StateFailed, errors.New("nameInvalid"))
+	if status := getxattr(syncStatusXattr); status != string(StatusError) {
+		t.Fatalf("File that failed to upload was %q, expected %q.", status, StatusError)
+	}
+	if message := getxattr(syncErrorXattr); message != "nameInvalid" {
+		t.Fatalf("Unexpected sync error %q.", message)
+	}
+}
@@ -0,0 +1,85 @@
+package graph
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Every request to the server carries a client-request-id, and the server
+// answers with a request-id of its own. Microsoft support needs both to find a
+// request in their logs. With tracing on, every request is logged along with
+// them, how long it took and which attempt it was, so throttling and server
+// errors can be followed up on.
+var tracing int32
+
+// SetRequestTracing turns the logging of every request to the server on or off.
+// It can be changed at any time.
+func SetRequestTracing(enabled bool) {
+	value := int32(0)
+	if enabled {
+		value = 1
+	}
+	atomic.StoreInt32(&tracing, value)
+}
+
+// RequestTracing returns whether requests to the server are being logged.
+func RequestTracing() bool {
+	return atomic.LoadInt32(&tracing) == 1
+}
+
+// requestTrace identifies an attempt at a request, for tracing.
+type requestTrace struct {
+	clientRequestID string
+	attempt         int // starting at 1
+}
+
+// newClientRequestID returns a random ID in the GUID format the server expects
+// for client-request-id.
+func newClientRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40 // version 4
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// setHeaders asks the server to tag its side of the request with our ID.
+func (t requestTrace) setHeaders(request *http.Request) {
+	request.Header.Set("client-request-id", t.clientRequestID)
+	request.Header.Set("return-client-request-id", "true")
+}
+
+// log logs an attempt at a request that took dt, if tracing is on. response is
+// nil if the request failed before the server answered.
+func (t requestTrace) log(method string, resource string, response *http.Response, err error,
+	dt time.Duration) {
+	if !RequestTracing() {
+		return
+	}
+	fields := log.Fields{
+		"method":          method,
+		"resource":        resource,
+		"clientRequestId": t.clientRequestID,
+		"attempt":         t.attempt,
+		"latency":         dt.Round(time.Millisecond),
+	}
+	if response != nil {
+		fields["status"] = response.StatusCode
+		fields["requestId"] = response.Header.Get("request-id")
+		if diagnostic := response.Header.Get("x-ms-ags-diagnostic"); diagnostic != "" {
+			fields["diagnostic"] = diagnostic
+		}
+		if retryAfter := response.Header.Get("Retry-After"); retryAfter != "" {
+			fields["retryAfter"] = retryAfter
+		}
+	}
+	if err != nil {
+		fields["err"] = err
+	}
+	log.WithFields(fields).Info("Graph request.")
+}
@@ -0,0 +1,20 @@
+package graph
+
+import (
+	"regexp"
+	"testing"
+)
+
+// Client request IDs must look like the GUIDs the server expects, and be
+// different for every request.
+func TestNewClientRequestID(t *testing.T) {
+	t.Parallel()
+	guid := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	first, second := newClientRequestID(), newClientRequestID()
+	if !guid.MatchString(first) {
+		t.Fatalf("%s is not a GUID.", first)
+	}
+	if first == second {
+		t.Fatal("Client request IDs were not unique.")
+	}
+}
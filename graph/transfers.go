@@ -0,0 +1,148 @@
+package graph
+
+import (
+	"context"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// transfers holds content transfers while they are paused, and large ones while
+// the connection is metered
+var transfers = &transferGate{}
+
+// PauseTransfers holds all uploads and downloads of file content until
+// ResumeTransfers is called.
+func PauseTransfers() {
+	transfers.setPaused(true)
+	log.Info("Transfers paused.")
+}
+
+// ResumeTransfers continues transfers held by PauseTransfers.
+func ResumeTransfers() {
+	transfers.setPaused(false)
+	log.Info("Transfers resumed.")
+}
+
+// TransfersPaused returns whether transfers are currently paused.
+func TransfersPaused() bool {
+	return transfers.isPaused()
+}
+
+// TransfersMetered returns whether large transfers are held because the
+// connection is metered.
+func TransfersMetered() bool {
+	return transfers.isMetered()
+}
+
+// transferGate holds transfers while they are paused.
+type transferGate struct {
+	mutex   sync.Mutex
+	paused  bool
+	metered bool                    // large transfers are held
+	opened  chan struct{}           // closed when transfers are let through again
+	conds   map[*sync.Cond]struct{} // woken up when transfers are let through again
+}
+
+func (g *transferGate) setPaused(paused bool) {
+	g.mutex.Lock()
+	if paused == g.paused {
+		g.mutex.Unlock()
+		return
+	}
+	g.paused = paused
+	g.changed()
+}
+
+// setMetered holds large transfers while on a metered connection.
+func (g *transferGate) setMetered(metered bool) {
+	g.mutex.Lock()
+	if metered == g.metered {
+		g.mutex.Unlock()
+		return
+	}
+	g.metered = metered
+	g.changed()
+}
+
+// changed wakes up everything waiting on the gate to check whether it may go
+// now. Must be called with the mutex held, and unlocks it.
+func (g *transferGate) changed() {
+	opened := g.opened
+	g.opened = make(chan struct{})
+	if opened != nil {
+		close(opened)
+	}
+	conds := make([]*sync.Cond, 0, len(g.conds))
+	for cond := range g.conds {
+		conds = append(conds, cond)
+	}
+	g.mutex.Unlock()
+
+	for _, cond := range conds {
+		// holding the lock means nobody can miss the wake up between
+		// checking whether we are paused and waiting
+		cond.L.Lock()
+		cond.Broadcast()
+		cond.L.Unlock()
+	}
+}
+
+func (g *transferGate) isPaused() bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.paused
+}
+
+func (g *transferGate) isMetered() bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.metered
+}
+
+// holds returns whether a transfer has to wait right now. large is whether it
+// is made in chunks.
+func (g *transferGate) holds(large bool) bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.paused || (large && g.metered)
+}
+
+// wait blocks while a transfer is held, or until ctx is cancelled.
+func (g *transferGate) wait(ctx context.Context, large bool) error {
+	for {
+		g.mutex.Lock()
+		if !g.paused && !(large && g.metered) {
+			g.mutex.Unlock()
+			return nil
+		}
+		if g.opened == nil {
+			g.opened = make(chan struct{})
+		}
+		opened := g.opened
+		g.mutex.Unlock()
+		select {
+		case <-opened:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// notify registers a condition to be broadcast when transfers are resumed, for
+// code that waits on a condition rather than calling wait.
+func (g *transferGate) notify(cond *sync.Cond) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.conds == nil {
+		g.conds = make(map[*sync.Cond]struct{})
+	}
+	g.conds[cond] = struct{}{}
+}
+
+// forget stops broadcasting a condition registered with notify.
+func (g *transferGate) forget(cond *sync.Cond) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	delete(g.conds, cond)
+}
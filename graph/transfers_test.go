@@ -0,0 +1,90 @@
+package graph
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// Paused transfers should wait until resumed, or until they are cancelled.
+func TestTransferGate(t *testing.T) {
+	t.Parallel()
+	gate := &transferGate{}
+	failOnErr(t, gate.wait(context.Background(), false))
+
+	gate.setPaused(true)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := gate.wait(ctx, false); err == nil {
+		t.Fatal("A cancelled transfer was not released.")
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- gate.wait(context.Background(), false)
+	}()
+	select {
+	case <-done:
+		t.Fatal("A transfer was not held while paused.")
+	case <-time.After(50 * time.Millisecond):
+	}
+	gate.setPaused(false)
+	select {
+	case err := <-done:
+		failOnErr(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("A transfer was not released when resumed.")
+	}
+
+	gate.setMetered(true)
+	failOnErr(t, gate.wait(context.Background(), false))
+	go func() {
+		done <- gate.wait(context.Background(), true)
+	}()
+	select {
+	case <-done:
+		t.Fatal("A large transfer was not held on a metered connection.")
+	case <-time.After(50 * time.Millisecond):
+	}
+	gate.setMetered(false)
+	select {
+	case err := <-done:
+		failOnErr(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("A large transfer was not released once off the metered connection.")
+	}
+}
+
+// While transfers are paused, streams should only fetch what a reader is
+// waiting on, and continue with the rest once resumed. Not parallel, since it
+// pauses every transfer.
+func TestStreamPaused(t *testing.T) {
+	PauseTransfers()
+	defer ResumeTransfers()
+
+	fake := &fakeContent{content: streamContent(4 * streamChunkSize)}
+	done := make(chan *buffer, 1)
+	s := newStream(context.Background(), "paused", uint64(len(fake.content)), 2, fake.fetch,
+		func(content *buffer) error { done <- content; return nil })
+	defer s.Cancel()
+
+	buf := make([]byte, 10)
+	n, err := s.ReadAt(buf, int64(2*streamChunkSize))
+	failOnErr(t, err)
+	if n != len(buf) {
+		t.Fatalf("Read %d bytes instead of %d.", n, len(buf))
+	}
+	time.Sleep(50 * time.Millisecond)
+	fake.mutex.Lock()
+	fetched := len(fake.fetched)
+	fake.mutex.Unlock()
+	if fetched != 1 {
+		t.Fatalf("Fetched %d chunks while paused, expected only the one read.", fetched)
+	}
+
+	ResumeTransfers()
+	failOnErr(t, s.Wait())
+	if content := bufferBytes(t, <-done); len(content) != len(fake.content) {
+		t.Fatalf("Expected %d bytes after resuming, got %d", len(fake.content), len(content))
+	}
+}
@@ -0,0 +1,113 @@
+package graph
+
+import (
+	"sync"
+	"time"
+)
+
+// how long a chunk should take to transfer
+const chunkTarget = 8 * time.Second
+
+// how much weight the newest measurement of throughput gets
+const chunkSmoothing = 0.3
+
+var (
+	uploadChunks   = newChunkTuner(chunkSize, chunkSizeUnit, maxChunkSize)
+	downloadChunks = newChunkTuner(streamChunkSize, 1024*1024, 64*1024*1024)
+)
+
+// SetChunkTuning sets whether upload and download chunk sizes are adjusted to
+// the connection. Uploads only use the size set with SetChunkSize when upload
+// tuning is disabled. Should be called before any transfers start.
+func SetChunkTuning(uploads bool, downloads bool) {
+	uploadChunks.setTuning(uploads)
+	downloadChunks.setTuning(downloads)
+}
+
+// chunkTuner picks the size of the chunks content is transferred in. Sizes are
+// always a multiple of unit, between unit and max.
+type chunkTuner struct {
+	mutex  sync.Mutex
+	start  uint64
+	unit   uint64
+	max    uint64
+	size   uint64
+	rate   float64 // smoothed bytes per second, 0 until measured
+	tuning bool
+}
+
+func newChunkTuner(start uint64, unit uint64, max uint64) *chunkTuner {
+	t := &chunkTuner{unit: unit, max: max}
+	t.reset(start)
+	return t
+}
+
+// reset starts tuning over from a chunk size.
+func (t *chunkTuner) reset(start uint64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.start = t.round(start)
+	t.size = t.start
+	t.rate = 0
+}
+
+func (t *chunkTuner) setTuning(tuning bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.tuning = tuning
+	t.size = t.start
+	t.rate = 0
+}
+
+// round returns the closest valid chunk size at or below size. Must be called
+// with the mutex held.
+func (t *chunkTuner) round(size uint64) uint64 {
+	size -= size % t.unit
+	if size < t.unit {
+		size = t.unit
+	}
+	if size > t.max {
+		size = t.max
+	}
+	return size
+}
+
+// chunkSize returns the size the next chunk should be.
+func (t *chunkTuner) chunkSize() uint64 {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if !t.tuning {
+		return t.start
+	}
+	return t.size
+}
+
+// success records that a chunk of some size was transferred in elapsed time.
+// Chunks grow at most twofold at a time, so one lucky measurement can't make
+// them huge.
+func (t *chunkTuner) success(size uint64, elapsed time.Duration) {
+	if size == 0 || elapsed <= 0 {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	rate := float64(size) / elapsed.Seconds()
+	if t.rate == 0 {
+		t.rate = rate
+	} else {
+		t.rate = chunkSmoothing*rate + (1-chunkSmoothing)*t.rate
+	}
+	target := uint64(t.rate * chunkTarget.Seconds())
+	if target > 2*t.size {
+		target = 2 * t.size
+	}
+	t.size = t.round(target)
+}
+
+// failure records that a chunk could not be transferred, which halves the size
+// of the next ones.
+func (t *chunkTuner) failure() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.size = t.round(t.size / 2)
+}
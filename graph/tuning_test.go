@@ -0,0 +1,49 @@
+package graph
+
+import (
+	"testing"
+	"time"
+)
+
+// Chunks should grow on fast links, but only so much at a time, shrink when
+// chunks fail, and always stay a size the API accepts.
+func TestChunkTuner(t *testing.T) {
+	t.Parallel()
+	tuner := newChunkTuner(10*1024*1024, chunkSizeUnit, maxChunkSize)
+	start := tuner.chunkSize()
+	tuner.success(start, 100*time.Millisecond)
+	if tuner.chunkSize() != start {
+		t.Fatal("Chunk size changed while tuning was disabled.")
+	}
+
+	tuner.setTuning(true)
+	tuner.success(start, 100*time.Millisecond)
+	if size := tuner.chunkSize(); size != 2*start {
+		t.Fatalf("Chunks should double on a fast link, got %d.", size)
+	}
+	for n := 0; n < 10; n++ {
+		tuner.success(tuner.chunkSize(), 100*time.Millisecond)
+	}
+	if size := tuner.chunkSize(); size != maxChunkSize {
+		t.Fatalf("Chunks should grow up to the largest size allowed, got %d.", size)
+	}
+
+	tuner.failure()
+	if size := tuner.chunkSize(); size > maxChunkSize/2 || size%chunkSizeUnit != 0 {
+		t.Fatalf("Chunks should halve after a failure, got %d.", size)
+	}
+
+	// 100KiB/s should settle on chunks that take chunkTarget to upload
+	for n := 0; n < 50; n++ {
+		tuner.success(100*1024, time.Second)
+	}
+	if size := tuner.chunkSize(); size != 640*1024 {
+		t.Fatalf("Unexpected chunk size on a slow link: %d.", size)
+	}
+	for n := 0; n < 10; n++ {
+		tuner.failure()
+	}
+	if size := tuner.chunkSize(); size != chunkSizeUnit {
+		t.Fatalf("Chunks should not shrink below the smallest size allowed, got %d.", size)
+	}
+}
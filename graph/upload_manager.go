@@ -1,25 +1,96 @@
 package graph
 
 import (
+	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"sync"
 	"time"
 
+	bolt "github.com/etcd-io/bbolt"
 	log "github.com/sirupsen/logrus"
 )
 
+// UPLOADS is the boltdb bucket used to remember uploads in progress, so that
+// large uploads can pick up where they left off after a restart.
+var UPLOADS = []byte("uploads")
+
+// uploadRecord is what is saved to disk about an upload in progress. The
+// content itself is in the content cache, the hash is used to check it is
+// still the content that was being uploaded.
+type uploadRecord struct {
+	ID                 string    `json:"id"`
+	UploadURL          string    `json:"uploadUrl,omitempty"`
+	ExpirationDateTime time.Time `json:"expirationDateTime"`
+	Size               uint64    `json:"size"`
+	Uploaded           uint64    `json:"uploaded"`
+	ModTime            time.Time `json:"modTime"`
+	SHA1               string    `json:"sha1"`
+}
+
+const (
+	// how many uploads can run at once
+	maxConcurrentUploads = 4
+	// how many times an upload is attempted before giving up on it
+	uploadAttempts = 5
+	// failed uploads are retried after this long, doubling with each attempt
+	uploadRetryBase     = 5 * time.Second
+	maxUploadRetryDelay = 10 * time.Minute
+)
+
+// how long uploads wait for further changes to a file before starting
+var uploadDelay = 2 * time.Second
+
+// SetUploadDelay sets how long uploads wait for further changes to a file
+// before starting. Files that are saved over and over again in quick
+// succession, like editors and build tools do, are only uploaded once they
+// settle down. Should be called before the filesystem is mounted.
+func SetUploadDelay(delay time.Duration) {
+	uploadDelay = delay
+}
+
 // UploadManager is used to manage and retry uploads.
 type UploadManager struct {
 	queue    chan *UploadSession
 	sessions map[string]*UploadSession
 	auth     *Auth
+	changes  *changeTracker // upload progress is reported here, may be nil
+	db       *bolt.DB       // uploads in progress are saved here, may be nil
+	mutex    sync.RWMutex   // guards sessions, paused, offline and seq
+	paused   bool
+	offline  bool   // uploads are held until we are back online
+	seq      uint64 // the last position handed out in the queue
+	ctx      context.Context
+	active   sync.WaitGroup // uploads in progress
+	delay    time.Duration  // see SetUploadDelay
+	janitor  *sessionJanitor
+	// called when an upload fails because the server can't be reached
+	onOffline func(err error)
+	// uploads of items this returns true for wait, like conflicted ones
+	held func(id string) bool
+	// finished uploads are recorded here, may be nil
+	activity *activityLog
 }
 
 // NewUploadManager creates a new queue/thread for uploads
-func NewUploadManager(duration time.Duration, auth *Auth) *UploadManager {
+// that runs until ctx is cancelled.
+func NewUploadManager(ctx context.Context, duration time.Duration, auth *Auth,
+	changes *changeTracker, db *bolt.DB) *UploadManager {
 	manager := UploadManager{
 		queue:    make(chan *UploadSession),
 		sessions: make(map[string]*UploadSession),
 		auth:     auth,
+		changes:  changes,
+		db:       db,
+		ctx:      ctx,
+		delay:    uploadDelay,
+		janitor:  newSessionJanitor(db),
 	}
+	go manager.janitor.run(ctx)
 	go manager.uploadLoop(duration)
 	return &manager
 }
@@ -27,36 +98,405 @@ func NewUploadManager(duration time.Duration, auth *Auth) *UploadManager {
 // uploadLoop manages the deduplication and tracking of uploads
 func (u *UploadManager) uploadLoop(duration time.Duration) {
 	ticker := time.NewTicker(duration)
+	defer ticker.Stop()
 	for {
 		select {
+		case <-u.ctx.Done():
+			log.Trace("Upload goroutine stopped.")
+			return
 		case session := <-u.queue:
-			// deduplicate sessions for the same item
+			// deduplicate sessions for the same item, only the latest content
+			// gets uploaded
+			session.startAt = time.Now().Add(u.delay)
+			session.janitor = u.janitor
+			u.mutex.Lock()
+			u.seq++
+			session.seq = u.seq
 			if old, exists := u.sessions[session.ID]; exists {
-				old.cancel(u.auth)
+				// newer content for the same file keeps its place in line
+				session.seq = old.seq
+				old.abort()
+				old.cancel()
+				if old.getState() == notStarted {
+					// one that is running frees its snapshot when it stops
+					old.close()
+				}
 			}
 			u.sessions[session.ID] = session
+			u.mutex.Unlock()
+			u.save(session)
 		case <-ticker.C:
-			// periodically start uploads, or remove them if done/failed
+			// periodically start uploads, finished ones remove themselves
+			u.mutex.Lock()
+			if u.paused || u.offline || transfers.isPaused() {
+				u.mutex.Unlock()
+				continue
+			}
+			running := 0
+			for _, session := range u.sessions {
+				if session.getState() == started {
+					running++
+				}
+			}
+			ready := make([]*UploadSession, 0)
 			for _, session := range u.sessions {
-				switch session.getState() {
-				case notStarted:
-					go session.Upload(u.auth)
-				case errored:
-					log.WithField("id", session.ID).Error("Upload failed.")
-					fallthrough
-				case complete:
-					delete(u.sessions, session.ID)
+				if session.readyToStart() && !transfers.holds(session.isLargeSession()) &&
+					(u.held == nil || !u.held(session.ID)) {
+					ready = append(ready, session)
+				}
+			}
+			sort.Slice(ready, func(i, j int) bool { return ready[i].seq < ready[j].seq })
+			for _, session := range ready {
+				if running >= maxConcurrentUploads {
+					break
 				}
+				running++
+				u.start(session)
 			}
+			u.mutex.Unlock()
+		}
+	}
+}
+
+// start kicks off an upload in the background. Must be called with the mutex
+// held.
+func (u *UploadManager) start(session *UploadSession) {
+	u.active.Add(1)
+	u.setChangeState(session.ID, StateInFlight, nil)
+	session.progress = func(uploaded uint64, total uint64) {
+		u.changes.setProgress(session.ID, uploaded, total)
+		u.save(session)
+	}
+	// so it is not started twice before the upload gets going
+	session.setState(started)
+	go u.upload(session)
+}
+
+// upload performs an upload, then either removes it from the manager or
+// schedules a retry if it failed.
+func (u *UploadManager) upload(session *UploadSession) {
+	defer u.active.Done()
+	err := u.resolveID(session)
+	if err == nil {
+		err = session.Upload(u.auth)
+	}
+
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if u.sessions[session.ID] != session {
+		// newer content was queued in the meantime, its upload takes over
+		session.cancel()
+		session.close()
+		return
+	}
+	if err != nil && IsOffline(err) {
+		// not the upload's fault, try again from where it stopped once we are
+		// back online
+		log.WithFields(log.Fields{
+			"id":  session.ID,
+			"err": err,
+		}).Warn("Upload interrupted by loss of connection, holding it until online.")
+		session.suspend()
+		u.offline = true
+		u.setChangeState(session.ID, StateQueued, err)
+		u.save(session)
+		if u.onOffline != nil {
+			go u.onOffline(err)
+		}
+		return
+	}
+	if IsQuotaExceeded(err) {
+		notifyEvent("quota", "OneDrive is full",
+			"Files can't be uploaded until space is freed up on OneDrive. "+
+				"They are kept on this computer in the meantime.")
+	}
+	if err != nil {
+		if delay, retry := uploadRetryDelay(session.attempts, err); retry {
+			log.WithFields(log.Fields{
+				"id":  session.ID,
+				"err": err,
+			}).Warnf("Upload failed, retrying in %s.", delay)
+			session.retryLater(delay)
+			u.setChangeState(session.ID, StateQueued, err)
+			u.save(session)
+			return
+		}
+		log.WithFields(log.Fields{
+			"id":  session.ID,
+			"err": err,
+		}).Error("Upload failed.")
+		if path := u.changes.path(session.ID); path != "" && !IsQuotaExceeded(err) {
+			notifyEvent("upload", "Could not upload "+filepath.Base(path),
+				fmt.Sprintf("%s did not reach OneDrive: %s", path, err))
+		}
+		u.setChangeState(session.ID, StateFailed, err)
+	} else {
+		if path := u.changes.path(session.ID); path != "" {
+			u.activity.record(activityLocal, "uploaded", path, activitySize(session.Size))
+		}
+		u.changes.done(session.ID, OpCreate)
+		u.changes.done(session.ID, OpWrite)
+		walClear(u.db, session.ID, OpCreate, 0)
+		walClear(u.db, session.ID, OpWrite, session.walSeq)
+	}
+	delete(u.sessions, session.ID)
+	u.forget(session.ID)
+	session.close()
+}
+
+// resolveID makes sure an item exists on the server before its content is
+// uploaded. Items are created on the server here rather than when they are
+// saved, so applications closing a new file don't have to wait on the network.
+func (u *UploadManager) resolveID(session *UploadSession) error {
+	id, err := session.remoteID(u.auth)
+	if err != nil || id == session.ID {
+		return err
+	}
+	u.mutex.Lock()
+	if u.sessions[session.ID] == session {
+		delete(u.sessions, session.ID)
+		u.forget(session.ID)
+		if _, exists := u.sessions[id]; !exists {
+			u.sessions[id] = session
 		}
 	}
+	session.ID = id
+	u.mutex.Unlock()
+	u.save(session)
+	return nil
 }
 
-// QueueUpload queues an item for upload.
+// uploadRetryDelay returns how long to wait before retrying an upload that has
+// failed a number of times already, or false if it should not be retried. The
+// delay doubles with each attempt, unless the server told us how long to wait.
+func uploadRetryDelay(attempts int, err error) (time.Duration, bool) {
+	if attempts+1 >= uploadAttempts {
+		return 0, false
+	}
+	if throttled, wait := IsThrottled(err); throttled && wait > 0 {
+		return wait, true
+	}
+	delay := uploadRetryBase << uint(attempts)
+	if delay > maxUploadRetryDelay {
+		delay = maxUploadRetryDelay
+	}
+	return delay, true
+}
+
+// setChangeState reports upload progress for the content changes of an item.
+func (u *UploadManager) setChangeState(id string, state ChangeState, err error) {
+	u.changes.setState(id, OpCreate, state, err)
+	u.changes.setState(id, OpWrite, state, err)
+}
+
+// SetPaused controls whether new uploads are started. Uploads already in
+// progress are allowed to finish.
+func (u *UploadManager) SetPaused(paused bool) {
+	u.mutex.Lock()
+	u.paused = paused
+	u.mutex.Unlock()
+}
+
+// SetOffline controls whether uploads are held because the server can't be
+// reached.
+func (u *UploadManager) SetOffline(offline bool) {
+	u.mutex.Lock()
+	u.offline = offline
+	u.mutex.Unlock()
+}
+
+// CancelUpload stops an item's upload, whether or not it has started, for when
+// the content being uploaded is no longer wanted.
+func (u *UploadManager) CancelUpload(id string) {
+	u.mutex.Lock()
+	session, exists := u.sessions[id]
+	if !exists {
+		u.mutex.Unlock()
+		return
+	}
+	delete(u.sessions, id)
+	if session.getState() == notStarted {
+		// one that is running frees its snapshot when it stops
+		session.close()
+	}
+	u.mutex.Unlock()
+
+	log.WithField("id", id).Info("Cancelling upload.")
+	u.forget(id)
+	session.abort()
+	session.cancel()
+}
+
+// HasPending returns whether an item has an upload that has not completed yet.
+func (u *UploadManager) HasPending(id string) bool {
+	u.mutex.RLock()
+	defer u.mutex.RUnlock()
+	session, exists := u.sessions[id]
+	return exists && session.getState() != complete
+}
+
+// pendingHash returns the SHA1 of the content a pending upload is uploading.
+func (u *UploadManager) pendingHash(id string) string {
+	u.mutex.RLock()
+	defer u.mutex.RUnlock()
+	if session, exists := u.sessions[id]; exists {
+		return session.hash
+	}
+	return ""
+}
+
+// Wait blocks until all uploads in progress complete, or until timeout. Returns
+// false if the timeout was reached.
+func (u *UploadManager) Wait(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		u.active.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// QueueUpload queues an item for upload. Only a snapshot of its content is
+// taken here, the upload itself happens in the background.
 func (u *UploadManager) QueueUpload(inode *Inode) error {
-	session, err := NewUploadSession(inode, u.auth)
+	session, err := NewUploadSession(inode)
 	if err == nil {
-		u.queue <- session
+		select {
+		case u.queue <- session:
+		case <-u.ctx.Done():
+			return errors.New("upload manager has been shut down")
+		}
 	}
 	return err
 }
+
+// save records an upload in progress to disk.
+func (u *UploadManager) save(session *UploadSession) {
+	if u.db == nil {
+		return
+	}
+	session.mutex.Lock()
+	record := uploadRecord{
+		ID:                 session.ID,
+		UploadURL:          session.UploadURL,
+		ExpirationDateTime: session.ExpirationDateTime,
+		Size:               session.Size,
+		Uploaded:           session.uploaded,
+		ModTime:            session.ModTime,
+		SHA1:               session.hash,
+	}
+	session.mutex.Unlock()
+	data, _ := json.Marshal(record)
+	err := u.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(UPLOADS)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(record.ID), data)
+	})
+	if err != nil {
+		log.WithFields(log.Fields{
+			"id":  record.ID,
+			"err": err,
+		}).Warn("Could not save upload progress.")
+	}
+}
+
+// forget removes an upload that has finished from disk.
+func (u *UploadManager) forget(id string) {
+	if u.db == nil {
+		return
+	}
+	u.db.Update(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(UPLOADS); b != nil {
+			return b.Delete([]byte(id))
+		}
+		return nil
+	})
+}
+
+// savedUploads returns the uploads that were in progress when onedriver last
+// stopped.
+func (u *UploadManager) savedUploads() []uploadRecord {
+	records := make([]uploadRecord, 0)
+	if u.db == nil {
+		return records
+	}
+	u.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(UPLOADS)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var record uploadRecord
+			if err := json.Unmarshal(v, &record); err == nil {
+				records = append(records, record)
+			}
+			return nil
+		})
+	})
+	return records
+}
+
+// resumeUploads restarts the uploads that were in progress when onedriver last
+// stopped. Uploads whose content no longer matches what was being uploaded are
+// dropped, the newer content gets uploaded on its own when it is saved.
+func (c *Cache) resumeUploads() {
+	for _, record := range c.uploads.savedUploads() {
+		inode := c.GetID(record.ID)
+		if inode == nil && isLocalID(record.ID) {
+			// no way to create the item on the server without its metadata
+			c.uploads.janitor.abandon(record.ID, record.UploadURL, record.ExpirationDateTime)
+			c.uploads.forget(record.ID)
+			continue
+		}
+		content, err := c.contentBuffer(record.ID)
+		hash := ""
+		if err == nil {
+			hash, _ = hashReader(sha1.New(), content.Reader())
+		}
+		if err != nil || uint64(content.Size()) != record.Size || hash != record.SHA1 {
+			log.WithField("id", record.ID).Warn(
+				"Content changed since upload was interrupted, not resuming it.")
+			if content != nil {
+				content.Close()
+			}
+			c.uploads.janitor.abandon(record.ID, record.UploadURL, record.ExpirationDateTime)
+			c.uploads.forget(record.ID)
+			continue
+		}
+		log.WithFields(log.Fields{
+			"id":       record.ID,
+			"uploaded": record.Uploaded,
+			"size":     record.Size,
+		}).Info("Resuming interrupted upload.")
+		session := &UploadSession{
+			ID:                 record.ID,
+			UploadURL:          record.UploadURL,
+			ExpirationDateTime: record.ExpirationDateTime,
+			Size:               record.Size,
+			ModTime:            record.ModTime,
+			data:               content,
+			uploaded:           record.Uploaded,
+			hash:               record.SHA1,
+			inode:              inode,
+			walSeq:             walSeq(c.db, record.ID, OpWrite),
+			janitor:            c.uploads.janitor,
+		}
+		path := ""
+		if inode != nil {
+			path = inode.Path()
+		}
+		c.changes.track(record.ID, path, OpWrite, StateQueued)
+		c.uploads.mutex.Lock()
+		if _, exists := c.uploads.sessions[record.ID]; !exists {
+			c.uploads.sessions[record.ID] = session
+		}
+		c.uploads.mutex.Unlock()
+	}
+}
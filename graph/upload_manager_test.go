@@ -0,0 +1,88 @@
+package graph
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// Failed uploads should back off exponentially, wait as long as the server asks
+// when throttled, and eventually give up.
+func TestUploadRetryDelay(t *testing.T) {
+	t.Parallel()
+	failure := errors.New("network down")
+	if delay, retry := uploadRetryDelay(0, failure); !retry || delay != uploadRetryBase {
+		t.Fatalf("First retry should wait %s, got %s", uploadRetryBase, delay)
+	}
+	if delay, _ := uploadRetryDelay(2, failure); delay != 4*uploadRetryBase {
+		t.Fatalf("Third retry should wait %s, got %s", 4*uploadRetryBase, delay)
+	}
+
+	throttled := &GraphError{StatusCode: 429, RetryAfter: 42 * time.Second}
+	if delay, retry := uploadRetryDelay(1, throttled); !retry || delay != 42*time.Second {
+		t.Fatalf("Retry-After was not honored, waiting %s", delay)
+	}
+
+	if _, retry := uploadRetryDelay(uploadAttempts-1, failure); retry {
+		t.Fatal("Upload was retried after running out of attempts.")
+	}
+}
+
+// A file saved several times in quick succession should only have its latest
+// content uploaded, once it stops changing.
+func TestUploadDebounce(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	manager := NewUploadManager(ctx, 10*time.Millisecond, nil, nil, nil)
+	manager.delay = time.Hour
+
+	inode := NewInode("debounced.txt", 0644, nil)
+	for _, content := range []string{"first", "second", "third"} {
+		failOnErr(t, inode.data.Truncate(0))
+		_, err := inode.data.WriteAt([]byte(content), 0)
+		failOnErr(t, err)
+		inode.SizeInternal = uint64(inode.data.Size())
+		failOnErr(t, manager.QueueUpload(inode))
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	manager.mutex.RLock()
+	defer manager.mutex.RUnlock()
+	session, exists := manager.sessions[inode.ID()]
+	if !exists || len(manager.sessions) != 1 {
+		t.Fatalf("Expected a single upload, got %d", len(manager.sessions))
+	}
+	if session.getState() != notStarted {
+		t.Fatal("Upload started before the file stopped changing.")
+	}
+	content, err := session.data.Bytes()
+	failOnErr(t, err)
+	if string(content) != "third" {
+		t.Fatalf("Upload does not have the latest content: \"%s\"", content)
+	}
+}
+
+// A cancelled upload should be dropped before it ever starts.
+func TestCancelUpload(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	manager := NewUploadManager(ctx, 10*time.Millisecond, nil, nil, nil)
+	manager.delay = time.Hour
+
+	inode := NewInode("cancelled.txt", 0644, nil)
+	_, err := inode.data.WriteAt([]byte("unwanted"), 0)
+	failOnErr(t, err)
+	failOnErr(t, manager.QueueUpload(inode))
+	time.Sleep(50 * time.Millisecond)
+	if !manager.HasPending(inode.ID()) {
+		t.Fatal("Upload was not queued.")
+	}
+
+	manager.CancelUpload(inode.ID())
+	if manager.HasPending(inode.ID()) {
+		t.Fatal("Upload is still pending after being cancelled.")
+	}
+}
@@ -2,11 +2,13 @@ package graph
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha1"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"math"
 	"net/http"
 	"strconv"
 	"strings"
@@ -17,7 +19,37 @@ import (
 )
 
 // 10MB is the recommended upload size according to the graph API docs
-const chunkSize uint64 = 10 * 1024 * 1024
+var chunkSize uint64 = 10 * 1024 * 1024
+
+const (
+	// chunks must be a multiple of 320KiB, and no more than 60MiB
+	chunkSizeUnit uint64 = 320 * 1024
+	maxChunkSize  uint64 = 60 * 1024 * 1024
+	// how many times a chunk is attempted before giving up on an upload
+	chunkRetries = 5
+)
+
+// SetChunkSize sets the size of the chunks large files are uploaded in, and
+// returns the size actually used. It is rounded down to a multiple of 320KiB,
+// as required by the API. With chunk tuning enabled, this is only the size the
+// first chunks are uploaded in. Should be called before any uploads start.
+func SetChunkSize(size uint64) uint64 {
+	chunkSize = validChunkSize(size)
+	uploadChunks.reset(chunkSize)
+	return chunkSize
+}
+
+// validChunkSize rounds a chunk size to one the API accepts.
+func validChunkSize(size uint64) uint64 {
+	size -= size % chunkSizeUnit
+	if size < chunkSizeUnit {
+		size = chunkSizeUnit
+	}
+	if size > maxChunkSize {
+		size = maxChunkSize
+	}
+	return size
+}
 
 // upload states
 const (
@@ -35,24 +67,41 @@ type UploadSession struct {
 	UploadURL          string    `json:"uploadUrl"`
 	ExpirationDateTime time.Time `json:"expirationDateTime"`
 	Size               uint64    `json:"-"`
-	data               []byte
+	ModTime            time.Time `json:"-"`
+	data               *buffer   // a snapshot, freed once the upload is over
 
-	mutex sync.Mutex
-	state int
+	mutex    sync.Mutex
+	state    int
+	uploaded uint64                              // bytes the server has received
+	hash     string                              // SHA1 of data, to check it on resume
+	progress func(uploaded uint64, total uint64) // called as chunks are uploaded
+	meter    rateMeter                           // how fast chunks are being uploaded
+	inode    *Inode                              // used to create new items, may be nil
+	ctx      context.Context                     // cancelled when the upload is aborted
+	stop     context.CancelFunc
+	janitor  *sessionJanitor // deletes the session on the server if abandoned
+
+	// uploads are scheduled by the upload manager
+	seq      uint64 // position in the queue, uploads start in this order
+	walSeq   uint64 // last journaled write included in the snapshot
+	attempts int
+	startAt  time.Time // not started before this, for debouncing and retries
 }
 
 // UploadSessionPost is the initial post used to create an upload session
 type UploadSessionPost struct {
-	Name             string `json:"name,omitempty"`
-	ConflictBehavior string `json:"@microsoft.graph.conflictBehavior,omitempty"`
-	FileSystemInfo   `json:"fileSystemInfo,omitempty"`
+	Name             string          `json:"name,omitempty"`
+	ConflictBehavior string          `json:"@microsoft.graph.conflictBehavior,omitempty"`
+	FileSystemInfo   *FileSystemInfo `json:"fileSystemInfo,omitempty"`
 }
 
-// FileSystemInfo carries the filesystem metadata like Mtime/Atime
+// FileSystemInfo carries the filesystem metadata like Mtime/Atime, as set by
+// the client that wrote the file rather than when the server received it.
+// https://docs.microsoft.com/en-us/onedrive/developer/rest-api/resources/filesysteminfo
 type FileSystemInfo struct {
-	CreatedDateTime      time.Time `json:"createdDateTime,omitempty"`
-	LastAccessedDateTime time.Time `json:"lastAccessedDateTime,omitempty"`
-	LastModifiedDateTime time.Time `json:"lastModifiedDateTime,omitempty"`
+	CreatedDateTime      *time.Time `json:"createdDateTime,omitempty"`
+	LastAccessedDateTime *time.Time `json:"lastAccessedDateTime,omitempty"`
+	LastModifiedDateTime *time.Time `json:"lastModifiedDateTime,omitempty"`
 }
 
 // isLargeSession returns whether or not this is a formal upload session that
@@ -73,24 +122,74 @@ func (u *UploadSession) setState(state int) {
 	u.mutex.Unlock()
 }
 
-// NewUploadSession wraps an upload of a file into an UploadSession struct
-// responsible for performing uploads for a file.
-func NewUploadSession(inode *Inode, auth *Auth) (*UploadSession, error) {
-	id, err := inode.RemoteID(auth)
-	if err != nil || isLocalID(id) {
-		log.WithFields(log.Fields{
-			"err":  err,
-			"path": inode.Path(),
-		}).Errorf("Could not obtain remote ID for upload.")
-		return nil, err
+// requestContext returns the context the upload's requests are made with.
+func (u *UploadSession) requestContext() context.Context {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if u.ctx == nil {
+		u.ctx, u.stop = context.WithCancel(context.Background())
+	}
+	return u.ctx
+}
+
+// abort stops an upload in progress by cancelling its requests. The upload
+// fails, and must not be attempted again.
+func (u *UploadSession) abort() {
+	u.requestContext()
+	u.mutex.Lock()
+	stop := u.stop
+	u.mutex.Unlock()
+	stop()
+}
+
+// close frees the snapshot of the content being uploaded.
+func (u *UploadSession) close() {
+	if u.data != nil {
+		u.data.Close()
 	}
+}
 
+// retryLater schedules a failed upload to be started over after a delay. The
+// old upload session was cancelled, so a new one is created when it starts.
+func (u *UploadSession) retryLater(delay time.Duration) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	u.state = notStarted
+	u.attempts++
+	u.startAt = time.Now().Add(delay)
+	u.uploaded = 0
+	u.UploadURL = ""
+}
+
+// suspend puts an upload that was interrupted back in line without counting it
+// as a failed attempt. Its upload session is kept, so it resumes where it
+// stopped.
+func (u *UploadSession) suspend() {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	u.state = notStarted
+	u.startAt = time.Now()
+}
+
+// readyToStart returns whether an upload is waiting to be started and the time
+// it was scheduled for, if any, has passed.
+func (u *UploadSession) readyToStart() bool {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return u.state == notStarted && !time.Now().Before(u.startAt)
+}
+
+// NewUploadSession takes a snapshot of a file's content for upload. It does
+// not talk to the server, that is left to Upload, so it is quick enough to call
+// when an application closes a file.
+func NewUploadSession(inode *Inode) (*UploadSession, error) {
+	modTime := inode.modTime()
 	inode.mutex.RLock()
 	// create a generic session for all files
 	session := UploadSession{
-		ID:   inode.IDInternal,
-		Size: inode.SizeInternal,
-		data: make([]byte, inode.SizeInternal),
+		ID:      inode.IDInternal,
+		ModTime: modTime,
+		inode:   inode,
 	}
 	if inode.data == nil {
 		log.WithFields(log.Fields{
@@ -100,88 +199,261 @@ func NewUploadSession(inode *Inode, auth *Auth) (*UploadSession, error) {
 		defer inode.mutex.RUnlock()
 		return nil, errors.New("inode data was nil")
 	}
-	copy(session.data, *inode.data)
+	data, err := inode.data.Copy()
+	if inode.cache != nil {
+		session.walSeq = walSeq(inode.cache.db, inode.IDInternal, OpWrite)
+	}
 	inode.mutex.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	session.data = data
+	session.Size = uint64(data.Size())
+	if session.hash, err = hashReader(sha1.New(), data.Reader()); err != nil {
+		data.Close()
+		return nil, err
+	}
+	return &session, nil
+}
 
-	if session.isLargeSession() {
-		// must create a formal upload session with the API
-		sessionResp, _ := json.Marshal(UploadSessionPost{
-			ConflictBehavior: "replace",
-			FileSystemInfo: FileSystemInfo{
-				LastModifiedDateTime: time.Unix(int64(inode.ModTime()), 0),
-			},
-		})
-
-		resp, err := Post(
-			fmt.Sprintf("/me/drive/items/%s/createUploadSession", session.ID),
-			auth,
-			bytes.NewReader(sessionResp),
-		)
-		if err != nil {
-			return nil, err
-		}
+// remoteID returns the ID the item should be uploaded to, creating the item on
+// the server first if it only exists locally.
+func (u *UploadSession) remoteID(auth *Auth) (string, error) {
+	if u.inode == nil || !isLocalID(u.ID) {
+		return u.ID, nil
+	}
+	id, err := u.inode.RemoteID(auth)
+	if err == nil && isLocalID(id) {
+		err = errors.New("could not obtain a remote ID for upload")
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":  err,
+			"path": u.inode.Path(),
+		}).Error("Could not obtain remote ID for upload.")
+		return u.ID, err
+	}
+	return id, nil
+}
 
-		// populates UploadURL/expiration
-		if err = json.Unmarshal(resp, &session); err != nil {
-			return nil, err
-		}
+// create registers a formal upload session with the API, which gives us an
+// upload URL to send chunks to.
+func (u *UploadSession) create(auth *Auth) error {
+	sessionResp, _ := json.Marshal(UploadSessionPost{
+		ConflictBehavior: "replace",
+		FileSystemInfo: &FileSystemInfo{
+			LastModifiedDateTime: &u.ModTime,
+		},
+	})
+
+	resp, err := request(
+		u.requestContext(),
+		itemResource(u.ID)+"/createUploadSession",
+		auth,
+		"POST",
+		bytes.NewReader(sessionResp),
+		nil,
+	)
+	if err != nil {
+		return err
 	}
-	return &session, nil
+
+	// populates UploadURL/expiration
+	return json.Unmarshal(resp, u)
+}
+
+// resumeOffset asks the server how much of a session it already has, so an
+// interrupted upload can continue where it left off.
+func (u *UploadSession) resumeOffset() (uint64, error) {
+	if u.UploadURL == "" || time.Now().After(u.ExpirationDateTime) {
+		return 0, errors.New("upload session has expired")
+	}
+	// no Authorization header, the upload URL is all the server needs
+	request, _ := http.NewRequestWithContext(u.requestContext(), "GET", u.UploadURL, nil)
+	resp, err := httpClient(30 * time.Second).Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("HTTP %d: %s", resp.StatusCode, string(body))
+	}
+	return nextOffset(body)
 }
 
-// cancel the upload session by deleting the temp file at the endpoint.
-func (u *UploadSession) cancel(auth *Auth) {
+// cancel the upload session by deleting the temp file at the endpoint. The
+// session can't be resumed afterwards.
+func (u *UploadSession) cancel() {
 	// is it an actual API upload session?
-	if u.isLargeSession() {
-		// dont care about result, this is purely us being polite to the server
-		go Delete(u.UploadURL, auth)
+	if !u.isLargeSession() {
+		return
+	}
+	u.mutex.Lock()
+	uploadURL, expires := u.UploadURL, u.ExpirationDateTime
+	u.UploadURL = ""
+	u.mutex.Unlock()
+	if uploadURL == "" {
+		return
 	}
+	if u.janitor != nil {
+		u.janitor.abandon(u.ID, uploadURL, expires)
+		return
+	}
+	// dont care about result, this is purely us being polite to the server
+	go deleteUploadSession(context.Background(), uploadURL)
 }
 
 // Internal method used for uploading individual chunks of a DriveItem. We have
 // to make things this way because the internal Put func doesn't work all that
 // well when we need to add custom headers.
-func (u *UploadSession) uploadChunk(auth *Auth, offset uint64) ([]byte, int, error) {
+func (u *UploadSession) uploadChunk(auth *Auth, offset uint64, length uint64,
+	trace requestTrace) ([]byte, int, time.Duration, error) {
 	if u.UploadURL == "" {
-		return nil, -1, errors.New("uploadSession UploadURL cannot be empty")
+		return nil, -1, 0, errors.New("uploadSession UploadURL cannot be empty")
+	}
+	if offset >= u.Size {
+		return nil, -1, 0, errors.New("offset cannot be larger than DriveItem size")
 	}
 
 	// how much of the file are we going to upload?
-	end := offset + chunkSize
-	var reqChunkSize uint64
+	end := offset + length
 	if end > u.Size {
 		end = u.Size
-		reqChunkSize = end - offset + 1
-	}
-	if offset > u.Size {
-		return nil, -1, errors.New("offset cannot be larger than DriveItem size")
 	}
 
 	auth.Refresh()
 
-	client := &http.Client{}
-	request, _ := http.NewRequest(
+	client := httpClient(0)
+	request, _ := http.NewRequestWithContext(
+		u.requestContext(),
 		"PUT",
 		u.UploadURL,
-		bytes.NewReader((u.data)[offset:end]),
+		uploadLimiter.reader(io.NewSectionReader(u.data, int64(offset), int64(end-offset))),
 	)
+	request.ContentLength = int64(end - offset)
 	// no Authorization header - it will throw a 401 if present
-	request.Header.Add("Content-Length", strconv.Itoa(int(reqChunkSize)))
 	frags := fmt.Sprintf("bytes %d-%d/%d", offset, end-1, u.Size)
 	log.WithField("id", u.ID).Info("Uploading ", frags)
 	request.Header.Add("Content-Range", frags)
+	trace.setHeaders(request)
 
+	// the upload URL is a secret, the ID of the item is logged instead
+	resource := "uploadSession " + u.ID + " " + frags
+	start := time.Now()
 	resp, err := client.Do(request)
+	trace.log("PUT", resource, resp, err, time.Since(start))
 	if err != nil {
 		// this is a serious error, not simply one with a non-200 return code
-		log.WithField(
-			"id", u.ID,
-		).Error("Error during file upload, terminating upload session.")
-		return nil, -1, err
+		log.WithFields(log.Fields{
+			"id":  u.ID,
+			"err": err,
+		}).Error("Error during chunk upload.")
+		return nil, -1, 0, err
 	}
 	defer resp.Body.Close()
 	response, _ := ioutil.ReadAll(resp.Body)
-	return response, resp.StatusCode, nil
+	return response, resp.StatusCode, parseRetryAfter(resp.Header.Get("Retry-After")), nil
+}
+
+// uploadChunkRetry uploads a chunk, retrying network and server-side failures
+// with an exponential back-off, or as long as the server asks us to wait when
+// it is throttling us.
+func (u *UploadSession) uploadChunkRetry(auth *Auth, offset uint64, length uint64) ([]byte, int, time.Duration, error) {
+	backoff := time.Second
+	trace := requestTrace{clientRequestID: newClientRequestID()}
+	for attempt := 1; ; attempt++ {
+		if err := transfers.wait(u.requestContext(), true); err != nil {
+			return nil, -1, 0, err
+		}
+		started := time.Now()
+		trace.attempt = attempt
+		resp, status, retryAfter, err := u.uploadChunk(auth, offset, length, trace)
+		retryable := err != nil || status >= 500 || status == http.StatusTooManyRequests
+		if err == nil && status < 300 {
+			sent := length
+			if offset+sent > u.Size {
+				sent = u.Size - offset
+			}
+			uploadChunks.success(sent, time.Since(started))
+		} else if retryable && u.requestContext().Err() == nil &&
+			status != http.StatusTooManyRequests {
+			// being throttled says nothing about the connection
+			uploadChunks.failure()
+		}
+		if !retryable || attempt == chunkRetries {
+			return resp, status, retryAfter, err
+		}
+		if u.requestContext().Err() != nil {
+			// aborted, there is nothing to retry
+			return resp, status, retryAfter, err
+		}
+		wait := backoff
+		if retryAfter > 0 {
+			wait = retryAfter
+		}
+		log.WithFields(log.Fields{
+			"id":      u.ID,
+			"offset":  offset,
+			"attempt": attempt,
+			"code":    status,
+		}).Warnf("Chunk upload failed, retrying in %s.", wait)
+		time.Sleep(wait)
+		backoff *= 2
+	}
+}
+
+// nextOffset returns where the server wants the next chunk to start, from the
+// response to a chunk upload.
+func nextOffset(resp []byte) (uint64, error) {
+	var ranges struct {
+		NextExpectedRanges []string `json:"nextExpectedRanges"`
+	}
+	if err := json.Unmarshal(resp, &ranges); err != nil {
+		return 0, err
+	}
+	if len(ranges.NextExpectedRanges) == 0 {
+		return 0, errors.New("no expected ranges in response")
+	}
+	start := strings.SplitN(ranges.NextExpectedRanges[0], "-", 2)[0]
+	return strconv.ParseUint(start, 10, 64)
+}
+
+// setProgress records how much of the file has been uploaded.
+func (u *UploadSession) setProgress(uploaded uint64) {
+	u.mutex.Lock()
+	u.uploaded = uploaded
+	progress := u.progress
+	u.mutex.Unlock()
+	u.meter.record(uploaded, time.Now())
+	if progress != nil {
+		progress(uploaded, u.Size)
+	}
+}
+
+// Progress returns how many bytes of the file have been uploaded so far.
+func (u *UploadSession) Progress() uint64 {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return u.uploaded
+}
+
+// verifyUploaded checks that the content the server ended up with, going by the
+// hashes in its response, is what we uploaded.
+func (u *UploadSession) verifyUploaded(resp []byte) error {
+	var item DriveItem
+	if err := json.Unmarshal(resp, &item); err != nil || item.FileInternal == nil {
+		// nothing to check against
+		return nil
+	}
+	err := verifyContent(u.data.Reader(), item.FileInternal.Hashes)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"id":  u.ID,
+			"err": err,
+		}).Error("Uploaded content was corrupted on its way to the server.")
+	}
+	return err
 }
 
 // Upload copies the file's contents to the server. Should only be called as a
@@ -190,22 +462,31 @@ func (u *UploadSession) Upload(auth *Auth) error {
 	log.WithField("id", u.ID).Debug("Uploading file.")
 	u.setState(started)
 	if !u.isLargeSession() {
-		resp, err := Put(
-			fmt.Sprintf("/me/drive/items/%s/content", u.ID),
+		if err := transfers.wait(u.requestContext(), false); err != nil {
+			u.setState(errored)
+			return err
+		}
+		resp, err := request(
+			u.requestContext(),
+			itemResource(u.ID)+"/content",
 			auth,
-			bytes.NewReader(u.data),
+			"PUT",
+			u.data.Reader(),
+			nil,
 		)
 		if err != nil && strings.Contains(err.Error(), "resourceModified") {
 			// retry the request after a second, likely the server is having issues
 			time.Sleep(time.Second)
-			resp, err = Put(
-				fmt.Sprintf("/me/drive/items/%s/content", u.ID),
+			resp, err = request(
+				u.requestContext(),
+				itemResource(u.ID)+"/content",
 				auth,
-				bytes.NewReader(u.data),
+				"PUT",
+				u.data.Reader(),
+				nil,
 			)
 		}
 
-		u.setState(complete)
 		if err != nil {
 			u.setState(errored)
 			log.WithFields(log.Fields{
@@ -213,41 +494,62 @@ func (u *UploadSession) Upload(auth *Auth) error {
 				"response": string(resp),
 				"err":      err,
 			}).Error("Error during small file upload.")
+			return err
 		}
-		return err
+		if err = u.verifyUploaded(resp); err != nil {
+			u.setState(errored)
+			return err
+		}
+		// simple uploads can't carry metadata, the server sets mtime to now
+		if err = SetModTime(u.ID, u.ModTime, auth); err != nil {
+			log.WithFields(log.Fields{
+				"id":  u.ID,
+				"err": err,
+			}).Warn("Could not set modification time after upload.")
+		}
+		u.setState(complete)
+		return nil
 	}
 
-	nchunks := int(math.Ceil(float64(u.Size) / float64(chunkSize)))
-	for i := 0; i < nchunks; i++ {
-		resp, status, err := u.uploadChunk(auth, uint64(i)*chunkSize)
+	if u.Progress() > 0 {
+		// resumed after a restart, check what the server actually has
+		offset, err := u.resumeOffset()
 		if err != nil {
 			log.WithFields(log.Fields{
-				"id":      u.ID,
-				"chunk":   i,
-				"nchunks": nchunks,
-				"err":     err,
-			}).Error("Error during chunk upload, cancelling upload session.")
-			u.cancel(auth)
+				"id":  u.ID,
+				"err": err,
+			}).Warn("Could not resume upload session, starting over.")
+			u.cancel()
+			if err = u.create(auth); err != nil {
+				u.setState(errored)
+				return err
+			}
+			offset = 0
+		}
+		u.setProgress(offset)
+	} else if u.UploadURL == "" {
+		// must register a formal upload session with the API first
+		if err := u.create(auth); err != nil {
+			u.setState(errored)
 			return err
 		}
-
-		// retry server-side failures with an exponential back-off strategy
-		for backoff := 1; status >= 500; backoff *= 2 {
+	}
+	u.meter.record(u.Progress(), time.Now())
+	for offset := u.Progress(); offset < u.Size; {
+		length := uploadChunks.chunkSize()
+		resp, status, retryAfter, err := u.uploadChunkRetry(auth, offset, length)
+		if err != nil {
 			log.WithFields(log.Fields{
-				"id":      u.ID,
-				"chunk":   i,
-				"nchunks": nchunks,
-			}).Errorf("The OneDrive server is having issues, retrying upload in %ds.", backoff)
-			resp, status, err = u.uploadChunk(auth, uint64(i)*chunkSize)
-			if err != nil {
-				log.WithFields(log.Fields{
-					"id":       u.ID,
-					"response": resp,
-					"err":      err,
-				}).Error("Failed while retrying upload. Killing upload session.")
-				u.cancel(auth)
-				return err
+				"id":     u.ID,
+				"offset": offset,
+				"err":    err,
+			}).Error("Error during chunk upload.")
+			if !IsOffline(err) {
+				// a session interrupted by the network can still be resumed
+				u.cancel()
 			}
+			u.setState(errored)
+			return err
 		}
 
 		// handle client-side errors
@@ -262,16 +564,35 @@ func (u *UploadSession) Upload(auth *Auth) error {
 		} else if status >= 400 {
 			log.WithFields(log.Fields{
 				"code":     status,
-				"response": resp,
+				"response": string(resp),
 			}).Errorf(
 				"Error code %d during upload. "+
 					"Onedriver doesn't know how to handle this case yet. "+
 					"Please file a bug report!",
 				status,
 			)
+			u.cancel()
 			u.setState(errored)
-			return errors.New(string(resp))
+			return &GraphError{
+				StatusCode: status,
+				Message:    string(resp),
+				RetryAfter: retryAfter,
+			}
+		}
+
+		if status == http.StatusOK || status == http.StatusCreated {
+			// the last chunk returns the finished item
+			if err = u.verifyUploaded(resp); err != nil {
+				u.setState(errored)
+				return err
+			}
+			offset = u.Size
+		} else if next, err := nextOffset(resp); err == nil && next > offset {
+			offset = next
+		} else {
+			offset += length
 		}
+		u.setProgress(offset)
 	}
 	u.setState(complete)
 	log.WithField("id", u.ID).Info("Upload completed!")
@@ -0,0 +1,229 @@
+package graph
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// zeroBuffer returns a buffer with size bytes of zeroes.
+func zeroBuffer(t *testing.T, size uint64) *buffer {
+	data := &buffer{}
+	failOnErr(t, data.Truncate(int64(size)))
+	return data
+}
+
+// Large files should be uploaded chunk by chunk, with failed chunks retried and
+// progress reported along the way.
+func TestUploadSessionChunks(t *testing.T) {
+	t.Parallel()
+	size := 2*chunkSize + 1000
+	var mutex sync.Mutex
+	var ranges []string
+	failed := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if r.Header.Get("Authorization") != "" {
+			t.Error("Upload URLs must not be sent credentials.")
+		}
+		if !failed {
+			// the first attempt fails, and should be retried
+			failed = true
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		contentRange := r.Header.Get("Content-Range")
+		ranges = append(ranges, contentRange)
+		var start, end, total uint64
+		fmt.Sscanf(contentRange, "bytes %d-%d/%d", &start, &end, &total)
+		if r.ContentLength != int64(end-start+1) {
+			t.Errorf("Content-Length %d does not match %s", r.ContentLength, contentRange)
+		}
+		if end+1 == total {
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprint(w, `{"id": "uploaded"}`)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintf(w, `{"nextExpectedRanges": ["%d-"]}`, end+1)
+	}))
+	defer server.Close()
+
+	var progress []uint64
+	session := &UploadSession{
+		ID:        "chunked",
+		UploadURL: server.URL,
+		Size:      size,
+		data:      zeroBuffer(t, size),
+		progress: func(uploaded uint64, total uint64) {
+			progress = append(progress, uploaded)
+		},
+	}
+	auth := &Auth{AccessToken: "token", ExpiresAt: time.Now().Unix() + 3600}
+	failOnErr(t, session.Upload(auth))
+
+	expected := []string{
+		fmt.Sprintf("bytes 0-%d/%d", chunkSize-1, size),
+		fmt.Sprintf("bytes %d-%d/%d", chunkSize, 2*chunkSize-1, size),
+		fmt.Sprintf("bytes %d-%d/%d", 2*chunkSize, size-1, size),
+	}
+	if fmt.Sprint(ranges) != fmt.Sprint(expected) {
+		t.Fatalf("Unexpected ranges uploaded: %v", ranges)
+	}
+	if len(progress) != 3 || progress[2] != size || session.Progress() != size {
+		t.Fatalf("Unexpected progress reported: %v", progress)
+	}
+	if session.getState() != complete {
+		t.Fatal("Session was not marked complete.")
+	}
+}
+
+func TestValidChunkSize(t *testing.T) {
+	t.Parallel()
+	tests := map[uint64]uint64{
+		10 * 1024 * 1024:  10 * 1024 * 1024,
+		1024 * 1024:       chunkSizeUnit * 3,
+		0:                 chunkSizeUnit,
+		100 * 1024 * 1024: maxChunkSize,
+	}
+	for size, expected := range tests {
+		if actual := validChunkSize(size); actual != expected {
+			t.Errorf("Chunk size %d was rounded to %d, expected %d", size, actual, expected)
+		}
+	}
+}
+
+// An upload that was interrupted should continue from where the server says it
+// left off instead of starting over.
+func TestUploadSessionResume(t *testing.T) {
+	t.Parallel()
+	size := 2*chunkSize + 1000
+	var mutex sync.Mutex
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if r.Method == http.MethodGet {
+			// the server only got the first chunk before we were interrupted
+			fmt.Fprintf(w, `{"nextExpectedRanges": ["%d-"]}`, chunkSize)
+			return
+		}
+		contentRange := r.Header.Get("Content-Range")
+		ranges = append(ranges, contentRange)
+		var start, end, total uint64
+		fmt.Sscanf(contentRange, "bytes %d-%d/%d", &start, &end, &total)
+		if end+1 == total {
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprint(w, `{"id": "resumed"}`)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintf(w, `{"nextExpectedRanges": ["%d-"]}`, end+1)
+	}))
+	defer server.Close()
+
+	session := &UploadSession{
+		ID:                 "resumed",
+		UploadURL:          server.URL,
+		ExpirationDateTime: time.Now().Add(time.Hour),
+		Size:               size,
+		data:               zeroBuffer(t, size),
+		uploaded:           chunkSize / 2, // saved progress lags behind the server
+	}
+	auth := &Auth{AccessToken: "token", ExpiresAt: time.Now().Unix() + 3600}
+	failOnErr(t, session.Upload(auth))
+
+	expected := []string{
+		fmt.Sprintf("bytes %d-%d/%d", chunkSize, 2*chunkSize-1, size),
+		fmt.Sprintf("bytes %d-%d/%d", 2*chunkSize, size-1, size),
+	}
+	if fmt.Sprint(ranges) != fmt.Sprint(expected) {
+		t.Fatalf("Upload did not resume where it left off: %v", ranges)
+	}
+}
+
+// An upload the server ends up with different content for should fail, so it
+// gets retried.
+func TestUploadSessionCorrupted(t *testing.T) {
+	t.Parallel()
+	size := chunkSize + 1000
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var start, end, total uint64
+		fmt.Sscanf(r.Header.Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &total)
+		if end+1 == total {
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprint(w, `{"id": "corrupted", "file": {"hashes": {"quickXorHash": "wrong=="}}}`)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintf(w, `{"nextExpectedRanges": ["%d-"]}`, end+1)
+	}))
+	defer server.Close()
+
+	session := &UploadSession{
+		ID:        "corrupted",
+		UploadURL: server.URL,
+		Size:      size,
+		data:      zeroBuffer(t, size),
+	}
+	auth := &Auth{AccessToken: "token", ExpiresAt: time.Now().Unix() + 3600}
+	if err := session.Upload(auth); !errors.Is(err, errHashMismatch) {
+		t.Fatalf("Expected a hash mismatch, got %v", err)
+	}
+	if session.getState() != errored {
+		t.Fatal("Corrupted upload was not marked as failed.")
+	}
+}
+
+// Aborting an upload should stop the request in progress rather than wait for
+// it, and not retry it.
+func TestUploadSessionAbort(t *testing.T) {
+	t.Parallel()
+	size := 2 * chunkSize
+	received := make(chan struct{}, chunkRetries)
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		received <- struct{}{}
+		// never answers, only the client giving up ends the request
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	session := &UploadSession{
+		ID:                 "aborted",
+		UploadURL:          server.URL,
+		ExpirationDateTime: time.Now().Add(time.Hour),
+		Size:               size,
+		data:               zeroBuffer(t, size),
+	}
+	auth := &Auth{AccessToken: "token", ExpiresAt: time.Now().Unix() + 3600}
+	result := make(chan error)
+	go func() {
+		result <- session.Upload(auth)
+	}()
+
+	<-received
+	session.abort()
+	select {
+	case err := <-result:
+		if err == nil {
+			t.Fatal("An aborted upload succeeded.")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Upload did not stop after being aborted.")
+	}
+	if len(received) != 0 {
+		t.Fatal("An aborted chunk upload was retried.")
+	}
+}
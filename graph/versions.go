@@ -0,0 +1,346 @@
+package graph
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	log "github.com/sirupsen/logrus"
+)
+
+// versionsFolderName is the hidden folder in every folder that lists the
+// previous versions of its files
+const versionsFolderName = ".versions"
+
+const (
+	versionsFolderPrefix = "versions:"    // the .versions folder of a folder
+	fileVersionsPrefix   = "versions-of:" // the folder listing a file's versions
+	versionPrefix        = "version:"     // a version of a file
+)
+
+// errLocalChanges is returned when restoring a version of a file that has
+// changes the server does not have yet, which would be lost.
+var errLocalChanges = errors.New("file has changes that are not uploaded yet")
+
+// driveItemVersion is a version of a file as the server lists it, newest
+// first.
+type driveItemVersion struct {
+	ID           string    `json:"id"`
+	LastModified time.Time `json:"lastModifiedDateTime"`
+	Size         uint64    `json:"size"`
+}
+
+// only used for parsing
+type driveItemVersions struct {
+	Versions []driveItemVersion `json:"value"`
+	NextLink string             `json:"@odata.nextLink,omitempty"`
+}
+
+// isVersions returns whether id is a .versions folder or anything in one.
+// Nothing in those can be changed.
+func isVersions(id string) bool {
+	return strings.HasPrefix(id, versionsFolderPrefix) ||
+		strings.HasPrefix(id, fileVersionsPrefix) || isVersion(id)
+}
+
+// isVersion returns whether id is a version of a file.
+func isVersion(id string) bool {
+	return strings.HasPrefix(id, versionPrefix)
+}
+
+// versionID returns the ID a version of a file is listed under.
+func versionID(fileID string, version string) string {
+	return versionPrefix + fileID + "/" + version
+}
+
+// splitVersionID returns the ID of the file and of the version a version is
+// listed under. Neither contains a slash.
+func splitVersionID(id string) (string, string) {
+	id = strings.TrimPrefix(id, versionPrefix)
+	sep := strings.Index(id, "/")
+	if sep < 0 {
+		return id, ""
+	}
+	return id[:sep], id[sep+1:]
+}
+
+// getVersions fetches the versions of a file, following every page of results.
+func getVersions(id string, auth *Auth) ([]driveItemVersion, error) {
+	versions := make([]driveItemVersion, 0)
+	resource := itemResource(id) + "/versions"
+	for resource != "" {
+		body, err := Get(resource, auth)
+		if err != nil {
+			return nil, err
+		}
+		var page driveItemVersions
+		if err = json.Unmarshal(body, &page); err != nil {
+			return nil, err
+		}
+		versions = append(versions, page.Versions...)
+		resource = strings.TrimPrefix(page.NextLink, auth.graphURL())
+	}
+	return versions, nil
+}
+
+// versionsFolder returns the .versions folder of a folder, or nil for folders
+// that have none, like virtual ones and ones not on the server yet. It is not
+// one of the folder's children, so it never shows up in listings.
+func (c *Cache) versionsFolder(folder *Inode) *Inode {
+	id := folder.ID()
+	if !folder.IsDir() || isLocalID(id) || isSharedFolder(id) || isRecycleFolder(id) ||
+		isRecycled(id) || isVersions(id) {
+		return nil
+	}
+	versionsID := versionsFolderPrefix + id
+	if existing, exists := c.metadata.Load(versionsID); exists {
+		return existing
+	}
+	now := time.Now()
+	versions := &Inode{
+		DriveItem: DriveItem{
+			IDInternal:      versionsID,
+			NameInternal:    versionsFolderName,
+			Parent:          &DriveItemParent{ID: id, Path: folder.Path()},
+			Folder:          &Folder{},
+			ModTimeInternal: &now,
+		},
+		mode:  fuse.S_IFDIR | 0555,
+		cache: c,
+	}
+	c.metadata.Store(versionsID, versions)
+	return versions
+}
+
+// fileVersions returns the folder in a .versions folder listing the versions
+// of file.
+func (c *Cache) fileVersions(versions *Inode, file *Inode) *Inode {
+	id := fileVersionsPrefix + file.ID()
+	if existing, exists := c.metadata.Load(id); exists && existing.Name() == file.Name() {
+		return existing
+	}
+	modTime := file.modTime()
+	dir := &Inode{
+		DriveItem: DriveItem{
+			IDInternal:      id,
+			NameInternal:    file.Name(),
+			Parent:          &DriveItemParent{ID: versions.ID(), Path: versions.Path()},
+			Folder:          &Folder{},
+			ModTimeInternal: &modTime,
+		},
+		mode:  fuse.S_IFDIR | 0555,
+		cache: c,
+	}
+	c.metadata.Store(id, dir)
+	return dir
+}
+
+// versionChildren turns the versions of a file into the children of the
+// folder listing them, dir. They are named after when they were saved, and
+// after their ID as well should two be saved within the same second.
+func versionChildren(dir *Inode, fileID string, versions []driveItemVersion) []*Inode {
+	name := dir.Name()
+	ext := filepath.Ext(name)
+	parent := &DriveItemParent{ID: dir.ID(), Path: dir.Path()}
+	children := make([]*Inode, 0, len(versions))
+	taken := make(map[string]bool)
+	for _, version := range versions {
+		saved := version.LastModified
+		stamp := saved.Local().Format("2006-01-02 15.04.05")
+		childName := stamp + " " + name
+		if taken[strings.ToLower(childName)] {
+			childName = fmt.Sprintf("%s %s (%s)%s", stamp, strings.TrimSuffix(name, ext),
+				version.ID, ext)
+		}
+		taken[strings.ToLower(childName)] = true
+		children = append(children, &Inode{
+			DriveItem: DriveItem{
+				IDInternal:      versionID(fileID, version.ID),
+				NameInternal:    childName,
+				Parent:          parent,
+				SizeInternal:    version.Size,
+				ModTimeInternal: &saved,
+			},
+			mode: fuse.S_IFREG | 0444,
+		})
+	}
+	return children
+}
+
+// versionsChildren lists a .versions folder, or one of the folders in it. The
+// virtual items involved may have been dropped from the cache while the
+// kernel still knows them, so they are found again from their IDs.
+func (c *Cache) versionsChildren(id string, auth *Auth) (map[string]*Inode, error) {
+	children := make(map[string]*Inode)
+	switch {
+	case strings.HasPrefix(id, versionsFolderPrefix):
+		folderID := strings.TrimPrefix(id, versionsFolderPrefix)
+		folder := c.GetID(folderID)
+		if folder == nil {
+			return children, errors.New(folderID + " not found in cache")
+		}
+		versions := c.versionsFolder(folder)
+		listed, err := c.GetChildrenID(folderID, auth)
+		if err != nil || versions == nil {
+			return children, err
+		}
+		for name, child := range listed {
+			if !child.IsDir() && !isLocalID(child.ID()) {
+				children[name] = c.fileVersions(versions, child)
+			}
+		}
+		return children, nil
+
+	case strings.HasPrefix(id, fileVersionsPrefix):
+		fileID := strings.TrimPrefix(id, fileVersionsPrefix)
+		file := c.GetID(fileID)
+		if file == nil {
+			return children, errors.New(fileID + " not found in cache")
+		}
+		folder := c.GetID(file.ParentID())
+		if folder == nil || c.versionsFolder(folder) == nil {
+			return children, errors.New(fileID + " has no versions folder")
+		}
+		return c.listVersions(c.fileVersions(c.versionsFolder(folder), file), file, auth)
+	}
+	// a version, which is a file
+	return children, nil
+}
+
+// listVersions lists the versions of file in dir. They are fetched again once
+// the file has changed.
+func (c *Cache) listVersions(dir *Inode, file *Inode, auth *Auth) (map[string]*Inode, error) {
+	file.mutex.RLock()
+	etag := file.ETag
+	file.mutex.RUnlock()
+
+	listed := func() map[string]*Inode {
+		children := make(map[string]*Inode)
+		dir.mutex.RLock()
+		defer dir.mutex.RUnlock()
+		for _, childID := range dir.children {
+			if child, exists := c.metadata.Load(childID); exists {
+				children[strings.ToLower(child.Name())] = child
+			}
+		}
+		return children
+	}
+	dir.mutex.RLock()
+	current := dir.children != nil && dir.ETag == etag
+	dir.mutex.RUnlock()
+	if current || auth == nil || c.IsOffline() {
+		return listed(), nil
+	}
+
+	versions, err := getVersions(file.ID(), auth)
+	if err != nil {
+		if IsOffline(err) {
+			c.noteOffline(err)
+			return listed(), nil
+		}
+		log.WithFields(log.Fields{
+			"id":   file.ID(),
+			"path": file.Path(),
+			"err":  err,
+		}).Error("Could not fetch versions of file.")
+		return nil, err
+	}
+	children := make(map[string]*Inode)
+	ids := make([]string, 0, len(versions))
+	kept := make(map[string]bool, len(versions))
+	for _, child := range versionChildren(dir, file.ID(), versions) {
+		child.cache = c
+		c.metadata.Store(child.ID(), child)
+		children[strings.ToLower(child.Name())] = child
+		ids = append(ids, child.ID())
+		kept[child.ID()] = true
+	}
+	dir.mutex.Lock()
+	previous := dir.children
+	dir.children = ids
+	dir.ETag = etag
+	dir.mutex.Unlock()
+	for _, childID := range previous {
+		if !kept[childID] {
+			c.metadata.Delete(childID)
+		}
+	}
+	return children, nil
+}
+
+// fetchVersion downloads the content of a version of a file. It is not kept in
+// the content cache, old versions are seldom read twice.
+func (i *Inode) fetchVersion() syscall.Errno {
+	cache := i.GetCache()
+	if cache.IsOffline() {
+		return syscall.EREMOTEIO
+	}
+	fileID, version := splitVersionID(i.ID())
+	body, err := Get(itemResource(fileID)+"/versions/"+version+"/content", cache.GetAuth())
+	if err != nil {
+		log.WithFields(log.Fields{
+			"id":      fileID,
+			"version": version,
+			"path":    i.Path(),
+			"err":     err,
+		}).Error("Could not fetch content of version.")
+		cache.noteOffline(err)
+		return syscall.EREMOTEIO
+	}
+	content, err := bufferOf(body)
+	if err != nil {
+		return syscall.EIO
+	}
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	i.SizeInternal = uint64(content.Size())
+	i.data = content
+	return 0
+}
+
+// restoreVersion makes a version of a file, listed under id, its current
+// version again.
+func (c *Cache) restoreVersion(id string) error {
+	fileID, version := splitVersionID(id)
+	file := c.GetID(fileID)
+	if file == nil {
+		return errors.New(fileID + " not found in cache")
+	}
+	if file.HasContent() || c.hasLocalChanges(file) {
+		// open files may be about to be saved over it
+		return errLocalChanges
+	}
+	auth := c.GetAuth()
+	resource := itemResource(fileID) + "/versions/" + version + "/restoreVersion"
+	if _, err := Post(resource, auth, nil); err != nil {
+		return err
+	}
+	path := file.Path()
+	c.activity.record(activityLocal, "restored", path, "(version "+version+")")
+	log.WithFields(log.Fields{
+		"id":      fileID,
+		"version": version,
+		"path":    path,
+	}).Info("Restored previous version of file.")
+
+	// the next delta would bring the change as well, but only after a while
+	restored, err := GetItem(fileID, auth)
+	if err == nil {
+		if restored.DriveItem.Parent != nil {
+			restored.DriveItem.Parent.ID = file.ParentID()
+		}
+		err = c.applyDelta(restored)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"id":  fileID,
+			"err": err,
+		}).Warn("Could not fetch restored file, it is updated with the next changes.")
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package graph
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "github.com/etcd-io/bbolt"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// Versions are named after when they were saved, keep the extension of the
+// file so they open in the same application, and can't be changed.
+func TestVersionChildren(t *testing.T) {
+	t.Parallel()
+	saved := time.Date(2024, 5, 1, 10, 22, 3, 0, time.Local)
+	dir := &Inode{DriveItem: DriveItem{
+		IDInternal:   fileVersionsPrefix + "01REPORT",
+		NameInternal: "report.docx",
+		Parent:       &DriveItemParent{ID: versionsFolderPrefix + "01DOCS", Path: "/Documents/.versions"},
+	}}
+	children := versionChildren(dir, "01REPORT", []driveItemVersion{
+		{ID: "3.0", LastModified: saved.Add(time.Hour), Size: 30},
+		{ID: "2.0", LastModified: saved, Size: 20},
+		{ID: "1.0", LastModified: saved, Size: 10},
+	})
+	expected := []string{
+		"2024-05-01 11.22.03 report.docx",
+		"2024-05-01 10.22.03 report.docx",
+		"2024-05-01 10.22.03 report (1.0).docx",
+	}
+	if len(children) != len(expected) {
+		t.Fatalf("Expected %d versions, got %d.", len(expected), len(children))
+	}
+	for n, child := range children {
+		if child.Name() != expected[n] {
+			t.Errorf("Expected version %d to be called %q, got %q.", n, expected[n], child.Name())
+		}
+		if child.Mode()&0222 != 0 || !isVersion(child.ID()) || child.ParentID() != dir.ID() {
+			t.Errorf("%s is writable or not listed as a version: %o %s",
+				child.Name(), child.Mode(), child.ID())
+		}
+	}
+	if path := children[0].Path(); path != "/Documents/.versions/report.docx/"+expected[0] {
+		t.Errorf("Wrong path for version: %s", path)
+	}
+	if file, version := splitVersionID(children[2].ID()); file != "01REPORT" || version != "1.0" {
+		t.Errorf("Version listed under the wrong ID: %s %s", file, version)
+	}
+}
+
+// The .versions folder is never listed, holds a folder for each file that is
+// on the server, and nothing in it can be changed or pinned.
+func TestVersionsFolder(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "onedriver-versions-")
+	failOnErr(t, err)
+	defer os.RemoveAll(dir)
+	db, err := bolt.Open(filepath.Join(dir, "versions.db"), 0600,
+		&bolt.Options{Timeout: time.Second * 5})
+	failOnErr(t, err)
+	defer db.Close()
+	failOnErr(t, db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(METADATA)
+		return err
+	}))
+	cache := &Cache{
+		db:       db,
+		metadata: newShardedMap(),
+		offline:  true,
+	}
+	root := NewInode("root", 0755|fuse.S_IFDIR, nil)
+	root.IDInternal = "01ROOT"
+	cache.InsertID(root.ID(), root)
+	cache.root = root.ID()
+
+	file := NewInode("report.docx", 0644|fuse.S_IFREG, root)
+	file.IDInternal = "01REPORT"
+	cache.InsertChild(root.ID(), file)
+	cache.InsertChild(root.ID(), NewInode("draft.txt", 0644|fuse.S_IFREG, root))
+	sub := NewInode("Photos", 0755|fuse.S_IFDIR, root)
+	sub.IDInternal = "01PHOTOS"
+	cache.InsertChild(root.ID(), sub)
+
+	versions := cache.versionsFolder(root)
+	if versions == nil || versions.Path() != "/.versions" {
+		t.Fatalf("Root has no .versions folder: %v", versions)
+	}
+	if listed, _ := cache.GetChildrenID(root.ID(), nil); listed[versionsFolderName] != nil {
+		t.Error(".versions should not be listed.")
+	}
+	children, err := cache.GetChildrenID(versions.ID(), nil)
+	failOnErr(t, err)
+	if len(children) != 1 || children["report.docx"] == nil || !children["report.docx"].IsDir() {
+		t.Fatalf("Expected a folder for only report.docx in .versions, got %v", children)
+	}
+	if cache.versionsFolder(children["report.docx"]) != nil || cache.versionsFolder(versions) != nil {
+		t.Error("Folders in .versions should not have a .versions folder of their own.")
+	}
+
+	// nothing was fetched, and we are offline
+	fileVersions := children["report.docx"]
+	listed, err := cache.GetChildrenID(fileVersions.ID(), nil)
+	if err != nil || len(listed) != 0 {
+		t.Errorf("Expected no versions while offline, got %v, %v", listed, err)
+	}
+	if errno := fileVersions.Setxattr(nil, pinXattr, []byte("1"), 0); errno == 0 {
+		t.Error("Pinned the versions of a file.")
+	}
+}
@@ -0,0 +1,441 @@
+package graph
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	bolt "github.com/etcd-io/bbolt"
+	log "github.com/sirupsen/logrus"
+)
+
+// WAL is the boltdb bucket holding the write-ahead log of local changes. It is
+// replayed on startup, so nothing acknowledged to applications is lost in a
+// crash.
+var WAL = []byte("wal")
+
+// walEntry is a logged local change. Only the latest change of each kind is
+// kept for an item, like the changeTracker does.
+type walEntry struct {
+	Seq      uint64    `json:"seq"` // order the changes were made in
+	Op       ChangeOp  `json:"op"`
+	ID       string    `json:"id"`
+	ParentID string    `json:"parentId,omitempty"` // new parent for creates and renames
+	Name     string    `json:"name,omitempty"`     // new name for creates and renames
+	Mode     uint32    `json:"mode,omitempty"`
+	ModTime  time.Time `json:"modTime"`
+	Content  string    `json:"content,omitempty"` // file with unsaved content of writes
+	// changes made while offline wait to be sent until we are back online,
+	// and are checked against what the item looked like on the server before
+	Queued       bool   `json:"queued,omitempty"`
+	ETag         string `json:"eTag,omitempty"`
+	FromParentID string `json:"fromParentId,omitempty"` // parent before a rename
+	FromName     string `json:"fromName,omitempty"`     // name before a rename
+}
+
+func walKey(id string, op ChangeOp) []byte {
+	return []byte(id + "\x00" + string(op))
+}
+
+// removeContent deletes the file holding an entry's unsaved content.
+func (e *walEntry) removeContent() {
+	if e.Content != "" {
+		os.Remove(e.Content)
+	}
+}
+
+// walLog records a change before it is acknowledged, replacing any earlier
+// change of the same kind to the item. Returns the sequence number of the
+// entry.
+func walLog(db *bolt.DB, entry walEntry) (uint64, error) {
+	if db == nil {
+		return 0, nil
+	}
+	var replaced walEntry
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(WAL)
+		if err != nil {
+			return err
+		}
+		key := walKey(entry.ID, entry.Op)
+		if old := b.Get(key); old != nil {
+			json.Unmarshal(old, &replaced)
+		}
+		if entry.Seq, err = b.NextSequence(); err != nil {
+			return err
+		}
+		data, _ := json.Marshal(entry)
+		return b.Put(key, data)
+	})
+	if err != nil {
+		return 0, err
+	}
+	if replaced.Content != entry.Content {
+		replaced.removeContent()
+	}
+	return entry.Seq, nil
+}
+
+// walSeq returns the sequence number of an item's logged change of a kind, or
+// 0 if there is none.
+func walSeq(db *bolt.DB, id string, op ChangeOp) uint64 {
+	entry, exists := walGet(db, id, op)
+	if !exists {
+		return 0
+	}
+	return entry.Seq
+}
+
+// walGet returns an item's logged change of a kind.
+func walGet(db *bolt.DB, id string, op ChangeOp) (walEntry, bool) {
+	var entry walEntry
+	exists := false
+	if db == nil {
+		return entry, false
+	}
+	db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(WAL); b != nil {
+			if data := b.Get(walKey(id, op)); data != nil {
+				exists = json.Unmarshal(data, &entry) == nil
+			}
+		}
+		return nil
+	})
+	return entry, exists
+}
+
+// walClear removes an item's logged changes once they have reached the server.
+// An empty op matches any kind of change. Changes logged after upTo are newer
+// than what reached the server and are kept, unless upTo is 0.
+func walClear(db *bolt.DB, id string, op ChangeOp, upTo uint64) {
+	if db == nil {
+		return
+	}
+	cleared := make([]walEntry, 0)
+	db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(WAL)
+		if b == nil {
+			return nil
+		}
+		ops := []ChangeOp{op}
+		if op == "" {
+			ops = []ChangeOp{OpCreate, OpWrite, OpRename, OpDelete}
+		}
+		for _, op := range ops {
+			key := walKey(id, op)
+			data := b.Get(key)
+			if data == nil {
+				continue
+			}
+			var entry walEntry
+			json.Unmarshal(data, &entry)
+			if upTo != 0 && entry.Seq > upTo {
+				continue
+			}
+			cleared = append(cleared, entry)
+			b.Delete(key)
+		}
+		return nil
+	})
+	for _, entry := range cleared {
+		entry.removeContent()
+	}
+}
+
+// walSettle marks a change made while offline as sent, keeping its place in
+// the log until it has reached the server.
+func walSettle(db *bolt.DB, id string, op ChangeOp) {
+	if db == nil {
+		return
+	}
+	db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(WAL)
+		if b == nil {
+			return nil
+		}
+		key := walKey(id, op)
+		data := b.Get(key)
+		if data == nil {
+			return nil
+		}
+		var entry walEntry
+		json.Unmarshal(data, &entry)
+		entry.Queued = false
+		settled, _ := json.Marshal(entry)
+		return b.Put(key, settled)
+	})
+}
+
+// walMove rekeys an item's logged changes when it goes from a local to a remote
+// ID, and points changes to its children at the new ID.
+func walMove(db *bolt.DB, oldID string, newID string) {
+	if db == nil {
+		return
+	}
+	db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(WAL)
+		if b == nil {
+			return nil
+		}
+		children := make(map[string][]byte)
+		b.ForEach(func(k, v []byte) error {
+			var entry walEntry
+			if json.Unmarshal(v, &entry) == nil && entry.ParentID == oldID {
+				entry.ParentID = newID
+				children[string(k)], _ = json.Marshal(entry)
+			}
+			return nil
+		})
+		for key, data := range children {
+			b.Put([]byte(key), data)
+		}
+		for _, op := range []ChangeOp{OpCreate, OpWrite, OpRename, OpDelete} {
+			data := b.Get(walKey(oldID, op))
+			if data == nil {
+				continue
+			}
+			var entry walEntry
+			json.Unmarshal(data, &entry)
+			entry.ID = newID
+			if op == OpCreate {
+				// it exists on the server now
+				b.Delete(walKey(oldID, op))
+				continue
+			}
+			moved, _ := json.Marshal(entry)
+			b.Put(walKey(newID, op), moved)
+			b.Delete(walKey(oldID, op))
+		}
+		return nil
+	})
+}
+
+// walEntries returns every logged change, in the order they were made.
+func walEntries(db *bolt.DB) []walEntry {
+	entries := make([]walEntry, 0)
+	if db == nil {
+		return entries
+	}
+	db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(WAL)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var entry walEntry
+			if err := json.Unmarshal(v, &entry); err == nil {
+				entries = append(entries, entry)
+			}
+			return nil
+		})
+	})
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Seq < entries[j].Seq })
+	return entries
+}
+
+// dirtyPath returns a new name for a file holding unsaved content.
+func (c *Cache) dirtyPath() string {
+	return filepath.Join(c.contentDir, "dirty", randString(16))
+}
+
+// logWrite records that an open file is about to be changed, and moves its
+// content somewhere it survives a crash. Must be called with the inode's mutex
+// held, before the change is acknowledged.
+func (i *Inode) logWrite() error {
+	if i.cache == nil || i.cache.db == nil || i.data == nil {
+		return nil
+	}
+	path, kept := i.data.keptAt()
+	if !kept {
+		path = i.cache.dirtyPath()
+		if err := i.data.keepAt(path); err != nil {
+			return err
+		}
+	}
+	entry := walEntry{
+		Op:      OpWrite,
+		ID:      i.IDInternal,
+		ModTime: time.Now(),
+		Content: path,
+	}
+	if old, exists := walGet(i.cache.db, i.IDInternal, OpWrite); exists && old.Queued {
+		// the server had what it had before the first change
+		entry.Queued = true
+		entry.ETag = old.ETag
+	} else if i.cache.IsOffline() {
+		entry.Queued = true
+		entry.ETag = i.ETag
+	}
+	_, err := walLog(i.cache.db, entry)
+	return err
+}
+
+// replayChanges redoes the local changes that had not reached the server yet
+// when onedriver last stopped. Creates and writes are queued for upload again,
+// renames and deletes are sent to the server again. Changes made while offline
+// are sent by replayQueue instead, once we are online.
+func (c *Cache) replayChanges() {
+	auth := c.GetAuth()
+	for _, entry := range walEntries(c.db) {
+		logger := log.WithFields(log.Fields{
+			"id": entry.ID,
+			"op": entry.Op,
+		})
+		switch entry.Op {
+		case OpCreate:
+			inode := c.GetID(entry.ID)
+			if inode == nil {
+				parent := c.GetID(entry.ParentID)
+				if parent == nil {
+					logger.Warn("Folder of file created before a crash is gone, dropping it.")
+					walClear(c.db, entry.ID, "", 0)
+					break
+				}
+				logger.Info("Restoring item created before a crash.")
+				inode = NewInode(entry.Name, entry.Mode, parent)
+				inode.IDInternal = entry.ID
+				modTime := entry.ModTime
+				inode.ModTimeInternal = &modTime
+				c.InsertChild(parent.ID(), inode)
+			}
+			c.changes.track(entry.ID, inode.Path(), OpCreate, StateQueued)
+			if inode.IsDir() {
+				// folders are only ever made offline, replayQueue sends them
+				break
+			}
+			if _, written := walGet(c.db, entry.ID, OpWrite); !written &&
+				!c.uploads.HasPending(entry.ID) {
+				// an empty file, nothing else would create it on the server
+				c.replayUpload(inode, &buffer{})
+			}
+
+		case OpWrite:
+			inode := c.GetID(entry.ID)
+			if inode == nil {
+				logger.Warn("File written before a crash is gone, dropping its changes.")
+				walClear(c.db, entry.ID, "", 0)
+				break
+			}
+			if c.IsConflicted(entry.ID) {
+				// held until the conflict is resolved, like before the crash
+				break
+			}
+			content, err := c.unsavedContent(entry)
+			if err != nil {
+				logger.WithField("err", err).Error(
+					"Could not recover content written before a crash.")
+				walClear(c.db, entry.ID, OpWrite, 0)
+				break
+			}
+			if c.uploads.HasPending(entry.ID) {
+				hash, _ := hashReader(sha1.New(), content.Reader())
+				if hash == c.uploads.pendingHash(entry.ID) {
+					// the resumed upload already has this content
+					content.Close()
+					break
+				}
+			}
+			logger.Info("Uploading content written before a crash.")
+			if err = c.insertBuffer(entry.ID, content); err != nil {
+				logger.WithField("err", err).Error("Could not save recovered content.")
+			}
+			inode.mutex.Lock()
+			inode.SizeInternal = uint64(content.Size())
+			inode.FileInternal = contentHashes(c.DriveType(), content)
+			inode.mutex.Unlock()
+			c.changes.track(entry.ID, inode.Path(), OpWrite, StateQueued)
+			c.replayUpload(inode, content)
+
+		case OpRename:
+			if entry.Queued {
+				if inode := c.GetID(entry.ID); inode != nil {
+					c.changes.track(entry.ID, inode.Path(), OpRename, StateQueued)
+				}
+				break
+			}
+			if c.IsOffline() {
+				// try again next time
+				break
+			}
+			logger.Info("Redoing rename interrupted by a crash.")
+			if err := Rename(entry.ID, entry.Name, entry.ParentID, auth); err != nil {
+				logger.WithField("err", err).Warn("Could not redo rename.")
+			}
+			walClear(c.db, entry.ID, OpRename, entry.Seq)
+
+		case OpDelete:
+			if entry.Queued {
+				c.DeleteID(entry.ID)
+				c.changes.track(entry.ID, "", OpDelete, StateQueued)
+				break
+			}
+			if c.IsOffline() {
+				break
+			}
+			logger.Info("Redoing delete interrupted by a crash.")
+			if !isLocalID(entry.ID) {
+				if err := Remove(entry.ID, auth); err != nil {
+					logger.WithField("err", err).Warn("Could not redo delete.")
+				}
+			}
+			c.DeleteID(entry.ID)
+			c.DeleteContent(entry.ID)
+			walClear(c.db, entry.ID, "", 0)
+		}
+	}
+	c.collectDirty()
+	if !c.IsOffline() {
+		c.replayQueue()
+	}
+}
+
+// unsavedContent returns the content of a logged write, from the file it was
+// being written to, or from the content cache if it was saved there already.
+func (c *Cache) unsavedContent(entry walEntry) (*buffer, error) {
+	if entry.Content != "" {
+		if file, err := os.Open(entry.Content); err == nil {
+			defer file.Close()
+			return newBuffer(file)
+		}
+	}
+	return c.contentBuffer(entry.ID)
+}
+
+// replayUpload queues recovered content for upload.
+func (c *Cache) replayUpload(inode *Inode, content *buffer) {
+	inode.mutex.Lock()
+	inode.data = content
+	inode.mutex.Unlock()
+	if err := c.uploads.QueueUpload(inode); err != nil {
+		log.WithFields(log.Fields{
+			"id":  inode.ID(),
+			"err": err,
+		}).Error("Could not queue recovered content for upload.")
+	}
+	inode.mutex.Lock()
+	inode.data = nil
+	inode.mutex.Unlock()
+	content.Close()
+}
+
+// collectDirty removes files of unsaved content that no logged write refers to
+// anymore.
+func (c *Cache) collectDirty() {
+	referenced := make(map[string]bool)
+	for _, entry := range walEntries(c.db) {
+		if entry.Content != "" {
+			referenced[entry.Content] = true
+		}
+	}
+	dir := filepath.Join(c.contentDir, "dirty")
+	files, _ := ioutil.ReadDir(dir)
+	for _, file := range files {
+		if path := filepath.Join(dir, file.Name()); !referenced[path] {
+			os.Remove(path)
+		}
+	}
+}
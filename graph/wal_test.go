@@ -0,0 +1,125 @@
+package graph
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "github.com/etcd-io/bbolt"
+)
+
+// Only the latest change of each kind is kept per item, and clearing a change
+// that reached the server must not clear a newer one logged in the meantime.
+func TestWAL(t *testing.T) {
+	t.Parallel()
+	os.Remove("test_wal.db")
+	db, err := bolt.Open("test_wal.db", 0600, &bolt.Options{Timeout: time.Second * 5})
+	failOnErr(t, err)
+	defer os.Remove("test_wal.db")
+	defer db.Close()
+	dir, err := ioutil.TempDir("", "onedriver-wal-")
+	failOnErr(t, err)
+	defer os.RemoveAll(dir)
+
+	first := filepath.Join(dir, "first")
+	second := filepath.Join(dir, "second")
+	failOnErr(t, ioutil.WriteFile(first, []byte("first"), 0600))
+	failOnErr(t, ioutil.WriteFile(second, []byte("second"), 0600))
+
+	_, err = walLog(db, walEntry{Op: OpCreate, ID: "local-a", ParentID: "root", Name: "a"})
+	failOnErr(t, err)
+	seq, err := walLog(db, walEntry{Op: OpWrite, ID: "local-a", Content: first})
+	failOnErr(t, err)
+	newer, err := walLog(db, walEntry{Op: OpWrite, ID: "local-a", Content: second})
+	failOnErr(t, err)
+	if newer <= seq {
+		t.Fatalf("Sequence numbers did not increase: %d then %d.", seq, newer)
+	}
+	if _, err := os.Stat(first); !os.IsNotExist(err) {
+		t.Fatal("Content of a replaced write was not removed.")
+	}
+	if entries := walEntries(db); len(entries) != 2 || entries[0].Op != OpCreate {
+		t.Fatalf("Unexpected entries: %+v", entries)
+	}
+
+	walMove(db, "local-a", "a")
+	if entries := walEntries(db); len(entries) != 1 || entries[0].ID != "a" {
+		t.Fatalf("Entries were not moved to the new ID: %+v", entries)
+	}
+
+	walClear(db, "a", OpWrite, seq)
+	if walSeq(db, "a", OpWrite) != newer {
+		t.Fatal("Clearing an older write cleared a newer one.")
+	}
+	walClear(db, "a", OpWrite, newer)
+	if walSeq(db, "a", OpWrite) != 0 {
+		t.Fatal("Write was not cleared.")
+	}
+	if _, err := os.Stat(second); !os.IsNotExist(err) {
+		t.Fatal("Content of a cleared write was not removed.")
+	}
+}
+
+// Changes made offline keep their place in the log once sent, and follow a
+// folder made offline when it gets its server ID.
+func TestWALQueued(t *testing.T) {
+	t.Parallel()
+	os.Remove("test_wal_queued.db")
+	db, err := bolt.Open("test_wal_queued.db", 0600, &bolt.Options{Timeout: time.Second * 5})
+	failOnErr(t, err)
+	defer os.Remove("test_wal_queued.db")
+	defer db.Close()
+
+	_, err = walLog(db, walEntry{Op: OpCreate, ID: "local-dir", ParentID: "root",
+		Name: "dir", Queued: true})
+	failOnErr(t, err)
+	seq, err := walLog(db, walEntry{Op: OpRename, ID: "b", ParentID: "local-dir",
+		Name: "b", FromParentID: "root", FromName: "b", Queued: true})
+	failOnErr(t, err)
+
+	walMove(db, "local-dir", "dir")
+	entry, exists := walGet(db, "b", OpRename)
+	if !exists || entry.ParentID != "dir" {
+		t.Fatalf("Rename into a moved folder was not updated: %+v", entry)
+	}
+	if _, exists := walGet(db, "local-dir", OpCreate); exists {
+		t.Fatal("Create of a folder that got its server ID was not dropped.")
+	}
+
+	walSettle(db, "b", OpRename)
+	entry, _ = walGet(db, "b", OpRename)
+	if entry.Queued || entry.Seq != seq || entry.FromName != "b" {
+		t.Fatalf("Settling a change should only clear its queued flag: %+v", entry)
+	}
+}
+
+// Content kept in a named file should be there after the buffer is closed.
+func TestBufferKeepAt(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "onedriver-keep-")
+	failOnErr(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "kept")
+
+	b, err := bufferOf([]byte("hello"))
+	failOnErr(t, err)
+	if _, kept := b.keptAt(); kept {
+		t.Fatal("Temporary content should not be kept anywhere.")
+	}
+	failOnErr(t, b.keepAt(path))
+	_, err = b.WriteAt([]byte(" world"), 5)
+	failOnErr(t, err)
+	if at, kept := b.keptAt(); !kept || at != path {
+		t.Fatalf("Content was not kept at %s.", path)
+	}
+	failOnErr(t, b.Sync())
+	b.Close()
+
+	content, err := ioutil.ReadFile(path)
+	failOnErr(t, err)
+	if string(content) != "hello world" {
+		t.Fatalf("Unexpected kept content: %q", content)
+	}
+}
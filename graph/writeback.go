@@ -0,0 +1,312 @@
+package graph
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	log "github.com/sirupsen/logrus"
+)
+
+// replayQueue sends the changes made while offline to the server. Stops early
+// if the connection is lost again, the rest is sent once it is back.
+func (c *Cache) replayQueue() {
+	c.queueMutex.Lock()
+	defer c.queueMutex.Unlock()
+	auth := c.GetAuth()
+	for _, queued := range walEntries(c.db) {
+		if !queued.Queued {
+			continue
+		}
+		if c.IsOffline() {
+			return
+		}
+		// earlier changes may have changed or cleared this one, like folders
+		// getting their server ID
+		entry, exists := walGet(c.db, queued.ID, queued.Op)
+		if !exists || !entry.Queued {
+			continue
+		}
+
+		var err error
+		switch entry.Op {
+		case OpCreate:
+			if entry.Mode&fuse.S_IFDIR != 0 {
+				err = c.replayMkdir(entry, auth)
+			}
+			// files are created on the server by their upload
+		case OpWrite:
+			err = c.replayWrite(entry, auth)
+		case OpRename:
+			err = c.replayRename(entry, auth)
+		case OpDelete:
+			err = c.replayDelete(entry, auth)
+		}
+		if err == nil {
+			continue
+		}
+		log.WithFields(log.Fields{
+			"id":  entry.ID,
+			"op":  entry.Op,
+			"err": err,
+		}).Warn("Could not send change made while offline to the server.")
+		if IsOffline(err) {
+			c.noteOffline(err)
+			return
+		}
+	}
+}
+
+// isGone returns whether an error is the server saying an item doesn't exist.
+func isGone(err error) bool {
+	var graphErr *GraphError
+	return errors.As(err, &graphErr) && graphErr.StatusCode == http.StatusNotFound
+}
+
+// replayMkdir creates a folder made while offline on the server. Its children
+// follow it to its new ID.
+func (c *Cache) replayMkdir(entry walEntry, auth *Auth) error {
+	if isLocalID(entry.ParentID) {
+		// its own folder comes first, try again next time
+		return errors.New("parent folder does not exist on the server yet")
+	}
+	c.changes.setState(entry.ID, OpCreate, StateInFlight, nil)
+	item, err := Mkdir(entry.Name, entry.ParentID, auth)
+	if err != nil {
+		state := StateQueued
+		if !IsOffline(err) {
+			// most likely a folder of the same name was made on the server,
+			// which the next delta merges this one into
+			state = StateFailed
+		}
+		c.changes.setState(entry.ID, OpCreate, state, err)
+		return err
+	}
+	log.WithFields(log.Fields{
+		"id":   item.ID(),
+		"name": entry.Name,
+	}).Info("Created folder made while offline on the server.")
+	c.activity.record(activityLocal, "created", c.activityPath(entry.ID), "")
+	c.changes.done(entry.ID, OpCreate)
+	// drops the logged create along with the local ID
+	return c.MoveID(entry.ID, item.ID())
+}
+
+// replayWrite checks content written while offline against the server before
+// it gets uploaded.
+func (c *Cache) replayWrite(entry walEntry, auth *Auth) error {
+	local := c.GetID(entry.ID)
+	if isLocalID(entry.ID) || entry.ETag == "" || local == nil {
+		// nothing on the server to check against
+		walSettle(c.db, entry.ID, OpWrite)
+		return nil
+	}
+	if conflict, exists := c.conflict(entry.ID); exists {
+		// already found while catching up on deltas
+		err := c.resolveWrite(local, &Inode{DriveItem: conflict.Remote}, entry)
+		walSettle(c.db, local.ID(), OpWrite)
+		return err
+	}
+	remote, err := GetItem(entry.ID, auth)
+	if err != nil && !isGone(err) {
+		return err
+	}
+	if isGone(err) {
+		remote = &Inode{DriveItem: DriveItem{IDInternal: entry.ID, Deleted: &Deleted{}}}
+	}
+	if remote.ETag != entry.ETag && (remote.Deleted != nil || !local.hashesMatch(remote)) {
+		err = c.resolveWrite(local, remote, entry)
+	}
+	walSettle(c.db, local.ID(), OpWrite)
+	return err
+}
+
+// resolveWrite settles content written while offline that was also changed or
+// deleted on the server.
+func (c *Cache) resolveWrite(local *Inode, remote *Inode, entry walEntry) error {
+	id := local.ID()
+	policy := conflictPolicy.forPath(local.Path())
+	logger := log.WithFields(log.Fields{
+		"id":     id,
+		"path":   local.Path(),
+		"policy": policy,
+	})
+	if policy != ConflictKeepLocal && local.HasContent() {
+		// its content can't be swapped out from under whoever has it open
+		logger.Warn("File changed on both sides is open, leaving the conflict to be resolved by hand.")
+		if c.IsConflicted(id) {
+			return nil
+		}
+		err := c.markConflict(local, remote)
+		c.fireRemoteChange(remote, ChangeConflicted)
+		return err
+	}
+
+	deleted := remote.Deleted != nil
+	switch {
+	case policy == ConflictKeepLocal && !deleted:
+		logger.Info("File was changed on both sides, keeping the local version.")
+		// the upload overwrites the server's version once let go
+		return c.ResolveConflict(id)
+	case policy == ConflictKeepRemote && deleted:
+		logger.Info("File changed while offline was deleted on the server, deleting it.")
+		c.dropWrite(id)
+		notifyDelete(c.GetID(local.ParentID()), local.Name(), local)
+		c.DeleteID(id)
+		c.DeleteContent(id)
+	case policy == ConflictKeepRemote:
+		logger.Info("File was changed on both sides, keeping the server's version.")
+		c.dropWrite(id)
+		c.overwriteContent(local, &remote.DriveItem)
+	case deleted:
+		logger.Info("File changed while offline was deleted on the server, uploading it again.")
+		return c.recreate(local, entry)
+	default:
+		copied, err := c.conflictCopy(local, entry)
+		if err != nil {
+			return err
+		}
+		logger.WithField("copy", copied.Path()).Info(
+			"File was changed on both sides, keeping both. The local version " +
+				"was saved as a conflicted copy.")
+		c.dropWrite(id)
+		c.overwriteContent(local, &remote.DriveItem)
+	}
+	c.fireRemoteChange(remote, ChangeModified)
+	return nil
+}
+
+// dropWrite abandons content written to a file in favor of the server's.
+func (c *Cache) dropWrite(id string) {
+	c.uploads.CancelUpload(id)
+	c.clearConflict(id)
+	walClear(c.db, id, OpWrite, 0)
+	c.changes.done(id, OpWrite)
+}
+
+// recreate uploads a file that was deleted on the server as a new one.
+func (c *Cache) recreate(local *Inode, entry walEntry) error {
+	content, err := c.unsavedContent(entry)
+	if err != nil {
+		return err
+	}
+	oldID := local.ID()
+	c.uploads.CancelUpload(oldID)
+	c.clearConflict(oldID)
+	newID := localID()
+	if err = c.MoveID(oldID, newID); err != nil {
+		content.Close()
+		return err
+	}
+	walLog(c.db, walEntry{
+		Op:       OpCreate,
+		ID:       newID,
+		ParentID: local.ParentID(),
+		Name:     local.Name(),
+		Mode:     local.Mode(),
+		ModTime:  local.modTime(),
+	})
+	walSettle(c.db, newID, OpWrite)
+	c.changes.setState(newID, "", StateQueued, nil)
+	c.replayUpload(local, content)
+	return nil
+}
+
+// replayRename renames an item that was moved while offline on the server,
+// unless it was moved there as well.
+func (c *Cache) replayRename(entry walEntry, auth *Auth) error {
+	logger := log.WithFields(log.Fields{
+		"id":       entry.ID,
+		"name":     entry.Name,
+		"parentID": entry.ParentID,
+	})
+	if isLocalID(entry.ParentID) {
+		return errors.New("destination folder does not exist on the server yet")
+	}
+	remote, err := GetItem(entry.ID, auth)
+	if isGone(err) {
+		logger.Warn("Item moved while offline was deleted on the server, not moving it.")
+		c.changes.done(entry.ID, OpRename)
+		walClear(c.db, entry.ID, OpRename, entry.Seq)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	// where the item was moved to locally decides, not where it ended up
+	policy := conflictPolicy.forPath(remote.Path())
+	if local := c.GetID(entry.ID); local != nil {
+		policy = conflictPolicy.forPath(local.Path())
+	}
+	logger = logger.WithField("policy", policy)
+	moved := remote.ParentID() != entry.FromParentID || remote.Name() != entry.FromName
+	if moved && policy == ConflictKeepLocal {
+		logger.Info("Item moved while offline was also moved on the server, " +
+			"keeping the local version.")
+	} else if moved {
+		logger.Info("Item moved while offline was also moved on the server, " +
+			"keeping the server's version.")
+		c.changes.setState(entry.ID, OpRename, StateFailed, errMovedOnServer)
+		walClear(c.db, entry.ID, OpRename, entry.Seq)
+		return nil
+	}
+
+	c.changes.setState(entry.ID, OpRename, StateInFlight, nil)
+	if err = Rename(entry.ID, entry.Name, entry.ParentID, auth); err != nil {
+		if IsOffline(err) {
+			c.changes.setState(entry.ID, OpRename, StateQueued, err)
+			return err
+		}
+		c.changes.setState(entry.ID, OpRename, StateFailed, err)
+		walClear(c.db, entry.ID, OpRename, entry.Seq)
+		return err
+	}
+	logger.Info("Moved item on the server that was moved while offline.")
+	c.activity.record(activityLocal, "renamed", remote.Path(),
+		activityMove(c.activityPath(entry.ID)))
+	c.changes.done(entry.ID, OpRename)
+	walClear(c.db, entry.ID, OpRename, entry.Seq)
+	return nil
+}
+
+// replayDelete deletes an item that was deleted while offline on the server,
+// unless it changed there in the meantime.
+func (c *Cache) replayDelete(entry walEntry, auth *Auth) error {
+	logger := log.WithField("id", entry.ID)
+	remote, err := GetItem(entry.ID, auth)
+	if isGone(err) {
+		// deleted on both sides
+		c.changes.done(entry.ID, OpDelete)
+		walClear(c.db, entry.ID, "", 0)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	policy := conflictPolicy.forPath(remote.Path())
+	logger = logger.WithField("policy", policy)
+	changed := entry.ETag != "" && remote.ETag != entry.ETag
+	if changed && policy == ConflictKeepLocal {
+		logger.Info("Item deleted while offline was changed on the server, deleting it anyway.")
+	} else if changed {
+		logger.Info("Item deleted while offline was changed on the server, keeping it.")
+		c.changes.setState(entry.ID, OpDelete, StateFailed, errChangedOnServer)
+		// the delta that brought the change has put it back in place already
+		walClear(c.db, entry.ID, "", 0)
+		return nil
+	}
+
+	c.changes.setState(entry.ID, OpDelete, StateInFlight, nil)
+	if err = Remove(entry.ID, auth); err != nil {
+		if IsOffline(err) {
+			c.changes.setState(entry.ID, OpDelete, StateQueued, err)
+			return err
+		}
+		c.changes.setState(entry.ID, OpDelete, StateFailed, err)
+		walClear(c.db, entry.ID, "", 0)
+		return err
+	}
+	logger.Info("Deleted item on the server that was deleted while offline.")
+	c.activity.record(activityLocal, "deleted", remote.Path(), "")
+	c.changes.done(entry.ID, OpDelete)
+	walClear(c.db, entry.ID, "", 0)
+	return nil
+}
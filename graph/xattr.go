@@ -0,0 +1,253 @@
+package graph
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// OneDrive metadata is exposed as read-only extended attributes under the
+// "user.onedriver." namespace, for scripts and file managers, along with
+// whether a file's content is downloaded ("hydrated"). The exceptions are
+// user.onedriver.pin, which is set to keep an item available offline (see
+// pin.go) and reads "1" on pinned items and "inherited" on items in a pinned
+// folder, and user.onedriver.dehydrate, which is set to free up the space an
+// item's content takes up (see placeholder.go). user.onedriver.sync_status is
+// how far local changes have gotten on their way to the server (see
+// sync_status.go), with the error they last failed with in
+// user.onedriver.sync_error. Items in the recycle bin say where they were
+// deleted from in user.onedriver.deleted_from, and are restored there by
+// setting user.onedriver.restore (see recycle.go). Setting it on a previous
+// version of a file, whose ID is in user.onedriver.version, restores that
+// version (see versions.go).
+const xattrPrefix = "user.onedriver."
+
+const (
+	pinXattr        = xattrPrefix + "pin"
+	dehydrateXattr  = xattrPrefix + "dehydrate"
+	syncStatusXattr = xattrPrefix + "sync_status"
+	syncErrorXattr  = xattrPrefix + "sync_error"
+)
+
+// xattrs returns the extended attributes an item has. Attributes without a
+// value, like the hash of a folder or the ID of an item that has not been
+// uploaded yet, are left out.
+func (i *Inode) xattrs() map[string]string {
+	attrs := make(map[string]string)
+	if cache := i.GetCache(); cache != nil && cache.pinned != nil {
+		if pinned, inherited := cache.pinState(i.ID()); pinned {
+			attrs[pinXattr] = "1"
+		} else if inherited {
+			attrs[pinXattr] = "inherited"
+		}
+	}
+	if cache := i.GetCache(); cache != nil {
+		status, message := cache.itemSyncStatus(i)
+		attrs[syncStatusXattr] = string(status)
+		if message != "" {
+			attrs[syncErrorXattr] = message
+		}
+	}
+	if cache := i.GetCache(); cache != nil && isRecycled(i.ID()) {
+		if item, err := cache.recycledItem(i.ID()); err == nil {
+			attrs[xattrPrefix+"deleted_from"] = item.Path
+		}
+	}
+	if isVersion(i.ID()) {
+		_, version := splitVersionID(i.ID())
+		attrs[xattrPrefix+"version"] = version
+	}
+	if cache := i.GetCache(); cache != nil && !i.IsDir() && !isVersion(i.ID()) {
+		attrs[xattrPrefix+"hydrated"] = "0"
+		if i.HasContent() || cache.hasCachedContent(i.ID()) {
+			attrs[xattrPrefix+"hydrated"] = "1"
+		}
+	}
+
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+	if !isLocalID(i.IDInternal) && !isVersions(i.IDInternal) {
+		attrs[xattrPrefix+"id"] = i.IDInternal
+	}
+	if i.ETag != "" {
+		attrs[xattrPrefix+"etag"] = i.ETag
+	}
+	if i.WebURL != "" {
+		attrs[xattrPrefix+"weburl"] = i.WebURL
+	}
+	if i.FileInternal != nil && i.FileInternal.Hashes.QuickXorHash != "" {
+		attrs[xattrPrefix+"quickxorhash"] = i.FileInternal.Hashes.QuickXorHash
+	}
+	return attrs
+}
+
+// copyXattr implements the getxattr/listxattr buffer convention: an empty
+// buffer asks for the size needed, a buffer that is too small is an error.
+func copyXattr(dest []byte, value []byte) (uint32, syscall.Errno) {
+	if len(dest) == 0 {
+		return uint32(len(value)), 0
+	}
+	if len(dest) < len(value) {
+		return uint32(len(value)), syscall.ERANGE
+	}
+	return uint32(copy(dest, value)), 0
+}
+
+// Getxattr reads the value of an extended attribute.
+func (i *Inode) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
+	defer i.timeOp("GETXATTR", "")()
+	value, exists := i.xattrs()[attr]
+	if !exists {
+		return 0, syscall.ENODATA
+	}
+	return copyXattr(dest, []byte(value))
+}
+
+// Listxattr lists the names of an item's extended attributes.
+func (i *Inode) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
+	defer i.timeOp("LISTXATTR", "")()
+	attrs := i.xattrs()
+	names := make([]string, 0, len(attrs))
+	for name := range attrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var list []byte
+	for _, name := range names {
+		list = append(list, name...)
+		list = append(list, 0)
+	}
+	return copyXattr(dest, list)
+}
+
+// Setxattr only pins, unpins, dehydrates and restores items, OneDrive has
+// nowhere to store custom attributes. ENOTSUP lets tools like "cp -a" skip
+// copying attributes quietly.
+func (i *Inode) Setxattr(ctx context.Context, attr string, data []byte, flags uint32) syscall.Errno {
+	defer i.timeOp("SETXATTR", "")()
+	cache := i.GetCache()
+	if attr == dehydrateXattr && cache != nil {
+		return i.dehydrateXattr()
+	}
+	if attr == restoreXattr && cache != nil {
+		return i.restoreXattr()
+	}
+	if attr != pinXattr || cache == nil {
+		return syscall.ENOTSUP
+	}
+	if isVersions(i.ID()) {
+		// never changes, but can't be kept offline either
+		return syscall.EPERM
+	}
+	var err error
+	switch strings.ToLower(strings.TrimSpace(string(data))) {
+	case "", "1", "true", "yes":
+		err = cache.Pin(i.ID())
+	case "0", "false", "no":
+		err = cache.Unpin(i.ID())
+	default:
+		return syscall.EINVAL
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"id":  i.ID(),
+			"err": err,
+		}).Error("Could not change pin of item.")
+		return syscall.EIO
+	}
+	return 0
+}
+
+// Removexattr only unpins items, our other attributes mirror the server.
+func (i *Inode) Removexattr(ctx context.Context, attr string) syscall.Errno {
+	defer i.timeOp("REMOVEXATTR", "")()
+	cache := i.GetCache()
+	if attr != pinXattr || cache == nil {
+		return syscall.ENOTSUP
+	}
+	if pinned, _ := cache.pinState(i.ID()); !pinned {
+		// inherited pins can only be removed from the folder that has them
+		return syscall.ENODATA
+	}
+	if err := cache.Unpin(i.ID()); err != nil {
+		log.WithFields(log.Fields{
+			"id":  i.ID(),
+			"err": err,
+		}).Error("Could not unpin item.")
+		return syscall.EIO
+	}
+	return 0
+}
+
+// restoreXattr restores an item in the recycle bin to where it was deleted
+// from, or a previous version of a file.
+func (i *Inode) restoreXattr() syscall.Errno {
+	cache := i.GetCache()
+	if !isRecycled(i.ID()) && !isVersion(i.ID()) {
+		return syscall.EINVAL
+	}
+	if cache.IsReadOnly() {
+		return syscall.EROFS
+	}
+	if cache.IsOffline() {
+		return syscall.EREMOTEIO
+	}
+	if isVersion(i.ID()) {
+		return i.restoreVersionXattr()
+	}
+	if _, err := cache.restore(i.ID(), "", ""); err == errNotRecycled {
+		return syscall.ENOENT
+	} else if err != nil {
+		log.WithFields(log.Fields{
+			"id":  i.ID(),
+			"err": err,
+		}).Error("Could not restore item from the recycle bin.")
+		return syscall.EREMOTEIO
+	}
+	return 0
+}
+
+// restoreVersionXattr makes a previous version of a file its current one.
+func (i *Inode) restoreVersionXattr() syscall.Errno {
+	err := i.GetCache().restoreVersion(i.ID())
+	if err == errLocalChanges {
+		return syscall.EBUSY
+	}
+	var graphErr *GraphError
+	if errors.As(err, &graphErr) && graphErr.StatusCode == http.StatusNotFound {
+		// the server let go of it, or of the file
+		return syscall.ENOENT
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"id":  i.ID(),
+			"err": err,
+		}).Error("Could not restore previous version of file.")
+		return syscall.EREMOTEIO
+	}
+	return 0
+}
+
+// dehydrateXattr frees up the space used by an item's content.
+func (i *Inode) dehydrateXattr() syscall.Errno {
+	freed, err := i.GetCache().Dehydrate(i.ID())
+	if err == errContentBusy || err == errPinnedByParent {
+		return syscall.EBUSY
+	} else if err != nil {
+		log.WithFields(log.Fields{
+			"id":  i.ID(),
+			"err": err,
+		}).Error("Could not free up space used by item.")
+		return syscall.EIO
+	}
+	log.WithFields(log.Fields{
+		"id":    i.ID(),
+		"freed": freed,
+	}).Info("Item is now a placeholder.")
+	return 0
+}
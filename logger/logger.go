@@ -3,31 +3,16 @@ package logger
 import (
 	"bytes"
 	"fmt"
+	stdlog "log"
 	"path/filepath"
 	"runtime"
 	"strconv"
 	"strings"
-	"sync"
 
 	log "github.com/sirupsen/logrus"
 )
 
-// LogLevel represents the severity of a log message
-type LogLevel int
-
-// various log levels
-const (
-	FATAL LogLevel = iota
-	ERROR
-	WARN
-	INFO
-	TRACE
-)
-
-var currentLevel = INFO
-var mutex = &sync.RWMutex{}
-
-// StringToLevel converts a string to a LogLevel in a case-insensitive manner.
+// StringToLevel converts a string to a log level in a case-insensitive manner.
 func StringToLevel(level string) log.Level {
 	level = strings.ToLower(level)
 	switch level {
@@ -49,21 +34,6 @@ func StringToLevel(level string) log.Level {
 	}
 }
 
-// SetLogLevel changes the current log level
-func SetLogLevel(level LogLevel) {
-	mutex.Lock()
-	currentLevel = level
-	mutex.Unlock()
-}
-
-func pad(text string, length int) string {
-	strlen := len(text)
-	if strlen < length {
-		text += strings.Repeat(" ", length-strlen)
-	}
-	return text
-}
-
 // funcName gets the current function name from a pointer
 func funcName(ptr uintptr) string {
 	fname := runtime.FuncForPC(ptr).Name()
@@ -124,3 +94,10 @@ func LogrusFormatter() *log.TextFormatter {
 		},
 	}
 }
+
+// CaptureStandardLog sends messages logged with the standard library's log
+// package, which go-fuse uses for its debug output, through logrus at level.
+func CaptureStandardLog(level log.Level) {
+	stdlog.SetFlags(0)
+	stdlog.SetOutput(log.StandardLogger().WriterLevel(level))
+}
@@ -0,0 +1,85 @@
+package logger
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// RotatingFile is a log file that is moved aside once it grows past a size,
+// so a long-running mount can't fill up the disk with logs. The previous files
+// are kept as path.1 (the most recent), path.2, and so on.
+type RotatingFile struct {
+	mutex   sync.Mutex
+	path    string
+	maxSize int64
+	keep    int
+	file    *os.File
+	size    int64
+}
+
+// NewRotatingFile opens the log file at path for appending. It is rotated once
+// it grows past maxSize bytes, keeping keep previous files. A maxSize of 0
+// never rotates it.
+func NewRotatingFile(path string, maxSize int64, keep int) (*RotatingFile, error) {
+	r := &RotatingFile{path: path, maxSize: maxSize, keep: keep}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *RotatingFile) open() error {
+	file, err := os.OpenFile(r.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	st, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	r.file = file
+	r.size = st.Size()
+	return nil
+}
+
+// Write appends to the log file, rotating it first if p would take it past
+// its size.
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			// better to keep logging to the file we have than to lose logs
+			fmt.Fprintf(os.Stderr, "Could not rotate log file: %s\n", err)
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate moves the log files aside and starts a new one.
+func (r *RotatingFile) rotate() error {
+	if err := r.file.Close(); err != nil {
+		return err
+	}
+	if r.keep <= 0 {
+		os.Remove(r.path)
+	} else {
+		os.Remove(fmt.Sprintf("%s.%d", r.path, r.keep))
+		for i := r.keep - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+		}
+		os.Rename(r.path, r.path+".1")
+	}
+	return r.open()
+}
+
+// Close closes the log file.
+func (r *RotatingFile) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.file.Close()
+}
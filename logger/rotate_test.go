@@ -0,0 +1,44 @@
+package logger
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Log files should be moved aside once full, keeping only as many old ones as
+// asked for.
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "onedriver-log-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "onedriver.log")
+
+	file, err := NewRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := file.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	file.Close()
+
+	expected := map[string]string{
+		path:        "fourth\n",
+		path + ".1": "third\n",
+		path + ".2": "second\n",
+	}
+	for name, contents := range expected {
+		if data, err := ioutil.ReadFile(name); err != nil || string(data) != contents {
+			t.Errorf("Expected %s to contain %q, got %q (%v).", name, contents, data, err)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Error("Only 2 old log files should have been kept.")
+	}
+}
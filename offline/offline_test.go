@@ -64,45 +64,86 @@ func TestOfflineBagelContents(t *testing.T) {
 	}
 }
 
-// Creating a file should fail
+// Files created offline should be readable right away.
 func TestOfflineFileCreation(t *testing.T) {
 	t.Parallel()
-	if ioutil.WriteFile(filepath.Join(TestDir, "donuts"), []byte("fail me"), 0644) == nil {
-		t.Fatal("Writing a file while offline should fail.")
+	fname := filepath.Join(TestDir, "donuts")
+	if err := ioutil.WriteFile(fname, []byte("queued donuts\n"), 0644); err != nil {
+		t.Fatalf("Writing a file while offline failed: %s", err)
+	}
+	contents, err := ioutil.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(contents, []byte("queued donuts\n")) {
+		t.Fatalf("Did not find \"queued donuts\", got %s instead", string(contents))
 	}
 }
 
-// Modifying a file offline should fail.
+// Modifying a file from the server offline should work as well, and be
+// checked against the server's version once back online. Not parallel, the
+// other tests expect bagels as it was, and it is put back before they run.
 func TestOfflineFileModification(t *testing.T) {
-	t.Parallel()
-	if ioutil.WriteFile(filepath.Join(TestDir, "bagels"), []byte("fail me too"), 0644) == nil {
-		t.Fatal("Modifying a file while offline should fail.")
+	fname := filepath.Join(TestDir, "bagels")
+	original, err := ioutil.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ioutil.WriteFile(fname, original, 0644)
+
+	if err := ioutil.WriteFile(fname, []byte("offline bagels\n"), 0644); err != nil {
+		t.Fatalf("Modifying a file while offline failed: %s", err)
+	}
+	contents, err := ioutil.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(contents, []byte("offline bagels\n")) {
+		t.Fatalf("Modification was not applied, got %s", string(contents))
 	}
 }
 
-// Deleting a file offline should fail.
+// Deleting files from the server offline should remove them locally.
 func TestOfflineFileDeletion(t *testing.T) {
 	t.Parallel()
-	if os.Remove(filepath.Join(TestDir, "write.txt")) == nil {
-		t.Fatal("Deleting a file while offline should fail.")
-	}
-	if os.Remove(filepath.Join(TestDir, "empty")) == nil {
-		t.Fatal("Deleting an empty file while offline should fail.")
+	for _, name := range []string{"write.txt", "empty"} {
+		fname := filepath.Join(TestDir, name)
+		if err := os.Remove(fname); err != nil {
+			t.Fatalf("Deleting %s while offline failed: %s", name, err)
+		}
+		if _, err := os.Stat(fname); !os.IsNotExist(err) {
+			t.Fatalf("Deleted file %s still exists.", name)
+		}
 	}
 }
 
-// Creating a directory offline should fail.
+// Directories can be created and used offline, then removed again.
 func TestOfflineMkdir(t *testing.T) {
 	t.Parallel()
-	if os.Mkdir(filepath.Join(TestDir, "offline_dir"), 0755) == nil {
-		t.Fatal("Creating a directory should have failed offline.")
+	dir := filepath.Join(TestDir, "offline_dir")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatalf("Creating a directory failed offline: %s", err)
+	}
+	fname := filepath.Join(dir, "inside")
+	if err := ioutil.WriteFile(fname, []byte("inside"), 0644); err != nil {
+		t.Fatalf("Creating a file in a new directory failed offline: %s", err)
+	}
+	if err := os.Remove(fname); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(dir); err != nil {
+		t.Fatalf("Removing a directory failed offline: %s", err)
 	}
 }
 
-// Deleting a directory offline should fail.
+// Deleting a directory from the server offline should remove it locally.
 func TestOfflineRmdir(t *testing.T) {
 	t.Parallel()
-	if os.Remove(filepath.Join(TestDir, "folder1")) == nil {
-		t.Fatal("Removing a directory should have failed offline.")
+	dir := filepath.Join(TestDir, "folder1")
+	if err := os.Remove(dir); err != nil {
+		t.Fatalf("Removing a directory failed offline: %s", err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatal("Removed directory still exists.")
 	}
 }
@@ -1,6 +1,7 @@
 package offline
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"os/exec"
@@ -48,7 +49,7 @@ func TestMain(m *testing.M) {
 	log.Info("Setup offline tests ------------------------------")
 
 	// reuses the cached data from the previous tests
-	root := graph.NewFS("test.db", "auth_tokens.json", 5*time.Second)
+	root := graph.NewFS(context.Background(), "test.db", "auth_tokens.json", 5*time.Second)
 	second := time.Second
 	server, _ := fs.Mount(mountLoc, root, &fs.Options{
 		EntryTimeout: &second,
@@ -64,7 +65,7 @@ func TestMain(m *testing.M) {
 	// setup sigint handler for graceful unmount on interrupt/terminate
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	go graph.UnmountHandler(sigChan, server)
+	go graph.UnmountHandler(sigChan, server, root.GetCache())
 
 	// mount fs in background thread
 	go server.Serve()